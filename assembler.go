@@ -0,0 +1,304 @@
+package schego
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// what each kind of operand is called in error messages
+var operandDescriptions = map[operandKind]string{boolOperand: "#t or #f", charOperand: "a quoted character",
+	intOperand: "an integer", doubleOperand: "a number", stringOperand: "a quoted string", mnemonicOperand: "a mnemonic",
+	localOperand: "a local", jumpOperand: "a label", syscallOperand: "a syscall", kindOperand: "an object kind"}
+
+// the syscalls documented in doc/bytecode.md, by name
+var syscallNames = map[string]byte{
+	"print_bool":   syscallPrintBool,
+	"print_char":   syscallPrintChar,
+	"print_int":    syscallPrintInt,
+	"print_double": syscallPrintDouble,
+	"print_string": syscallPrintString,
+	"exit":         syscallExit,
+	"print_record": syscallPrintRecord,
+	"print_object": syscallPrintObject,
+	"read":         syscallRead,
+}
+
+// AssembleError describes a line of assembly that couldn't be assembled.
+type AssembleError struct {
+	Position Position
+	Message  string
+}
+
+func (e AssembleError) Error() string {
+	return e.Message + " at " + e.Position.String()
+}
+
+// asmToken is a word, label or quoted literal on a line of assembly
+type asmToken struct {
+	text     string
+	position Position
+}
+
+// a label or named mnemonic whose value is only known once the whole program
+// has been read, along with where in the code it goes
+type asmFixup struct {
+	token  asmToken
+	offset int
+}
+
+type assembler struct {
+	code   []byte
+	labels map[string]int
+	// jumps to labels, and uses of named mnemonics
+	jumps     []asmFixup
+	mnemonics []asmFixup
+	// mnemonics given as numbers, which named ones mustn't clash with
+	usedMnemonics map[uint16]bool
+}
+
+// Assemble turns Schego assembly into bytecode for the VM. Each line holds an
+// instruction, written as its name from doc/bytecode.md followed by its
+// operands, such as pushi 42, pushs "hi" or syscall print_string, and can start
+// with a label such as loop:, which jumps can go to by name. Mnemonics can be
+// written as numbers or given names, with each name getting a mnemonic of its
+// own. Anything after a semicolon is a comment.
+func Assemble(source string) ([]byte, error) {
+	a := &assembler{code: make([]byte, 0), labels: make(map[string]int), usedMnemonics: make(map[uint16]bool)}
+	for index, line := range strings.Split(source, "\n") {
+		tokens, err := tokenizeAssembly(line, index+1)
+		if err != nil {
+			return nil, err
+		}
+		if err = a.assembleLine(tokens); err != nil {
+			return nil, err
+		}
+	}
+	if err := a.resolveJumps(); err != nil {
+		return nil, err
+	}
+	if err := a.resolveMnemonics(); err != nil {
+		return nil, err
+	}
+	return a.code, nil
+}
+
+// tokenizeAssembly splits a line into its tokens, dropping any comment
+func tokenizeAssembly(line string, lineNumber int) ([]asmToken, error) {
+	tokens := make([]asmToken, 0)
+	runes := []rune(line)
+	for index := 0; index < len(runes); {
+		glyph := runes[index]
+		if unicode.IsSpace(glyph) {
+			index++
+			continue
+		}
+		if glyph == ';' {
+			break
+		}
+		position := Position{Line: lineNumber, Column: index + 1}
+		start := index
+		if glyph == '"' || glyph == '\'' {
+			// a quoted literal runs up to the matching unescaped quote
+			for index++; index < len(runes) && runes[index] != glyph; index++ {
+				if runes[index] == '\\' {
+					index++
+				}
+			}
+			if index >= len(runes) {
+				return nil, AssembleError{position, "Unterminated " + string(glyph) + " quote"}
+			}
+			index++
+		} else {
+			for index < len(runes) && !unicode.IsSpace(runes[index]) && runes[index] != ';' {
+				index++
+			}
+		}
+		tokens = append(tokens, asmToken{string(runes[start:index]), position})
+	}
+	return tokens, nil
+}
+
+// assembleLine assembles a line's label, if it has one, and its instruction
+func (a *assembler) assembleLine(tokens []asmToken) error {
+	if len(tokens) > 0 && strings.HasSuffix(tokens[0].text, ":") {
+		label := strings.TrimSuffix(tokens[0].text, ":")
+		if !isAssemblyName(label) {
+			return AssembleError{tokens[0].position, "Expected a label name, found " + tokens[0].text}
+		}
+		if _, ok := a.labels[label]; ok {
+			return AssembleError{tokens[0].position, "Label " + label + " defined twice"}
+		}
+		a.labels[label] = len(a.code)
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+	instruction, ok := findInstruction(tokens[0].text)
+	if !ok {
+		return AssembleError{tokens[0].position, "Unknown instruction " + tokens[0].text}
+	}
+	operands := tokens[1:]
+	if len(operands) != len(instruction.operands) {
+		return AssembleError{tokens[0].position, "Expected " + strconv.Itoa(len(instruction.operands)) +
+			" operands for " + instruction.name + ", found " + strconv.Itoa(len(operands))}
+	}
+	a.code = append(a.code, instruction.opcode)
+	for index, kind := range instruction.operands {
+		if err := a.assembleOperand(operands[index], kind, instruction.name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func findInstruction(name string) (instruction, bool) {
+	for _, candidate := range instructions {
+		if candidate.name == name {
+			return candidate, true
+		}
+	}
+	return instruction{}, false
+}
+
+// isAssemblyName checks whether a label or mnemonic name is made up of letters,
+// digits, underscores and dashes, starting with a letter or underscore so it
+// can't be mistaken for a number
+func isAssemblyName(name string) bool {
+	for index, glyph := range name {
+		first := unicode.IsLetter(glyph) || glyph == '_'
+		if !first && (index == 0 || (glyph != '-' && !unicode.IsDigit(glyph))) {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// assembleOperand encodes an operand of the given kind
+func (a *assembler) assembleOperand(token asmToken, kind operandKind, instructionName string) error {
+	unexpected := AssembleError{token.position, "Expected " + operandDescriptions[kind] + " for " +
+		instructionName + ", found " + token.text}
+	switch kind {
+	case boolOperand:
+		if token.text != "#t" && token.text != "#f" {
+			return unexpected
+		}
+		a.code = append(a.code, pushBool(token.text == "#t")[1])
+	case charOperand:
+		char, err := strconv.Unquote(token.text)
+		if err != nil || !strings.HasPrefix(token.text, "'") || utf8.RuneCountInString(char) != 1 {
+			return unexpected
+		}
+		a.code = append(a.code, char...)
+	case intOperand:
+		num, err := strconv.ParseInt(token.text, 0, 64)
+		if err != nil {
+			return unexpected
+		}
+		a.code = appendInt(a.code, num)
+	case doubleOperand:
+		num, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return unexpected
+		}
+		a.code = appendDouble(a.code, num)
+	case stringOperand:
+		str, err := strconv.Unquote(token.text)
+		if err != nil || !strings.HasPrefix(token.text, "\"") {
+			return unexpected
+		}
+		if strings.ContainsRune(str, 0) {
+			return AssembleError{token.position, "Strings can't hold null characters"}
+		}
+		a.code = append(append(a.code, str...), 0)
+	case mnemonicOperand:
+		if isAssemblyName(token.text) {
+			a.mnemonics = append(a.mnemonics, asmFixup{token, len(a.code)})
+			a.code = append(a.code, 0, 0)
+			break
+		}
+		mnemonic, err := strconv.ParseUint(token.text, 0, 16)
+		if err != nil {
+			return unexpected
+		}
+		a.usedMnemonics[uint16(mnemonic)] = true
+		a.code = append(a.code, byte(mnemonic>>8), byte(mnemonic))
+	case localOperand:
+		local, err := strconv.ParseUint(token.text, 0, 32)
+		if err != nil {
+			return unexpected
+		}
+		a.code = appendSlot(a.code, uint32(local))
+	case jumpOperand:
+		if isAssemblyName(token.text) {
+			a.jumps = append(a.jumps, asmFixup{token, len(a.code)})
+			a.code = appendInt(a.code, 0)
+			break
+		}
+		offset, err := strconv.ParseInt(token.text, 0, 64)
+		if err != nil {
+			return unexpected
+		}
+		a.code = appendInt(a.code, offset)
+	case syscallOperand:
+		if syscall, ok := syscallNames[token.text]; ok {
+			a.code = append(a.code, syscall)
+			break
+		}
+		syscall, err := strconv.ParseUint(token.text, 0, 8)
+		if err != nil {
+			return unexpected
+		}
+		a.code = append(a.code, byte(syscall))
+	case kindOperand:
+		kind, err := strconv.ParseUint(token.text, 0, 8)
+		if err != nil {
+			return unexpected
+		}
+		a.code = append(a.code, byte(kind))
+	}
+	return nil
+}
+
+// resolveJumps fills in the offset of each jump to a label, which like any other
+// jump is counted from the end of the instruction
+func (a *assembler) resolveJumps() error {
+	for _, jump := range a.jumps {
+		target, ok := a.labels[jump.token.text]
+		if !ok {
+			return AssembleError{jump.token.position, "Unknown label " + jump.token.text}
+		}
+		offset := int64(target - (jump.offset + operandSizes[jumpOperand]))
+		buffer := new(bytes.Buffer)
+		binary.Write(buffer, binary.LittleEndian, &offset)
+		copy(a.code[jump.offset:], buffer.Bytes())
+	}
+	return nil
+}
+
+// resolveMnemonics gives each named mnemonic a number of its own, in the order
+// they first appear, skipping any numbers used directly
+func (a *assembler) resolveMnemonics() error {
+	named := make(map[string]uint16)
+	next := uint16(1)
+	for _, use := range a.mnemonics {
+		mnemonic, ok := named[use.token.text]
+		if !ok {
+			for a.usedMnemonics[next] {
+				next++
+			}
+			if next == 0 {
+				return AssembleError{use.token.position, "Too many mnemonics"}
+			}
+			mnemonic = next
+			named[use.token.text] = mnemonic
+			a.usedMnemonics[mnemonic] = true
+		}
+		a.code[use.offset], a.code[use.offset+1] = byte(mnemonic>>8), byte(mnemonic)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package schego
+
+import (
+	"bytes"
+	"testing"
+)
+
+// runAssembly assembles and runs a program, returning the last line it printed
+func runAssembly(t *testing.T, source string) string {
+	opcodes, err := Assemble(source)
+	if err != nil {
+		t.Fatalf("unexpected assemble error: %v", err)
+	}
+	console := DummyConsole{}
+	RunVM(opcodes, &console)
+	return console.consoleOutput
+}
+
+func TestAssembleEncoding(t *testing.T) {
+	source := `
+		pushi 42       ; the answer
+		hnewi 0xBEEF
+		hstorei 0xBEEF
+		jmp -9
+		lnewd 3
+		syscall print_int`
+	expected := []byte{
+		0x03, 0x2A, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x22, 0xBE, 0xEF,
+		0x0A, 0xBE, 0xEF,
+		0x2C, 0xF7, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+		0x29, 0x03, 0x00, 0x00, 0x00,
+		0x43, 0x03,
+	}
+	opcodes, err := Assemble(source)
+	if err != nil {
+		t.Fatalf("unexpected assemble error: %v", err)
+	}
+	if !bytes.Equal(opcodes, expected) {
+		t.Errorf("expected % X, got % X", expected, opcodes)
+	}
+}
+
+func TestAssembleLiterals(t *testing.T) {
+	tests := map[string]string{
+		`pushs "Hello, World!\n"
+		 syscall print_string`: "Hello, World!\n",
+		`pushs "; not a comment"
+		 syscall print_string`: "; not a comment",
+		`pushc 'λ'
+		 syscall print_char`: "λ",
+		`pushb #t
+		 syscall print_bool`: "#t",
+		`pushd -1.5
+		 syscall 0x04`: "-1.5",
+	}
+	for source, expected := range tests {
+		if output := runAssembly(t, source); output != expected {
+			t.Errorf("%s printed %q, expected %q", source, output, expected)
+		}
+	}
+}
+
+func TestAssembleLoop(t *testing.T) {
+	// add up the numbers from 1 to 10, jumping back to the start of the loop
+	// until the counter runs out
+	source := `
+		hnewi total
+		hnewi n
+		pushi 0
+		hstorei total
+		pushi 10
+		hstorei n
+	loop:
+		hloadi n
+		pushi 0
+		cmpi
+		jeq done
+		hloadi total
+		hloadi n
+		addi
+		hstorei total
+		hloadi n
+		pushi 1
+		subi
+		hstorei n
+		jmp loop
+	done: hloadi total
+		syscall print_int`
+	if output := runAssembly(t, source); output != "55" {
+		t.Errorf("expected 55, got %q", output)
+	}
+}
+
+func TestAssembleProcedure(t *testing.T) {
+	// the same program as TestCallFrame, written out in assembly
+	source := `
+		jmp main
+	double:
+		lnewi 0
+		lstorei 0
+		lloadi 0
+		lloadi 0
+		addi
+		jr
+	main:
+		pushi 21
+		jal double
+		syscall print_int`
+	if output := runAssembly(t, source); output != "42" {
+		t.Errorf("expected 42, got %q", output)
+	}
+}
+
+func TestAssembleMnemonics(t *testing.T) {
+	// named mnemonics are numbered from 1, skipping any used as numbers
+	opcodes, err := Assemble("hnewi 1\nhnewi first\nhnewi 3\nhnewi second\nhloadi first")
+	if err != nil {
+		t.Fatalf("unexpected assemble error: %v", err)
+	}
+	expected := []byte{0x22, 0x00, 0x01, 0x22, 0x00, 0x02, 0x22, 0x00, 0x03, 0x22, 0x00, 0x04, 0x16, 0x00, 0x02}
+	if !bytes.Equal(opcodes, expected) {
+		t.Errorf("expected % X, got % X", expected, opcodes)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := map[string]string{
+		"pushq 1":             "Unknown instruction pushq at 1:1",
+		"pushi":               "Expected 1 operands for pushi, found 0 at 1:1",
+		"addi 1":              "Expected 0 operands for addi, found 1 at 1:1",
+		"pushi one":           "Expected an integer for pushi, found one at 1:7",
+		"pushb 1":             "Expected #t or #f for pushb, found 1 at 1:7",
+		"pushc 'ab'":          "Expected a quoted character for pushc, found 'ab' at 1:7",
+		"pushs \"open":        "Unterminated \" quote at 1:7",
+		"\n  jmp nowhere":     "Unknown label nowhere at 2:7",
+		"a:\na:":              "Label a defined twice at 2:1",
+		"syscall print_float": "Expected a syscall for syscall, found print_float at 1:9",
+		"hnewi 0x10000":       "Expected a mnemonic for hnewi, found 0x10000 at 1:7",
+		"pushs \"null\\x00\"": "Strings can't hold null characters at 1:7",
+		"pushi 2\naddc":       "Unknown instruction addc at 2:1",
+	}
+	for source, expected := range tests {
+		_, err := Assemble(source)
+		if err == nil {
+			t.Errorf("expected an error assembling %q", source)
+		} else if err.Error() != expected {
+			t.Errorf("assembling %q gave %q, expected %q", source, err.Error(), expected)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Command schego parses a Scheme source file and prints the AST of each
+// top-level form, which is handy for checking what the parser made of a
+// program and, with -expand, what its macro uses expanded into. With -run, the
+// program is compiled and run on the VM instead. Files ending in .sasm hold
+// assembly, which is assembled and run.
+// Libraries and included files are looked for next to the file first, then in
+// any directories given with -I.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/DangerOnTheRanger/schego"
+)
+
+// pathList collects the directories given with each -I
+type pathList []string
+
+func (p *pathList) String() string {
+	return strings.Join(*p, string(filepath.ListSeparator))
+}
+func (p *pathList) Set(dir string) error {
+	*p = append(*p, dir)
+	return nil
+}
+
+// stdoutConsole prints what the VM writes to standard output
+type stdoutConsole struct{}
+
+func (c stdoutConsole) Write(line string) {
+	// strings come with their null terminator
+	fmt.Print(strings.TrimRight(line, "\x00"))
+}
+
+// runProgram runs bytecode on the VM and exits with the program's exit code,
+// reporting anything that stopped the VM along the way
+func runProgram(filename string, opcodes []byte) {
+	vm := schego.NewVM(opcodes, stdoutConsole{})
+	vm.Input = os.Stdin
+	for vm.CanStep() {
+		vm.Step()
+	}
+	if err := vm.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, filename+":", err)
+	}
+	os.Exit(int(vm.ExitCode()))
+}
+
+func main() {
+	run := flag.Bool("run", false, "compile the program and run it on the VM")
+	expand := flag.Bool("expand", false, "print the program with every macro use expanded")
+	var searchPath pathList
+	flag.Var(&searchPath, "I", "add a directory to search for libraries and included files")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: schego [-expand | -run] [-I dir]... file\n       schego file.sasm")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *run && *expand {
+		fmt.Fprintln(os.Stderr, "-expand and -run can't be used together")
+		flag.Usage()
+		os.Exit(2)
+	}
+	filename := flag.Arg(0)
+	source, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if filepath.Ext(filename) == ".sasm" {
+		opcodes, err := schego.Assemble(string(source))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, filename+":", err)
+			os.Exit(1)
+		}
+		runProgram(filename, opcodes)
+	}
+	failed := false
+	tokens, lexErrors := schego.LexExp(string(source))
+	for _, lexErr := range lexErrors {
+		fmt.Fprintln(os.Stderr, filename+":", lexErr)
+		failed = true
+	}
+	searchPath = append(pathList{filepath.Dir(filename)}, searchPath...)
+	program, parseErrors := schego.ParseTokensWithPath(tokens, searchPath)
+	for _, parseErr := range parseErrors {
+		fmt.Fprintln(os.Stderr, filename+":", parseErr)
+		failed = true
+	}
+	if *run {
+		if failed {
+			os.Exit(1)
+		}
+		opcodes, err := schego.Compile(program)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, filename+":", err)
+			os.Exit(1)
+		}
+		runProgram(filename, opcodes)
+	}
+	var node schego.AstNode = program
+	if *expand {
+		if node, err = schego.Expand(program); err != nil {
+			fmt.Fprintln(os.Stderr, filename+":", err)
+			os.Exit(1)
+		}
+	}
+	for _, subNode := range node.GetSubNodes() {
+		fmt.Println(subNode.DebugString())
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,2495 @@
+package schego
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// valueType is the type of value an expression leaves on the VM's stack. The VM's
+// opcodes are typed, so the compiler has to know each expression's type up front.
+type valueType int
+
+const (
+	// for expressions that don't leave anything on the stack, like define
+	noValue valueType = iota
+	boolType
+	charType
+	intType
+	doubleType
+	stringType
+	// for values whose type is only known at run time, such as lists and the
+	// elements in them, which are objects in the heap that the stack holds
+	// the address of
+	objectType
+	// for variables bound to procedures, which aren't values on the stack
+	procedureType
+)
+
+func (t valueType) String() string {
+	switch t {
+	case boolType:
+		return "boolean"
+	case charType:
+		return "character"
+	case intType:
+		return "integer"
+	case doubleType:
+		return "double"
+	case stringType:
+		return "string"
+	case objectType:
+		return "object"
+	case procedureType:
+		return "procedure"
+	}
+	return "no value"
+}
+
+// article gives the type's name with an indefinite article, for error messages
+func (t valueType) article() string {
+	if t == intType || t == objectType {
+		return "an " + t.String()
+	}
+	return "a " + t.String()
+}
+
+// the opcodes to allocate, store and load globals of each type in the heap;
+// objects are held as their 8-byte address, the same as an integer
+var heapNewOpcodes = map[valueType]byte{boolType: opHnewb, charType: opHnewc, intType: opHnewi, doubleType: opHnewd,
+	stringType: opHnews, objectType: opHnewi}
+var heapStoreOpcodes = map[valueType]byte{boolType: opHstoreb, charType: opHstorec, intType: opHstorei,
+	doubleType: opHstored, stringType: opHstores, objectType: opHstorei}
+var heapLoadOpcodes = map[valueType]byte{boolType: opHloadb, charType: opHloadc, intType: opHloadi, doubleType: opHloadd,
+	stringType: opHloads, objectType: opHloadi}
+
+// and the same for locals in a procedure's frame
+var localNewOpcodes = map[valueType]byte{boolType: opLnewb, charType: opLnewc, intType: opLnewi, doubleType: opLnewd,
+	stringType: opLnews, objectType: opLnewi}
+var localStoreOpcodes = map[valueType]byte{boolType: opLstoreb, charType: opLstorec, intType: opLstorei,
+	doubleType: opLstored, stringType: opLstores, objectType: opLstorei}
+var localLoadOpcodes = map[valueType]byte{boolType: opLloadb, charType: opLloadc, intType: opLloadi,
+	doubleType: opLloadd, stringType: opLloads, objectType: opLloadi}
+
+// the opcodes to drop a value of each type from the stack, and to turn one into
+// an object
+var dropOpcodes = map[valueType]byte{boolType: opDropb, charType: opDropc, intType: opDropi, doubleType: opDropd,
+	stringType: opDrops, objectType: opDropi}
+var boxOpcodes = map[valueType]byte{boolType: opBoxb, charType: opBoxc, intType: opBoxi, doubleType: opBoxd,
+	stringType: opBoxs}
+var unboxOpcodes = map[valueType]byte{boolType: opUnboxb, charType: opUnboxc, intType: opUnboxi,
+	doubleType: opUnboxd, stringType: opUnboxs}
+
+// a jump instruction is its opcode followed by an 8-byte offset
+const jumpLength = 9
+
+// the integer, double and object opcodes for each arithmetic operator; there's
+// no integer division, since dividing integers can give a fraction
+var arithmeticOpcodes = map[string][3]byte{
+	"+": {opAddi, opAddd, opOadd},
+	"-": {opSubi, opSubd, opOsub},
+	"*": {opMuli, opMuld, opOmul},
+	"/": {0, opDivd, opOdiv},
+}
+
+// CompileError describes an expression that couldn't be compiled.
+type CompileError struct {
+	Span    Span
+	Message string
+}
+
+func (e CompileError) Error() string {
+	return e.Message + " at " + e.Span.Start.String()
+}
+
+func compileError(node AstNode, message string) error {
+	return CompileError{node.GetSpan(), message}
+}
+
+// nodeName gives the name of a node's type, for error messages
+func nodeName(node AstNode) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", node), "*schego.")
+}
+
+// variable is a global living in the heap under its mnemonic, a local living in
+// a slot of a procedure's frame, or a procedure, which only exists as code
+type variable struct {
+	valueType valueType
+	global    bool
+	mnemonic  []byte
+	slot      uint32
+	frame     *frame
+	procedure *procedure
+	// whether the local's slot holds a cell with the value in it, so that
+	// closures capturing the local see it being assigned to; since the
+	// closures can assign anything to it, the value is always an object
+	cell bool
+	// whether this is how a closure refers to a local captured from outside
+	// it, in which case the slot is the index of the capture
+	captured bool
+	// what the procedure does, if it's one a define-record-type generated
+	record *recordProcedure
+}
+
+// load gives the code to push the variable's value onto the stack
+func (v *variable) load() []byte {
+	code := v.loadSlot()
+	if v.cell {
+		return append(code, opOget)
+	}
+	if v.captured && v.valueType != objectType {
+		code = append(code, unboxOpcodes[v.valueType])
+	}
+	return code
+}
+
+// loadSlot gives the code to push whatever the variable's slot holds: its value,
+// the cell holding it, or for a capture without a cell, an object holding it
+func (v *variable) loadSlot() []byte {
+	switch {
+	case v.global:
+		return append([]byte{heapLoadOpcodes[v.valueType]}, v.mnemonic...)
+	case v.captured:
+		return appendSlot([]byte{opCload}, v.slot)
+	case v.cell:
+		return appendSlot([]byte{opLloadi}, v.slot)
+	}
+	return appendSlot([]byte{localLoadOpcodes[v.valueType]}, v.slot)
+}
+
+// store gives the code to pop a value off the stack into the variable. Captures
+// without a cell never get stored in, since only locals that are never assigned
+// to are captured without one.
+func (v *variable) store() []byte {
+	if v.cell {
+		return append(v.loadSlot(), opOset)
+	}
+	if v.global {
+		return append([]byte{heapStoreOpcodes[v.valueType]}, v.mnemonic...)
+	}
+	return appendSlot([]byte{localStoreOpcodes[v.valueType]}, v.slot)
+}
+
+// the kinds of procedure a define-record-type generates
+const (
+	recordConstructor = iota
+	recordPredicate
+	recordAccessor
+	recordModifier
+)
+
+// recordProcedure is one of the procedures a define-record-type generates, whose
+// calls are compiled straight into record instructions
+type recordProcedure struct {
+	kind       int
+	typeID     int64
+	typeName   string
+	fieldCount int
+	// the field each argument of a constructor goes in, or the field an
+	// accessor or modifier gets or sets
+	fields []int
+}
+
+// frame is where a procedure keeps its locals while it runs, with a frame of its
+// own for code outside any procedure. A closure's frame also has the locals from
+// outside it that it captures, in the order they were first referred to.
+type frame struct {
+	slots    uint32
+	closure  bool
+	captures []*variable
+	// how the closure refers to each local it captures
+	captureVariables map[*variable]*variable
+}
+
+// scope holds the local variables and procedures bound by a lambda, let or body
+type scope struct {
+	variables map[string]*variable
+	parent    *scope
+}
+
+func newScope(parent *scope) *scope {
+	return &scope{make(map[string]*variable), parent}
+}
+
+// find looks a local up in the scope and the ones it's nested in
+func (s *scope) find(name string) (*variable, bool) {
+	for ; s != nil; s = s.parent {
+		if local, ok := s.variables[name]; ok {
+			return local, true
+		}
+	}
+	return nil, false
+}
+
+// procedure is a lambda that can be called. Since the VM's instructions are
+// typed, a procedure gets compiled separately for each combination of argument
+// types it's called with, when it's first called with them.
+type procedure struct {
+	name   string
+	lambda *LambdaExp
+	// the scope the lambda appears in
+	scope           *scope
+	specializations map[string]*specialization
+}
+
+func newProcedure(name string, lambda *LambdaExp, scope *scope) *procedure {
+	return &procedure{name, lambda, scope, make(map[string]*specialization)}
+}
+
+// specialization is a procedure compiled for one combination of argument types
+type specialization struct {
+	// where the specialization comes in the list of every specialization, which
+	// calls use to refer to it until the program's been laid out
+	id         int
+	procedure  *procedure
+	key        string
+	argTypes   []valueType
+	returnType valueType
+	// whether the specialization is being compiled, whether the return type
+	// is known yet, and whether it called itself along the way
+	compiling       bool
+	returnTypeKnown bool
+	recursive       bool
+	code            []byte
+	// whether this is the entry procedure objects jump to, along with the
+	// locals it captures if it's the entry of a closure
+	entry    bool
+	captures []*variable
+}
+
+// the key of a procedure's entry, which unlike the keys of its other
+// specializations isn't made up of type names
+const entryKey = "entry"
+
+// widenError is given when a variable is assigned a value of a different type
+// from the one it holds, so that the program can be compiled again with the
+// variable widened to hold objects, which can be of any type
+type widenError struct {
+	name string
+}
+
+func (e widenError) Error() string {
+	return e.name + " has to hold objects"
+}
+
+// errReturnTypeUnknown is given by a recursive call made before the return type
+// of the procedure it calls is known
+var errReturnTypeUnknown = errors.New("return type of a recursive call isn't known yet")
+
+// the types a recursive procedure could return, in the order they're tried
+var returnTypeCandidates = []valueType{intType, doubleType, boolType, charType, stringType, objectType, noValue}
+
+type compiler struct {
+	globals map[string]*variable
+	// how many mnemonics have been handed out
+	mnemonics int
+	// the innermost scope of local variables, which is nil at top level, and
+	// the frame the code being compiled runs in
+	scope *scope
+	frame *frame
+	// every specialization compiled so far, which end up laid out in this order
+	specializations []*specialization
+	// the names of locals that need a cell, which are found before compiling
+	cells map[string]bool
+	// how many record types have been defined, each getting the next ID
+	recordTypes int64
+	// the procedures built-in procedures used as values have become
+	builtins map[string]*procedure
+	// the names of variables that have been assigned values of different types,
+	// which hold objects instead of values of any one type
+	widened map[string]bool
+}
+
+// Compile turns a program into bytecode for the VM. Top-level expressions leave
+// their values on the stack, while globals get stored in the heap, each under a
+// mnemonic of its own. Since the VM's stack is typed, every expression needs a
+// type that's known ahead of time, with a variable keeping the type of the value
+// it was first bound to, unless it's assigned values of another type, in which
+// case the program is compiled again with the variable holding objects. Values
+// whose type can't be known ahead of time, such as lists, the elements in them,
+// or an if whose branches give different types, are objects in the heap, which
+// the VM checks the type of as it goes.
+// Procedures take their arguments off the stack and leave their result on it,
+// keeping their locals in a frame of their own. Their code comes first in the
+// program, with a jump over it to where the top-level code begins. Procedures used
+// as values, and lambdas referring to locals from outside them, become procedure
+// objects, which take and return objects, with any locals they capture that can
+// be assigned to kept in cells. Records are objects too, with calls to the
+// procedures a define-record-type generates compiled into record instructions.
+// Quoted data and quasiquotes become the objects they give. The VM has no
+// multiple values, so let-values can only bind more than one value to the results
+// of a call to values, and no exact rationals or bytevectors, so those are
+// rejected.
+func Compile(program *Program) ([]byte, error) {
+	cells, widened := findCells(program), make(map[string]bool)
+	for {
+		c := &compiler{globals: make(map[string]*variable), frame: &frame{}, cells: cells,
+			builtins: make(map[string]*procedure), widened: widened}
+		code, err := c.compileProgram(program)
+		if widen, ok := err.(widenError); ok {
+			widened[widen.name] = true
+			continue
+		}
+		return code, err
+	}
+}
+
+// compileProgram compiles each top-level form of a program in turn
+func (c *compiler) compileProgram(program *Program) ([]byte, error) {
+	code := make([]byte, 0)
+	for _, node := range program.GetSubNodes() {
+		nodeCode, err := c.compileTopLevel(node)
+		if err != nil {
+			return nil, err
+		}
+		code = append(code, nodeCode...)
+	}
+	return c.link(code), nil
+}
+
+// compileTopLevel compiles a top-level form, which unlike other expressions can
+// be a definition
+func (c *compiler) compileTopLevel(node AstNode) ([]byte, error) {
+	switch exp := node.(type) {
+	case *MacroUseExp:
+		return c.compileTopLevel(exp.GetSubNodes()[0])
+	case *BeginExp:
+		// a begin at top level can hold definitions, as if they were at top level too
+		code := make([]byte, 0)
+		for _, subNode := range exp.GetSubNodes() {
+			subCode, err := c.compileTopLevel(subNode)
+			if err != nil {
+				return nil, err
+			}
+			code = append(code, subCode...)
+		}
+		return code, nil
+	case *DefExp:
+		return c.compileDefine(exp)
+	case *DefineRecordTypeExp:
+		return c.compileRecordType(exp, true)
+	case *ImportExp:
+		// the built-in libraries are always there, so only the libraries the
+		// import loaded need compiling, ahead of the code importing them
+		return c.compileLibraries(exp.GetSubNodes())
+	case *DefineLibraryExp:
+		return c.compileLibraries([]AstNode{exp})
+	}
+	code, _, err := c.compile(node)
+	return code, err
+}
+
+// compileLibraries compiles the imports and bodies of libraries, which are at top
+// level like the program's own. Their definitions already have the library's name
+// in front, so they're compiled as globals like any others.
+func (c *compiler) compileLibraries(libraries []AstNode) ([]byte, error) {
+	code := make([]byte, 0)
+	for _, library := range libraries {
+		for _, node := range library.GetSubNodes() {
+			nodeCode, err := c.compileTopLevel(node)
+			if err != nil {
+				return nil, err
+			}
+			code = append(code, nodeCode...)
+		}
+	}
+	return code, nil
+}
+
+// compile compiles an expression, returning its code and the type of value it
+// leaves on the stack
+func (c *compiler) compile(node AstNode) ([]byte, valueType, error) {
+	switch exp := node.(type) {
+	case *MacroUseExp:
+		return c.compile(exp.GetSubNodes()[0])
+	case *DefineSyntaxExp:
+		// macros have all been expanded by now
+		return nil, noValue, nil
+	case *IntLiteral:
+		return appendInt([]byte{opPushi}, exp.Value), intType, nil
+	case *FloatLiteral:
+		return appendDouble([]byte{opPushd}, exp.Value), doubleType, nil
+	case *BoolLiteral:
+		return pushBool(exp.Value), boolType, nil
+	case *CharLiteral:
+		return append([]byte{opPushc}, string(exp.Value)...), charType, nil
+	case *StringLiteral:
+		if strings.ContainsRune(exp.Value, 0) {
+			return nil, noValue, compileError(node, "Strings with null characters can't be compiled")
+		}
+		return pushString(exp.Value), stringType, nil
+	case *AddExp:
+		return c.compileArithmetic(exp, "+")
+	case *SubExp:
+		return c.compileArithmetic(exp, "-")
+	case *MulExp:
+		return c.compileArithmetic(exp, "*")
+	case *DivExp:
+		return c.compileArithmetic(exp, "/")
+	case *LtExp:
+		return c.compileComparison(exp, opJlt)
+	case *LteExp:
+		return c.compileComparison(exp, opJlte)
+	case *GtExp:
+		return c.compileComparison(exp, opJgt)
+	case *GteExp:
+		return c.compileComparison(exp, opJgte)
+	case *EqExp:
+		return c.compileComparison(exp, opJeq)
+	case *IfExp:
+		return c.compileIf(exp)
+	case *CondExp:
+		return c.compileCond(exp)
+	case *CaseExp:
+		return c.compileCase(exp)
+	case *AndExp:
+		return c.compileAnd(exp.GetSubNodes())
+	case *OrExp:
+		return c.compileOr(exp.GetSubNodes())
+	case *WhenExp:
+		return c.compileWhen(exp.GetSubNodes(), false)
+	case *UnlessExp:
+		return c.compileWhen(exp.GetSubNodes(), true)
+	case *DoExp:
+		return c.compileDo(exp)
+	case *BeginExp:
+		return c.compileSequence(exp.GetSubNodes())
+	case *LetExp:
+		return c.compileLet(exp.Names, exp.Inits(), exp.Body(), false)
+	case *LetStarExp:
+		return c.compileLet(exp.Names, exp.Inits(), exp.Body(), true)
+	case *LetrecExp:
+		return c.compileLetrec(exp.Names, exp.Inits(), exp.Body())
+	case *LetrecStarExp:
+		return c.compileLetrec(exp.Names, exp.Inits(), exp.Body())
+	case *NamedLetExp:
+		return c.compileNamedLet(exp)
+	case *LetValuesExp:
+		return c.compileLetValues(exp, exp.Formals, exp.Inits(), exp.Body(), false)
+	case *LetStarValuesExp:
+		return c.compileLetValues(exp, exp.Formals, exp.Inits(), exp.Body(), true)
+	case *QuoteExp:
+		return c.compileDatum(exp.GetSubNodes()[0])
+	case *QuasiquoteExp:
+		return c.compileTemplate(exp.GetSubNodes()[0])
+	case *RationalLiteral:
+		return nil, noValue, compileError(node, "Can't compile "+strconv.FormatInt(exp.Numerator, 10)+"/"+
+			strconv.FormatInt(exp.Denominator, 10)+", since the VM has no exact rationals")
+	case *BytevectorLiteral:
+		return nil, noValue, compileError(node, "Can't compile bytevectors, since the VM has no bytevector objects")
+	case *VectorLiteral:
+		// vectors evaluate to themselves, as if they were quoted
+		return c.compileDatum(exp)
+	case *IdentExp:
+		if isBuiltinValue(exp.Name) && exp.Global && c.globals[exp.Name] == nil {
+			code, err := c.compileProcedureObject(exp, c.builtinProcedure(exp))
+			return code, objectType, err
+		}
+		variable, err := c.lookup(exp, exp.Name, exp.Global)
+		if err != nil {
+			return nil, noValue, err
+		}
+		if variable.procedure != nil {
+			code, err := c.compileProcedureObject(exp, variable.procedure)
+			return code, objectType, err
+		}
+		return variable.load(), variable.valueType, nil
+	case *SetExp:
+		variable, err := c.lookup(exp, exp.Name, exp.Global)
+		if err != nil {
+			return nil, noValue, err
+		}
+		code, err := c.compileStore(exp.GetSubNodes()[0], exp.Name, variable)
+		return code, noValue, err
+	case *CallExp:
+		return c.compileCall(exp)
+	case *LambdaExp:
+		code, err := c.compileProcedureObject(exp, newProcedure("lambda", exp, c.scope))
+		return code, objectType, err
+	case *DefExp, *DefineRecordTypeExp:
+		return nil, noValue, compileError(node, "Definitions can only be compiled at top level and in bodies")
+	}
+	return nil, noValue, compileError(node, nodeName(node)+" can't be compiled yet")
+}
+
+// lookup finds the variable a name refers to
+func (c *compiler) lookup(node AstNode, name string, isGlobal bool) (*variable, error) {
+	if isGlobal {
+		if global, ok := c.globals[name]; ok {
+			return global, nil
+		}
+		return nil, compileError(node, "Unbound variable "+name)
+	}
+	if local, ok := c.scope.find(name); ok {
+		// procedures are only ever called directly, but a local in another
+		// frame has to be captured by the closure being compiled
+		if local.procedure == nil && local.frame != c.frame {
+			return c.capture(node, name, local)
+		}
+		return local, nil
+	}
+	// a local can be referred to before the definition binding it
+	return nil, compileError(node, "Unbound variable "+name)
+}
+
+// capture gives the variable the closure being compiled refers to a local from
+// outside it by, capturing the local the first time it's referred to
+func (c *compiler) capture(node AstNode, name string, local *variable) (*variable, error) {
+	if !c.frame.closure {
+		// only closures get compiled to refer to locals from outside them
+		return nil, compileError(node, "Can't refer to "+name+" from here")
+	}
+	if captured, ok := c.frame.captureVariables[local]; ok {
+		return captured, nil
+	}
+	if c.frame.captureVariables == nil {
+		c.frame.captureVariables = make(map[*variable]*variable)
+	}
+	captured := &variable{valueType: local.valueType, slot: uint32(len(c.frame.captures)), frame: c.frame,
+		cell: local.cell, captured: true}
+	c.frame.captures = append(c.frame.captures, local)
+	c.frame.captureVariables[local] = captured
+	return captured, nil
+}
+
+// needsClosure checks whether a lambda refers to any locals from outside it other
+// than procedures, which means it has to be a closure rather than a procedure. A
+// name that isn't bound yet is taken to be a local bound later on.
+func (c *compiler) needsClosure(lambda *LambdaExp) bool {
+	for name := range freeLocals(lambda) {
+		if local, ok := c.scope.find(name); !ok || local.procedure == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// freeLocals finds the names of the locals a lambda refers to without binding
+// them itself. Locals along any one chain of scopes all have names of their own,
+// since the parser renames any that shadow another, so a name bound anywhere in
+// the lambda can't also refer to a local from outside it.
+func freeLocals(lambda *LambdaExp) map[string]bool {
+	referred := make(map[string]bool)
+	bound := make(map[string]bool)
+	bind := func(names ...string) {
+		for _, name := range names {
+			bound[name] = true
+		}
+	}
+	var visit func(node AstNode)
+	visit = func(node AstNode) {
+		switch exp := node.(type) {
+		case *IdentExp:
+			if !exp.Global {
+				referred[exp.Name] = true
+			}
+		case *SetExp:
+			if !exp.Global {
+				referred[exp.Name] = true
+			}
+		case *LambdaExp:
+			bind(exp.Args...)
+			bind(exp.Rest)
+		case *LetExp:
+			bind(exp.Names...)
+		case *LetStarExp:
+			bind(exp.Names...)
+		case *LetrecExp:
+			bind(exp.Names...)
+		case *LetrecStarExp:
+			bind(exp.Names...)
+		case *NamedLetExp:
+			bind(exp.Names...)
+			bind(exp.Name)
+		case *LetValuesExp:
+			for _, formals := range exp.Formals {
+				bind(formals.Args...)
+				bind(formals.Rest)
+			}
+		case *LetStarValuesExp:
+			for _, formals := range exp.Formals {
+				bind(formals.Args...)
+				bind(formals.Rest)
+			}
+		case *DoExp:
+			bind(exp.Names...)
+		case *DefExp:
+			bind(exp.Name)
+		case *DefineRecordTypeExp:
+			bind(exp.Name, exp.Constructor, exp.Predicate)
+			for _, field := range exp.Fields {
+				bind(field.Accessor, field.Modifier)
+			}
+		}
+		for _, subNode := range node.GetSubNodes() {
+			visit(subNode)
+		}
+	}
+	visit(lambda)
+	for name := range bound {
+		delete(referred, name)
+	}
+	return referred
+}
+
+// findCells finds the locals that need a cell, which are those captured by a
+// lambda that get assigned to, whether inside the lambda or outside it. Like
+// freeLocals, it tells locals apart by name, so locals with the same name in
+// scopes that can't see each other get treated alike, which is only ever more
+// cautious than needed.
+func findCells(program AstNode) map[string]bool {
+	captured := make(map[string]bool)
+	assigned := make(map[string]bool)
+	var visit func(node AstNode)
+	visit = func(node AstNode) {
+		switch exp := node.(type) {
+		case *LambdaExp:
+			for name := range freeLocals(exp) {
+				captured[name] = true
+			}
+		case *NamedLetExp:
+			// the body of a named let gets compiled as a lambda
+			for name := range freeLocals(NewLambdaExp(exp.Names, exp.Body()...)) {
+				captured[name] = true
+			}
+		case *SetExp:
+			if !exp.Global {
+				assigned[exp.Name] = true
+			}
+		}
+		for _, subNode := range node.GetSubNodes() {
+			visit(subNode)
+		}
+	}
+	visit(program)
+	cells := make(map[string]bool)
+	for name := range captured {
+		if assigned[name] {
+			cells[name] = true
+		}
+	}
+	return cells
+}
+
+// lambdaOf checks whether a node is a lambda, which gets bound as a procedure
+// rather than stored in a variable
+func lambdaOf(node AstNode) (*LambdaExp, bool) {
+	if use, ok := node.(*MacroUseExp); ok {
+		return lambdaOf(use.GetSubNodes()[0])
+	}
+	lambda, ok := node.(*LambdaExp)
+	return lambda, ok
+}
+
+// compileDefine compiles a top-level definition, allocating the global in the
+// heap the first time it's defined. Defining it again assigns to it like set!
+// would, so a procedure that's redefined has to be held in the global as a
+// procedure object, for calls compiled before the redefinition to see it.
+func (c *compiler) compileDefine(exp *DefExp) ([]byte, error) {
+	global, defined := c.globals[exp.Name]
+	if lambda, ok := lambdaOf(exp.GetSubNodes()[0]); ok && !c.widened[exp.Name] {
+		if defined {
+			return nil, widenError{exp.Name}
+		}
+		c.globals[exp.Name] = &variable{valueType: procedureType, global: true, procedure: newProcedure(exp.Name, lambda, nil)}
+		return nil, nil
+	}
+	if defined {
+		return c.compileStore(exp.GetSubNodes()[0], exp.Name, global)
+	}
+	valueCode, valueType, err := c.compile(exp.GetSubNodes()[0])
+	if err != nil {
+		return nil, err
+	}
+	if valueType == noValue {
+		return nil, compileError(exp, "No value to define "+exp.Name+" as")
+	}
+	if c.widened[exp.Name] {
+		valueCode, valueType = toObject(valueCode, valueType), objectType
+	}
+	global, code, err := c.newGlobal(exp, exp.Name, valueType)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(code, valueCode...), global.store()...), nil
+}
+
+// newGlobal binds a new global of the given type, returning the code allocating
+// it in the heap
+func (c *compiler) newGlobal(node AstNode, name string, valueType valueType) (*variable, []byte, error) {
+	if c.mnemonics == 0xFFFF {
+		return nil, nil, compileError(node, "Too many globals")
+	}
+	c.mnemonics++
+	global := &variable{valueType: valueType, global: true, mnemonic: []byte{byte(c.mnemonics >> 8), byte(c.mnemonics)}}
+	c.globals[name] = global
+	code := make([]byte, 0)
+	if valueType == stringType {
+		// hnews pops how many bytes to set aside for the string, which hstores
+		// will grow as needed
+		code = appendInt(append(code, opPushi), 0)
+	}
+	return global, append(append(code, heapNewOpcodes[valueType]), global.mnemonic...), nil
+}
+
+// compileRecordType compiles a define-record-type, which defines the record type
+// when it's run, and binds the procedures it generates as globals if it's at top
+// level, or in the current scope otherwise. Each procedure is a lambda calling
+// itself, so that it can be used as a value like any other procedure, while calls
+// to it get compiled straight into record instructions. Any that get assigned to
+// are held in variables instead, starting out as procedure objects.
+func (c *compiler) compileRecordType(exp *DefineRecordTypeExp, global bool) ([]byte, error) {
+	c.recordTypes++
+	fieldIndices := make(map[string]int)
+	for index, field := range exp.Fields {
+		fieldIndices[field.Name] = index
+	}
+	code := appendInt(append(pushString(exp.Name), opRdef), c.recordTypes)
+	code = appendInt(code, int64(len(exp.Fields)))
+	bind := func(name string, kind int, fields []int, arity int) error {
+		record := &recordProcedure{kind, c.recordTypes, exp.Name, len(exp.Fields), fields}
+		lambda := callingLambda(exp, name, global, arity)
+		procedure := &variable{valueType: procedureType, global: global, procedure: newProcedure(name, lambda, c.scope), record: record}
+		if global {
+			c.globals[name] = procedure
+		} else {
+			c.scope.variables[name] = procedure
+		}
+		if !c.widened[name] {
+			return nil
+		}
+		// the object's created while the name still refers to the procedure,
+		// which the lambda calls
+		objectCode, err := c.compileProcedureObject(exp, procedure.procedure)
+		if err != nil {
+			return err
+		}
+		if !global {
+			code = append(append(code, objectCode...), c.bindLocal(name, objectType)...)
+			return nil
+		}
+		variable, globalCode, err := c.newGlobal(exp, name, objectType)
+		if err != nil {
+			return err
+		}
+		code = append(append(append(code, globalCode...), objectCode...), variable.store()...)
+		return nil
+	}
+	constructorFields := make([]int, 0)
+	for _, name := range exp.ConstructorFields {
+		constructorFields = append(constructorFields, fieldIndices[name])
+	}
+	if err := bind(exp.Constructor, recordConstructor, constructorFields, len(constructorFields)); err != nil {
+		return nil, err
+	}
+	if err := bind(exp.Predicate, recordPredicate, nil, 1); err != nil {
+		return nil, err
+	}
+	for index, field := range exp.Fields {
+		if err := bind(field.Accessor, recordAccessor, []int{index}, 1); err != nil {
+			return nil, err
+		}
+		if field.Modifier != "" {
+			if err := bind(field.Modifier, recordModifier, []int{index}, 2); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return code, nil
+}
+
+// callingLambda makes a lambda that passes its arguments on to a call to the
+// procedure of the given name, for procedures whose calls get compiled into
+// instructions of their own, so they can still be turned into procedure objects
+func callingLambda(node AstNode, name string, global bool, arity int) *LambdaExp {
+	operator := NewIdentExp(name)
+	operator.Global = global
+	operator.SetSpan(node.GetSpan())
+	call := NewCallExp(operator)
+	call.SetSpan(node.GetSpan())
+	args := make([]string, 0)
+	for index := 0; index < arity; index++ {
+		// a name with a space in can't clash with any from the source
+		args = append(args, "argument "+strconv.Itoa(index+1))
+		arg := NewIdentExp(args[index])
+		arg.SetSpan(node.GetSpan())
+		call.AddSubNode(arg)
+	}
+	lambda := NewLambdaExp(args, call)
+	lambda.SetSpan(node.GetSpan())
+	return lambda
+}
+
+// compileStore compiles storing a new value in a variable. A value of a different
+// type from the variable's means the variable has to be widened to hold objects.
+func (c *compiler) compileStore(value AstNode, name string, variable *variable) ([]byte, error) {
+	code, valueType, err := c.compile(value)
+	if err != nil {
+		return nil, err
+	}
+	if variable.valueType == objectType {
+		code, valueType = toObject(code, valueType), objectType
+	}
+	if valueType != variable.valueType {
+		if !c.widened[name] {
+			return nil, widenError{name}
+		}
+		return nil, compileError(value, "Can't store "+valueType.article()+" in "+name+", which holds "+variable.valueType.article())
+	}
+	return append(code, variable.store()...), nil
+}
+
+// bindLocal binds a new local in the current scope and frame, returning the code
+// creating it and storing the value on top of the stack in it, turned into an
+// object if the local's been widened
+func (c *compiler) bindLocal(name string, valueType valueType) []byte {
+	if c.cells[name] {
+		local := &variable{valueType: objectType, slot: c.frame.slots, frame: c.frame, cell: true}
+		c.frame.slots++
+		c.scope.variables[name] = local
+		return append(toObject(nil, valueType), newCell(local)...)
+	}
+	code := make([]byte, 0)
+	if c.widened[name] {
+		code, valueType = toObject(code, valueType), objectType
+	}
+	local := &variable{valueType: valueType, slot: c.frame.slots, frame: c.frame}
+	c.frame.slots++
+	c.scope.variables[name] = local
+	return append(appendSlot(append(code, localNewOpcodes[valueType]), local.slot), local.store()...)
+}
+
+// newCell gives the code to put the object on top of the stack in a new cell,
+// held in the slot of the given local
+func newCell(local *variable) []byte {
+	code := appendSlot([]byte{opOcell, opLnewi}, local.slot)
+	return appendSlot(append(code, opLstorei), local.slot)
+}
+
+// bindProcedure binds a lambda as a procedure in the current scope
+func (c *compiler) bindProcedure(name string, lambda *LambdaExp) {
+	c.scope.variables[name] = &variable{valueType: procedureType, procedure: newProcedure(name, lambda, c.scope)}
+}
+
+// bindProcedures binds lambdas that can all see each other, like the internal
+// definitions of a body, in the current scope. They're bound as procedures to
+// begin with, but any that refer to locals from outside them, or to one of the
+// others that does, have to be closures instead, as do any that are assigned to,
+// so that they can hold other values. Each closure gets a local
+// holding a cell for it, with the cells all created up front by the code returned,
+// so the closures can capture each other before they've all been created.
+func (c *compiler) bindProcedures(names []string, lambdas []*LambdaExp) []byte {
+	for index, name := range names {
+		c.bindProcedure(name, lambdas[index])
+	}
+	code := make([]byte, 0)
+	for changed := true; changed; {
+		changed = false
+		for index, name := range names {
+			if c.scope.variables[name].procedure == nil || (!c.needsClosure(lambdas[index]) && !c.widened[name]) {
+				continue
+			}
+			local := &variable{valueType: objectType, slot: c.frame.slots, frame: c.frame, cell: true}
+			c.frame.slots++
+			c.scope.variables[name] = local
+			code = append(append(code, opOvoid), newCell(local)...)
+			changed = true
+		}
+	}
+	return code
+}
+
+// compileClosureBinding compiles creating the closure for a lambda bound by
+// bindProcedures and storing it in its cell, which procedures don't need
+func (c *compiler) compileClosureBinding(name string, lambda *LambdaExp) ([]byte, error) {
+	local := c.scope.variables[name]
+	if local.procedure != nil {
+		return nil, nil
+	}
+	code, err := c.compileProcedureObject(lambda, newProcedure(name, lambda, c.scope))
+	if err != nil {
+		return nil, err
+	}
+	return append(code, local.store()...), nil
+}
+
+// compileLet compiles a let or let*, whose bindings become locals in the current
+// frame. The inits of a let can't see any of its bindings, while those of a let*
+// can see the ones before them.
+func (c *compiler) compileLet(names []string, inits []AstNode, body []AstNode, sequential bool) ([]byte, valueType, error) {
+	outer := c.scope
+	defer func() { c.scope = outer }()
+	letScope := newScope(outer)
+	code := make([]byte, 0)
+	for index, init := range inits {
+		c.scope = outer
+		if sequential {
+			c.scope = letScope
+		}
+		if lambda, ok := lambdaOf(init); ok && !c.needsClosure(lambda) && !c.widened[names[index]] {
+			// the lambda sees the same bindings any other init would
+			letScope.variables[names[index]] = &variable{valueType: procedureType, procedure: newProcedure(names[index], lambda, c.scope)}
+			continue
+		}
+		initCode, initType, err := c.compile(init)
+		if err != nil {
+			return nil, noValue, err
+		}
+		if initType == noValue {
+			return nil, noValue, compileError(init, "No value to bind "+names[index]+" to")
+		}
+		c.scope = letScope
+		code = append(append(code, initCode...), c.bindLocal(names[index], initType)...)
+	}
+	c.scope = letScope
+	bodyCode, bodyType, err := c.compileBody(body)
+	if err != nil {
+		return nil, noValue, err
+	}
+	return append(code, bodyCode...), bodyType, nil
+}
+
+// compileLetValues compiles a let-values or let*-values, binding the values of
+// each init to its formals like the arguments of a procedure. A let*-values is
+// compiled as a let-values for each binding, one inside the other.
+func (c *compiler) compileLetValues(exp AstNode, formals []Formals, inits []AstNode, body []AstNode, sequential bool) ([]byte, valueType, error) {
+	if sequential && len(formals) > 1 {
+		inner := NewLetStarValuesExp(formals[1:], inits[1:], body...)
+		inner.SetSpan(exp.GetSpan())
+		return c.compileLetValues(exp, formals[:1], inits[:1], []AstNode{inner}, false)
+	}
+	names := make([]string, 0)
+	values := make([]AstNode, 0)
+	for index, init := range inits {
+		args, rest := formals[index].Args, formals[index].Rest
+		operands, ok := c.valuesOperands(init)
+		if !ok {
+			// anything other than a call to values gives a single value
+			if single := len(args) == 1 && rest == "" || len(args) == 0 && rest != ""; !single {
+				return nil, noValue, compileError(init, "Expected a call to values for "+formals[index].String())
+			}
+			operands = []AstNode{init}
+		}
+		if len(operands) < len(args) || (rest == "" && len(operands) > len(args)) {
+			return nil, noValue, compileError(init, "Expected "+strconv.Itoa(len(args))+" values for "+
+				formals[index].String()+", found "+strconv.Itoa(len(operands)))
+		}
+		names, values = append(names, args...), append(values, operands[:len(args)]...)
+		if rest != "" {
+			// the rest of the values are quasiquoted into a list
+			list := NewListLiteral()
+			for _, operand := range operands[len(args):] {
+				list.AddSubNode(NewUnquoteExp(1, operand))
+			}
+			restList := NewQuasiquoteExp(1, list)
+			restList.SetSpan(init.GetSpan())
+			names, values = append(names, rest), append(values, restList)
+		}
+	}
+	return c.compileLet(names, values, body, false)
+}
+
+// valuesOperands gives the operands of a call to values, which are the values the
+// call returns
+func (c *compiler) valuesOperands(exp AstNode) ([]AstNode, bool) {
+	if use, ok := exp.(*MacroUseExp); ok {
+		exp = use.GetSubNodes()[0]
+	}
+	call, ok := exp.(*CallExp)
+	if !ok {
+		return nil, false
+	}
+	operator, ok := call.GetSubNodes()[0].(*IdentExp)
+	if !ok || operator.Name != "values" || !operator.Global || c.globals["values"] != nil {
+		return nil, false
+	}
+	return call.GetSubNodes()[1:], true
+}
+
+// compileLetrec compiles a letrec or letrec*, whose bindings can all see each
+// other. Lambdas are bound before anything else, so they can call each other,
+// while the other inits are evaluated in order and become locals.
+func (c *compiler) compileLetrec(names []string, inits []AstNode, body []AstNode) ([]byte, valueType, error) {
+	outer := c.scope
+	defer func() { c.scope = outer }()
+	c.scope = newScope(outer)
+	lambdaNames := make([]string, 0)
+	lambdas := make([]*LambdaExp, 0)
+	for index, init := range inits {
+		if lambda, ok := lambdaOf(init); ok {
+			lambdaNames, lambdas = append(lambdaNames, names[index]), append(lambdas, lambda)
+		}
+	}
+	code := c.bindProcedures(lambdaNames, lambdas)
+	for index, init := range inits {
+		if lambda, ok := lambdaOf(init); ok {
+			closureCode, err := c.compileClosureBinding(names[index], lambda)
+			if err != nil {
+				return nil, noValue, err
+			}
+			code = append(code, closureCode...)
+			continue
+		}
+		initCode, initType, err := c.compile(init)
+		if err != nil {
+			return nil, noValue, err
+		}
+		if initType == noValue {
+			return nil, noValue, compileError(init, "No value to bind "+names[index]+" to")
+		}
+		code = append(append(code, initCode...), c.bindLocal(names[index], initType)...)
+	}
+	bodyCode, bodyType, err := c.compileBody(body)
+	if err != nil {
+		return nil, noValue, err
+	}
+	return append(code, bodyCode...), bodyType, nil
+}
+
+// compileNamedLet compiles a named let as a procedure taking the bindings as its
+// arguments, or a closure if it refers to locals from outside it, called with the
+// inits straight away
+func (c *compiler) compileNamedLet(exp *NamedLetExp) ([]byte, valueType, error) {
+	outer := c.scope
+	defer func() { c.scope = outer }()
+	c.scope = newScope(outer)
+	lambda := NewLambdaExp(exp.Names, exp.Body()...)
+	lambda.SetSpan(exp.GetSpan())
+	code := c.bindProcedures([]string{exp.Name}, []*LambdaExp{lambda})
+	local := c.scope.variables[exp.Name]
+	if local.procedure != nil {
+		return c.compileProcedureCall(exp, local.procedure, exp.Inits())
+	}
+	closureCode, err := c.compileClosureBinding(exp.Name, lambda)
+	if err != nil {
+		return nil, noValue, err
+	}
+	callCode, callType, err := c.compileObjectCall(exp.Name, local.load(), exp.Inits())
+	if err != nil {
+		return nil, noValue, err
+	}
+	return append(append(code, closureCode...), callCode...), callType, nil
+}
+
+// compileBody compiles the body of a lambda or let, in a scope of its own. Any
+// internal definitions of procedures are bound before the rest of the body, so
+// they can call each other, with closures being created where they're defined,
+// while the definitions of other values become locals.
+func (c *compiler) compileBody(body []AstNode) ([]byte, valueType, error) {
+	outer := c.scope
+	defer func() { c.scope = outer }()
+	c.scope = newScope(outer)
+	definitions := make(map[AstNode]bool)
+	names := make([]string, 0)
+	lambdas := make([]*LambdaExp, 0)
+	for _, exp := range body {
+		if def, ok := exp.(*DefExp); ok {
+			definitions[exp] = true
+			if lambda, ok := lambdaOf(def.GetSubNodes()[0]); ok {
+				names, lambdas = append(names, def.Name), append(lambdas, lambda)
+			}
+		}
+	}
+	// record types come first, so that their procedures are bound along with
+	// the rest
+	code := make([]byte, 0)
+	for _, exp := range body {
+		if recordType, ok := exp.(*DefineRecordTypeExp); ok {
+			recordCode, err := c.compileRecordType(recordType, false)
+			if err != nil {
+				return nil, noValue, err
+			}
+			code = append(code, recordCode...)
+		}
+	}
+	code = append(code, c.bindProcedures(names, lambdas)...)
+	valueType := noValue
+	for index, exp := range body {
+		if _, ok := exp.(*DefineRecordTypeExp); ok {
+			continue
+		}
+		if definitions[exp] {
+			def := exp.(*DefExp)
+			if lambda, ok := lambdaOf(def.GetSubNodes()[0]); ok {
+				closureCode, err := c.compileClosureBinding(def.Name, lambda)
+				if err != nil {
+					return nil, noValue, err
+				}
+				code = append(code, closureCode...)
+				continue
+			}
+			valueCode, defType, err := c.compile(def.GetSubNodes()[0])
+			if err != nil {
+				return nil, noValue, err
+			}
+			if defType == noValue {
+				return nil, noValue, compileError(exp, "No value to define "+def.Name+" as")
+			}
+			code = append(append(code, valueCode...), c.bindLocal(def.Name, defType)...)
+			continue
+		}
+		expCode, expType, err := c.compile(exp)
+		if err != nil {
+			return nil, noValue, err
+		}
+		if index != len(body)-1 {
+			expCode, expType = dropValue(expCode, expType), noValue
+		}
+		code, valueType = append(code, expCode...), expType
+	}
+	return code, valueType, nil
+}
+
+// compileNumber compiles an operand that has to be a number
+func (c *compiler) compileNumber(node AstNode, operator string) ([]byte, valueType, error) {
+	code, valueType, err := c.compile(node)
+	if err != nil {
+		return nil, noValue, err
+	}
+	if valueType != intType && valueType != doubleType && valueType != objectType {
+		return nil, noValue, compileError(node, "Expected a number for "+operator+", found "+valueType.article())
+	}
+	return code, valueType, nil
+}
+
+// compileArithmetic compiles an arithmetic operator, which gives a double if any
+// of its operands are doubles, with any integer operands getting converted. If
+// any of them are objects, the VM works out what sort of number the result is,
+// so the result is an object too.
+func (c *compiler) compileArithmetic(node AstNode, operator string) ([]byte, valueType, error) {
+	operands := node.GetSubNodes()
+	codes := make([][]byte, 0)
+	types := make([]valueType, 0)
+	resultType := intType
+	// division always gives a double, since the VM has no fractions
+	if operator == "/" {
+		resultType = doubleType
+	}
+	for _, operand := range operands {
+		code, valueType, err := c.compileNumber(operand, operator)
+		if err != nil {
+			return nil, noValue, err
+		}
+		if valueType == objectType || (valueType == doubleType && resultType != objectType) {
+			resultType = valueType
+		}
+		codes, types = append(codes, code), append(types, valueType)
+	}
+	for index, valueType := range types {
+		if resultType == objectType {
+			codes[index] = toObject(codes[index], valueType)
+		} else if valueType == intType && resultType == doubleType {
+			codes[index] = append(codes[index], opItod)
+		}
+	}
+	// (+) and (*) give their identity, which (- x) and (/ x) act on too
+	identity := int64(0)
+	if operator == "*" || operator == "/" {
+		identity = 1
+	}
+	if len(operands) == 0 || (len(operands) == 1 && (operator == "-" || operator == "/")) {
+		identityCode := pushNumber(identity, resultType)
+		if resultType == objectType {
+			identityCode = toObject(pushNumber(identity, intType), intType)
+		}
+		codes = append([][]byte{identityCode}, codes...)
+	}
+	opcode := arithmeticOpcodes[operator][0]
+	if resultType == doubleType {
+		opcode = arithmeticOpcodes[operator][1]
+	} else if resultType == objectType {
+		opcode = arithmeticOpcodes[operator][2]
+	}
+	code := codes[0]
+	for _, operandCode := range codes[1:] {
+		code = append(append(code, operandCode...), opcode)
+	}
+	return code, resultType, nil
+}
+
+// compileComparison compiles a comparison operator into a comparison of each pair
+// of neighbouring operands, which all have to hold for the result to be true
+func (c *compiler) compileComparison(node AstNode, jumpOpcode byte) ([]byte, valueType, error) {
+	operands := node.GetSubNodes()
+	if len(operands) > 2 {
+		// the operands in the middle get compared twice, so they mustn't have
+		// side effects
+		for _, operand := range operands {
+			if !isSimple(operand) {
+				return nil, noValue, compileError(operand, "Comparisons of more than 2 operands can only compare literals and variables")
+			}
+		}
+	}
+	comparisons := make([][]byte, 0)
+	for index := range operands[1:] {
+		comparison, err := c.compileComparePair(operands[index], operands[index+1], jumpOpcode)
+		if err != nil {
+			return nil, noValue, err
+		}
+		comparisons = append(comparisons, comparison)
+	}
+	return allTrue(comparisons), boolType, nil
+}
+
+// compileComparePair compares two numbers, leaving a boolean on the stack
+func (c *compiler) compileComparePair(x AstNode, y AstNode, jumpOpcode byte) ([]byte, error) {
+	xCode, xType, err := c.compileNumber(x, "a comparison")
+	if err != nil {
+		return nil, err
+	}
+	yCode, yType, err := c.compileNumber(y, "a comparison")
+	if err != nil {
+		return nil, err
+	}
+	compareOpcode := opCmpi
+	if xType == objectType || yType == objectType {
+		compareOpcode = opOcmp
+		xCode, yCode = toObject(xCode, xType), toObject(yCode, yType)
+	} else if xType == doubleType || yType == doubleType {
+		compareOpcode = opCmpd
+		if xType == intType {
+			xCode = append(xCode, opItod)
+		}
+		if yType == intType {
+			yCode = append(yCode, opItod)
+		}
+	}
+	return jumpToBool(append(append(xCode, yCode...), compareOpcode), jumpOpcode), nil
+}
+
+// jumpToBool turns code leaving a comparison result on the stack into code
+// leaving a boolean, which is true if the given jump would be taken
+func jumpToBool(code []byte, jumpOpcode byte) []byte {
+	falseCode := appendJump(pushBool(false), opJmp, 2)
+	code = appendJump(code, jumpOpcode, int64(len(falseCode)))
+	return append(append(code, falseCode...), pushBool(true)...)
+}
+
+// allTrue combines code leaving booleans on the stack into code checking whether
+// they're all true, stopping at the first one that's false
+func allTrue(tests [][]byte) []byte {
+	if len(tests) == 1 {
+		return tests[0]
+	}
+	// the last test's result is the overall one; any earlier false result
+	// jumps to the end, which pushes false
+	code := appendJump(tests[len(tests)-1], opJmp, 2)
+	code = append(code, pushBool(false)...)
+	for index := len(tests) - 2; index >= 0; index-- {
+		test := appendJump(tests[index], opJeq, int64(len(code)-2))
+		code = append(test, code...)
+	}
+	return code
+}
+
+// isSimple checks whether a node is a literal or variable, which can be
+// evaluated any number of times without side effects
+func isSimple(node AstNode) bool {
+	switch exp := node.(type) {
+	case *MacroUseExp:
+		return isSimple(exp.GetSubNodes()[0])
+	case *IntLiteral, *FloatLiteral, *BoolLiteral, *CharLiteral, *StringLiteral, *IdentExp:
+		return true
+	}
+	return false
+}
+
+// compileTest compiles the test of a conditional, leaving a boolean on the stack.
+// Only #f is false, so a test of any type other than a boolean or object is
+// always true, in which case its value is dropped and there's nothing to check.
+func (c *compiler) compileTest(node AstNode) ([]byte, bool, error) {
+	code, valueType, err := c.compile(node)
+	if err != nil {
+		return nil, false, err
+	}
+	switch valueType {
+	case noValue:
+		return nil, false, compileError(node, "No value to test")
+	case boolType:
+		return code, false, nil
+	case objectType:
+		return append(code, opOtruth), false, nil
+	}
+	return dropValue(code, valueType), true, nil
+}
+
+// branch is one arm of a conditional, taken if its test leaves true on the stack
+type branch struct {
+	test []byte
+	// whether the test is always true, in which case it's only run for its
+	// side effects
+	always    bool
+	code      []byte
+	valueType valueType
+}
+
+// joinBranches lays out a chain of branches, taking the first whose test is true
+// or falling back on the given code if none of them are. The result is an object
+// unless every arm gives the same type of value, with an arm that doesn't give
+// one giving an unspecified object instead.
+func joinBranches(branches []branch, fallback branch) ([]byte, valueType) {
+	for index, arm := range branches {
+		if arm.always {
+			// none of the branches after this one can be reached
+			branches, fallback = branches[:index], arm
+			fallback.code = append(arm.test, arm.code...)
+			break
+		}
+	}
+	resultType := fallback.valueType
+	for _, arm := range branches {
+		resultType = unify(resultType, arm.valueType)
+	}
+	code := fallback.code
+	if resultType == objectType {
+		code = toObject(code, fallback.valueType)
+	}
+	for index := len(branches) - 1; index >= 0; index-- {
+		armCode := branches[index].code
+		if resultType == objectType {
+			armCode = toObject(armCode, branches[index].valueType)
+		}
+		armCode = appendJump(armCode, opJmp, int64(len(code)))
+		test := appendJump(branches[index].test, opJeq, int64(len(armCode)))
+		code = append(append(test, armCode...), code...)
+	}
+	return code, resultType
+}
+
+// unify gives the type of a value that can come from either of two places, which
+// has to be an object if they give different types
+func unify(x valueType, y valueType) valueType {
+	if x == y {
+		return x
+	}
+	return objectType
+}
+
+// toObject turns code leaving a value on the stack into code leaving an object
+// holding it, with code that doesn't leave a value leaving an unspecified object
+func toObject(code []byte, valueType valueType) []byte {
+	switch valueType {
+	case objectType:
+		return code
+	case noValue:
+		return append(code, opOvoid)
+	}
+	return append(code, boxOpcodes[valueType])
+}
+
+// dropValue drops whatever value code leaves on the stack, for when it's only
+// run for its side effects
+func dropValue(code []byte, valueType valueType) []byte {
+	if valueType == noValue {
+		return code
+	}
+	return append(code, dropOpcodes[valueType])
+}
+
+// compileIf compiles an if, whose value is unspecified if its test is false and
+// it has no alternative
+func (c *compiler) compileIf(exp *IfExp) ([]byte, valueType, error) {
+	subNodes := exp.GetSubNodes()
+	test, always, err := c.compileTest(subNodes[0])
+	if err != nil {
+		return nil, noValue, err
+	}
+	thenCode, thenType, err := c.compile(subNodes[1])
+	if err != nil {
+		return nil, noValue, err
+	}
+	fallback := branch{}
+	if len(subNodes) == 3 {
+		fallback.code, fallback.valueType, err = c.compile(subNodes[2])
+		if err != nil {
+			return nil, noValue, err
+		}
+	}
+	code, valueType := joinBranches([]branch{{test, always, thenCode, thenType}}, fallback)
+	return code, valueType, nil
+}
+
+// compileWhen compiles a when, or an unless if negated, whose body is only run if
+// the test is true, or false for an unless
+func (c *compiler) compileWhen(subNodes []AstNode, negated bool) ([]byte, valueType, error) {
+	test, always, err := c.compileTest(subNodes[0])
+	if err != nil {
+		return nil, noValue, err
+	}
+	bodyCode, bodyType, err := c.compileSequence(subNodes[1:])
+	if err != nil {
+		return nil, noValue, err
+	}
+	body := branch{code: bodyCode, valueType: bodyType}
+	if negated {
+		code, valueType := joinBranches([]branch{{test: test, always: always}}, body)
+		return code, valueType, nil
+	}
+	code, valueType := joinBranches([]branch{{test, always, bodyCode, bodyType}}, branch{})
+	return code, valueType, nil
+}
+
+// compileAnd compiles an and, which gives #f as soon as one of its expressions is
+// false, or the value of the last one if none are
+func (c *compiler) compileAnd(exps []AstNode) ([]byte, valueType, error) {
+	if len(exps) == 0 {
+		return pushBool(true), boolType, nil
+	}
+	code, valueType, err := c.compile(exps[len(exps)-1])
+	if err != nil {
+		return nil, noValue, err
+	}
+	for index := len(exps) - 2; index >= 0; index-- {
+		test, always, err := c.compileTest(exps[index])
+		if err != nil {
+			return nil, noValue, err
+		}
+		code, valueType = joinBranches([]branch{{test, always, code, valueType}}, branch{code: pushBool(false), valueType: boolType})
+	}
+	return code, valueType, nil
+}
+
+// compileOr compiles an or, which gives the value of the first of its
+// expressions that isn't false, or #f if they all are
+func (c *compiler) compileOr(exps []AstNode) ([]byte, valueType, error) {
+	if len(exps) == 0 {
+		return pushBool(false), boolType, nil
+	}
+	outer := c.scope
+	defer func() { c.scope = outer }()
+	c.scope = newScope(outer)
+	branches := make([]branch, 0)
+	for _, exp := range exps[:len(exps)-1] {
+		arm, local, err := c.compileValueTest(exp, "or value")
+		if err != nil {
+			return nil, noValue, err
+		}
+		arm.code, arm.valueType = local.load(), local.valueType
+		branches = append(branches, arm)
+	}
+	last := branch{}
+	var err error
+	last.code, last.valueType, err = c.compile(exps[len(exps)-1])
+	if err != nil {
+		return nil, noValue, err
+	}
+	code, valueType := joinBranches(branches, last)
+	return code, valueType, nil
+}
+
+// compileValueTest compiles a test whose value is needed again if it isn't false,
+// keeping it in a local of the given name. Names with spaces in can't come from
+// the source, so the local can't clash with anything else.
+func (c *compiler) compileValueTest(node AstNode, name string) (branch, *variable, error) {
+	code, valueType, err := c.compile(node)
+	if err != nil {
+		return branch{}, nil, err
+	}
+	if valueType == noValue {
+		return branch{}, nil, compileError(node, "No value to test")
+	}
+	test := append(code, c.bindLocal(name, valueType)...)
+	local := c.scope.variables[name]
+	switch valueType {
+	case boolType:
+		return branch{test: append(test, local.load()...)}, local, nil
+	case objectType:
+		return branch{test: append(append(test, local.load()...), opOtruth)}, local, nil
+	}
+	return branch{test: test, always: true}, local, nil
+}
+
+// compileCond compiles a cond into a chain of branches, one per clause
+func (c *compiler) compileCond(exp *CondExp) ([]byte, valueType, error) {
+	outer := c.scope
+	defer func() { c.scope = outer }()
+	c.scope = newScope(outer)
+	branches := make([]branch, 0)
+	fallback := branch{}
+	for _, node := range exp.GetSubNodes() {
+		clause := node.(*CondClause)
+		subNodes := clause.GetSubNodes()
+		if clause.Else {
+			code, valueType, err := c.compileSequence(subNodes)
+			if err != nil {
+				return nil, noValue, err
+			}
+			fallback = branch{code: code, valueType: valueType}
+			break
+		}
+		if len(subNodes) > 1 && !clause.Arrow {
+			test, always, err := c.compileTest(subNodes[0])
+			if err != nil {
+				return nil, noValue, err
+			}
+			code, valueType, err := c.compileSequence(subNodes[1:])
+			if err != nil {
+				return nil, noValue, err
+			}
+			branches = append(branches, branch{test, always, code, valueType})
+			continue
+		}
+		// the test's value is what the clause gives, or what gets passed to
+		// the receiver
+		arm, local, err := c.compileValueTest(subNodes[0], "cond value")
+		if err != nil {
+			return nil, noValue, err
+		}
+		arm.code, arm.valueType = local.load(), local.valueType
+		if clause.Arrow {
+			arm.code, arm.valueType, err = c.compileReceiverCall(clause, subNodes[1], "cond value")
+			if err != nil {
+				return nil, noValue, err
+			}
+		}
+		branches = append(branches, arm)
+	}
+	code, valueType := joinBranches(branches, fallback)
+	return code, valueType, nil
+}
+
+// compileReceiverCall compiles the call to the receiver of a => clause, which
+// gets passed the value in the local of the given name
+func (c *compiler) compileReceiverCall(clause AstNode, receiver AstNode, name string) ([]byte, valueType, error) {
+	arg := NewIdentExp(name)
+	arg.SetSpan(receiver.GetSpan())
+	call := NewCallExp(receiver, arg)
+	call.SetSpan(clause.GetSpan())
+	return c.compileCall(call)
+}
+
+// compileCase compiles a case, whose key is kept in a local and compared against
+// each clause's data in turn with eqv?
+func (c *compiler) compileCase(exp *CaseExp) ([]byte, valueType, error) {
+	outer := c.scope
+	defer func() { c.scope = outer }()
+	c.scope = newScope(outer)
+	subNodes := exp.GetSubNodes()
+	keyCode, keyType, err := c.compile(subNodes[0])
+	if err != nil {
+		return nil, noValue, err
+	}
+	if keyType == noValue {
+		return nil, noValue, compileError(subNodes[0], "No value to compare")
+	}
+	code := append(toObject(keyCode, keyType), c.bindLocal("case key", objectType)...)
+	key := c.scope.variables["case key"]
+	branches := make([]branch, 0)
+	fallback := branch{}
+	for _, node := range subNodes[1:] {
+		clause := node.(*CaseClause)
+		arm := branch{}
+		if clause.Arrow {
+			arm.code, arm.valueType, err = c.compileReceiverCall(clause, clause.GetSubNodes()[0], "case key")
+		} else {
+			arm.code, arm.valueType, err = c.compileSequence(clause.GetSubNodes())
+		}
+		if err != nil {
+			return nil, noValue, err
+		}
+		if clause.Else {
+			fallback = arm
+			break
+		}
+		matches := make([][]byte, 0)
+		for _, datum := range clause.Data {
+			datumCode, datumType, err := c.compileDatum(datum)
+			if err != nil {
+				return nil, noValue, err
+			}
+			match := append(append(key.load(), toObject(datumCode, datumType)...), opOeqv)
+			matches = append(matches, jumpToBool(match, opJeq))
+		}
+		if len(matches) == 0 {
+			// a clause without any data can never match
+			continue
+		}
+		arm.test = anyTrue(matches)
+		branches = append(branches, arm)
+	}
+	branchesCode, valueType := joinBranches(branches, fallback)
+	return append(code, branchesCode...), valueType, nil
+}
+
+// anyTrue combines code leaving booleans on the stack into code checking whether
+// any of them are true, stopping at the first one that is
+func anyTrue(tests [][]byte) []byte {
+	if len(tests) == 1 {
+		return tests[0]
+	}
+	// the last test's result is the overall one; any earlier true result
+	// jumps to the end, which pushes true
+	code := appendJump(tests[len(tests)-1], opJmp, 2)
+	code = append(code, pushBool(true)...)
+	for index := len(tests) - 2; index >= 0; index-- {
+		test := appendJump(tests[index], opJne, int64(len(code)-2))
+		code = append(test, code...)
+	}
+	return code
+}
+
+// compileDo compiles a do loop, whose variables are locals that get their steps
+// stored in them at the end of each time round the loop. Each step has to give
+// the same type of value as its variable's init.
+func (c *compiler) compileDo(exp *DoExp) ([]byte, valueType, error) {
+	outer := c.scope
+	defer func() { c.scope = outer }()
+	loopScope := newScope(outer)
+	code := make([]byte, 0)
+	locals := make([]*variable, 0)
+	for index, init := range exp.Inits() {
+		c.scope = outer
+		initCode, initType, err := c.compile(init)
+		if err != nil {
+			return nil, noValue, err
+		}
+		if initType == noValue {
+			return nil, noValue, compileError(init, "No value to bind "+exp.Names[index]+" to")
+		}
+		c.scope = loopScope
+		code = append(append(code, initCode...), c.bindLocal(exp.Names[index], initType)...)
+		locals = append(locals, loopScope.variables[exp.Names[index]])
+	}
+	c.scope = loopScope
+	test, always, err := c.compileTest(exp.Test())
+	if err != nil {
+		return nil, noValue, err
+	}
+	resultCode, resultType, err := c.compileSequence(exp.Results())
+	if err != nil {
+		return nil, noValue, err
+	}
+	if always {
+		// the loop ends before it starts
+		return append(append(code, test...), resultCode...), resultType, nil
+	}
+	bodyCode, bodyType, err := c.compileSequence(exp.Commands())
+	if err != nil {
+		return nil, noValue, err
+	}
+	bodyCode = dropValue(bodyCode, bodyType)
+	// every step is worked out before any of them get stored, since they can
+	// refer to each other's variables
+	stores := make([]byte, 0)
+	for index, step := range exp.Steps() {
+		stepCode, stepType, err := c.compile(step)
+		if err != nil {
+			return nil, noValue, err
+		}
+		if locals[index].valueType == objectType {
+			stepCode, stepType = toObject(stepCode, stepType), objectType
+		}
+		if stepType != locals[index].valueType {
+			if !c.widened[exp.Names[index]] {
+				return nil, noValue, widenError{exp.Names[index]}
+			}
+			return nil, noValue, compileError(step, "Can't store "+stepType.article()+" in "+exp.Names[index]+", which holds "+locals[index].valueType.article())
+		}
+		bodyCode = append(bodyCode, stepCode...)
+		stores = append(locals[index].store(), stores...)
+	}
+	bodyCode = append(bodyCode, stores...)
+	resultCode = appendJump(resultCode, opJmp, int64(len(bodyCode)+jumpLength))
+	loop := append(appendJump(test, opJeq, int64(len(resultCode))), resultCode...)
+	loop = append(loop, bodyCode...)
+	loop = appendJump(loop, opJmp, -int64(len(loop)+jumpLength))
+	return append(code, loop...), resultType, nil
+}
+
+// compileSequence compiles expressions evaluated one after the other for the
+// value of the last one, dropping the values of the others
+func (c *compiler) compileSequence(exps []AstNode) ([]byte, valueType, error) {
+	code := make([]byte, 0)
+	valueType := noValue
+	for index, exp := range exps {
+		expCode, expType, err := c.compile(exp)
+		if err != nil {
+			return nil, noValue, err
+		}
+		if index != len(exps)-1 {
+			expCode, expType = dropValue(expCode, expType), noValue
+		}
+		code, valueType = append(code, expCode...), expType
+	}
+	return code, valueType, nil
+}
+
+// compileDatum compiles a quoted datum. Literals give the same values they would
+// unquoted, while symbols, lists and vectors are objects.
+func (c *compiler) compileDatum(node AstNode) ([]byte, valueType, error) {
+	switch datum := node.(type) {
+	case *IntLiteral, *FloatLiteral, *BoolLiteral, *CharLiteral, *StringLiteral, *RationalLiteral, *BytevectorLiteral:
+		return c.compile(datum)
+	case *SymbolLiteral:
+		if strings.ContainsRune(datum.Name, 0) {
+			return nil, noValue, compileError(node, "Symbols with null characters can't be compiled")
+		}
+		return append(pushString(datum.Name), opOsym), objectType, nil
+	case *ListLiteral:
+		elements := datum.GetSubNodes()
+		tail := []byte{opOnil}
+		if datum.Dotted {
+			tailCode, tailType, err := c.compileDatum(elements[len(elements)-1])
+			if err != nil {
+				return nil, noValue, err
+			}
+			elements, tail = elements[:len(elements)-1], toObject(tailCode, tailType)
+		}
+		code := make([]byte, 0)
+		for _, element := range elements {
+			elementCode, elementType, err := c.compileDatum(element)
+			if err != nil {
+				return nil, noValue, err
+			}
+			code = append(code, toObject(elementCode, elementType)...)
+		}
+		// each ocons pairs the list so far with the element before it
+		code = append(code, tail...)
+		for range elements {
+			code = append(code, opOcons)
+		}
+		return code, objectType, nil
+	case *VectorLiteral:
+		code := make([]byte, 0)
+		for _, element := range datum.GetSubNodes() {
+			elementCode, elementType, err := c.compileDatum(element)
+			if err != nil {
+				return nil, noValue, err
+			}
+			code = append(code, toObject(elementCode, elementType)...)
+		}
+		return appendInt(append(code, opOvec), int64(len(datum.GetSubNodes()))), objectType, nil
+	}
+	return nil, noValue, compileError(node, nodeName(node)+" can't be compiled yet")
+}
+
+// compileTemplate compiles a quasiquote template, which gives what quoting it
+// would, except with the values of the unquoted expressions in it. Quasiquotes
+// nested inside it stay as lists, the same as the unquotes belonging to them.
+func (c *compiler) compileTemplate(node AstNode) ([]byte, valueType, error) {
+	switch template := node.(type) {
+	case *UnquoteExp:
+		if template.Level > 1 {
+			return c.compileTemplateForm("unquote", template.GetSubNodes()[0])
+		}
+		code, valueType, err := c.compile(template.GetSubNodes()[0])
+		if err == nil && valueType == noValue {
+			err = compileError(node, "No value to unquote")
+		}
+		return code, valueType, err
+	case *UnquoteSplicingExp:
+		if template.Level > 1 {
+			return c.compileTemplateForm("unquote-splicing", template.GetSubNodes()[0])
+		}
+		return nil, noValue, compileError(node, "Expected unquote-splicing within a list")
+	case *QuasiquoteExp:
+		return c.compileTemplateForm("quasiquote", template.GetSubNodes()[0])
+	case *ListLiteral:
+		return c.compileTemplateList(template)
+	case *VectorLiteral:
+		code := make([]byte, 0)
+		for _, element := range template.GetSubNodes() {
+			if splicing, ok := element.(*UnquoteSplicingExp); ok && splicing.Level == 1 {
+				return nil, noValue, compileError(element, "Can't compile unquote-splicing within a vector")
+			}
+			elementCode, elementType, err := c.compileTemplate(element)
+			if err != nil {
+				return nil, noValue, err
+			}
+			code = append(code, toObject(elementCode, elementType)...)
+		}
+		return appendInt(append(code, opOvec), int64(len(template.GetSubNodes()))), objectType, nil
+	}
+	return c.compileDatum(node)
+}
+
+// compileTemplateForm compiles a quasiquote, unquote or unquote-splicing nested in
+// a template, which gives a list of the keyword and the template inside it
+func (c *compiler) compileTemplateForm(keyword string, template AstNode) ([]byte, valueType, error) {
+	templateCode, templateType, err := c.compileTemplate(template)
+	if err != nil {
+		return nil, noValue, err
+	}
+	code := append(append(pushString(keyword), opOsym), toObject(templateCode, templateType)...)
+	return append(code, opOnil, opOcons, opOcons), objectType, nil
+}
+
+// compileTemplateList compiles a list in a quasiquote template. The list gets
+// built from its tail back, consing each element onto the rest of the list, and
+// appending each list spliced into it to the rest with a call to appendProcedure.
+func (c *compiler) compileTemplateList(list *ListLiteral) ([]byte, valueType, error) {
+	elements := list.GetSubNodes()
+	if list.Dotted {
+		elements = elements[:len(elements)-1]
+	}
+	// the elements are compiled in order, so any errors come in order too
+	codes := make([][]byte, 0)
+	for _, element := range elements {
+		if splicing, ok := element.(*UnquoteSplicingExp); ok && splicing.Level == 1 {
+			spliced := splicing.GetSubNodes()[0]
+			splicedCode, splicedType, err := c.compile(spliced)
+			if err != nil {
+				return nil, noValue, err
+			}
+			if splicedType != objectType {
+				return nil, noValue, compileError(spliced, "Expected a list to splice, found "+splicedType.article())
+			}
+			codes = append(codes, splicedCode)
+			continue
+		}
+		elementCode, elementType, err := c.compileTemplate(element)
+		if err != nil {
+			return nil, noValue, err
+		}
+		codes = append(codes, toObject(elementCode, elementType))
+	}
+	code := []byte{opOnil}
+	if list.Dotted {
+		tail := list.GetSubNodes()[len(elements)]
+		tailCode, tailType, err := c.compileTemplate(tail)
+		if err != nil {
+			return nil, noValue, err
+		}
+		code = toObject(tailCode, tailType)
+	}
+	for index := len(elements) - 1; index >= 0; index-- {
+		code = append(append([]byte(nil), codes[index]...), code...)
+		if splicing, ok := elements[index].(*UnquoteSplicingExp); ok && splicing.Level == 1 {
+			appendCode, err := c.compileProcedureObject(splicing, c.appendProcedure())
+			if err != nil {
+				return nil, noValue, err
+			}
+			code = appendInt(append(append(code, appendCode...), opJalc), 2)
+			continue
+		}
+		code = append(code, opOcons)
+	}
+	return code, objectType, nil
+}
+
+// compileCall compiles a procedure call. A lambda, a variable bound to one, or one
+// of the built-in procedures the VM has syscalls for is called directly, while
+// anything else has to give a procedure object.
+func (c *compiler) compileCall(exp *CallExp) ([]byte, valueType, error) {
+	subNodes := exp.GetSubNodes()
+	operator, args := subNodes[0], subNodes[1:]
+	if use, ok := operator.(*MacroUseExp); ok {
+		operator = use.GetSubNodes()[0]
+	}
+	switch op := operator.(type) {
+	case *LambdaExp:
+		if !c.needsClosure(op) {
+			return c.compileProcedureCall(exp, newProcedure("lambda", op, c.scope), args)
+		}
+	case *IdentExp:
+		if _, defined := c.globals[op.Name]; op.Global && !defined {
+			return c.compileBuiltinCall(exp, op.Name, args)
+		}
+		variable, err := c.lookup(op, op.Name, op.Global)
+		if err != nil {
+			return nil, noValue, err
+		}
+		if variable.record != nil {
+			return c.compileRecordCall(exp, op.Name, variable.record, args)
+		}
+		if variable.procedure != nil {
+			return c.compileProcedureCall(exp, variable.procedure, args)
+		}
+		if variable.valueType != objectType {
+			return nil, noValue, compileError(op, op.Name+" holds "+variable.valueType.article()+", not a procedure")
+		}
+		return c.compileObjectCall(op.Name, variable.load(), args)
+	}
+	operatorCode, operatorType, err := c.compile(operator)
+	if err != nil {
+		return nil, noValue, err
+	}
+	if operatorType == noValue {
+		return nil, noValue, compileError(operator, "No procedure to call")
+	}
+	if operatorType != objectType {
+		return nil, noValue, compileError(operator, "Expected a procedure, found "+operatorType.article())
+	}
+	return c.compileObjectCall("the procedure", operatorCode, args)
+}
+
+// compileRecordCall compiles a call to one of the procedures a define-record-type
+// generates. Fields a constructor doesn't take start out unspecified.
+func (c *compiler) compileRecordCall(exp *CallExp, name string, record *recordProcedure, args []AstNode) ([]byte, valueType, error) {
+	count := map[int]int{recordConstructor: len(record.fields), recordPredicate: 1, recordAccessor: 1, recordModifier: 2}
+	codes, types, err := c.compileArgs(exp, name, args, count[record.kind])
+	if err != nil {
+		return nil, noValue, err
+	}
+	switch record.kind {
+	case recordConstructor:
+		fieldCodes := make([][]byte, record.fieldCount)
+		for index, field := range record.fields {
+			fieldCodes[field] = toObject(codes[index], types[index])
+		}
+		code := make([]byte, 0)
+		for _, fieldCode := range fieldCodes {
+			if fieldCode == nil {
+				fieldCode = []byte{opOvoid}
+			}
+			code = append(code, fieldCode...)
+		}
+		return appendInt(append(code, opHnewr), record.typeID), objectType, nil
+	case recordPredicate:
+		if types[0] != objectType {
+			// only objects can be records
+			return append(dropValue(codes[0], types[0]), pushBool(false)...), boolType, nil
+		}
+		return jumpToBool(appendInt(append(codes[0], opRtest), record.typeID), opJeq), boolType, nil
+	}
+	if types[0] != objectType {
+		return nil, noValue, compileError(args[0], "Expected a record of type "+record.typeName+" for "+name+", found "+types[0].article())
+	}
+	code, opcode, resultType := codes[0], opRget, objectType
+	if record.kind == recordModifier {
+		code, opcode, resultType = append(code, toObject(codes[1], types[1])...), opRset, noValue
+	}
+	code = appendInt(appendInt(append(code, opcode), record.typeID), int64(record.fields[0]))
+	return code, resultType, nil
+}
+
+// compileObjectCall compiles a call to a procedure object, which could be any
+// procedure, so the arguments are passed as objects and the result is one too.
+// The procedure object is pushed last, for jalc to check it takes that many
+// arguments.
+func (c *compiler) compileObjectCall(name string, operatorCode []byte, args []AstNode) ([]byte, valueType, error) {
+	code := make([]byte, 0)
+	for _, arg := range args {
+		argCode, argType, err := c.compile(arg)
+		if err != nil {
+			return nil, noValue, err
+		}
+		if argType == noValue {
+			return nil, noValue, compileError(arg, "No value to pass to "+name)
+		}
+		code = append(code, toObject(argCode, argType)...)
+	}
+	code = append(code, operatorCode...)
+	return appendInt(append(code, opJalc), int64(len(args))), objectType, nil
+}
+
+// compileProcedureObject compiles creating a procedure object, which jumps to the
+// procedure's entry when called. A closure captures the locals from outside it
+// that it refers to, as objects holding their values, or as the cells holding
+// them if they have one.
+func (c *compiler) compileProcedureObject(node AstNode, procedure *procedure) ([]byte, error) {
+	spec, err := c.entry(procedure)
+	if err != nil {
+		return nil, err
+	}
+	code := make([]byte, 0)
+	for _, local := range spec.captures {
+		if local.frame != c.frame {
+			// a closure inside another closure, which has to capture the
+			// local too
+			local, err = c.capture(node, "a captured local", local)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if local.cell || local.captured {
+			code = append(code, local.loadSlot()...)
+		} else {
+			code = append(code, toObject(local.load(), local.valueType)...)
+		}
+	}
+	arity := int64(len(procedure.lambda.Args))
+	if procedure.lambda.Rest != "" {
+		// hnewp marks procedures taking any number of arguments with a
+		// negative arity
+		arity = -arity - 1
+	}
+	code = appendInt(append(code, opHnewp), arity)
+	code = appendInt(code, int64(len(spec.captures)))
+	// the code is wherever the entry ends up, which link fills in
+	return appendInt(code, int64(spec.id)), nil
+}
+
+// compileProcedureCall compiles a call to a procedure, pushing the arguments in
+// order and then jumping to the procedure with jal. A procedure taking any number
+// of arguments gets the rest of them as a list, passed after the others.
+func (c *compiler) compileProcedureCall(exp AstNode, procedure *procedure, args []AstNode) ([]byte, valueType, error) {
+	lambda := procedure.lambda
+	if lambda.Rest != "" && len(args) < len(lambda.Args) {
+		return nil, noValue, compileError(exp, "Expected at least "+strconv.Itoa(len(lambda.Args))+" arguments for "+procedure.name+", found "+strconv.Itoa(len(args)))
+	}
+	if lambda.Rest == "" && len(args) != len(lambda.Args) {
+		return nil, noValue, compileError(exp, "Expected "+strconv.Itoa(len(lambda.Args))+" arguments for "+procedure.name+", found "+strconv.Itoa(len(args)))
+	}
+	code := make([]byte, 0)
+	argTypes := make([]valueType, 0)
+	rest := make([]byte, 0)
+	for index, arg := range args {
+		argCode, argType, err := c.compile(arg)
+		if err != nil {
+			return nil, noValue, err
+		}
+		if argType == noValue {
+			return nil, noValue, compileError(arg, "No value to pass to "+procedure.name)
+		}
+		if index >= len(lambda.Args) {
+			rest = append(rest, toObject(argCode, argType)...)
+			continue
+		}
+		code, argTypes = append(code, argCode...), append(argTypes, argType)
+	}
+	if lambda.Rest != "" {
+		// each ocons pairs the list so far with the argument before it
+		code = append(append(code, rest...), opOnil)
+		for range args[len(lambda.Args):] {
+			code = append(code, opOcons)
+		}
+		argTypes = append(argTypes, objectType)
+	}
+	spec, err := c.specialize(procedure, argTypes)
+	if err != nil {
+		return nil, noValue, err
+	}
+	// the jump goes to wherever the specialization ends up, which link fills in
+	return appendJump(code, opJal, int64(spec.id)), spec.returnType, nil
+}
+
+// specialize finds or compiles the specialization of a procedure for the given
+// argument types
+func (c *compiler) specialize(procedure *procedure, argTypes []valueType) (*specialization, error) {
+	typeNames := make([]string, 0)
+	for _, argType := range argTypes {
+		typeNames = append(typeNames, argType.String())
+	}
+	key := strings.Join(typeNames, " ")
+	if spec, ok := procedure.specializations[key]; ok {
+		if spec.compiling {
+			spec.recursive = true
+			if !spec.returnTypeKnown {
+				return nil, errReturnTypeUnknown
+			}
+		}
+		return spec, nil
+	}
+	spec := &specialization{id: len(c.specializations), procedure: procedure, key: key, argTypes: argTypes, compiling: true}
+	procedure.specializations[key] = spec
+	c.specializations = append(c.specializations, spec)
+	returnType, err := c.compileSpecialization(spec)
+	if spec.recursive {
+		err = c.inferReturnType(spec)
+		returnType = spec.returnType
+	}
+	spec.compiling = false
+	if err != nil {
+		c.forgetSpecializations(spec.id)
+		return nil, err
+	}
+	spec.returnType, spec.returnTypeKnown = returnType, true
+	return spec, nil
+}
+
+// entry finds or compiles the entry of a procedure, the specialization procedure
+// objects jump to. A call through an object can't know the types of its arguments
+// ahead of time, so the entry takes them all as objects, and returns one too.
+func (c *compiler) entry(procedure *procedure) (*specialization, error) {
+	if spec, ok := procedure.specializations[entryKey]; ok {
+		return spec, nil
+	}
+	argTypes := make([]valueType, 0)
+	for range parameters(procedure.lambda) {
+		argTypes = append(argTypes, objectType)
+	}
+	spec := &specialization{id: len(c.specializations), procedure: procedure, key: entryKey, argTypes: argTypes,
+		returnType: objectType, compiling: true, returnTypeKnown: true, entry: true}
+	procedure.specializations[entryKey] = spec
+	c.specializations = append(c.specializations, spec)
+	_, err := c.compileSpecialization(spec)
+	spec.compiling = false
+	if err != nil {
+		c.forgetSpecializations(spec.id)
+		return nil, err
+	}
+	return spec, nil
+}
+
+// inferReturnType compiles a recursive specialization, whose recursive calls need
+// its return type before its body has been compiled. Each type is tried in turn
+// until one turns out to be what the body returns.
+func (c *compiler) inferReturnType(spec *specialization) error {
+	var firstErr error
+	for _, candidate := range returnTypeCandidates {
+		// anything compiled on the strength of the last guess goes too
+		c.forgetSpecializations(spec.id + 1)
+		spec.returnType, spec.returnTypeKnown = candidate, true
+		returnType, err := c.compileSpecialization(spec)
+		if err == nil && returnType == candidate {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	return compileError(spec.procedure.lambda, "Couldn't work out what type "+spec.procedure.name+" returns")
+}
+
+// forgetSpecializations throws away the specializations from the given one on,
+// which were compiled along with one whose compilation failed
+func (c *compiler) forgetSpecializations(id int) {
+	for _, spec := range c.specializations[id:] {
+		delete(spec.procedure.specializations, spec.key)
+	}
+	c.specializations = c.specializations[:id]
+}
+
+// parameters gives the names a lambda binds its arguments to, with the rest of the
+// arguments coming last if it takes any number of them
+func parameters(lambda *LambdaExp) []string {
+	if lambda.Rest != "" {
+		return append(append([]string(nil), lambda.Args...), lambda.Rest)
+	}
+	return lambda.Args
+}
+
+// compileSpecialization compiles a specialization's code, in a frame of its own.
+// The arguments are on the stack when it's called, with the last one on top.
+func (c *compiler) compileSpecialization(spec *specialization) (valueType, error) {
+	outerScope, outerFrame := c.scope, c.frame
+	defer func() { c.scope, c.frame = outerScope, outerFrame }()
+	c.scope, c.frame = newScope(spec.procedure.scope), &frame{closure: spec.entry}
+	code := make([]byte, 0)
+	args := parameters(spec.procedure.lambda)
+	// bind the arguments in order, so they get their slots in order too
+	stores := make([][]byte, 0)
+	for index, arg := range args {
+		stores = append(stores, c.bindLocal(arg, spec.argTypes[index]))
+	}
+	for index := len(stores) - 1; index >= 0; index-- {
+		code = append(code, stores[index]...)
+	}
+	bodyCode, returnType, err := c.compileBody(spec.procedure.lambda.GetSubNodes())
+	if err != nil {
+		return noValue, err
+	}
+	if spec.entry {
+		bodyCode, returnType = toObject(bodyCode, returnType), objectType
+	}
+	spec.code = append(append(code, bodyCode...), opJr)
+	spec.captures = c.frame.captures
+	return returnType, nil
+}
+
+// the number of arguments each built-in procedure takes, for when one is used as
+// a value
+var builtinArities = map[string]int{"display": 1, "newline": 0, "car": 1, "cdr": 1, "cons": 2, "null?": 1,
+	"pair?": 1, "not": 1, "eq?": 2, "eqv?": 2, "features": 0, "read": 0, "eof-object?": 1}
+
+// the procedures the operators and the built-in procedures taking any number of
+// arguments become when they're used as values, which go through their arguments
+// one at a time
+var variadicBuiltins = map[string]string{
+	"+": "(lambda xs (let loop ((xs xs) (sum 0)) (if (null? xs) sum (loop (cdr xs) (+ sum (car xs))))))",
+	"*": "(lambda xs (let loop ((xs xs) (product 1)) (if (null? xs) product (loop (cdr xs) (* product (car xs))))))",
+	"-": "(lambda (x . xs) (if (null? xs) (- 0 x) " +
+		"(let loop ((xs xs) (difference x)) (if (null? xs) difference (loop (cdr xs) (- difference (car xs)))))))",
+	"/": "(lambda (x . xs) (if (null? xs) (/ 1 x) " +
+		"(let loop ((xs xs) (quotient x)) (if (null? xs) quotient (loop (cdr xs) (/ quotient (car xs)))))))",
+	"<":    comparisonBuiltin("<"),
+	"<=":   comparisonBuiltin("<="),
+	">":    comparisonBuiltin(">"),
+	">=":   comparisonBuiltin(">="),
+	"=":    comparisonBuiltin("="),
+	"list": "(lambda xs xs)",
+}
+
+// comparisonBuiltin gives the procedure a comparison becomes, which checks each
+// of its arguments against the next
+func comparisonBuiltin(operator string) string {
+	return "(lambda (x y . xs) (let loop ((x x) (y y) (xs xs)) " +
+		"(and (" + operator + " x y) (or (null? xs) (loop y (car xs) (cdr xs))))))"
+}
+
+// isBuiltinValue checks whether a built-in procedure or operator can be used as a
+// value
+func isBuiltinValue(name string) bool {
+	_, fixed := builtinArities[name]
+	_, variadic := variadicBuiltins[name]
+	return fixed || variadic
+}
+
+// builtinProcedure gives the procedure a built-in procedure or operator becomes
+// when it's used as a value, which calls it with its arguments
+func (c *compiler) builtinProcedure(exp *IdentExp) *procedure {
+	if procedure, ok := c.builtins[exp.Name]; ok {
+		return procedure
+	}
+	var lambda *LambdaExp
+	if source, ok := variadicBuiltins[exp.Name]; ok {
+		lambda = parseBuiltin(source)
+	} else {
+		lambda = callingLambda(exp, exp.Name, true, builtinArities[exp.Name])
+	}
+	procedure := newProcedure(exp.Name, lambda, nil)
+	c.builtins[exp.Name] = procedure
+	return procedure
+}
+
+// the procedure a quasiquote calls to splice a list into the rest of the list
+// it's building, which copies the spliced list onto the front of the rest
+const appendSource = "(lambda (xs tail) (let loop ((xs xs) (tail tail)) " +
+	"(if (null? xs) tail (cons (car xs) (loop (cdr xs) tail)))))"
+
+// appendProcedure gives the procedure appendSource compiles to
+func (c *compiler) appendProcedure() *procedure {
+	if procedure, ok := c.builtins["append"]; ok {
+		return procedure
+	}
+	procedure := newProcedure("append", parseBuiltin(appendSource), nil)
+	c.builtins["append"] = procedure
+	return procedure
+}
+
+// parseBuiltin parses the source of a built-in procedure, which is always a
+// lambda that parses without any errors
+func parseBuiltin(source string) *LambdaExp {
+	tokens, _ := LexExp(source)
+	program, _ := ParseTokens(tokens)
+	return program.GetSubNodes()[0].(*LambdaExp)
+}
+
+// compileBuiltinCall compiles a call to one of the built-in procedures the VM has
+// syscalls for
+func (c *compiler) compileBuiltinCall(exp *CallExp, name string, args []AstNode) ([]byte, valueType, error) {
+	switch name {
+	case "display":
+		if len(args) != 1 {
+			return nil, noValue, compileError(exp, "Expected 1 argument for display")
+		}
+		code, argType, err := c.compile(args[0])
+		if err != nil {
+			return nil, noValue, err
+		}
+		syscalls := map[valueType]byte{boolType: syscallPrintBool, charType: syscallPrintChar,
+			intType: syscallPrintInt, doubleType: syscallPrintDouble, stringType: syscallPrintString,
+			objectType: syscallPrintObject}
+		if argType == noValue {
+			return nil, noValue, compileError(args[0], "No value to display")
+		}
+		return append(code, opSyscall, syscalls[argType]), noValue, nil
+	case "newline":
+		if len(args) != 0 {
+			return nil, noValue, compileError(exp, "Expected no arguments for newline")
+		}
+		return append(pushString("\n"), opSyscall, syscallPrintString), noValue, nil
+	case "features":
+		if len(args) != 0 {
+			return nil, noValue, compileError(exp, "Expected no arguments for features")
+		}
+		// the features are whatever's registered when the program's compiled
+		code := make([]byte, 0)
+		features := Features()
+		for _, feature := range features {
+			code = append(append(code, pushString(feature)...), opOsym)
+		}
+		code = append(code, opOnil)
+		for range features {
+			code = append(code, opOcons)
+		}
+		return code, objectType, nil
+	case "read":
+		if len(args) != 0 {
+			return nil, noValue, compileError(exp, "Expected no arguments for read")
+		}
+		return []byte{opSyscall, syscallRead}, objectType, nil
+	case "exit":
+		if len(args) > 1 {
+			return nil, noValue, compileError(exp, "Expected at most 1 argument for exit")
+		}
+		code := appendInt([]byte{opPushi}, 0)
+		if len(args) == 1 {
+			argCode, argType, err := c.compile(args[0])
+			if err != nil {
+				return nil, noValue, err
+			}
+			if argType != intType {
+				return nil, noValue, compileError(args[0], "Expected an integer exit code")
+			}
+			code = argCode
+		}
+		return append(code, opSyscall, syscallExit), noValue, nil
+	case "car", "cdr":
+		codes, types, err := c.compileArgs(exp, name, args, 1)
+		if err != nil {
+			return nil, noValue, err
+		}
+		if types[0] != objectType {
+			return nil, noValue, compileError(args[0], "Expected a pair for "+name+", found "+types[0].article())
+		}
+		opcode := opOcar
+		if name == "cdr" {
+			opcode = opOcdr
+		}
+		return append(codes[0], opcode), objectType, nil
+	case "cons", "list":
+		count := 2
+		if name == "list" {
+			count = len(args)
+		}
+		codes, types, err := c.compileArgs(exp, name, args, count)
+		if err != nil {
+			return nil, noValue, err
+		}
+		code := make([]byte, 0)
+		for index, argCode := range codes {
+			code = append(code, toObject(argCode, types[index])...)
+		}
+		if name == "cons" {
+			return append(code, opOcons), objectType, nil
+		}
+		code = append(code, opOnil)
+		for range codes {
+			code = append(code, opOcons)
+		}
+		return code, objectType, nil
+	case "null?", "pair?", "eof-object?":
+		codes, types, err := c.compileArgs(exp, name, args, 1)
+		if err != nil {
+			return nil, noValue, err
+		}
+		if types[0] != objectType {
+			// only objects can be lists
+			return append(dropValue(codes[0], types[0]), pushBool(false)...), boolType, nil
+		}
+		kind := emptyListObject
+		if name == "pair?" {
+			kind = pairObject
+		} else if name == "eof-object?" {
+			kind = eofObject
+		}
+		return jumpToBool(append(codes[0], opOtest, byte(kind)), opJeq), boolType, nil
+	case "not":
+		codes, types, err := c.compileArgs(exp, name, args, 1)
+		if err != nil {
+			return nil, noValue, err
+		}
+		switch types[0] {
+		case boolType:
+			return jumpToBool(codes[0], opJeq), boolType, nil
+		case objectType:
+			return jumpToBool(append(codes[0], opOtruth), opJeq), boolType, nil
+		}
+		return append(dropValue(codes[0], types[0]), pushBool(false)...), boolType, nil
+	case "eq?", "eqv?":
+		// every value that eq? can tell apart from another with eqv? is an
+		// object, so they're the same here
+		codes, types, err := c.compileArgs(exp, name, args, 2)
+		if err != nil {
+			return nil, noValue, err
+		}
+		code := append(toObject(codes[0], types[0]), toObject(codes[1], types[1])...)
+		return jumpToBool(append(code, opOeqv), opJeq), boolType, nil
+	}
+	return nil, noValue, compileError(exp, "Unbound variable "+name)
+}
+
+// compileArgs compiles the arguments of a call to a built-in procedure, which has
+// to be given the number of them it takes
+func (c *compiler) compileArgs(exp *CallExp, name string, args []AstNode, count int) ([][]byte, []valueType, error) {
+	if len(args) != count {
+		plural := "s"
+		if count == 1 {
+			plural = ""
+		}
+		return nil, nil, compileError(exp, "Expected "+strconv.Itoa(count)+" argument"+plural+" for "+name)
+	}
+	codes := make([][]byte, 0)
+	types := make([]valueType, 0)
+	for _, arg := range args {
+		code, argType, err := c.compile(arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if argType == noValue {
+			return nil, nil, compileError(arg, "No value to pass to "+name)
+		}
+		codes, types = append(codes, code), append(types, argType)
+	}
+	return codes, types, nil
+}
+
+// link lays out the program, with the code of every specialization first and
+// a jump over it to the top-level code. Each jal, and each hnewp, is then pointed
+// at the specialization it jumps to, which was only known by its ID until now.
+func (c *compiler) link(code []byte) []byte {
+	if len(c.specializations) == 0 {
+		return code
+	}
+	starts := make([]int, 0)
+	procedures := make([]byte, 0)
+	for _, spec := range c.specializations {
+		starts = append(starts, jumpLength+len(procedures))
+		procedures = append(procedures, spec.code...)
+	}
+	program := appendJump(make([]byte, 0), opJmp, int64(len(procedures)))
+	program = append(append(program, procedures...), code...)
+	for position := 0; position < len(program); position += instructionLength(program, position) {
+		if program[position] != opJal && program[position] != opHnewp {
+			continue
+		}
+		// the offset is the last operand of both, counted from the end
+		end := position + instructionLength(program, position)
+		var id int64
+		binary.Read(bytes.NewReader(program[end-8:end]), binary.LittleEndian, &id)
+		offset := appendInt(make([]byte, 0), int64(starts[id]-end))
+		copy(program[end-8:], offset)
+	}
+	return program
+}
+
+func appendInt(code []byte, num int64) []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.LittleEndian, &num)
+	return append(code, buffer.Bytes()...)
+}
+
+func appendDouble(code []byte, num float64) []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.LittleEndian, &num)
+	return append(code, buffer.Bytes()...)
+}
+
+// appendJump adds a jump by the given number of bytes, counted from the end of
+// the jump instruction
+func appendJump(code []byte, opcode byte, offset int64) []byte {
+	return appendInt(append(code, opcode), offset)
+}
+
+// appendSlot adds the 4-byte slot of a local
+func appendSlot(code []byte, slot uint32) []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.LittleEndian, &slot)
+	return append(code, buffer.Bytes()...)
+}
+
+func pushBool(value bool) []byte {
+	if value {
+		return []byte{opPushb, 1}
+	}
+	return []byte{opPushb, 0}
+}
+
+func pushNumber(value int64, valueType valueType) []byte {
+	if valueType == doubleType {
+		return appendDouble([]byte{opPushd}, float64(value))
+	}
+	return appendInt([]byte{opPushi}, value)
+}
+
+func pushString(value string) []byte {
+	return append(append([]byte{opPushs}, value...), 0)
+}
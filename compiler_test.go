@@ -0,0 +1,393 @@
+package schego
+
+import (
+	"strings"
+	"testing"
+)
+
+func compileSource(t *testing.T, source string) ([]byte, error) {
+	tokens, lexErrors := LexExp(source)
+	if len(lexErrors) != 0 {
+		t.Fatalf("unexpected lex errors: %v", lexErrors)
+	}
+	program, parseErrors := ParseTokens(tokens)
+	if len(parseErrors) != 0 {
+		t.Fatalf("unexpected parse errors: %v", parseErrors)
+	}
+	return Compile(program)
+}
+
+// runSource compiles and runs a program, returning everything it printed
+func runSource(t *testing.T, source string) string {
+	opcodes, err := compileSource(t, source)
+	if err != nil {
+		t.Fatalf("unexpected compile error for %s: %v", source, err)
+	}
+	console := DummyConsole{}
+	vm := NewVM(opcodes, &console)
+	for vm.CanStep() {
+		vm.Step()
+	}
+	if vm.Err() != nil {
+		t.Fatalf("unexpected VM error for %s: %v", source, vm.Err())
+	}
+	return console.consoleOutput
+}
+
+func TestCompileArithmetic(t *testing.T) {
+	tests := map[string]string{
+		"(display (+ 1 2))":           "3",
+		"(display (+))":               "0",
+		"(display (*))":               "1",
+		"(display (- 10 3 2))":        "5",
+		"(display (- 4))":             "-4",
+		"(display (* 2 3 4))":         "24",
+		"(display (+ 1.5 2.25))":      "3.75",
+		"(display (+ 1 0.5))":         "1.5",
+		"(display (* 2 (- 1.5 1)))":   "1",
+		"(display (/ 7 2))":           "3.5",
+		"(display (/ 4))":             "0.25",
+		"(display (+ (* 2 3) (- 5)))": "1",
+	}
+	for source, expected := range tests {
+		if output := runSource(t, source); output != expected {
+			t.Errorf("%s printed %q, expected %q", source, output, expected)
+		}
+	}
+}
+
+func TestCompileComparisons(t *testing.T) {
+	tests := map[string]string{
+		"(display (< 1 2))":                               "#t",
+		"(display (< 2 1))":                               "#f",
+		"(display (<= 2 2))":                              "#t",
+		"(display (> 1.5 1))":                             "#t",
+		"(display (>= 1 1.5))":                            "#f",
+		"(display (= 3 3))":                               "#t",
+		"(display (= 3 4))":                               "#f",
+		"(display (< 1 2 3))":                             "#t",
+		"(display (< 1 3 2))":                             "#f",
+		"(display (< 3 1 2))":                             "#f",
+		"(display (= 2 2 2.0 2))":                         "#t",
+		"(display (if (< 1 2) 1 2))":                      "1",
+		"(display (if (> 1 2) 1 2))":                      "2",
+		"(display (if #f 1.5 2.5))":                       "2.5",
+		"(display (if 0 #\\y #\\n))":                      "y",
+		"(if (< 1 2) (display \"yes\") (display \"no\"))": "yes",
+		"(if (> 1 2) (display \"yes\"))":                  "",
+	}
+	for source, expected := range tests {
+		if output := runSource(t, source); output != expected {
+			t.Errorf("%s printed %q, expected %q", source, output, expected)
+		}
+	}
+}
+
+func TestCompileGlobals(t *testing.T) {
+	tests := map[string]string{
+		"(define x 5) (define y (* x 2)) (display (+ x y))":                              "15",
+		"(define x 1.5) (set! x (+ x 1)) (display x)":                                    "2.5",
+		"(define x 1) (define x 2) (display x)":                                          "2",
+		"(define flag #t) (display (if flag \"on\" \"off\"))":                            "on",
+		"(define greeting \"hi\") (display greeting)":                                    "hi",
+		"(define greeting \"\") (set! greeting \"hello\") (display greeting)":            "hello",
+		"(define c #\\λ) (display c)":                                                    "λ",
+		"(begin (define x 2) (define y 3)) (display (* x y))":                            "6",
+		"(define-syntax double (syntax-rules () ((_ e) (* 2 e)))) (display (double 21))": "42",
+	}
+	for source, expected := range tests {
+		if output := runSource(t, source); output != expected {
+			t.Errorf("%s printed %q, expected %q", source, output, expected)
+		}
+	}
+}
+
+func TestCompileProcedures(t *testing.T) {
+	tests := map[string]string{
+		"(define (square x) (* x x)) (display (square 12))":                                                                        "144",
+		"(define (square x) (* x x)) (display (square 1.5))":                                                                       "2.25",
+		"(define (square x) (* x x)) (display (+ (square 2) (square 0.5)))":                                                        "4.25",
+		"(define add (lambda (x y) (+ x y))) (display (add 2 3))":                                                                  "5",
+		"(display ((lambda (x) (- x)) 4))":                                                                                         "-4",
+		"(define (greet) (display \"hi\")) (greet)":                                                                                "hi",
+		"(define (pick flag a b) (if flag a b)) (display (pick #f \"yes\" \"no\"))":                                                "no",
+		"(define (fact n) (if (= n 0) 1 (* n (fact (- n 1))))) (display (fact 10))":                                                "3628800",
+		"(define (fib n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2))))) (display (fib 15))":                                       "610",
+		"(define (count n) (if (= n 0) \"done\" (count (- n 1)))) (display (count 1000))":                                          "done",
+		"(define (halve x) (if (< x 1) x (halve (/ x 2)))) (display (halve 12.0))":                                                 "0.75",
+		"(define (even? n) (if (= n 0) #t (odd? (- n 1)))) (define (odd? n) (if (= n 0) #f (even? (- n 1)))) (display (even? 10))": "#t",
+		"(define (f x) (define y (* x 2)) (define (g z) (+ z 1)) (g y)) (display (f 20))":                                          "41",
+		"(define (f x) (set! x (+ x 1)) x) (display (f 1))":                                                                        "2",
+		"(define total 0) (define (add! x) (set! total (+ total x))) (add! 2) (add! 3) (display total)":                            "5",
+	}
+	for source, expected := range tests {
+		if output := runSource(t, source); output != expected {
+			t.Errorf("%s printed %q, expected %q", source, output, expected)
+		}
+	}
+}
+
+func TestCompileLet(t *testing.T) {
+	tests := map[string]string{
+		"(display (let ((x 2) (y 3)) (* x y)))":                                                  "6",
+		"(display (let ((x 2)) (let ((x 3) (y x)) (+ x y))))":                                    "5",
+		"(display (let* ((x 2) (y (* x 10))) (+ x y)))":                                          "22",
+		"(display (let ((s \"inner\")) s))":                                                      "inner",
+		"(define (f x) (let ((y (* x x))) (+ x y))) (display (f 3))":                             "12",
+		"(display (let ((double (lambda (x) (* 2 x)))) (double 21)))":                            "42",
+		"(let-values (((a b) (values 1 2)) ((c) 3)) (display (+ a b c)))":                        "6",
+		"(let-values ((all (values 1 \"two\"))) (display all))":                                  "(1 two)",
+		"(let*-values (((a b) (values 1 2)) ((c . d) (values b a 3))) (display (list a b c d)))": "(1 2 2 (1 3))",
+	}
+	for source, expected := range tests {
+		if output := runSource(t, source); output != expected {
+			t.Errorf("%s printed %q, expected %q", source, output, expected)
+		}
+	}
+}
+
+func TestCompileConditionals(t *testing.T) {
+	tests := map[string]string{
+		"(define x 0) (display (if x \"then\" \"else\"))":              "then",
+		"(define x #f) (display (if x 1 2))":                           "2",
+		"(display (if (car '(#f)) \"then\" \"else\"))":                 "else",
+		"(display (if (car '(0)) \"then\" \"else\"))":                  "then",
+		"(define (pick flag) (if flag 1 \"two\")) (display (pick #f))": "two",
+		"(display (if (> 1 2) 1))":                                     "",
+		"(display (and 1 2))":                                          "2",
+		"(display (and))":                                              "#t",
+		"(display (and (< 1 2) (> 1 2)))":                              "#f",
+		"(display (or #f 3))":                                          "3",
+		"(display (or (> 1 2) (car '(#f)) \"last\"))":                  "last",
+		"(display (or (car '(5)) 1))":                                  "5",
+		"(define x #f) (display (or x (< 1 2)))":                       "#t",
+		"(when (< 1 2) (display \"yes\"))":                             "yes",
+		"(unless (< 1 2) (display \"no\"))":                            "",
+		"(display (unless #f 1 2))":                                    "2",
+		"(define x 5) (display (cond ((< x 3) \"small\") ((< x 10) \"medium\") (else \"large\")))":      "medium",
+		"(display (cond ((car '(#f)) 1) ((+ 1 1) => (lambda (n) (* n 10)))))":                           "20",
+		"(display (cond ((> 1 2) 1) (3)))":                                                              "3",
+		"(define (name n) (case n ((1) \"one\") ((2 3) \"a few\") (else \"many\"))) (display (name 3))": "a few",
+		"(display (case (car '(b)) ((a) 1) ((b c) 2)))":                                                 "2",
+		"(display (case 4 ((1 2) 'low) (else => (lambda (n) (* n n)))))":                                "16",
+		"(define (f) (+ 1 2) (display \"done\")) (f)":                                                   "done",
+	}
+	for source, expected := range tests {
+		if output := runSource(t, source); output != expected {
+			t.Errorf("%s printed %q, expected %q", source, output, expected)
+		}
+	}
+}
+
+func TestCompileLoops(t *testing.T) {
+	tests := map[string]string{
+		"(display (do ((i 0 (+ i 1)) (total 0 (+ total i))) ((= i 5) total)))":                                                                  "10",
+		"(do ((i 0 (+ i 1))) ((= i 3)) (display i))":                                                                                            "012",
+		"(display (let loop ((i 0) (total 0)) (if (> i 4) total (loop (+ i 1) (+ total i)))))":                                                  "10",
+		"(display (letrec ((even? (lambda (n) (if (= n 0) #t (odd? (- n 1))))) (odd? (lambda (n) (if (= n 0) #f (even? (- n 1)))))) (odd? 7)))": "#t",
+	}
+	for source, expected := range tests {
+		if output := runSource(t, source); output != expected {
+			t.Errorf("%s printed %q, expected %q", source, output, expected)
+		}
+	}
+}
+
+func TestCompileLists(t *testing.T) {
+	tests := map[string]string{
+		"(display '(1 2 3))":                                 "(1 2 3)",
+		"(display '(a (b . c) #(1 \"s\")))":                  "(a (b . c) #(1 s))",
+		"(display 'sym)":                                     "sym",
+		"(display '5)":                                       "5",
+		"(display (cons 1 '()))":                             "(1)",
+		"(display (list 1 2.5 #\\c))":                        "(1 2.5 c)",
+		"(display (car (cdr '(1 2 3))))":                     "2",
+		"(display (+ (car '(1)) 2))":                         "3",
+		"(display (/ (car '(1)) 2))":                         "0.5",
+		"(display (< (car '(1)) 1.5))":                       "#t",
+		"(display (null? '()))":                              "#t",
+		"(display (pair? '()))":                              "#f",
+		"(display (null? 1))":                                "#f",
+		"(display (not (car '(#f))))":                        "#t",
+		"(display (eqv? 'a (car '(a))))":                     "#t",
+		"(display (eq? 2 2.0))":                              "#f",
+		"(define xs '()) (set! xs (cons 1 xs)) (display xs)": "(1)",
+		"(define (sum xs) (if (null? xs) 0 (+ (car xs) (sum (cdr xs))))) (display (sum '(1 2 3)))": "6",
+		"(define x 1) (display `(,x (+ x 1) ,(+ x 1)))":                                            "(1 (+ x 1) 2)",
+		"(define xs '(2 3)) (display `(1 ,@xs 4 ,@xs))":                                            "(1 2 3 4 2 3)",
+		"(display `(1 . ,(+ 1 1)))":                                                                "(1 . 2)",
+		"(display `#(a ,(* 2 3)))":                                                                 "#(a 6)",
+		"(display `(a `(b ,(c ,(+ 1 2)))))":                                                        "(a (quasiquote (b (unquote (c 3)))))",
+	}
+	for source, expected := range tests {
+		if output := runSource(t, source); output != expected {
+			t.Errorf("%s printed %q, expected %q", source, output, expected)
+		}
+	}
+}
+
+func TestCompileClosures(t *testing.T) {
+	tests := map[string]string{
+		"(display (lambda (x) x))":                                                                            "#<procedure>",
+		"(define (f x) (define (g) x) (g)) (display (f 1))":                                                   "1",
+		"(define (adder n) (lambda (x) (+ x n))) (display ((adder 2) 3))":                                     "5",
+		"(define (twice f x) (f (f x))) (define (inc x) (+ x 1)) (display (twice inc 1))":                     "3",
+		"(define (f n) (let loop ((i 0) (sum 0)) (if (< i n) (loop (+ i 1) (+ sum i)) sum))) (display (f 4))": "6",
+		"(define (counter) (let ((n 0)) (lambda () (set! n (+ n 1)) n))) " +
+			"(define c (counter)) (c) (c) (display (c))": "3",
+		"(define (f) (define n 0) (define (add! x) (set! n (+ n x))) (add! 2) (add! 3) n) (display (f))": "5",
+		"(define (f x) (define (get) x) (set! x (+ x 1)) (get)) (display (f 1))":                         "2",
+		"(define (f x) (define (even? n) (if (= n 0) x (odd? (- n 1)))) " +
+			"(define (odd? n) (if (= n 0) #f (even? (- n 1)))) (even? 4)) (display (f 'yes))": "yes",
+		"(let ((x 1)) (define (f) (lambda () x)) (display ((f))))":                               "1",
+		"(define (twice f x) (f (f x))) (display (twice car '((1) 2)))":                          "1",
+		"(display ((lambda args args) 1 2))":                                                     "(1 2)",
+		"(define (f x . xs) (cons x xs)) (display (list (f 1) (f 1 2 3)))":                       "((1) (1 2 3))",
+		"(define (f . xs) xs) (define g f) (display (list (g) (g 1 2)))":                         "(() (1 2))",
+		"(define (f g) (g 1 2 3)) (display (list (f +) (f -) (f *) (f /) (f <) (f =) (f list)))": "(6 -4 6 0.16666666666666666 #t #f (1 2 3))",
+		"(define (f g) (g 5)) (display (list (f -) (f /)))":                                      "(-5 0.2)",
+	}
+	for source, expected := range tests {
+		if output := runSource(t, source); output != expected {
+			t.Errorf("%s printed %q, expected %q", source, output, expected)
+		}
+	}
+}
+
+func TestCompileAssignment(t *testing.T) {
+	tests := map[string]string{
+		"(define x 1) (set! x \"s\") (display x)":                                                       "s",
+		"(define x 1) (define x \"s\") (display x)":                                                     "s",
+		"(display (let ((x 1)) (set! x 2.5) x))":                                                        "2.5",
+		"(define (f) 1) (set! f (lambda () 2)) (display (f))":                                           "2",
+		"(define (f) 1) (define (g) (f)) (define a (g)) (define (f) 2) (display (list a (g)))":          "(1 2)",
+		"(define (f) (define (g) 1) (set! g 'two) g) (display (f))":                                     "two",
+		"(define (f x) (set! x (cons x x)) x) (display (f 1))":                                          "(1 . 1)",
+		"(display (do ((i 0 (+ i 0.5))) ((> i 2) i)))":                                                  "2.5",
+		"(define-record-type point (make-point x) point? (x point-x)) (set! point? 1) (display point?)": "1",
+	}
+	for source, expected := range tests {
+		if output := runSource(t, source); output != expected {
+			t.Errorf("%s printed %q, expected %q", source, output, expected)
+		}
+	}
+}
+
+func TestCompileRecords(t *testing.T) {
+	pointType := "(define-record-type point (make-point x y) point? (x point-x set-point-x!) (y point-y)) "
+	tests := map[string]string{
+		pointType + "(display (make-point 1 2))":                                                     "#<point>",
+		pointType + "(define p (make-point 1 2)) (display (+ (point-x p) (point-y p)))":              "3",
+		pointType + "(define p (make-point 1 2)) (set-point-x! p 'a) (display (point-x p))":          "a",
+		pointType + "(display (list (point? (make-point 1 2)) (point? '(1)) (point? 1)))":            "(#t #f #f)",
+		pointType + "(define (f get) (get (make-point 1 2))) (display (f point-y))":                  "2",
+		"(define (f) (define-record-type box (box v) box? (v unbox)) (unbox (box 5))) (display (f))": "5",
+	}
+	for source, expected := range tests {
+		if output := runSource(t, source); output != expected {
+			t.Errorf("%s printed %q, expected %q", source, output, expected)
+		}
+	}
+	opcodes, err := compileSource(t, pointType+"(define-record-type box (box v) box? (v unbox)) (point-x (box 1))")
+	if err != nil {
+		t.Fatalf("unexpected compile error: %v", err)
+	}
+	vm := NewVM(opcodes, &DummyConsole{})
+	for vm.CanStep() {
+		vm.Step()
+	}
+	if vm.Err() == nil || !strings.HasPrefix(vm.Err().Error(), "Expected a record of type point, found a record of type box") {
+		t.Error("Expected a record type error, got: ", vm.Err())
+	}
+}
+
+func TestCompileStack(t *testing.T) {
+	opcodes, err := compileSource(t, "(+ 1 2)")
+	if err != nil {
+		t.Fatalf("unexpected compile error: %v", err)
+	}
+	vm := NewVM(opcodes, &DummyConsole{})
+	for vm.CanStep() {
+		vm.Step()
+	}
+	if result := vm.Stack.PopInt(); result != 3 {
+		t.Errorf("expected 3 on the stack, got %d", result)
+	}
+}
+
+func TestCompileExit(t *testing.T) {
+	opcodes, err := compileSource(t, "(display 1) (exit (+ 2 3)) (display 2)")
+	if err != nil {
+		t.Fatalf("unexpected compile error: %v", err)
+	}
+	console := DummyConsole{}
+	if exitCode := RunVM(opcodes, &console); exitCode != 5 {
+		t.Errorf("expected exit code 5, got %d", exitCode)
+	}
+	if console.consoleOutput != "1" {
+		t.Errorf("expected output to stop after exit, got %q", console.consoleOutput)
+	}
+}
+
+func TestCompileRead(t *testing.T) {
+	opcodes, err := compileSource(t, "(define x (read)) (define y (read)) "+
+		"(display (list x y (eof-object? x) (eof-object? (read)) (eq? (car (cdr x)) 'two)))")
+	if err != nil {
+		t.Fatalf("unexpected compile error: %v", err)
+	}
+	console := DummyConsole{}
+	vm := NewVM(opcodes, &console)
+	vm.Input = strings.NewReader(`(1 two "three" #\4 . 5.5) #(#t ())`)
+	for vm.CanStep() {
+		vm.Step()
+	}
+	if vm.Err() != nil {
+		t.Fatalf("unexpected VM error: %v", vm.Err())
+	}
+	if expected := "((1 two three 4 . 5.5) #(#t ()) #f #t #t)"; console.consoleOutput != expected {
+		t.Errorf("expected %q, got %q", expected, console.consoleOutput)
+	}
+	if output := runSource(t, "(display (read))"); output != "#<eof>" {
+		t.Errorf("expected read without any input to give the end of file object, got %q", output)
+	}
+	vm = NewVM(opcodes, &console)
+	vm.Input = strings.NewReader("(1 2")
+	for vm.CanStep() {
+		vm.Step()
+	}
+	if vm.Err() == nil {
+		t.Error("expected an error reading an unfinished list")
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := map[string]string{
+		"(display x)":                         "Unbound variable x at 1:10",
+		"(+ 1 \"two\")":                       "Expected a number for +, found a string at 1:6",
+		"(< 1 (+ 1 1) 3)":                     "Comparisons of more than 2 operands can only compare literals and variables at 1:6",
+		"(if #t (define x 1))":                "Definitions can only be compiled at top level and in bodies at 1:8",
+		"((+ 1 2) 3)":                         "Expected a procedure, found an integer at 1:2",
+		"(display 1 2)":                       "Expected 1 argument for display at 1:1",
+		"(define (f x) x) (f 1 2)":            "Expected 1 arguments for f, found 2 at 1:18",
+		"(define x 1) (x)":                    "x holds an integer, not a procedure at 1:15",
+		"(define (f x . xs) 1) (f)":           "Expected at least 1 arguments for f, found 0 at 1:23",
+		"(display 1/2)":                       "Can't compile 1/2, since the VM has no exact rationals at 1:10",
+		"(if (newline) 1 2)":                  "No value to test at 1:5",
+		"(car 1)":                             "Expected a pair for car, found an integer at 1:6",
+		"(cons 1)":                            "Expected 2 arguments for cons at 1:1",
+		"(display `(1 ,@2))":                  "Expected a list to splice, found an integer at 1:16",
+		"(display `#(,@'(1)))":                "Can't compile unquote-splicing within a vector at 1:13",
+		"(let-values (((a b) 1)) a)":          "Expected a call to values for (a b) at 1:21",
+		"(let-values (((a b) (values 1))) a)": "Expected 2 values for (a b), found 1 at 1:21",
+		"(display '#u8(1 2))":                 "Can't compile bytevectors, since the VM has no bytevector objects at 1:11",
+		"(define-record-type point (make-point x) point? (x point-x)) (point-x 1)": "Expected a record of type point for point-x, found an integer at 1:71",
+	}
+	for source, expected := range tests {
+		_, err := compileSource(t, source)
+		if err == nil {
+			t.Errorf("expected an error compiling %s", source)
+		} else if err.Error() != expected {
+			t.Errorf("compiling %s gave %q, expected %q", source, err.Error(), expected)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package schego
+
+import (
+	"runtime"
+	"sync"
+)
+
+// the names R7RS gives the platforms Go reports by other names
+var architectureFeatures = map[string]string{
+	"amd64": "x86-64",
+	"386":   "i386",
+	"arm64": "aarch64",
+}
+
+// features lists the feature identifiers cond-expand checks requirements against.
+// Features can be registered while programs are being parsed or compiled, so it's
+// only ever used with featuresLock held.
+var features = defaultFeatures()
+var featuresLock sync.RWMutex
+
+// defaultFeatures gives the features Schego always has. Exact rationals can be read
+// but not compiled, with division always giving a double, so neither ratios nor
+// exact-closed are among them.
+func defaultFeatures() []string {
+	list := []string{"r7rs", "full-unicode", "schego", runtime.GOOS}
+	if runtime.GOOS != "windows" && runtime.GOOS != "plan9" {
+		list = append(list, "posix")
+	}
+	if architecture, ok := architectureFeatures[runtime.GOARCH]; ok {
+		return append(list, architecture)
+	}
+	return append(list, runtime.GOARCH)
+}
+
+// Features returns the feature identifiers Schego supports, which is what the
+// features procedure returns too, as they stand when the program is compiled
+func Features() []string {
+	featuresLock.RLock()
+	defer featuresLock.RUnlock()
+	return append([]string(nil), features...)
+}
+
+// RegisterFeature adds a feature identifier for cond-expand to check for, such
+// as one describing an application Schego is embedded in. It's safe to call
+// while other programs are being parsed or compiled.
+func RegisterFeature(feature string) {
+	featuresLock.Lock()
+	defer featuresLock.Unlock()
+	if !containsFeature(feature) {
+		features = append(features, feature)
+	}
+}
+
+func hasFeature(feature string) bool {
+	featuresLock.RLock()
+	defer featuresLock.RUnlock()
+	return containsFeature(feature)
+}
+
+// containsFeature checks the list of features, which featuresLock has to be held for
+func containsFeature(feature string) bool {
+	for _, candidate := range features {
+		if candidate == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRequirement evaluates a cond-expand feature requirement, which is a
+// feature identifier or an and, or, not or library requirement
+func checkRequirement(requirement Datum, env *syntaxEnv) (bool, error) {
+	if isIdentifier(requirement) {
+		return hasFeature(identifierName(requirement)), nil
+	}
+	elements, tail := listElements(requirement)
+	if _, ok := tail.(*EmptyList); !ok || len(elements) == 0 || !isIdentifier(elements[0]) {
+		return false, syntaxError("feature requirement", requirement)
+	}
+	operands := elements[1:]
+	switch identifierName(elements[0]) {
+	case "and", "or":
+		// and looks for the first requirement that fails, or for the first that passes
+		wanted := identifierName(elements[0]) == "or"
+		for _, operand := range operands {
+			met, err := checkRequirement(operand, env)
+			if err != nil {
+				return false, err
+			}
+			if met == wanted {
+				return wanted, nil
+			}
+		}
+		return !wanted, nil
+	case "not":
+		if len(operands) != 1 {
+			return false, syntaxError("1 operand for not", requirement)
+		}
+		met, err := checkRequirement(operands[0], env)
+		return !met, err
+	case "library":
+		if len(operands) != 1 {
+			return false, syntaxError("1 library name", requirement)
+		}
+		return libraryAvailable(operands[0], env)
+	}
+	return false, syntaxError("feature requirement", requirement)
+}
+
+// libraryAvailable checks whether a library could be imported, without loading it
+func libraryAvailable(name Datum, env *syntaxEnv) (bool, error) {
+	parts, err := libraryName(name)
+	if err != nil {
+		return false, err
+	}
+	if _, ok := env.state.libraries[name.String()]; ok {
+		return true, nil
+	}
+	if parts[0] == "scheme" {
+		_, ok := builtinImports(parts)
+		return ok, nil
+	}
+	_, found := findFile(libraryFilename(parts), env)
+	return found, nil
+}
+
+// condExpandClause picks out the body of the first cond-expand clause whose
+// requirement is met, with an else clause always being met. It reports whether
+// any clause was chosen at all.
+func condExpandClause(exp Datum, clauses []Datum, env *syntaxEnv) ([]Datum, bool, error) {
+	if len(clauses) == 0 {
+		return nil, false, syntaxError("at least 1 clause for cond-expand", exp)
+	}
+	for index, clause := range clauses {
+		elements, tail := listElements(clause)
+		if _, ok := tail.(*EmptyList); !ok || len(elements) == 0 {
+			return nil, false, syntaxError("(requirement body ...) clause", clause)
+		}
+		if isIdentifier(elements[0]) && identifierName(elements[0]) == "else" {
+			if index != len(clauses)-1 {
+				return nil, false, syntaxError("else clause last", clause)
+			}
+			return elements[1:], true, nil
+		}
+		met, err := checkRequirement(elements[0], env)
+		if err != nil {
+			return nil, false, err
+		}
+		if met {
+			return elements[1:], true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// parseCondExpand parses cond-expand used as an expression or definition, which
+// acts like a begin holding the body of the chosen clause
+func parseCondExpand(exp Datum, operands []Datum, env *syntaxEnv) (AstNode, error) {
+	body, chosen, err := condExpandClause(exp, operands, env)
+	if err != nil {
+		return nil, err
+	}
+	if !chosen {
+		return nil, syntaxError("clause with a requirement that's met", exp)
+	}
+	if len(body) == 0 {
+		return nil, syntaxError("at least 1 expression in the chosen clause", exp)
+	}
+	subExps, err := parseExpressions(body, env)
+	if err != nil {
+		return nil, err
+	}
+	return NewBeginExp(subExps...), nil
+}
@@ -0,0 +1,98 @@
+package schego
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestFeatures(t *testing.T) {
+	for _, feature := range []string{"r7rs", "schego", "full-unicode", runtime.GOOS} {
+		if !hasFeature(feature) {
+			t.Error("Expected feature", feature)
+		}
+	}
+	if runtime.GOARCH == "amd64" && !hasFeature("x86-64") {
+		t.Error("Expected feature x86-64")
+	}
+	for _, feature := range []string{"ratios", "exact-closed"} {
+		if hasFeature(feature) {
+			t.Error("Didn't expect feature", feature)
+		}
+	}
+	RegisterFeature("test-feature")
+	RegisterFeature("test-feature")
+	count := 0
+	for _, feature := range Features() {
+		if feature == "test-feature" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Error("Expected test-feature to be registered once, got", count)
+	}
+	program := parseProgram("(let ((features list)) (features))", t)
+	if program.GetSubNodes()[0].DebugString() != "LetExp((features list), CallExp(features))" {
+		t.Error("Expected a local features to be called, got", program.GetSubNodes()[0].DebugString())
+	}
+	expected := "(" + strings.Join(Features(), " ") + ")"
+	for _, source := range []string{"(display (features))", "(define f features) (display (f))"} {
+		if output := runSource(t, source); output != expected {
+			t.Errorf("%s printed %q, expected %q", source, output, expected)
+		}
+	}
+}
+
+func TestCondExpand(t *testing.T) {
+	program := parseProgram(`(cond-expand (no-such-feature 1) ((and r7rs (not no-such-feature)) (define x 2) x) (else 3))
+(cond-expand ((or no-such-feature schego) 4))
+(cond-expand ((library (scheme base)) 5))
+(cond-expand ((library (no such library)) 6) (else 7))
+(cond-expand ((and) 8))
+(cond-expand ((or) 9) (else 10))`, t)
+	expected := []string{
+		"BeginExp(DefExp(x, 2), x)",
+		"BeginExp(4)",
+		"BeginExp(5)",
+		"BeginExp(7)",
+		"BeginExp(8)",
+		"BeginExp(10)",
+	}
+	for index, node := range program.GetSubNodes() {
+		if node.DebugString() != expected[index] {
+			t.Error("Incorrect node, got", node.DebugString(), "expected", expected[index])
+		}
+	}
+	inputs := []string{"(cond-expand)", "(cond-expand (no-such-feature 1))", "(cond-expand (else 1) (r7rs 2))",
+		"(cond-expand ((not) 1))", "(cond-expand ((maybe r7rs) 1))", "(cond-expand (r7rs))", "(cond-expand (1 2))"}
+	for _, input := range inputs {
+		tokens, _ := LexExp(input)
+		if _, parseErrors := ParseTokens(tokens); len(parseErrors) != 1 {
+			t.Error("Expected an error parsing", input, "got", parseErrors)
+		}
+	}
+}
+
+func TestLibraryCondExpand(t *testing.T) {
+	dir := writeFiles(testLibraries, t)
+	defer os.RemoveAll(dir)
+	program := parseWithPath(`(define-library (portable)
+  (export f)
+  (cond-expand
+    ((library (foo bar)) (import (foo bar)) (begin (define (f) (greet))))
+    (else (begin (define (f) 0)))))
+(define-library (fallback)
+  (export g)
+  (cond-expand (no-such-feature (import (no such library))))
+  (cond-expand (schego (cond-expand (r7rs (begin (define g 1)))))))`, []string{dir}, t)
+	expected := []string{
+		"DefineLibraryExp((portable), (f), ImportExp((foo bar)), DefExp(portable/f, LambdaExp(, CallExp(foo/bar/greet))))",
+		"DefineLibraryExp((fallback), (g), DefExp(fallback/g, 1))",
+	}
+	for index, node := range program.GetSubNodes() {
+		if node.DebugString() != expected[index] {
+			t.Error("Incorrect node, got", node.DebugString(), "expected", expected[index])
+		}
+	}
+}
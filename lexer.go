@@ -1,12 +1,18 @@
 package schego
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
+	"fmt"
+	"io"
 	"math"
+	"math/big"
+	"regexp"
 	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 type TokenType int
@@ -18,31 +24,72 @@ const (
 	TokenIdent
 	TokenIntLiteral
 	TokenFloatLiteral
+	TokenRationalLiteral
 	TokenStringLiteral
 	TokenBoolLiteral
+	TokenCharLiteral
 	TokenDot
 	TokenOp
 	TokenChar
+	// #; which comments out the datum after it
+	TokenDatumComment
+	TokenQuote
+	TokenQuasiquote
+	TokenUnquote
+	TokenUnquoteSplicing
+	// #( and #u8(, both of which are closed by a regular rparen
+	TokenVectorStart
+	TokenBytevectorStart
 )
 
-type overrideType int
+// Position is a single point in the source text. Line and Column are 1-based,
+// with columns counted in runes, while Offset is the 0-based byte offset.
+type Position struct {
+	Line   int
+	Column int
+	Offset int
+}
 
-const (
-	overrideNone overrideType = iota
-	overrideIdent
-	overrideString
-)
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// advance returns the position just past the given rune.
+func (p Position) advance(glyph rune) Position {
+	p.Offset += len(string(glyph))
+	if glyph == '\n' {
+		p.Line++
+		p.Column = 1
+	} else {
+		p.Column++
+	}
+	return p
+}
+
+// Span covers the source text from Start up to, but not including, End.
+type Span struct {
+	Start Position
+	End   Position
+}
+
+func (s Span) String() string {
+	return s.Start.String() + "-" + s.End.String()
+}
 
 type Token struct {
 	Type  TokenType
 	Value bytes.Buffer
+	Span  Span
+	// the source text the token was lexed from, which is what error messages
+	// show, since numbers and booleans are stored encoded in Value
+	Text string
 }
 
 // NewTokenString is a convenience function that returns a token with
 // a given string value.
 func NewTokenString(tokenType TokenType, tokenString string) *Token {
 	tokenValue := bytes.NewBufferString(tokenString)
-	token := Token{tokenType, *tokenValue}
+	token := Token{Type: tokenType, Value: *tokenValue}
 	return &token
 }
 
@@ -53,219 +100,687 @@ func NewTokenRaw(tokenType TokenType, tokenBuffer bytes.Buffer) *Token {
 	// future code
 	copy(tokenSlice, tokenBuffer.Bytes())
 	tokenValue := bytes.NewBuffer(tokenSlice)
-	token := Token{tokenType, *tokenValue}
+	token := Token{Type: tokenType, Value: *tokenValue}
 	return &token
 }
 
-// bufferStringToNum takes an input buffer and converts it from a string of
-// character bytes to a float/int
-func bufferStringToNum(tokenType TokenType, inputBuffer bytes.Buffer) *bytes.Buffer {
-	bufferString := inputBuffer.String()
+// intToBuffer encodes an int the way int literal tokens store them
+func intToBuffer(num int64) *bytes.Buffer {
 	var byteBuffer [binary.MaxVarintLen64]byte
-	if tokenType == TokenFloatLiteral {
-		num, _ := strconv.ParseFloat(bufferString, 64)
-		binary.LittleEndian.PutUint64(byteBuffer[:], math.Float64bits(num))
-	} else {
-		num, _ := strconv.ParseInt(bufferString, 10, 64)
-		binary.PutVarint(byteBuffer[:], num)
-	}
-	returnBuffer := bytes.NewBuffer(byteBuffer[:])
-	return returnBuffer
-}
-
-// flushAccumulator empties the contents of the given Buffer into a new Token
-// and resets it and the accumulator token type. A convenience function for LexExp.
-func flushAccumulator(
-	accumulatorType *TokenType,
-	accumulatorBuffer *bytes.Buffer,
-	tokenBuffer *[]*Token) {
-	if *accumulatorType == TokenFloatLiteral || *accumulatorType == TokenIntLiteral {
-		convertedBuffer := bufferStringToNum(*accumulatorType, *accumulatorBuffer)
-		*tokenBuffer = append(*tokenBuffer, NewTokenRaw(*accumulatorType, *convertedBuffer))
-	} else {
-		*tokenBuffer = append(*tokenBuffer, NewTokenRaw(*accumulatorType, *accumulatorBuffer))
+	binary.PutVarint(byteBuffer[:], num)
+	return bytes.NewBuffer(byteBuffer[:])
+}
+
+// floatToBuffer encodes a float the way float literal tokens store them
+func floatToBuffer(num float64) *bytes.Buffer {
+	var byteBuffer [binary.MaxVarintLen64]byte
+	binary.LittleEndian.PutUint64(byteBuffer[:], math.Float64bits(num))
+	return bytes.NewBuffer(byteBuffer[:])
+}
+
+func newIntToken(num int64) *Token {
+	return NewTokenRaw(TokenIntLiteral, *intToBuffer(num))
+}
+
+func newFloatToken(num float64) *Token {
+	return NewTokenRaw(TokenFloatLiteral, *floatToBuffer(num))
+}
+
+// newRationalToken creates a rational literal token, which stores the numerator
+// and denominator back to back as varints
+func newRationalToken(numerator int64, denominator int64) *Token {
+	byteBuffer := make([]byte, 2*binary.MaxVarintLen64)
+	numLength := binary.PutVarint(byteBuffer, numerator)
+	denomLength := binary.PutVarint(byteBuffer[numLength:], denominator)
+	return NewTokenRaw(TokenRationalLiteral, *bytes.NewBuffer(byteBuffer[:numLength+denomLength]))
+}
+
+type LexErrorKind int
+
+const (
+	LexErrorUnterminatedString LexErrorKind = iota
+	LexErrorUnterminatedIdent
+	LexErrorInvalidHash
+	LexErrorMalformedNumber
+	LexErrorNumberOutOfRange
+	LexErrorInvalidChar
+	LexErrorInvalidEscape
+	LexErrorUnterminatedComment
+)
+
+func (k LexErrorKind) String() string {
+	switch k {
+	case LexErrorUnterminatedString:
+		return "Unterminated string literal"
+	case LexErrorUnterminatedIdent:
+		return "Unterminated |ident|"
+	case LexErrorInvalidHash:
+		return "Invalid # syntax"
+	case LexErrorMalformedNumber:
+		return "Malformed number literal"
+	case LexErrorNumberOutOfRange:
+		return "Number literal out of range"
+	case LexErrorInvalidChar:
+		return "Invalid character literal"
+	case LexErrorInvalidEscape:
+		return "Invalid escape sequence"
+	case LexErrorUnterminatedComment:
+		return "Unterminated block comment"
 	}
-	accumulatorBuffer.Reset()
-	*accumulatorType = TokenNone
+	return "Unknown lexical error"
+}
+
+// LexError describes a piece of malformed source text found while lexing.
+type LexError struct {
+	Kind LexErrorKind
+	Span Span
+	// the offending source text
+	Text string
+}
+
+func (e LexError) Error() string {
+	return e.Kind.String() + " " + e.Text + " at " + e.Span.Start.String()
+}
+
+// Lexer reads Scheme source from an io.Reader and hands out tokens one at a time,
+// so large files and interactive input never need to be held in memory all at once.
+type Lexer struct {
+	reader *bufio.Reader
+	// position of the next rune to be read
+	pos Position
+	// the runes read since the token being lexed started
+	text strings.Builder
 }
 
-// peek peeks at the next rune in the given input string.
-func peek(input string, currentIndex int) rune {
-	// at the end of the string?
-	if len(input)-1 == currentIndex {
-		return '\000'
+// NewLexer creates a Lexer that reads source text from the given reader.
+func NewLexer(reader io.Reader) *Lexer {
+	lexer := new(Lexer)
+	lexer.reader = bufio.NewReader(reader)
+	lexer.pos = Position{Line: 1, Column: 1}
+	return lexer
+}
+
+// readRune reads the next rune and advances the lexer's position past it.
+func (l *Lexer) readRune() (rune, error) {
+	glyph, _, err := l.reader.ReadRune()
+	if err != nil {
+		return 0, err
 	}
-	return rune(input[currentIndex+1])
+	l.pos = l.pos.advance(glyph)
+	l.text.WriteRune(glyph)
+	return glyph, nil
 }
 
-// LexExp lexes an input string into Token objects. There are no possible user-facing
-// errors from this process.
-func LexExp(input string) []*Token {
-	var tokens []*Token
-	// accumulation variables for multi-character tokens such as idents and literals
-	accumulating := false
-	var accumulatingType TokenType
-	var accumulatorBuffer bytes.Buffer
-	// characters that can be used in an ident asides from ., which has meaning outside
-	// idents
-	specialInitials := "!$%&*/:<=>?^_~"
-	// flag as to whether or not the | character has taken effect
-	// anything enclosed within | | is a valid ident in R7RS
-	overrideState := overrideNone
-	// operator characters
-	operatorChars := "+-/*<=>"
-	for index, glyphRune := range input {
-		glyph := string(glyphRune)
-		if overrideState == overrideIdent {
-			accumulatorBuffer.WriteString(glyph)
-			if glyph == "|" {
-				flushAccumulator(&accumulatingType, &accumulatorBuffer, &tokens)
-				accumulating = false
-				overrideState = overrideNone
-			}
-		} else if overrideState == overrideString {
-			if glyph == "\"" {
-				flushAccumulator(&accumulatingType, &accumulatorBuffer, &tokens)
-				accumulating = false
-				overrideState = overrideNone
-			} else {
-				accumulatorBuffer.WriteString(glyph)
-			}
-		} else if unicode.IsSpace(glyphRune) {
-			// flush the accumulator if we were trying to accumulate beforehand
-			// no multi-char token accepts a space
-			if accumulating == true {
-				flushAccumulator(&accumulatingType, &accumulatorBuffer, &tokens)
-				accumulating = false
-			}
-			// flush the accumulator for newlines, as well
-		} else if glyph == "\n" {
-			flushAccumulator(&accumulatingType, &accumulatorBuffer, &tokens)
-			accumulating = false
-			// lparen
-		} else if glyph == "(" {
-			if accumulating == true {
-				flushAccumulator(&accumulatingType, &accumulatorBuffer, &tokens)
-				accumulating = false
+// peekRune returns the next rune without consuming it. A rune of 0 means
+// there's nothing left to read.
+func (l *Lexer) peekRune() (rune, error) {
+	glyph, _, err := l.reader.ReadRune()
+	if err == io.EOF {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	l.reader.UnreadRune()
+	return glyph, nil
+}
+
+// nextIs reports whether the next rune to be read is the given one.
+func (l *Lexer) nextIs(expected rune) bool {
+	glyph, err := l.peekRune()
+	return err == nil && glyph == expected
+}
+
+// isDelimiter reports whether the given rune ends an ident or literal.
+func isDelimiter(glyph rune) bool {
+	return glyph == 0 || unicode.IsSpace(glyph) || strings.ContainsRune("()\";", glyph)
+}
+
+// isAtomRune reports whether the given rune may appear in an ident or
+// number literal.
+func isAtomRune(glyph rune) bool {
+	// characters that can be used in an ident asides from letters and digits
+	// # is only allowed after the first character, which lexToken takes care of
+	specialInitials := "!$%&*/:<=>?^_~+-.@|#"
+	return unicode.IsLetter(glyph) || unicode.IsNumber(glyph) || strings.ContainsRune(specialInitials, glyph)
+}
+
+// readAtom reads runes up until the next delimiter, starting with the given rune.
+func (l *Lexer) readAtom(first rune) (string, error) {
+	var atom strings.Builder
+	atom.WriteRune(first)
+	for {
+		glyph, err := l.peekRune()
+		if err != nil {
+			return "", err
+		}
+		if isDelimiter(glyph) || !isAtomRune(glyph) {
+			return atom.String(), nil
+		}
+		l.readRune()
+		atom.WriteRune(glyph)
+	}
+}
+
+// readUntil reads runes up to and including the given terminator, returning
+// everything read before it. Hitting the end of the input first is reported as
+// io.ErrUnexpectedEOF, along with whatever was read.
+func (l *Lexer) readUntil(terminator rune) (string, error) {
+	var text strings.Builder
+	for {
+		glyph, err := l.readRune()
+		if err == io.EOF {
+			return text.String(), io.ErrUnexpectedEOF
+		} else if err != nil {
+			return "", err
+		} else if glyph == terminator {
+			return text.String(), nil
+		}
+		text.WriteRune(glyph)
+	}
+}
+
+// looksNumeric reports whether an atom was meant to be a number literal, which is
+// the case whenever it starts with a digit, optionally preceded by a sign and/or a .
+func looksNumeric(atom string) bool {
+	atom = strings.TrimLeft(atom, "+-")
+	atom = strings.TrimPrefix(atom, ".")
+	return atom != "" && unicode.IsDigit([]rune(atom)[0])
+}
+
+// classifyAtom turns an atom into an operator, number literal, dot, or ident token.
+func classifyAtom(atom string) (*Token, LexErrorKind, bool) {
+	if atom == "." {
+		return NewTokenString(TokenDot, atom), 0, true
+	}
+	switch atom {
+	case "+", "-", "*", "/", "<", ">", "=", "<=", ">=":
+		return NewTokenString(TokenOp, atom), 0, true
+	}
+	if token, errorKind, ok := parseNumber(atom); ok {
+		return token, 0, true
+	} else if errorKind != LexErrorMalformedNumber || looksNumeric(atom) {
+		return nil, errorKind, false
+	}
+	return NewTokenString(TokenIdent, atom), 0, true
+}
+
+type exactness int
+
+const (
+	exactnessDefault exactness = iota
+	exactnessExact
+	exactnessInexact
+)
+
+// decimals with an optional fractional part and exponent, i.e. 1, 1., .5, 1.5e-3
+var decimalPattern = regexp.MustCompile(`^(?i)([0-9]+\.?[0-9]*|\.[0-9]+)(e[+-]?[0-9]+)?$`)
+
+// isRadixDigits reports whether text is a non-empty run of digits in the given radix.
+func isRadixDigits(text string, radix int) bool {
+	digitChars := "0123456789abcdef"[:radix]
+	for _, glyph := range text {
+		if !strings.ContainsRune(digitChars, unicode.ToLower(glyph)) {
+			return false
+		}
+	}
+	return text != ""
+}
+
+// parseNumber parses a number literal written in R7RS syntax, including radix (#x, #b,
+// #o, #d) and exactness (#e, #i) prefixes, signs, exponents, rationals, and the
+// +inf.0/-inf.0/+nan.0 special values. Exact integral values become int tokens, other
+// exact values become rational tokens, and inexact values become float tokens.
+// ok is false if the text isn't a valid number literal, with the reason why in errorKind.
+func parseNumber(text string) (token *Token, errorKind LexErrorKind, ok bool) {
+	radix := 0
+	exact := exactnessDefault
+	// prefixes can come in either order, but each at most once
+	for strings.HasPrefix(text, "#") && len(text) >= 2 {
+		switch unicode.ToLower(rune(text[1])) {
+		case 'x', 'b', 'o', 'd':
+			if radix != 0 {
+				return nil, LexErrorMalformedNumber, false
 			}
-			tokens = append(tokens, NewTokenString(TokenLParen, glyph))
-			// rparen
-		} else if glyph == ")" {
-			if accumulating == true {
-				flushAccumulator(&accumulatingType, &accumulatorBuffer, &tokens)
-				accumulating = false
+			radix = map[rune]int{'x': 16, 'b': 2, 'o': 8, 'd': 10}[unicode.ToLower(rune(text[1]))]
+		case 'e', 'i':
+			if exact != exactnessDefault {
+				return nil, LexErrorMalformedNumber, false
 			}
-			tokens = append(tokens, NewTokenString(TokenRParen, glyph))
-			// opening " of a string literal
-			// the overrideState stuff takes care of the closing "
-		} else if glyph == "\"" {
-			if accumulating == true {
-				flushAccumulator(&accumulatingType, &accumulatorBuffer, &tokens)
+			exact = exactnessExact
+			if unicode.ToLower(rune(text[1])) == 'i' {
+				exact = exactnessInexact
 			}
-			accumulating = true
-			accumulatingType = TokenStringLiteral
-			overrideState = overrideString
-			// identify any operators
-			// normally they'll be a single character, but >= and <= aren't
-		} else if strings.ContainsAny(glyph, operatorChars) && (accumulatingType == TokenOp || accumulatingType == TokenNone) {
-			// handle >= and <= correctly
-			if (glyph == ">" || glyph == "<") && (peek(input, index) == '=') {
-				accumulating = true
-				accumulatingType = TokenOp
-				accumulatorBuffer.WriteString(glyph)
-			} else {
-				// did we already accumulate > or < and are now on =?
-				if accumulating == true && glyph == "=" {
-					accumulatorBuffer.WriteString(glyph)
-					flushAccumulator(&accumulatingType, &accumulatorBuffer, &tokens)
-					accumulating = false
-				} else {
-					// simplest case if we found a single-character op, just inject it directly
-					tokens = append(tokens, NewTokenString(TokenOp, glyph))
-				}
+		default:
+			return nil, LexErrorMalformedNumber, false
+		}
+		text = text[2:]
+	}
+	if radix == 0 {
+		radix = 10
+	}
+	switch strings.ToLower(text) {
+	case "+inf.0", "-inf.0", "+nan.0", "-nan.0":
+		// there's no exact representation of infinity or NaN
+		if exact == exactnessExact {
+			return nil, LexErrorMalformedNumber, false
+		}
+		num := math.Inf(1)
+		if text[1] == 'n' || text[1] == 'N' {
+			num = math.NaN()
+		} else if text[0] == '-' {
+			num = math.Inf(-1)
+		}
+		return newFloatToken(num), 0, true
+	}
+	sign := ""
+	if strings.HasPrefix(text, "+") || strings.HasPrefix(text, "-") {
+		sign = text[:1]
+		text = text[1:]
+	}
+	var value *big.Rat
+	if slash := strings.IndexByte(text, '/'); slash != -1 {
+		if !isRadixDigits(text[:slash], radix) || !isRadixDigits(text[slash+1:], radix) {
+			return nil, LexErrorMalformedNumber, false
+		}
+		numerator, _ := new(big.Int).SetString(sign+text[:slash], radix)
+		denominator, _ := new(big.Int).SetString(text[slash+1:], radix)
+		if denominator.Sign() == 0 {
+			return nil, LexErrorMalformedNumber, false
+		}
+		value = new(big.Rat).SetFrac(numerator, denominator)
+	} else if isRadixDigits(text, radix) {
+		if exact != exactnessInexact {
+			num, err := strconv.ParseInt(sign+text, radix, 64)
+			if err != nil {
+				return nil, LexErrorNumberOutOfRange, false
 			}
-			// idents delimited with | can contain pretty much any character
-		} else if glyph == "|" {
-			if accumulating == true && accumulatingType != TokenIdent && accumulatingType != TokenStringLiteral {
-				flushAccumulator(&accumulatingType, &accumulatorBuffer, &tokens)
-			} else if accumulating == false {
-				overrideState = overrideIdent
+			return newIntToken(num), 0, true
+		}
+		numerator, _ := new(big.Int).SetString(sign+text, radix)
+		value = new(big.Rat).SetInt(numerator)
+	} else if radix == 10 && decimalPattern.MatchString(text) {
+		// decimals are inexact unless asked otherwise
+		if exact != exactnessExact {
+			num, err := strconv.ParseFloat(sign+text, 64)
+			if err != nil {
+				return nil, LexErrorNumberOutOfRange, false
 			}
-			accumulating = true
-			accumulatorBuffer.WriteString(glyph)
-			accumulatingType = TokenIdent
-		} else if glyph == "." {
-			// . is a valid character in an ident - add it to the accumulator
-			// if we were building an ident
-			if accumulating == true && accumulatingType == TokenIdent {
-				accumulatorBuffer.WriteString(glyph)
-				// we can't start an ident with . - are we building a floating point literal?
-			} else if chr := peek(input, index); !unicode.IsSpace(chr) && unicode.IsNumber(chr) {
-				accumulating = true
-				accumulatingType = TokenFloatLiteral
-				accumulatorBuffer.WriteString(glyph)
-				// there's situations where a standalone . is valid
-			} else {
-				tokens = append(tokens, NewTokenString(TokenDot, glyph))
+			return newFloatToken(num), 0, true
+		}
+		value, _ = new(big.Rat).SetString(sign + text)
+	} else {
+		return nil, LexErrorMalformedNumber, false
+	}
+	if exact == exactnessInexact {
+		num, _ := value.Float64()
+		return newFloatToken(num), 0, true
+	}
+	if !value.Num().IsInt64() || !value.Denom().IsInt64() {
+		return nil, LexErrorNumberOutOfRange, false
+	}
+	if value.IsInt() {
+		return newIntToken(value.Num().Int64()), 0, true
+	}
+	return newRationalToken(value.Num().Int64(), value.Denom().Int64()), 0, true
+}
+
+// Next lexes and returns the next token in the input, returning io.EOF once the
+// input has been exhausted. Malformed input is reported as a LexError; the lexer
+// skips past it, so Next can be called again to carry on with the rest of the input.
+func (l *Lexer) Next() (*Token, error) {
+	// skip past any leading whitespace and comments
+	var glyph rune
+	var start Position
+	for {
+		start = l.pos
+		l.text.Reset()
+		var err error
+		glyph, err = l.readRune()
+		if err != nil {
+			return nil, err
+		}
+		if glyph == ';' {
+			// line comments run until the end of the line
+			if _, err := l.readUntil('\n'); err != nil && err != io.ErrUnexpectedEOF {
+				return nil, err
 			}
-			// boolean literals
-		} else if glyph == "#" || (accumulating == true && accumulatingType == TokenBoolLiteral) {
-			// make sure we didn't find a standalone #
-			if chr := peek(input, index); chr == 't' || chr == 'f' {
-				// semi-hacky way way of using the accumulator buffer to skip processing
-				// of the current glyph
-				accumulating = true
-				accumulatingType = TokenBoolLiteral
-			} else if accumulating == true {
-				// represent true as 1 and false as 0 (doh)
-				if glyph == "t" {
-					accumulatorBuffer.WriteByte(1)
-				} else {
-					accumulatorBuffer.WriteByte(0)
-				}
-				flushAccumulator(&accumulatingType, &accumulatorBuffer, &tokens)
-				accumulating = false
-			} else {
-				// handle the case of just having a # hanging out all by itself
-				tokens = append(tokens, NewTokenString(TokenChar, glyph))
+		} else if glyph == '#' && l.nextIs('|') {
+			l.readRune()
+			if err := l.skipBlockComment(); err == io.ErrUnexpectedEOF {
+				return nil, LexError{LexErrorUnterminatedComment, Span{start, l.pos}, "#|"}
+			} else if err != nil {
+				return nil, err
 			}
-			// ident
-		} else if unicode.IsLetter(glyphRune) {
-			// were we building a number literal beforehand?
-			if accumulating == true && accumulatingType != TokenIdent {
-				flushAccumulator(&accumulatingType, &accumulatorBuffer, &tokens)
+		} else if !unicode.IsSpace(glyph) {
+			break
+		}
+	}
+	token, err := l.lexToken(glyph)
+	if lexErr, ok := err.(LexError); ok {
+		lexErr.Span = Span{start, l.pos}
+		return nil, lexErr
+	} else if err != nil {
+		return nil, err
+	}
+	token.Span = Span{start, l.pos}
+	token.Text = l.text.String()
+	return token, nil
+}
+
+// skipBlockComment skips past a #| |# block comment, whose opening #| has already
+// been consumed. Block comments nest, so each #| needs its own matching |#.
+func (l *Lexer) skipBlockComment() error {
+	depth := 1
+	var previous rune
+	for depth > 0 {
+		glyph, err := l.readRune()
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+		if previous == '#' && glyph == '|' {
+			depth++
+			// don't let the | count towards a closing |#
+			glyph = 0
+		} else if previous == '|' && glyph == '#' {
+			depth--
+			glyph = 0
+		}
+		previous = glyph
+	}
+	return nil
+}
+
+// lexToken lexes the token beginning with the given (already consumed) rune.
+func (l *Lexer) lexToken(glyph rune) (*Token, error) {
+	switch {
+	case glyph == '(':
+		return NewTokenString(TokenLParen, "("), nil
+	case glyph == ')':
+		return NewTokenString(TokenRParen, ")"), nil
+	case glyph == '\'':
+		return NewTokenString(TokenQuote, "'"), nil
+	case glyph == '`':
+		return NewTokenString(TokenQuasiquote, "`"), nil
+	case glyph == ',':
+		if l.nextIs('@') {
+			l.readRune()
+			return NewTokenString(TokenUnquoteSplicing, ",@"), nil
+		}
+		return NewTokenString(TokenUnquote, ","), nil
+	case glyph == '"':
+		return l.lexString()
+	case glyph == '|':
+		// anything enclosed within | | is a valid ident in R7RS
+		text, err := l.readUntil('|')
+		if err == io.ErrUnexpectedEOF {
+			return nil, LexError{Kind: LexErrorUnterminatedIdent, Text: "|" + text}
+		} else if err != nil {
+			return nil, err
+		}
+		return NewTokenString(TokenIdent, "|"+text+"|"), nil
+	case glyph == '#':
+		return l.lexHash()
+	case isAtomRune(glyph):
+		atom, err := l.readAtom(glyph)
+		if err != nil {
+			return nil, err
+		}
+		token, errorKind, ok := classifyAtom(atom)
+		if !ok {
+			return nil, LexError{Kind: errorKind, Text: atom}
+		}
+		return token, nil
+	}
+	// we're not sure what this character is, let the parser deal with it
+	return NewTokenString(TokenChar, string(glyph)), nil
+}
+
+// lexHash lexes the syntax following a #.
+func (l *Lexer) lexHash() (*Token, error) {
+	next, err := l.peekRune()
+	if err != nil {
+		return nil, err
+	}
+	if next == '\\' {
+		l.readRune()
+		return l.lexChar()
+	} else if next == ';' {
+		l.readRune()
+		return NewTokenString(TokenDatumComment, "#;"), nil
+	} else if next == '(' {
+		l.readRune()
+		return NewTokenString(TokenVectorStart, "#("), nil
+	} else if isDelimiter(next) || !isAtomRune(next) {
+		// a # hanging out all by itself
+		return nil, LexError{Kind: LexErrorInvalidHash, Text: "#"}
+	}
+	l.readRune()
+	atom, err := l.readAtom(next)
+	if err != nil {
+		return nil, err
+	}
+	// radix/exactness prefixes start a number literal
+	if strings.ContainsRune("xXbBoOdDeEiI", next) {
+		token, errorKind, ok := parseNumber("#" + atom)
+		if !ok {
+			return nil, LexError{Kind: errorKind, Text: "#" + atom}
+		}
+		return token, nil
+	}
+	if (atom == "u8" || atom == "U8") && l.nextIs('(') {
+		l.readRune()
+		return NewTokenString(TokenBytevectorStart, "#u8("), nil
+	}
+	// represent true as 1 and false as 0 (doh)
+	switch atom {
+	case "t", "true":
+		return NewTokenRaw(TokenBoolLiteral, *bytes.NewBuffer([]byte{1})), nil
+	case "f", "false":
+		return NewTokenRaw(TokenBoolLiteral, *bytes.NewBuffer([]byte{0})), nil
+	}
+	return nil, LexError{Kind: LexErrorInvalidHash, Text: "#" + atom}
+}
+
+// the single-character string escapes from R7RS, i.e. \n
+var stringEscapes = map[rune]rune{
+	'a':  '\a',
+	'b':  '\b',
+	't':  '\t',
+	'n':  '\n',
+	'r':  '\r',
+	'"':  '"',
+	'\\': '\\',
+	'|':  '|',
+}
+
+// lexString lexes a string literal whose opening " has already been consumed,
+// decoding any escape sequences along the way. A bad escape is only reported once
+// the closing " is found, so lexing picks back up after the string as a whole.
+func (l *Lexer) lexString() (*Token, error) {
+	var raw strings.Builder
+	var value strings.Builder
+	badEscape := ""
+	for {
+		glyph, err := l.readRune()
+		if err == io.EOF {
+			return nil, LexError{Kind: LexErrorUnterminatedString, Text: "\"" + raw.String()}
+		} else if err != nil {
+			return nil, err
+		}
+		if glyph == '"' {
+			break
+		}
+		raw.WriteRune(glyph)
+		if glyph != '\\' {
+			value.WriteRune(glyph)
+			continue
+		}
+		escape, err := l.readEscape()
+		if err != nil {
+			return nil, err
+		}
+		raw.WriteString(escape.raw)
+		if !escape.ok && badEscape == "" {
+			badEscape = "\\" + escape.raw
+		}
+		value.WriteString(escape.value)
+	}
+	if badEscape != "" {
+		return nil, LexError{Kind: LexErrorInvalidEscape, Text: badEscape}
+	}
+	return NewTokenString(TokenStringLiteral, value.String()), nil
+}
+
+// stringEscape is a single decoded escape sequence within a string literal
+type stringEscape struct {
+	// source text after the backslash
+	raw string
+	// what the escape decodes to
+	value string
+	ok    bool
+}
+
+// isIntralineSpace reports whether the given rune is whitespace other than a newline
+func isIntralineSpace(glyph rune) bool {
+	return glyph == ' ' || glyph == '\t'
+}
+
+// readEscape reads the escape sequence following a backslash in a string literal.
+// The terminating " of the string is never consumed, even for a malformed escape.
+func (l *Lexer) readEscape() (stringEscape, error) {
+	var raw strings.Builder
+	glyph, err := l.peekRune()
+	if err != nil {
+		return stringEscape{}, err
+	}
+	if glyph == 0 {
+		// let lexString report the unterminated string
+		return stringEscape{ok: true}, nil
+	}
+	if char, ok := stringEscapes[glyph]; ok {
+		l.readRune()
+		return stringEscape{string(glyph), string(char), true}, nil
+	}
+	if glyph == 'x' || glyph == 'X' {
+		// hex escapes look like \x41; with a mandatory semicolon
+		l.readRune()
+		raw.WriteRune(glyph)
+		for {
+			digit, err := l.peekRune()
+			if err != nil {
+				return stringEscape{}, err
 			}
-			accumulating = true
-			accumulatingType = TokenIdent
-			accumulatorBuffer.WriteString(glyph)
-			// were we building an ident and are now trying to add a special initial?
-		} else if strings.ContainsAny(glyph, specialInitials) {
-			if accumulating == true && accumulatingType == TokenIdent {
-				accumulatorBuffer.WriteString(glyph)
-			} else {
-				tokens = append(tokens, NewTokenString(TokenChar, glyph))
+			if !isRadixDigits(string(digit), 16) {
+				break
 			}
-			// number literal
-		} else if unicode.IsNumber(glyphRune) {
-			if accumulating == true && accumulatingType == TokenIdent {
-				flushAccumulator(&accumulatingType, &accumulatorBuffer, &tokens)
+			l.readRune()
+			raw.WriteRune(digit)
+		}
+		if next, _ := l.peekRune(); next != ';' {
+			return stringEscape{raw: raw.String()}, nil
+		}
+		l.readRune()
+		hexDigits := raw.String()[1:]
+		raw.WriteRune(';')
+		char, ok := decodeCharName("x" + hexDigits)
+		return stringEscape{raw.String(), string(char), ok && hexDigits != ""}, nil
+	}
+	if isIntralineSpace(glyph) || glyph == '\n' || glyph == '\r' {
+		// line continuations skip the newline, along with whitespace on either side
+		sawNewline := false
+		for {
+			next, err := l.peekRune()
+			if err != nil {
+				return stringEscape{}, err
 			}
-			accumulating = true
-			// only declare that we are accumulating an int if we didn't see a . already
-			if accumulatingType != TokenFloatLiteral {
-				accumulatingType = TokenIntLiteral
+			if next == '\n' && !sawNewline {
+				sawNewline = true
+			} else if !isIntralineSpace(next) && next != '\r' {
+				break
 			}
-			accumulatorBuffer.WriteString(glyph)
-			// we're not sure what this character is, let the parser deal with it
-		} else {
-			tokens = append(tokens, NewTokenString(TokenChar, glyph))
+			l.readRune()
+			raw.WriteRune(next)
+		}
+		return stringEscape{raw: raw.String(), ok: sawNewline}, nil
+	}
+	// unknown escape
+	l.readRune()
+	return stringEscape{raw: string(glyph)}, nil
+}
+
+// the named characters from R7RS, i.e. #\space
+var charNames = map[string]rune{
+	"alarm":     '\a',
+	"backspace": '\b',
+	"delete":    0x7F,
+	"escape":    0x1B,
+	"newline":   '\n',
+	"null":      0,
+	"return":    '\r',
+	"space":     ' ',
+	"tab":       '\t',
+}
+
+// lexChar lexes a character literal, whose #\ has already been consumed.
+func (l *Lexer) lexChar() (*Token, error) {
+	first, err := l.readRune()
+	if err == io.EOF {
+		return nil, LexError{Kind: LexErrorInvalidChar, Text: "#\\"}
+	} else if err != nil {
+		return nil, err
+	}
+	name := string(first)
+	// anything past the first character makes this a named or hex character,
+	// with the exception of delimiters like #\( which stand alone
+	if isAtomRune(first) {
+		name, err = l.readAtom(first)
+		if err != nil {
+			return nil, err
 		}
 	}
-	// corner case if the input string while we're still accumulating
-	// should never happen in proper Scheme, but still...
-	if accumulating == true {
-		flushAccumulator(&accumulatingType, &accumulatorBuffer, &tokens)
-		accumulating = false
+	char, ok := decodeCharName(name)
+	if !ok {
+		return nil, LexError{Kind: LexErrorInvalidChar, Text: "#\\" + name}
+	}
+	return NewTokenString(TokenCharLiteral, string(char)), nil
+}
+
+// decodeCharName turns the text after #\ into the character it names.
+func decodeCharName(name string) (rune, bool) {
+	if utf8.RuneCountInString(name) == 1 {
+		char, _ := utf8.DecodeRuneInString(name)
+		return char, true
+	} else if char, ok := charNames[name]; ok {
+		return char, true
+	} else if (name[0] == 'x' || name[0] == 'X') && isRadixDigits(name[1:], 16) {
+		scalar, err := strconv.ParseInt(name[1:], 16, 32)
+		if err == nil && utf8.ValidRune(rune(scalar)) {
+			return rune(scalar), true
+		}
+	}
+	return 0, false
+}
+
+// LexExp lexes an input string into Token objects. Every token records the span of
+// source text it came from. Malformed input is left out of the tokens and reported
+// as a LexError instead, with lexing picking back up right after it so that every
+// problem in the input gets reported at once.
+func LexExp(input string) ([]*Token, []LexError) {
+	var tokens []*Token
+	var lexErrors []LexError
+	lexer := NewLexer(strings.NewReader(input))
+	for {
+		token, err := lexer.Next()
+		if lexErr, ok := err.(LexError); ok {
+			lexErrors = append(lexErrors, lexErr)
+			continue
+		} else if err != nil {
+			// reading from a string can only ever fail with io.EOF
+			break
+		}
+		tokens = append(tokens, token)
 	}
-	return tokens
+	return tokens, lexErrors
 }
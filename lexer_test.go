@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"math"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 // convenience functions to grab the value of the underlying byte buffer of a token
@@ -16,6 +19,9 @@ func getProperValue(input *Token) string {
 	} else if input.Type == TokenFloatLiteral {
 		convertedNum := getFloatValue(input)
 		return fmt.Sprint(convertedNum)
+	} else if input.Type == TokenRationalLiteral {
+		numerator, denominator := getRationalValue(input)
+		return fmt.Sprint(numerator, "/", denominator)
 	} else {
 		return getStringValue(input)
 	}
@@ -27,14 +33,23 @@ func getIntValue(input *Token) int64 {
 	num, _ := binary.Varint(input.Value.Bytes())
 	return num
 }
+func getRationalValue(input *Token) (int64, int64) {
+	numerator, numLength := binary.Varint(input.Value.Bytes())
+	denominator, _ := binary.Varint(input.Value.Bytes()[numLength:])
+	return numerator, denominator
+}
 func getFloatValue(input *Token) float64 {
 	bits := binary.LittleEndian.Uint64(input.Value.Bytes())
 	return math.Float64frombits(bits)
 }
 
+// NewTokenNum builds a number token the same way the lexer does, so the
+// expected tokens in these tests can't drift from the real encoding
 func NewTokenNum(tokenType TokenType, tokenString string) *Token {
-	token := NewTokenString(tokenType, tokenString)
-	token.Value = *bufferStringToNum(tokenType, token.Value)
+	token, _, ok := parseNumber(tokenString)
+	if !ok || token.Type != tokenType {
+		panic(fmt.Sprintf("%q isn't a valid number of the expected type", tokenString))
+	}
 	return token
 }
 
@@ -62,7 +77,7 @@ func checkTokens(tokens []*Token, expectedTokens []*Token, t *testing.T) {
 
 // test lexing a single s-expression
 func TestLexSingleExp(t *testing.T) {
-	tokens := LexExp("(abc def ghi)")
+	tokens, _ := LexExp("(abc def ghi)")
 	expectedTokens := []*Token{
 		NewTokenString(TokenLParen, "("),
 		NewTokenString(TokenIdent, "abc"),
@@ -74,7 +89,7 @@ func TestLexSingleExp(t *testing.T) {
 
 // test lexing nested s-expressions
 func TestLexNestedExp(t *testing.T) {
-	tokens := LexExp("(abc (def ghi (jkl)))")
+	tokens, _ := LexExp("(abc (def ghi (jkl)))")
 	expectedTokens := []*Token{
 		NewTokenString(TokenLParen, "("),
 		NewTokenString(TokenIdent, "abc"),
@@ -91,7 +106,7 @@ func TestLexNestedExp(t *testing.T) {
 
 // test to make sure whitespace is properly ignored
 func TestIgnoreExtraWhitespace(t *testing.T) {
-	tokens := LexExp("( ab   cd efg)")
+	tokens, _ := LexExp("( ab   cd efg)")
 	expectedTokens := []*Token{
 		NewTokenString(TokenLParen, "("),
 		NewTokenString(TokenIdent, "ab"),
@@ -103,7 +118,7 @@ func TestIgnoreExtraWhitespace(t *testing.T) {
 
 // test corner case where the is no closing rparen and only EOL/EOF
 func TestLexIdentCorner(t *testing.T) {
-	tokens := LexExp("(abc")
+	tokens, _ := LexExp("(abc")
 	expectedTokens := []*Token{
 		NewTokenString(TokenLParen, "("),
 		NewTokenString(TokenIdent, "abc")}
@@ -112,7 +127,7 @@ func TestLexIdentCorner(t *testing.T) {
 
 // test number literals
 func TestLexNumberLiterals(t *testing.T) {
-	tokens := LexExp("(123 abc def 456.789 .012 345)")
+	tokens, _ := LexExp("(123 abc def 456.789 .012 345)")
 	expectedTokens := []*Token{
 		NewTokenString(TokenLParen, "("),
 		NewTokenNum(TokenIntLiteral, "123"),
@@ -127,7 +142,7 @@ func TestLexNumberLiterals(t *testing.T) {
 
 // test special characters
 func TestIdentSpecial(t *testing.T) {
-	tokens := LexExp("ab.c . d|ef? |gh +i|")
+	tokens, _ := LexExp("ab.c . d|ef? |gh +i|")
 	expectedTokens := []*Token{
 		NewTokenString(TokenIdent, "ab.c"),
 		NewTokenString(TokenDot, "."),
@@ -138,7 +153,7 @@ func TestIdentSpecial(t *testing.T) {
 
 // test operators
 func TestOps(t *testing.T) {
-	tokens := LexExp("(>= 150 (* (+ 10 3.2) 5))")
+	tokens, _ := LexExp("(>= 150 (* (+ 10 3.2) 5))")
 	expectedTokens := []*Token{
 		NewTokenString(TokenLParen, "("),
 		NewTokenString(TokenOp, ">="),
@@ -158,7 +173,7 @@ func TestOps(t *testing.T) {
 
 // test newline
 func TestNewline(t *testing.T) {
-	tokens := LexExp("(ab\ncd\nef)")
+	tokens, _ := LexExp("(ab\ncd\nef)")
 	expectedTokens := []*Token{
 		NewTokenString(TokenLParen, "("),
 		NewTokenString(TokenIdent, "ab"),
@@ -170,24 +185,301 @@ func TestNewline(t *testing.T) {
 
 // test to make sure single-constant expressions are lexed/converted correctly
 func TestSingleFloat(t *testing.T) {
-	tokens := LexExp("3.14")
+	tokens, _ := LexExp("3.14")
 	expectedTokens := []*Token{NewTokenNum(TokenFloatLiteral, "3.14")}
 	checkTokens(tokens, expectedTokens, t)
 }
 
 // test string literals
 func TestString(t *testing.T) {
-	tokens := LexExp("\"la li lu le lo\"")
+	tokens, _ := LexExp("\"la li lu le lo\"")
 	expectedTokens := []*Token{NewTokenString(TokenStringLiteral, "la li lu le lo")}
 	checkTokens(tokens, expectedTokens, t)
 }
 
 // test bool literals
 func TestBool(t *testing.T) {
-	tokens := LexExp("#t #f bla")
+	tokens, _ := LexExp("#t #f bla")
 	expectedTokens := []*Token{
 		NewTokenRaw(TokenBoolLiteral, *bytes.NewBuffer([]byte{1})),
 		NewTokenRaw(TokenBoolLiteral, *bytes.NewBuffer([]byte{0})),
 		NewTokenString(TokenIdent, "bla")}
 	checkTokens(tokens, expectedTokens, t)
 }
+
+// test that tokens record where they came from
+func TestTokenSpans(t *testing.T) {
+	tokens, _ := LexExp("(ab 12\n  \"cd\")")
+	expectedSpans := []Span{
+		{Position{1, 1, 0}, Position{1, 2, 1}},
+		{Position{1, 2, 1}, Position{1, 4, 3}},
+		{Position{1, 5, 4}, Position{1, 7, 6}},
+		{Position{2, 3, 9}, Position{2, 7, 13}},
+		{Position{2, 7, 13}, Position{2, 8, 14}}}
+	if len(tokens) != len(expectedSpans) {
+		t.Fatal("Incorrect token count, got", len(tokens))
+	}
+	for index, token := range tokens {
+		if token.Span != expectedSpans[index] {
+			t.Error("Incorrect span for", getProperValue(token), "got", token.Span, "expected", expectedSpans[index])
+		}
+	}
+}
+
+// test pulling tokens from a reader one at a time
+func TestLexerStream(t *testing.T) {
+	// hand the lexer a single byte per read to make sure tokens spanning
+	// multiple reads are put back together properly
+	lexer := NewLexer(iotest.OneByteReader(strings.NewReader("(define pi 3.14)\n(display \"こんにちは\")")))
+	expectedTokens := []*Token{
+		NewTokenString(TokenLParen, "("),
+		NewTokenString(TokenIdent, "define"),
+		NewTokenString(TokenIdent, "pi"),
+		NewTokenNum(TokenFloatLiteral, "3.14"),
+		NewTokenString(TokenRParen, ")"),
+		NewTokenString(TokenLParen, "("),
+		NewTokenString(TokenIdent, "display"),
+		NewTokenString(TokenStringLiteral, "こんにちは"),
+		NewTokenString(TokenRParen, ")")}
+	var tokens []*Token
+	for {
+		token, err := lexer.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		tokens = append(tokens, token)
+	}
+	if len(tokens) != len(expectedTokens) {
+		t.Fatal("Incorrect token count, got", len(tokens))
+	}
+	checkTokens(tokens, expectedTokens, t)
+	// the lexer should keep reporting EOF once it's done
+	if _, err := lexer.Next(); err != io.EOF {
+		t.Error("Expected io.EOF, got", err)
+	}
+}
+
+// test that malformed input is reported instead of being turned into tokens
+func TestLexErrors(t *testing.T) {
+	tokens, lexErrors := LexExp("(a 1.2.3 # b 99999999999999999999 #tru |cd \"ef)")
+	expectedTokens := []*Token{
+		NewTokenString(TokenLParen, "("),
+		NewTokenString(TokenIdent, "a"),
+		NewTokenString(TokenIdent, "b")}
+	if len(tokens) != len(expectedTokens) {
+		t.Fatal("Incorrect token count, got", len(tokens))
+	}
+	checkTokens(tokens, expectedTokens, t)
+	expectedErrors := []LexError{
+		{LexErrorMalformedNumber, Span{Position{1, 4, 3}, Position{1, 9, 8}}, "1.2.3"},
+		{LexErrorInvalidHash, Span{Position{1, 10, 9}, Position{1, 11, 10}}, "#"},
+		{LexErrorNumberOutOfRange, Span{Position{1, 14, 13}, Position{1, 34, 33}}, "99999999999999999999"},
+		{LexErrorInvalidHash, Span{Position{1, 35, 34}, Position{1, 39, 38}}, "#tru"},
+		{LexErrorUnterminatedIdent, Span{Position{1, 40, 39}, Position{1, 48, 47}}, "|cd \"ef)"}}
+	if len(lexErrors) != len(expectedErrors) {
+		t.Fatal("Incorrect error count, got", lexErrors)
+	}
+	for index, lexError := range lexErrors {
+		if lexError != expectedErrors[index] {
+			t.Error("Incorrect error, got", lexError, "expected", expectedErrors[index])
+		}
+	}
+}
+
+// test that an unterminated string is reported
+func TestLexUnterminatedString(t *testing.T) {
+	_, lexErrors := LexExp("(display \"abc")
+	if len(lexErrors) != 1 || lexErrors[0].Kind != LexErrorUnterminatedString {
+		t.Fatal("Expected unterminated string error, got", lexErrors)
+	}
+	if lexErrors[0].Error() != "Unterminated string literal \"abc at 1:10" {
+		t.Error("Incorrect error message, got", lexErrors[0].Error())
+	}
+}
+
+// test the full range of R7RS number syntax
+func TestLexNumberSyntax(t *testing.T) {
+	tokens, lexErrors := LexExp("-5 +7 -2.5 1e3 1.5E-1 #x1F #b-101 #o17 #d10 #e1.5 #i3 #x#e10 #e#x10 " +
+		"1/3 -6/4 4/2 #i1/4 +inf.0 -inf.0 - -x ...")
+	if len(lexErrors) != 0 {
+		t.Fatal("Unexpected errors:", lexErrors)
+	}
+	expectedTokens := []*Token{
+		NewTokenNum(TokenIntLiteral, "-5"),
+		NewTokenNum(TokenIntLiteral, "7"),
+		NewTokenNum(TokenFloatLiteral, "-2.5"),
+		NewTokenNum(TokenFloatLiteral, "1e3"),
+		NewTokenNum(TokenFloatLiteral, "0.15"),
+		NewTokenNum(TokenIntLiteral, "31"),
+		NewTokenNum(TokenIntLiteral, "-5"),
+		NewTokenNum(TokenIntLiteral, "15"),
+		NewTokenNum(TokenIntLiteral, "10"),
+		newRationalToken(3, 2),
+		NewTokenNum(TokenFloatLiteral, "3.0"),
+		NewTokenNum(TokenIntLiteral, "16"),
+		NewTokenNum(TokenIntLiteral, "16"),
+		newRationalToken(1, 3),
+		newRationalToken(-3, 2),
+		NewTokenNum(TokenIntLiteral, "2"),
+		NewTokenNum(TokenFloatLiteral, "0.25"),
+		NewTokenNum(TokenFloatLiteral, "+inf.0"),
+		NewTokenNum(TokenFloatLiteral, "-inf.0"),
+		NewTokenString(TokenOp, "-"),
+		NewTokenString(TokenIdent, "-x"),
+		NewTokenString(TokenIdent, "...")}
+	if len(tokens) != len(expectedTokens) {
+		t.Fatal("Incorrect token count, got", len(tokens))
+	}
+	checkTokens(tokens, expectedTokens, t)
+	// NaN never compares equal to itself, so check it separately
+	tokens, _ = LexExp("+nan.0")
+	if tokens[0].Type != TokenFloatLiteral || !math.IsNaN(getFloatValue(tokens[0])) {
+		t.Error("Expected NaN, got", getProperValue(tokens[0]))
+	}
+}
+
+// test malformed number syntax
+func TestLexBadNumbers(t *testing.T) {
+	_, lexErrors := LexExp("#x1.5 #e#e1 1/0 #e+inf.0 #b102 1/2/3 -1x")
+	if len(lexErrors) != 7 {
+		t.Fatal("Expected 7 errors, got", lexErrors)
+	}
+	for _, lexError := range lexErrors {
+		if lexError.Kind != LexErrorMalformedNumber {
+			t.Error("Expected malformed number error, got", lexError)
+		}
+	}
+}
+
+// test character literals
+func TestLexChars(t *testing.T) {
+	tokens, lexErrors := LexExp("(#\\a #\\space #\\newline #\\x41 #\\( #\\) #\\x #\\λ #\\alarm)")
+	if len(lexErrors) != 0 {
+		t.Fatal("Unexpected errors:", lexErrors)
+	}
+	expectedTokens := []*Token{
+		NewTokenString(TokenLParen, "("),
+		NewTokenString(TokenCharLiteral, "a"),
+		NewTokenString(TokenCharLiteral, " "),
+		NewTokenString(TokenCharLiteral, "\n"),
+		NewTokenString(TokenCharLiteral, "A"),
+		NewTokenString(TokenCharLiteral, "("),
+		NewTokenString(TokenCharLiteral, ")"),
+		NewTokenString(TokenCharLiteral, "x"),
+		NewTokenString(TokenCharLiteral, "λ"),
+		NewTokenString(TokenCharLiteral, "\a"),
+		NewTokenString(TokenRParen, ")")}
+	if len(tokens) != len(expectedTokens) {
+		t.Fatal("Incorrect token count, got", len(tokens))
+	}
+	checkTokens(tokens, expectedTokens, t)
+	_, lexErrors = LexExp("#\\bogus #\\xD800 #\\")
+	if len(lexErrors) != 3 {
+		t.Fatal("Expected 3 errors, got", lexErrors)
+	}
+	for _, lexError := range lexErrors {
+		if lexError.Kind != LexErrorInvalidChar {
+			t.Error("Expected invalid character error, got", lexError)
+		}
+	}
+}
+
+// test escape sequences within string literals
+func TestStringEscapes(t *testing.T) {
+	tokens, lexErrors := LexExp(`"say \"hi\"" "a\\b\n\t\a\b\r" "\x41;\x3bb;" "one \
+	    two" "three\   
+four"`)
+	if len(lexErrors) != 0 {
+		t.Fatal("Unexpected errors:", lexErrors)
+	}
+	expectedTokens := []*Token{
+		NewTokenString(TokenStringLiteral, "say \"hi\""),
+		NewTokenString(TokenStringLiteral, "a\\b\n\t\a\b\r"),
+		NewTokenString(TokenStringLiteral, "Aλ"),
+		NewTokenString(TokenStringLiteral, "one two"),
+		NewTokenString(TokenStringLiteral, "threefour")}
+	if len(tokens) != len(expectedTokens) {
+		t.Fatal("Incorrect token count, got", len(tokens))
+	}
+	checkTokens(tokens, expectedTokens, t)
+	tokens, lexErrors = LexExp(`"bad \q escape" "\x41" ok "\x;"`)
+	if len(lexErrors) != 3 {
+		t.Fatal("Expected 3 errors, got", lexErrors)
+	}
+	for _, lexError := range lexErrors {
+		if lexError.Kind != LexErrorInvalidEscape {
+			t.Error("Expected invalid escape error, got", lexError)
+		}
+	}
+	// lexing should carry on after a bad string
+	if len(tokens) != 1 || getStringValue(tokens[0]) != "ok" {
+		t.Error("Expected a single ok ident, got", tokens)
+	}
+}
+
+// test that comments are skipped, with datum comments left for the parser
+func TestComments(t *testing.T) {
+	tokens, lexErrors := LexExp("(a ; line comment (\n #| block #| nested |# comment |# b #;c d)")
+	if len(lexErrors) != 0 {
+		t.Fatal("Unexpected errors:", lexErrors)
+	}
+	expectedTokens := []*Token{
+		NewTokenString(TokenLParen, "("),
+		NewTokenString(TokenIdent, "a"),
+		NewTokenString(TokenIdent, "b"),
+		NewTokenString(TokenDatumComment, "#;"),
+		NewTokenString(TokenIdent, "c"),
+		NewTokenString(TokenIdent, "d"),
+		NewTokenString(TokenRParen, ")")}
+	if len(tokens) != len(expectedTokens) {
+		t.Fatal("Incorrect token count, got", len(tokens))
+	}
+	checkTokens(tokens, expectedTokens, t)
+	_, lexErrors = LexExp("a #| never closed #| |#")
+	if len(lexErrors) != 1 || lexErrors[0].Kind != LexErrorUnterminatedComment {
+		t.Error("Expected unterminated comment error, got", lexErrors)
+	}
+}
+
+// test quote, quasiquote, unquote and unquote-splicing
+func TestQuoteTokens(t *testing.T) {
+	tokens, _ := LexExp("'a `(b ,c ,@d)")
+	expectedTokens := []*Token{
+		NewTokenString(TokenQuote, "'"),
+		NewTokenString(TokenIdent, "a"),
+		NewTokenString(TokenQuasiquote, "`"),
+		NewTokenString(TokenLParen, "("),
+		NewTokenString(TokenIdent, "b"),
+		NewTokenString(TokenUnquote, ","),
+		NewTokenString(TokenIdent, "c"),
+		NewTokenString(TokenUnquoteSplicing, ",@"),
+		NewTokenString(TokenIdent, "d"),
+		NewTokenString(TokenRParen, ")")}
+	if len(tokens) != len(expectedTokens) {
+		t.Fatal("Incorrect token count, got", len(tokens))
+	}
+	checkTokens(tokens, expectedTokens, t)
+}
+
+// test vector and bytevector literals
+func TestVectorTokens(t *testing.T) {
+	tokens, lexErrors := LexExp("#(1 a) #u8(0 255)")
+	if len(lexErrors) != 0 {
+		t.Fatal("Unexpected errors:", lexErrors)
+	}
+	expectedTokens := []*Token{
+		NewTokenString(TokenVectorStart, "#("),
+		NewTokenNum(TokenIntLiteral, "1"),
+		NewTokenString(TokenIdent, "a"),
+		NewTokenString(TokenRParen, ")"),
+		NewTokenString(TokenBytevectorStart, "#u8("),
+		NewTokenNum(TokenIntLiteral, "0"),
+		NewTokenNum(TokenIntLiteral, "255"),
+		NewTokenString(TokenRParen, ")")}
+	if len(tokens) != len(expectedTokens) {
+		t.Fatal("Incorrect token count, got", len(tokens))
+	}
+	checkTokens(tokens, expectedTokens, t)
+}
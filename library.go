@@ -0,0 +1,501 @@
+package schego
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// importSet resolves a name made visible by an import to what it's bound to
+type importSet func(name string) (syntaxBinding, bool)
+
+// library is an R7RS library, defined either in the program itself or in a file
+// found in the search path
+type library struct {
+	Name string
+	// put in front of the names the library defines, to keep them apart from
+	// any other library's
+	prefix string
+	// directory of the file the library was loaded from, if any
+	dir     string
+	exports map[string]syntaxBinding
+	// set while the library is being parsed, to catch libraries importing themselves
+	loading bool
+}
+
+// the extension library files are expected to have
+const libraryExtension = ".sld"
+
+// builtinProcedures lists the procedures built into Schego, under the (scheme
+// ...) library R7RS puts each of them in. (scheme base) also holds the
+// arithmetic and comparison operators, and the special forms.
+var builtinProcedures = map[string][]string{
+	"base": {"car", "cdr", "cons", "eof-object?", "eq?", "eqv?", "features", "list", "newline", "not", "null?",
+		"pair?"},
+	"process-context": {"exit"},
+	"read":            {"read"},
+	"write":           {"display"},
+}
+
+// isBuiltin checks whether a global variable is one of the built-in procedures
+// or operators
+func isBuiltin(name string) bool {
+	if _, ok := operatorArities[name]; ok {
+		return true
+	}
+	for _, procedures := range builtinProcedures {
+		for _, procedure := range procedures {
+			if procedure == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// builtinImports makes the built-in bindings in one of the (scheme ...)
+// libraries visible under their usual names, reporting whether there's such a
+// library at all. Everything in those libraries is already available to
+// programs and libraries alike, so importing one only matters once its names
+// get changed with only, except, prefix or rename.
+func builtinImports(parts []string) (importSet, bool) {
+	procedures, ok := builtinProcedures[strings.Join(parts[1:], " ")]
+	if !ok {
+		return nil, false
+	}
+	names := make(map[string]bool)
+	for _, procedure := range procedures {
+		names[procedure] = true
+	}
+	base := len(parts) == 2 && parts[1] == "base"
+	return func(name string) (syntaxBinding, bool) {
+		if base {
+			if _, ok := operatorArities[name]; ok {
+				return &variableBinding{Name: name, Global: true}, true
+			}
+			// import and define-library aren't part of any library
+			for _, keyword := range specialFormKeywords {
+				if keyword == name && name != "import" && name != "define-library" {
+					return &specialForm{keyword}, true
+				}
+			}
+		}
+		if !names[name] {
+			return nil, false
+		}
+		return &variableBinding{Name: name, Global: true}, true
+	}, true
+}
+
+// libraryName checks the name of a library, such as (scheme base) or (srfi 1),
+// returning its parts
+func libraryName(name Datum) ([]string, error) {
+	elements, err := properList(name, "library name")
+	if err != nil {
+		return nil, err
+	}
+	if len(elements) == 0 {
+		return nil, syntaxError("library name", name)
+	}
+	parts := make([]string, 0)
+	for _, element := range elements {
+		switch part := element.(type) {
+		case *Symbol:
+			parts = append(parts, part.Name)
+		case *IntDatum:
+			if part.Value < 0 {
+				return nil, syntaxError("identifier or exact non-negative integer", element)
+			}
+			parts = append(parts, strconv.FormatInt(part.Value, 10))
+		default:
+			return nil, syntaxError("identifier or exact non-negative integer", element)
+		}
+	}
+	return parts, nil
+}
+
+// libraryFilename gives the path of the file a library is expected to be in,
+// relative to the directories in the search path
+func libraryFilename(parts []string) string {
+	return filepath.Join(parts...) + libraryExtension
+}
+
+// inFile records which file a ParseError happened in, unless it's already known
+func inFile(err error, path string) error {
+	if parseErr, ok := err.(ParseError); ok && parseErr.File == "" {
+		parseErr.File = path
+		return parseErr
+	}
+	return err
+}
+
+// readFile reads every datum in a source file
+func readFile(path string) ([]Datum, error) {
+	source, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tokens, lexErrors := LexExp(string(source))
+	if len(lexErrors) > 0 {
+		lexErr := lexErrors[0]
+		return nil, ParseError{Span: lexErr.Span, Found: lexErr.Kind.String() + " " + lexErr.Text, File: path}
+	}
+	reader := NewDatumReaderTokens(tokens)
+	data := make([]Datum, 0)
+	for {
+		datum, err := reader.Read()
+		if err == io.EOF {
+			return data, nil
+		} else if err != nil {
+			return nil, inFile(err, path)
+		}
+		data = append(data, datum)
+	}
+}
+
+// findFile looks for a file in the search path. Files included by a library
+// loaded from a file are looked for next to it first.
+func findFile(filename string, env *syntaxEnv) (string, bool) {
+	dirs := env.state.searchPath
+	if lib := env.global().library; lib != nil && lib.dir != "" {
+		dirs = append([]string{lib.dir}, dirs...)
+	}
+	if filepath.IsAbs(filename) {
+		dirs = []string{""}
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, filename)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// includeFiles reads the data in each of the files an include names
+func includeFiles(exp Datum, filenames []Datum, env *syntaxEnv) ([]Datum, error) {
+	if len(filenames) == 0 {
+		return nil, syntaxError("file name for include", exp)
+	}
+	data := make([]Datum, 0)
+	for _, filename := range filenames {
+		literal, ok := filename.(*StringDatum)
+		if !ok {
+			return nil, syntaxError("file name", filename)
+		}
+		path, found := findFile(literal.Value, env)
+		if !found {
+			return nil, syntaxError("file in the search path", filename)
+		}
+		fileData, err := readFile(path)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, fileData...)
+	}
+	return data, nil
+}
+
+// parseInclude parses (include "file" ...), whose contents act like they were
+// written inside a begin in place of the include
+func parseInclude(exp Datum, operands []Datum, env *syntaxEnv) (AstNode, error) {
+	data, err := includeFiles(exp, operands, env)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, syntaxError("included files with at least 1 form", exp)
+	}
+	nodes := make([]AstNode, 0)
+	for _, datum := range data {
+		node, err := parseExpression(datum, env)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return NewBeginExp(nodes...), nil
+}
+
+// parseImport parses (import import-set ...), making the names each import set
+// names visible from then on. Libraries getting loaded for the first time end
+// up as the ImportExp's sub-nodes, so their definitions happen before the code
+// importing them runs.
+func parseImport(exp Datum, operands []Datum, env *syntaxEnv) (AstNode, error) {
+	if env.parent != nil {
+		return nil, syntaxError("import at top level", exp)
+	}
+	if len(operands) == 0 {
+		return nil, syntaxError("import set", exp)
+	}
+	sets := make([]string, 0)
+	loaded := make([]AstNode, 0)
+	for _, operand := range operands {
+		imported, setLoaded, err := parseImportSet(operand, env)
+		if err != nil {
+			return nil, err
+		}
+		env.imports = append(env.imports, imported)
+		sets = append(sets, operand.String())
+		loaded = append(loaded, setLoaded...)
+	}
+	return NewImportExp(sets, loaded...), nil
+}
+
+// parseImportSet parses a library name, or an only, except, prefix or rename
+// modifying another import set, returning what the set makes visible along with
+// any libraries it had to load
+func parseImportSet(set Datum, env *syntaxEnv) (importSet, []AstNode, error) {
+	elements, err := properList(set, "import set")
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(elements) < 2 || !isIdentifier(elements[0]) {
+		return loadLibrary(set, env)
+	}
+	// a library can't be named (only (foo)) and so on, since the modifiers take precedence
+	modifier := identifierName(elements[0])
+	if _, ok := elements[1].(*Pair); !ok || (modifier != "only" && modifier != "except" &&
+		modifier != "prefix" && modifier != "rename") {
+		return loadLibrary(set, env)
+	}
+	inner, loaded, err := parseImportSet(elements[1], env)
+	if err != nil {
+		return nil, nil, err
+	}
+	// modifiers can only refer to names the set they modify makes visible
+	checkNames := func(names []Datum) (map[string]bool, error) {
+		nameSet := make(map[string]bool)
+		for _, name := range names {
+			if !isIdentifier(name) {
+				return nil, syntaxError("identifier", name)
+			}
+			if _, ok := inner(identifierName(name)); !ok {
+				return nil, syntaxError("identifier imported by "+elements[1].String(), name)
+			}
+			nameSet[identifierName(name)] = true
+		}
+		return nameSet, nil
+	}
+	switch modifier {
+	case "only", "except":
+		names, err := checkNames(elements[2:])
+		if err != nil {
+			return nil, nil, err
+		}
+		only := modifier == "only"
+		return func(name string) (syntaxBinding, bool) {
+			if names[name] != only {
+				return nil, false
+			}
+			return inner(name)
+		}, loaded, nil
+	case "prefix":
+		if len(elements) != 3 || !isIdentifier(elements[2]) {
+			return nil, nil, syntaxError("(prefix import-set identifier)", set)
+		}
+		prefix := identifierName(elements[2])
+		return func(name string) (syntaxBinding, bool) {
+			if !strings.HasPrefix(name, prefix) {
+				return nil, false
+			}
+			return inner(strings.TrimPrefix(name, prefix))
+		}, loaded, nil
+	}
+	// what's left is rename, mapping each new name to the name it replaces
+	renames := make(map[string]string)
+	oldNames := make([]Datum, 0)
+	for _, rename := range elements[2:] {
+		parts, tail := listElements(rename)
+		if _, ok := tail.(*EmptyList); !ok || len(parts) != 2 || !isIdentifier(parts[1]) {
+			return nil, nil, syntaxError("(old-name new-name) rename", rename)
+		}
+		oldNames = append(oldNames, parts[0])
+		renames[identifierName(parts[1])] = identifierName(parts[0])
+	}
+	renamed, err := checkNames(oldNames)
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(name string) (syntaxBinding, bool) {
+		if oldName, ok := renames[name]; ok {
+			return inner(oldName)
+		}
+		if renamed[name] {
+			return nil, false
+		}
+		return inner(name)
+	}, loaded, nil
+}
+
+// loadLibrary finds the library with the given name, loading it from the search
+// path if it hasn't been defined yet
+func loadLibrary(name Datum, env *syntaxEnv) (importSet, []AstNode, error) {
+	parts, err := libraryName(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parts[0] == "scheme" {
+		imported, ok := builtinImports(parts)
+		if !ok {
+			return nil, nil, syntaxError("built-in library", name)
+		}
+		return imported, nil, nil
+	}
+	loaded := make([]AstNode, 0)
+	lib, ok := env.state.libraries[name.String()]
+	if !ok {
+		path, found := findFile(libraryFilename(parts), env)
+		if !found {
+			return nil, nil, syntaxError("library in the search path", name)
+		}
+		data, err := readFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		// the file should hold the one library, and nothing else
+		if len(data) == 0 {
+			return nil, nil, ParseError{Expected: "define-library form", Found: "EOF", File: path}
+		} else if len(data) > 1 {
+			return nil, nil, inFile(syntaxError("EOF after the library", data[1]), path)
+		}
+		form, ok := data[0].(*Pair)
+		if !ok || identifierName(form.Car) != "define-library" {
+			return nil, nil, inFile(syntaxError("define-library form", data[0]), path)
+		}
+		operands, _ := listElements(form.Cdr)
+		if len(operands) == 0 || operands[0].String() != name.String() {
+			return nil, nil, inFile(syntaxError("definition of library "+name.String(), data[0]), path)
+		}
+		node, err := parseDefineLibrary(data[0], operands, filepath.Dir(path), env.state)
+		if err != nil {
+			return nil, nil, inFile(err, path)
+		}
+		node.SetSpan(data[0].GetSpan())
+		loaded = append(loaded, node)
+		lib = env.state.libraries[name.String()]
+	}
+	if lib.loading {
+		return nil, nil, ParseError{Span: name.GetSpan(), Found: "import cycle through " + lib.Name}
+	}
+	return func(name string) (syntaxBinding, bool) {
+		binding, ok := lib.exports[name]
+		return binding, ok
+	}, loaded, nil
+}
+
+// parseDefineLibrary parses (define-library name declaration ...), with the
+// declarations being export, import, begin, include and cond-expand. Its body gets parsed
+// in a top-level environment of its own, seeing only what it imports along
+// with the built-in bindings.
+func parseDefineLibrary(exp Datum, operands []Datum, dir string, state *parseState) (AstNode, error) {
+	if len(operands) == 0 {
+		return nil, syntaxError("library name", exp)
+	}
+	parts, err := libraryName(operands[0])
+	if err != nil {
+		return nil, err
+	}
+	name := operands[0].String()
+	if _, defined := state.libraries[name]; defined {
+		return nil, syntaxError("library not defined already", operands[0])
+	}
+	lib := &library{Name: name, prefix: strings.Join(parts, "/") + "/", dir: dir,
+		exports: make(map[string]syntaxBinding), loading: true}
+	state.libraries[name] = lib
+	node, err := parseLibraryDeclarations(lib, operands[1:], newTopLevelEnv(state, lib))
+	if err != nil {
+		// forget the library, so that importing it again isn't taken for a cycle
+		delete(state.libraries, name)
+		return nil, err
+	}
+	lib.loading = false
+	return node, nil
+}
+
+// parseLibraryDeclarations parses the declarations making up a library,
+// filling in its exports
+func parseLibraryDeclarations(lib *library, declarations []Datum, env *syntaxEnv) (AstNode, error) {
+	nodes := make([]AstNode, 0)
+	body := make([]Datum, 0)
+	// exported identifiers, with the names they're exported under
+	exports := make([][2]Datum, 0)
+	for len(declarations) > 0 {
+		declaration := declarations[0]
+		declarations = declarations[1:]
+		elements, err := properList(declaration, "library declaration")
+		if err != nil {
+			return nil, err
+		}
+		keyword := ""
+		if len(elements) > 0 && isIdentifier(elements[0]) {
+			keyword = identifierName(elements[0])
+		}
+		switch keyword {
+		case "export":
+			for _, spec := range elements[1:] {
+				if isIdentifier(spec) {
+					exports = append(exports, [2]Datum{spec, spec})
+					continue
+				}
+				specParts, tail := listElements(spec)
+				if _, ok := tail.(*EmptyList); !ok || len(specParts) != 3 || !isIdentifier(specParts[0]) ||
+					identifierName(specParts[0]) != "rename" || !isIdentifier(specParts[1]) || !isIdentifier(specParts[2]) {
+					return nil, syntaxError("identifier or (rename internal external) export", spec)
+				}
+				exports = append(exports, [2]Datum{specParts[1], specParts[2]})
+			}
+		case "import":
+			node, err := parseImport(declaration, elements[1:], env)
+			if err != nil {
+				return nil, err
+			}
+			node.SetSpan(declaration.GetSpan())
+			nodes = append(nodes, node)
+		case "begin":
+			body = append(body, elements[1:]...)
+		case "include":
+			data, err := includeFiles(declaration, elements[1:], env)
+			if err != nil {
+				return nil, err
+			}
+			body = append(body, data...)
+		case "cond-expand":
+			// the chosen clause's declarations take the cond-expand's place,
+			// with there being none if no clause was chosen
+			chosen, _, err := condExpandClause(declaration, elements[1:], env)
+			if err != nil {
+				return nil, err
+			}
+			declarations = append(chosen, declarations...)
+		default:
+			return nil, syntaxError("library declaration", declaration)
+		}
+	}
+	bodyNodes, _, err := parseDefinitions(body, env, false)
+	if err != nil {
+		return nil, err
+	}
+	if errs := env.checkAssignments(); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	exportNames := make([]string, 0)
+	for _, export := range exports {
+		external := identifierName(export[1])
+		if _, exported := lib.exports[external]; exported {
+			return nil, syntaxError("distinct export names", export[1])
+		}
+		// whatever's exported has to be bound by the library, whether it defines
+		// it, imports it or it's built in
+		binding := env.lookup(export[0])
+		if variable, ok := binding.(*variableBinding); ok && !variable.defined && !isBuiltin(variable.Name) {
+			return nil, syntaxError("identifier the library defines or imports", export[0])
+		}
+		lib.exports[external] = binding
+		exportNames = append(exportNames, external)
+	}
+	return NewDefineLibraryExp(lib.Name, exportNames, append(nodes, bodyNodes...)...), nil
+}
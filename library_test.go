@@ -0,0 +1,236 @@
+package schego
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFiles creates a directory holding the given files, keyed by their paths
+// within it
+func writeFiles(files map[string]string, t *testing.T) string {
+	dir, err := ioutil.TempDir("", "schego")
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+	}
+	return dir
+}
+
+// parseWithPath parses the input, failing on any error
+func parseWithPath(input string, searchPath []string, t *testing.T) *Program {
+	tokens, _ := LexExp(input)
+	program, parseErrors := ParseTokensWithPath(tokens, searchPath)
+	if len(parseErrors) != 0 {
+		t.Fatal("Unexpected errors:", parseErrors)
+	}
+	return program
+}
+
+var testLibraries = map[string]string{
+	"foo/bar.sld": `(define-library (foo bar)
+  (export greet (rename helper assist) twice)
+  (import (scheme base))
+  (begin
+    (define (greet) (helper 41))
+    (define (helper x) (+ x 1))
+    (define-syntax twice (syntax-rules () ((_ e) (begin e e))))))`,
+	"foo/baz.sld": `(define-library (foo baz)
+  (export z)
+  (import (foo bar))
+  (include "baz-body.scm"))`,
+	"foo/baz-body.scm": "(define z (assist 1))",
+	"body.scm":         "(define y 2) (display y)",
+}
+
+func TestDefineLibrary(t *testing.T) {
+	dir := writeFiles(testLibraries, t)
+	defer os.RemoveAll(dir)
+	program := parseWithPath(`(import (foo bar))
+(greet)
+(assist 1)
+(twice (greet))
+(define (helper) 0)
+(helper)
+(import (foo bar))`, []string{dir}, t)
+	expected := []string{
+		"ImportExp((foo bar))",
+		"CallExp(foo/bar/greet)",
+		"CallExp(foo/bar/helper, 1)",
+		"MacroUseExp((twice (greet)))",
+		"DefExp(helper, LambdaExp(, 0))",
+		"CallExp(helper)",
+		"ImportExp((foo bar))",
+	}
+	for index, node := range program.GetSubNodes() {
+		if node.DebugString() != expected[index] {
+			t.Error("Incorrect node, got", node.DebugString(), "expected", expected[index])
+		}
+	}
+	// the library gets loaded by the first import only
+	imports := program.GetSubNodes()[0].GetSubNodes()
+	if len(imports) != 1 || len(program.GetSubNodes()[6].GetSubNodes()) != 0 {
+		t.Fatal("Expected the library to be loaded once, got", len(imports))
+	}
+	library := "DefineLibraryExp((foo bar), (greet assist twice), ImportExp((scheme base)), " +
+		"DefExp(foo/bar/greet, LambdaExp(, CallExp(foo/bar/helper, 41))), " +
+		"DefExp(foo/bar/helper, LambdaExp(x, AddExp(x, 1))), DefineSyntaxExp(twice))"
+	if imports[0].DebugString() != library {
+		t.Error("Incorrect library, got", imports[0].DebugString())
+	}
+	// the macro's template refers to the library's bindings
+	expansion := program.GetSubNodes()[3].GetSubNodes()[0]
+	if expansion.DebugString() != "BeginExp(CallExp(foo/bar/greet), CallExp(foo/bar/greet))" {
+		t.Error("Incorrect expansion, got", expansion.DebugString())
+	}
+	// libraries and their includes can be found through other libraries
+	program = parseWithPath("(import (foo baz)) z", []string{dir}, t)
+	loaded := program.GetSubNodes()[0].GetSubNodes()[0]
+	if loaded.DebugString() != "DefineLibraryExp((foo baz), (z), ImportExp((foo bar)), DefExp(foo/baz/z, CallExp(foo/bar/helper, 1)))" {
+		t.Error("Incorrect library, got", loaded.DebugString())
+	}
+	if len(loaded.GetSubNodes()[0].GetSubNodes()) != 1 {
+		t.Error("Expected (foo baz) to load (foo bar)")
+	}
+	if program.GetSubNodes()[1].DebugString() != "foo/baz/z" {
+		t.Error("Incorrect reference, got", program.GetSubNodes()[1].DebugString())
+	}
+}
+
+func TestImportSets(t *testing.T) {
+	dir := writeFiles(testLibraries, t)
+	defer os.RemoveAll(dir)
+	program := parseWithPath(`(import (prefix (only (foo bar) greet) f:)
+        (rename (except (foo bar) twice) (greet hello)))
+(f:greet)
+(hello)
+(greet)
+(twice 1)
+(import (prefix (scheme base) s:))
+(s:if (s:car x) 1 2)
+(define-library (c) (import (only (scheme write) display)) (export display (rename car first)))
+(import (c))
+(first (display 1))`, []string{dir}, t)
+	expected := []string{
+		"ImportExp((prefix (only (foo bar) greet) f:), (rename (except (foo bar) twice) (greet hello)))",
+		"CallExp(foo/bar/greet)",
+		"CallExp(foo/bar/greet)",
+		"CallExp(greet)",
+		"CallExp(twice, 1)",
+		"ImportExp((prefix (scheme base) s:))",
+		"IfExp(CallExp(car, x), 1, 2)",
+		"DefineLibraryExp((c), (display first), ImportExp((only (scheme write) display)))",
+		"ImportExp((c))",
+		"CallExp(car, CallExp(display, 1))",
+	}
+	for index, node := range program.GetSubNodes() {
+		if node.DebugString() != expected[index] {
+			t.Error("Incorrect node, got", node.DebugString(), "expected", expected[index])
+		}
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := writeFiles(testLibraries, t)
+	defer os.RemoveAll(dir)
+	program := parseWithPath(`(include "body.scm")
+(define-library (local) (export w) (begin (define w 3)))
+(import (local))
+w`, []string{dir}, t)
+	expected := []string{
+		"BeginExp(DefExp(y, 2), CallExp(display, y))",
+		"DefineLibraryExp((local), (w), DefExp(local/w, 3))",
+		"ImportExp((local))",
+		"local/w",
+	}
+	for index, node := range program.GetSubNodes() {
+		if node.DebugString() != expected[index] {
+			t.Error("Incorrect node, got", node.DebugString(), "expected", expected[index])
+		}
+	}
+}
+
+func TestCompileLibraries(t *testing.T) {
+	dir := writeFiles(testLibraries, t)
+	defer os.RemoveAll(dir)
+	tests := map[string]string{
+		"(import (foo baz) (foo bar)) (twice (greet)) (display (list (greet) z))": "(42 2)",
+		`(define-library (counter) (export next!) (import (scheme base))
+  (begin (define n 0) (define (next!) (set! n (+ n 1)) n)))
+(import (counter))
+(next!)
+(display (next!))`: "2",
+	}
+	for source, expected := range tests {
+		opcodes, err := Compile(parseWithPath(source, []string{dir}, t))
+		if err != nil {
+			t.Fatalf("unexpected compile error for %s: %v", source, err)
+		}
+		console := DummyConsole{}
+		RunVM(opcodes, &console)
+		if console.consoleOutput != expected {
+			t.Errorf("%s printed %q, expected %q", source, console.consoleOutput, expected)
+		}
+	}
+}
+
+func TestLibraryErrors(t *testing.T) {
+	files := map[string]string{
+		"a.sld":   "(define-library (a) (import (b)))",
+		"b.sld":   "(define-library (b) (import (a)))",
+		"bad.sld": "(define-library (bad) (begin (if)))",
+		"two.sld": "(define-library (two)) (define x 1)",
+	}
+	for name, contents := range testLibraries {
+		files[name] = contents
+	}
+	dir := writeFiles(files, t)
+	defer os.RemoveAll(dir)
+	inputs := []string{
+		"(import (missing))",
+		"(import (a))",
+		"(import (bad))",
+		"(import (two))",
+		"(import (only (foo bar) missing))",
+		"(import (rename (foo bar) (twice)))",
+		"(import (prefix (foo bar)))",
+		"(import (foo 1.5))",
+		"(import)",
+		"(lambda () (import (foo bar)) 1)",
+		"(define-library (c) (export x x) (begin (define x 1)))",
+		"(define-library (c) (export (rename x)) (begin (define x 1)))",
+		"(define-library (c) (frobnicate))",
+		"(define-library (c) (export y) (begin (define x 1)))",
+		"(define-library (c) (export x) (begin (define x 1) (set! y 2)))",
+		"(import (only (scheme base) no-such-thing))",
+		"(import (scheme no-such-library))",
+		"(import (foo bar)) (define-library (foo bar))",
+		"(include \"missing.scm\")",
+		"(include body.scm)",
+	}
+	for _, input := range inputs {
+		tokens, _ := LexExp(input)
+		if _, parseErrors := ParseTokensWithPath(tokens, []string{dir}); len(parseErrors) != 1 {
+			t.Error("Expected an error parsing", input, "got", parseErrors)
+		}
+	}
+	// errors within library files say which file they're in
+	tokens, _ := LexExp("(import (bad))")
+	_, parseErrors := ParseTokensWithPath(tokens, []string{dir})
+	if len(parseErrors) != 1 || !strings.HasSuffix(parseErrors[0].File, "bad.sld") {
+		t.Fatal("Expected an error in bad.sld, got", parseErrors)
+	}
+	if !strings.Contains(parseErrors[0].Error(), "bad.sld:1:30") {
+		t.Error("Incorrect error message, got", parseErrors[0].Error())
+	}
+}
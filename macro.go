@@ -0,0 +1,747 @@
+package schego
+
+import (
+	"reflect"
+	"strconv"
+)
+
+// Alias stands in for an identifier that a macro template introduced into an
+// expansion. Every expansion gets fresh aliases, so a binding one introduces
+// can't capture the user's variables of the same name, and an alias that the
+// expansion doesn't bind itself means whatever its identifier meant where the
+// macro was defined.
+type Alias struct {
+	datumBase
+	// the identifier the template held, which is a Symbol or another Alias
+	Identifier Datum
+	env        *syntaxEnv
+}
+
+// String writes the alias out as the symbol it was renamed from
+func (a *Alias) String() string {
+	return a.Identifier.String()
+}
+
+// isIdentifier checks whether the datum is a symbol or an alias for one
+func isIdentifier(datum Datum) bool {
+	switch datum.(type) {
+	case *Symbol, *Alias:
+		return true
+	}
+	return false
+}
+
+// identifierName returns the name of the symbol an identifier stands for
+func identifierName(datum Datum) string {
+	for {
+		switch identifier := datum.(type) {
+		case *Symbol:
+			return identifier.Name
+		case *Alias:
+			datum = identifier.Identifier
+		default:
+			return ""
+		}
+	}
+}
+
+// identifierKey returns what an identifier gets bound under: symbols by name,
+// and aliases by identity, so that each alias is distinct from every other
+func identifierKey(datum Datum) interface{} {
+	if alias, ok := datum.(*Alias); ok {
+		return alias
+	}
+	return identifierName(datum)
+}
+
+// syntaxBinding is whatever an identifier can be bound to while parsing: a
+// *variableBinding, *specialForm or *macro
+type syntaxBinding interface{}
+
+// variableBinding is a variable, with Name being what it goes by in the AST.
+// That's the name it was written with unless an alias introduced it or it
+// shadows another local variable, in which case it gets a unique name.
+type variableBinding struct {
+	Name   string
+	Global bool
+	// whether the program binds the variable itself, rather than it being
+	// left to the built-in procedures
+	defined bool
+}
+
+// specialForm is one of the forms built into the parser, such as if or lambda
+type specialForm struct {
+	Keyword string
+}
+
+// the keywords of the forms built into the parser
+var specialFormKeywords = []string{
+	"if", "define", "set!", "lambda", "quote", "quasiquote", "unquote", "unquote-splicing",
+	"let", "let*", "letrec", "letrec*", "let-values", "let*-values",
+	"cond", "case", "and", "or", "when", "unless", "begin", "do",
+	"define-syntax", "let-syntax", "letrec-syntax", "syntax-rules", "define-record-type",
+	"define-library", "import", "include", "cond-expand",
+}
+
+// how deeply macro uses can nest before expansion is assumed to never finish
+const maxExpansionDepth = 1000
+
+// parseState is shared by every syntaxEnv created while parsing a program
+type parseState struct {
+	// how many variables have been given unique names
+	renames int
+	// how many macro expansions are currently being parsed
+	expansionDepth int
+	// directories searched for libraries and included files, in order
+	searchPath []string
+	// every library defined or loaded so far, by name
+	libraries map[string]*library
+}
+
+// syntaxEnv maps identifiers to what they mean at some point in the program.
+// Each binding construct gets its own environment, extending the one around it.
+type syntaxEnv struct {
+	parent   *syntaxEnv
+	bindings map[interface{}]syntaxBinding
+	state    *parseState
+	// only set for top-level environments: the library being defined, if any,
+	// and what's been imported into it
+	library *library
+	imports []importSet
+	// every set! of a global that hadn't been defined when it was parsed, which
+	// can only be checked once everything that could define it has been
+	assignments []assignment
+}
+
+// assignment is a set! of a global, along with the identifier it assigns to
+type assignment struct {
+	variable *variableBinding
+	target   Datum
+}
+
+// checkAssignments gives an error for each set! of a global that's never defined
+func (e *syntaxEnv) checkAssignments() []error {
+	errs := make([]error, 0)
+	for _, assigned := range e.global().assignments {
+		if !assigned.variable.defined {
+			errs = append(errs, syntaxError("defined variable", assigned.target))
+		}
+	}
+	return errs
+}
+
+// newGlobalEnv creates the top-level environment of a program, holding the
+// special forms
+func newGlobalEnv() *syntaxEnv {
+	state := &parseState{searchPath: []string{"."}, libraries: make(map[string]*library)}
+	return newTopLevelEnv(state, nil)
+}
+
+// newTopLevelEnv creates the top-level environment of a program or library
+func newTopLevelEnv(state *parseState, lib *library) *syntaxEnv {
+	env := &syntaxEnv{bindings: make(map[interface{}]syntaxBinding), state: state, library: lib}
+	for _, keyword := range specialFormKeywords {
+		env.bindings[keyword] = &specialForm{keyword}
+	}
+	return env
+}
+
+// extend creates a new environment nested within this one
+func (e *syntaxEnv) extend() *syntaxEnv {
+	return &syntaxEnv{parent: e, bindings: make(map[interface{}]syntaxBinding), state: e.state}
+}
+
+func (e *syntaxEnv) global() *syntaxEnv {
+	env := e
+	for env.parent != nil {
+		env = env.parent
+	}
+	return env
+}
+
+// lookup finds what an identifier means here
+func (e *syntaxEnv) lookup(identifier Datum) syntaxBinding {
+	key := identifierKey(identifier)
+	for env := e; env != nil; env = env.parent {
+		if binding, ok := env.bindings[key]; ok {
+			return binding
+		}
+	}
+	// an alias nothing in the expansion bound means what its identifier meant
+	// where the macro was defined
+	if alias, ok := identifier.(*Alias); ok {
+		return alias.env.lookup(alias.Identifier)
+	}
+	global := e.global()
+	for _, imported := range global.imports {
+		if binding, ok := imported(key.(string)); ok {
+			global.bindings[key] = binding
+			return binding
+		}
+	}
+	// anything else that's unbound is a global variable, whether or not it's
+	// been defined yet
+	binding := &variableBinding{Name: key.(string), Global: true}
+	global.bindings[key] = binding
+	return binding
+}
+
+// sameBinding checks whether two bindings mean the same thing. Every top-level
+// environment has its own bindings for special forms and undefined globals, so
+// those are compared by name.
+func sameBinding(first syntaxBinding, second syntaxBinding) bool {
+	switch firstBinding := first.(type) {
+	case *specialForm:
+		secondBinding, ok := second.(*specialForm)
+		return ok && firstBinding.Keyword == secondBinding.Keyword
+	case *variableBinding:
+		secondBinding, ok := second.(*variableBinding)
+		if ok && firstBinding.Global && secondBinding.Global {
+			return firstBinding.Name == secondBinding.Name
+		}
+	}
+	return first == second
+}
+
+// bindVariable binds an identifier to a new variable in this environment
+func (e *syntaxEnv) bindVariable(identifier Datum) *variableBinding {
+	name := identifierName(identifier)
+	if _, isAlias := identifier.(*Alias); isAlias || e.shadowsLocal(name) {
+		e.state.renames++
+		name += "." + strconv.Itoa(e.state.renames)
+	}
+	// a library's definitions get its name in front, so they can't clash with
+	// those of the program or any other library
+	if e.parent == nil && e.library != nil {
+		name = e.library.prefix + name
+	}
+	binding := &variableBinding{Name: name, Global: e.parent == nil, defined: true}
+	e.bindings[identifierKey(identifier)] = binding
+	return binding
+}
+
+// defineVariable returns the variable an identifier is bound to in this very
+// environment, binding a new one if there's none yet
+func (e *syntaxEnv) defineVariable(identifier Datum) *variableBinding {
+	if binding, ok := e.bindings[identifierKey(identifier)].(*variableBinding); ok {
+		binding.defined = true
+		return binding
+	}
+	return e.bindVariable(identifier)
+}
+
+// shadowsLocal checks whether a local variable visible from here already goes
+// by the given name in the AST. Giving the new variable a unique name instead
+// means a macro can still refer to the outer one.
+func (e *syntaxEnv) shadowsLocal(name string) bool {
+	for env := e; env.parent != nil; env = env.parent {
+		for _, binding := range env.bindings {
+			if variable, ok := binding.(*variableBinding); ok && variable.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// macro is a syntax-rules transformer, along with the environment it was
+// defined in, which is where the identifiers its templates introduce get
+// looked up
+type macro struct {
+	Name     string
+	ellipsis Datum
+	literals []Datum
+	rules    []syntaxRule
+	env      *syntaxEnv
+}
+
+type syntaxRule struct {
+	pattern  Datum
+	template Datum
+}
+
+// parseSyntaxRules parses a (syntax-rules ...) transformer spec
+func parseSyntaxRules(name string, spec Datum, env *syntaxEnv) (*macro, error) {
+	elements, err := properList(spec, "syntax-rules transformer")
+	if err != nil {
+		return nil, err
+	}
+	if len(elements) == 0 || !isIdentifier(elements[0]) {
+		return nil, syntaxError("syntax-rules transformer", spec)
+	}
+	if form, ok := env.lookup(elements[0]).(*specialForm); !ok || form.Keyword != "syntax-rules" {
+		return nil, syntaxError("syntax-rules transformer", spec)
+	}
+	transformer := &macro{Name: name, env: env}
+	transformer.ellipsis = NewSymbol("...")
+	operands := elements[1:]
+	// a custom ellipsis comes before the literals
+	if len(operands) > 0 && isIdentifier(operands[0]) {
+		transformer.ellipsis = operands[0]
+		operands = operands[1:]
+	}
+	if len(operands) == 0 {
+		return nil, syntaxError("literals for syntax-rules", spec)
+	}
+	literals, err := properList(operands[0], "list of literals")
+	if err != nil {
+		return nil, err
+	}
+	for _, literal := range literals {
+		if !isIdentifier(literal) {
+			return nil, syntaxError("literal identifier", literal)
+		}
+		// listing the ellipsis as a literal makes it match itself instead
+		if identifierKey(literal) == identifierKey(transformer.ellipsis) {
+			transformer.ellipsis = nil
+		}
+	}
+	transformer.literals = literals
+	for _, rule := range operands[1:] {
+		parts, err := properList(rule, "(pattern template) rule")
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) != 2 {
+			return nil, syntaxError("(pattern template) rule", rule)
+		}
+		pattern, ok := parts[0].(*Pair)
+		if !ok {
+			return nil, syntaxError("list pattern", parts[0])
+		}
+		transformer.rules = append(transformer.rules, syntaxRule{pattern, parts[1]})
+	}
+	return transformer, nil
+}
+
+// isEllipsis checks whether an identifier is the macro's ellipsis. They're compared
+// by what they're bound to where the macro was defined, since the ellipsis of a
+// macro that another macro's template defined comes from the template as an alias.
+// Identifiers can only be bound to the same thing if they have the same name.
+func (m *macro) isEllipsis(datum Datum) bool {
+	return m.ellipsis != nil && isIdentifier(datum) && identifierName(datum) == identifierName(m.ellipsis) &&
+		sameBinding(m.env.lookup(datum), m.env.lookup(m.ellipsis))
+}
+
+func (m *macro) isLiteral(datum Datum) bool {
+	for _, literal := range m.literals {
+		if identifierKey(literal) == identifierKey(datum) {
+			return true
+		}
+	}
+	return false
+}
+
+// expand transcribes a use of the macro, using the first rule whose pattern
+// matches it
+func (m *macro) expand(form *Pair, useEnv *syntaxEnv) (Datum, error) {
+	for _, rule := range m.rules {
+		bindings := make(matchBindings)
+		// the keyword position of the pattern is ignored
+		if !m.match(rule.pattern.(*Pair).Cdr, form.Cdr, useEnv, bindings) {
+			continue
+		}
+		t := &transcriber{m, make(map[interface{}]*Alias), form.GetSpan()}
+		return t.transcribe(rule.template, bindings, false)
+	}
+	return nil, syntaxError("form matching a rule of "+m.Name, form)
+}
+
+// patternMatch is what a pattern variable matched: a single datum, or for a
+// variable following an ellipsis, one match per repetition
+type patternMatch struct {
+	datum    Datum
+	repeated bool
+	repeats  []*patternMatch
+}
+
+// matchBindings maps pattern variables, by identifierKey, to what they matched
+type matchBindings map[interface{}]*patternMatch
+
+// match checks whether the form matches the pattern, recording what each
+// pattern variable matched in bindings
+func (m *macro) match(pattern Datum, form Datum, useEnv *syntaxEnv, bindings matchBindings) bool {
+	switch p := pattern.(type) {
+	case *Symbol, *Alias:
+		if m.isLiteral(p) {
+			// literals match identifiers meaning the same thing
+			return isIdentifier(form) && sameBinding(useEnv.lookup(form), m.env.lookup(p))
+		}
+		if identifierName(p) != "_" {
+			bindings[identifierKey(p)] = &patternMatch{datum: form}
+		}
+		return true
+	case *Pair:
+		patternElements, patternTail := listElements(p)
+		formElements, formTail := listElements(form)
+		return m.matchSequence(patternElements, patternTail, formElements, formTail, useEnv, bindings)
+	case *Vector:
+		v, ok := form.(*Vector)
+		if !ok {
+			return false
+		}
+		return m.matchSequence(p.Elements, NewEmptyList(), v.Elements, NewEmptyList(), useEnv, bindings)
+	case *EmptyList:
+		_, ok := form.(*EmptyList)
+		return ok
+	}
+	// anything else has to be the very same datum
+	return !isIdentifier(form) && form.String() == pattern.String() && sameDatumType(form, pattern)
+}
+
+// matchSequence matches the elements of a list or vector, which may contain an
+// ellipsis, followed by whatever terminates it
+func (m *macro) matchSequence(patterns []Datum, patternTail Datum, forms []Datum, formTail Datum, useEnv *syntaxEnv, bindings matchBindings) bool {
+	ellipsisIndex := -1
+	for index := 1; index < len(patterns); index++ {
+		if m.isEllipsis(patterns[index]) {
+			ellipsisIndex = index - 1
+			break
+		}
+	}
+	if ellipsisIndex == -1 {
+		if len(forms) < len(patterns) {
+			return false
+		}
+		for index, pattern := range patterns {
+			if !m.match(pattern, forms[index], useEnv, bindings) {
+				return false
+			}
+		}
+		// the tail of the pattern matches whatever's left of the form
+		return m.match(patternTail, NewDottedList(formTail, forms[len(patterns):]...), useEnv, bindings)
+	}
+	before := patterns[:ellipsisIndex]
+	repeated := patterns[ellipsisIndex]
+	after := patterns[ellipsisIndex+2:]
+	repeats := len(forms) - len(before) - len(after)
+	if repeats < 0 {
+		return false
+	}
+	for index, pattern := range before {
+		if !m.match(pattern, forms[index], useEnv, bindings) {
+			return false
+		}
+	}
+	matches := make([]matchBindings, 0)
+	for _, form := range forms[len(before) : len(before)+repeats] {
+		repeatBindings := make(matchBindings)
+		if !m.match(repeated, form, useEnv, repeatBindings) {
+			return false
+		}
+		matches = append(matches, repeatBindings)
+	}
+	for _, variable := range m.patternVariables(repeated) {
+		match := &patternMatch{repeated: true}
+		for _, repeatBindings := range matches {
+			match.repeats = append(match.repeats, repeatBindings[variable])
+		}
+		bindings[variable] = match
+	}
+	for index, pattern := range after {
+		if !m.match(pattern, forms[len(before)+repeats+index], useEnv, bindings) {
+			return false
+		}
+	}
+	return m.match(patternTail, formTail, useEnv, bindings)
+}
+
+// patternVariables lists the keys of the pattern variables within a pattern
+func (m *macro) patternVariables(pattern Datum) []interface{} {
+	switch p := pattern.(type) {
+	case *Symbol, *Alias:
+		if m.isLiteral(p) || m.isEllipsis(p) || identifierName(p) == "_" {
+			return nil
+		}
+		return []interface{}{identifierKey(p)}
+	case *Pair:
+		return append(m.patternVariables(p.Car), m.patternVariables(p.Cdr)...)
+	case *Vector:
+		variables := make([]interface{}, 0)
+		for _, element := range p.Elements {
+			variables = append(variables, m.patternVariables(element)...)
+		}
+		return variables
+	}
+	return nil
+}
+
+// sameDatumType checks that two data are of the same type, so that the string
+// 1 doesn't match the number 1
+func sameDatumType(a Datum, b Datum) bool {
+	switch a.(type) {
+	case *IntDatum:
+		_, ok := b.(*IntDatum)
+		return ok
+	case *FloatDatum:
+		_, ok := b.(*FloatDatum)
+		return ok
+	case *RationalDatum:
+		_, ok := b.(*RationalDatum)
+		return ok
+	case *StringDatum:
+		_, ok := b.(*StringDatum)
+		return ok
+	case *BoolDatum:
+		_, ok := b.(*BoolDatum)
+		return ok
+	case *CharDatum:
+		_, ok := b.(*CharDatum)
+		return ok
+	case *Bytevector:
+		_, ok := b.(*Bytevector)
+		return ok
+	}
+	return false
+}
+
+// transcriber fills in a template for one use of a macro
+type transcriber struct {
+	macro *macro
+	// the alias each identifier the template introduces gets, by identifierKey
+	aliases map[interface{}]*Alias
+	// where the macro was used, which is where everything the template
+	// introduces is considered to come from
+	span Span
+}
+
+// transcribe fills in the template using the pattern variable bindings. escaped
+// is set within (... ...), where ellipses are just identifiers.
+func (t *transcriber) transcribe(template Datum, bindings matchBindings, escaped bool) (Datum, error) {
+	switch tmpl := template.(type) {
+	case *Symbol, *Alias:
+		if match, ok := bindings[identifierKey(tmpl)]; ok {
+			if match.repeated {
+				return nil, syntaxError("ellipsis following pattern variable", tmpl)
+			}
+			return match.datum, nil
+		}
+		if !escaped && t.macro.isEllipsis(tmpl) {
+			return nil, syntaxError("template element before ellipsis", tmpl)
+		}
+		alias, ok := t.aliases[identifierKey(tmpl)]
+		if !ok {
+			alias = &Alias{Identifier: tmpl, env: t.macro.env}
+			alias.SetSpan(t.span)
+			t.aliases[identifierKey(tmpl)] = alias
+		}
+		return alias, nil
+	case *Pair:
+		elements, tail := listElements(tmpl)
+		// (... template) escapes the ellipsis within the template
+		if !escaped && t.macro.isEllipsis(elements[0]) {
+			if _, ok := tail.(*EmptyList); !ok || len(elements) != 2 {
+				return nil, syntaxError("(... template) escape", tmpl)
+			}
+			return t.transcribe(elements[1], bindings, true)
+		}
+		transcribed, err := t.transcribeSequence(elements, bindings, escaped)
+		if err != nil {
+			return nil, err
+		}
+		transcribedTail, err := t.transcribe(tail, bindings, escaped)
+		if err != nil {
+			return nil, err
+		}
+		list := NewDottedList(transcribedTail, transcribed...)
+		for pair, ok := list.(*Pair); ok; pair, ok = pair.Cdr.(*Pair) {
+			pair.SetSpan(t.span)
+		}
+		return list, nil
+	case *Vector:
+		transcribed, err := t.transcribeSequence(tmpl.Elements, bindings, escaped)
+		if err != nil {
+			return nil, err
+		}
+		vector := NewVector(transcribed...)
+		vector.SetSpan(t.span)
+		return vector, nil
+	case *EmptyList:
+		list := NewEmptyList()
+		list.SetSpan(t.span)
+		return list, nil
+	}
+	return template, nil
+}
+
+// transcribeSequence fills in the elements of a list or vector template, any of
+// which can be followed by ellipses
+func (t *transcriber) transcribeSequence(elements []Datum, bindings matchBindings, escaped bool) ([]Datum, error) {
+	transcribed := make([]Datum, 0)
+	for index := 0; index < len(elements); index++ {
+		depth := 0
+		for !escaped && index+depth+1 < len(elements) && t.macro.isEllipsis(elements[index+depth+1]) {
+			depth++
+		}
+		if depth == 0 {
+			element, err := t.transcribe(elements[index], bindings, escaped)
+			if err != nil {
+				return nil, err
+			}
+			transcribed = append(transcribed, element)
+			continue
+		}
+		repeated, err := t.transcribeRepeated(elements[index], bindings, depth)
+		if err != nil {
+			return nil, err
+		}
+		transcribed = append(transcribed, repeated...)
+		index += depth
+	}
+	return transcribed, nil
+}
+
+// transcribeRepeated fills in a template followed by depth ellipses, once for
+// each repetition of the pattern variables within it
+func (t *transcriber) transcribeRepeated(template Datum, bindings matchBindings, depth int) ([]Datum, error) {
+	repeats := -1
+	variables := make([]interface{}, 0)
+	for _, variable := range t.templateVariables(template, bindings) {
+		match := bindings[variable]
+		if !match.repeated {
+			continue
+		}
+		if repeats != -1 && len(match.repeats) != repeats {
+			return nil, syntaxError("pattern variables repeating the same number of times", template)
+		}
+		repeats = len(match.repeats)
+		variables = append(variables, variable)
+	}
+	if repeats == -1 {
+		return nil, syntaxError("pattern variable before ellipsis", template)
+	}
+	transcribed := make([]Datum, 0)
+	for index := 0; index < repeats; index++ {
+		repeatBindings := make(matchBindings)
+		for variable, match := range bindings {
+			repeatBindings[variable] = match
+		}
+		for _, variable := range variables {
+			repeatBindings[variable] = bindings[variable].repeats[index]
+		}
+		if depth > 1 {
+			repeated, err := t.transcribeRepeated(template, repeatBindings, depth-1)
+			if err != nil {
+				return nil, err
+			}
+			transcribed = append(transcribed, repeated...)
+			continue
+		}
+		element, err := t.transcribe(template, repeatBindings, false)
+		if err != nil {
+			return nil, err
+		}
+		transcribed = append(transcribed, element)
+	}
+	return transcribed, nil
+}
+
+// templateVariables lists the pattern variables used within a template
+func (t *transcriber) templateVariables(template Datum, bindings matchBindings) []interface{} {
+	switch tmpl := template.(type) {
+	case *Symbol, *Alias:
+		if _, ok := bindings[identifierKey(tmpl)]; ok {
+			return []interface{}{identifierKey(tmpl)}
+		}
+	case *Pair:
+		return append(t.templateVariables(tmpl.Car, bindings), t.templateVariables(tmpl.Cdr, bindings)...)
+	case *Vector:
+		variables := make([]interface{}, 0)
+		for _, element := range tmpl.Elements {
+			variables = append(variables, t.templateVariables(element, bindings)...)
+		}
+		return variables
+	}
+	return nil
+}
+
+// expandHead expands the datum for as long as it's a macro use, returning what
+// it finally expands into along with each of the uses along the way
+func expandHead(datum Datum, env *syntaxEnv) (Datum, []Datum, error) {
+	uses := make([]Datum, 0)
+	for {
+		pair, ok := datum.(*Pair)
+		if !ok || !isIdentifier(pair.Car) {
+			return datum, uses, nil
+		}
+		transformer, ok := env.lookup(pair.Car).(*macro)
+		if !ok {
+			return datum, uses, nil
+		}
+		if len(uses) == maxExpansionDepth {
+			return nil, nil, syntaxError("macro expansion to finish", datum)
+		}
+		expanded, err := transformer.expand(pair, env)
+		if err != nil {
+			return nil, nil, err
+		}
+		uses = append(uses, datum)
+		datum = expanded
+	}
+}
+
+// wrapMacroUses wraps the node parsed from a macro expansion in a MacroUseExp
+// for each of the uses it was expanded from, outermost first
+func wrapMacroUses(node AstNode, uses []Datum) AstNode {
+	for index := len(uses) - 1; index >= 0; index-- {
+		use := NewMacroUseExp(uses[index], node)
+		use.SetSpan(uses[index].GetSpan())
+		node = use
+	}
+	return node
+}
+
+// ExpandOnce gives a copy of the tree with each outermost macro use replaced by
+// what it expanded into, leaving any macro uses within those expansions for a
+// later step. The tree passed in is left as it was.
+//
+// The parser expands every macro use as it goes, so this can't rerun a single
+// expansion step: it only peels the outermost layer of MacroUseExp markers off a
+// tree that's already fully expanded. What shows through is each expansion as the
+// parser made sense of it, with its variables already renamed, rather than the
+// raw output of the macro's template. The macro uses nested inside each expansion
+// keep their markers until the next call.
+func ExpandOnce(node AstNode) (AstNode, error) {
+	return expandUses(node, false)
+}
+
+// Expand gives a copy of the tree with every macro use replaced by what it
+// expanded into, leaving only the forms the parser knows about. Like ExpandOnce,
+// the tree passed in is left as it was.
+func Expand(node AstNode) (AstNode, error) {
+	return expandUses(node, true)
+}
+
+// expandUses copies the tree without the MacroUseExps in it, either all of them or
+// just the outermost ones
+func expandUses(node AstNode, all bool) (AstNode, error) {
+	if use, ok := node.(*MacroUseExp); ok {
+		if len(use.subNodes) != 1 || use.subNodes[0] == nil {
+			return nil, syntaxError("macro use with an expansion", use.Form)
+		}
+		if !all {
+			return use.subNodes[0], nil
+		}
+		return expandUses(use.subNodes[0], all)
+	}
+	subNodes := make([]AstNode, 0, len(node.GetSubNodes()))
+	for _, subNode := range node.GetSubNodes() {
+		expanded, err := expandUses(subNode, all)
+		if err != nil {
+			return nil, err
+		}
+		subNodes = append(subNodes, expanded)
+	}
+	copied := copyNode(node)
+	copied.(interface{ setSubNodes([]AstNode) }).setSubNodes(subNodes)
+	return copied, nil
+}
+
+// copyNode makes a shallow copy of a node, which still shares its subnodes with
+// the original until they're replaced
+func copyNode(node AstNode) AstNode {
+	original := reflect.ValueOf(node).Elem()
+	copied := reflect.New(original.Type())
+	copied.Elem().Set(original)
+	return copied.Interface().(AstNode)
+}
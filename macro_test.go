@@ -0,0 +1,259 @@
+package schego
+
+import (
+	"testing"
+)
+
+// parseProgram lexes and parses the input, failing on any error
+func parseProgram(input string, t *testing.T) *Program {
+	tokens, _ := LexExp(input)
+	program, parseErrors := ParseTokens(tokens)
+	if len(parseErrors) != 0 {
+		t.Fatal("Unexpected errors:", parseErrors)
+	}
+	return program
+}
+
+// checkExpansion checks what the macro use at the given index of the program
+// expanded into
+func checkExpansion(program *Program, index int, expected string, t *testing.T) {
+	use, ok := program.GetSubNodes()[index].(*MacroUseExp)
+	if !ok {
+		t.Fatal("Expected a macro use, got", program.GetSubNodes()[index].DebugString())
+	}
+	if use.GetSubNodes()[0].DebugString() != expected {
+		t.Error("Incorrect expansion of", use.Form.String(), "got:\n"+use.GetSubNodes()[0].DebugString()+"\nexpected:\n"+expected)
+	}
+}
+
+func TestSyntaxRules(t *testing.T) {
+	program := parseProgram(`(define-syntax swap!
+  (syntax-rules ()
+    ((_ a b) (let ((tmp a)) (set! a b) (set! b tmp)))))
+(swap! x y)
+(let ((tmp 1) (other 2)) (swap! tmp other))
+(define x 1)
+(define y 2)`, t)
+	if program.GetSubNodes()[0].DebugString() != "DefineSyntaxExp(swap!)" {
+		t.Error("Incorrect definition, got", program.GetSubNodes()[0].DebugString())
+	}
+	if program.GetSubNodes()[1].DebugString() != "MacroUseExp((swap! x y))" {
+		t.Error("Incorrect macro use, got", program.GetSubNodes()[1].DebugString())
+	}
+	// the tmp the template introduces gets renamed, so it can't capture the user's tmp
+	checkExpansion(program, 1, "LetExp((tmp.1 x), SetExp(x, y), SetExp(y, tmp.1))", t)
+	let := program.GetSubNodes()[2].(*LetExp)
+	use := let.Body()[0].(*MacroUseExp)
+	expected := "LetExp((tmp.2 tmp), SetExp(tmp, other), SetExp(other, tmp.2))"
+	if use.GetSubNodes()[0].DebugString() != expected {
+		t.Error("Incorrect expansion, got", use.GetSubNodes()[0].DebugString())
+	}
+}
+
+func TestMacroHygiene(t *testing.T) {
+	program := parseProgram(`(define-syntax my-or
+  (syntax-rules ()
+    ((_) #f)
+    ((_ e) e)
+    ((_ e r ...) (let ((t e)) (if t t (my-or r ...))))))
+(let ((if list) (t 5)) (my-or #f t))
+(define-syntax say (syntax-rules () ((_ x) (display x))))
+(lambda (display) (say display))`, t)
+	// the template's if still means if, and its t doesn't capture the user's
+	let := program.GetSubNodes()[1].(*LetExp)
+	expansion := let.Body()[0].GetSubNodes()[0]
+	if expansion.DebugString() != "LetExp((t.1 false), IfExp(t.1, t.1, MacroUseExp((my-or t))))" {
+		t.Error("Incorrect expansion, got", expansion.DebugString())
+	}
+	inner := expansion.(*LetExp).Body()[0].GetSubNodes()[2].GetSubNodes()[0]
+	if inner.DebugString() != "t" {
+		t.Error("Incorrect inner expansion, got", inner.DebugString())
+	}
+	// the template's display is still the global one
+	lambda := program.GetSubNodes()[3].(*LambdaExp)
+	call := lambda.GetSubNodes()[0].GetSubNodes()[0].(*CallExp)
+	operator := call.GetSubNodes()[0].(*IdentExp)
+	arg := call.GetSubNodes()[1].(*IdentExp)
+	if !operator.Global || arg.Global {
+		t.Error("Expected only the template's display to be global, got", operator.Global, arg.Global)
+	}
+}
+
+func TestMacroEllipsis(t *testing.T) {
+	program := parseProgram(`(define-syntax my-let
+  (syntax-rules ()
+    ((_ ((name val) ...) body1 body2 ...) ((lambda (name ...) body1 body2 ...) val ...))))
+(my-let ((a 1) (b 2)) (+ a b))
+(define-syntax my-cond
+  (syntax-rules (else)
+    ((_ (else e ...)) (begin e ...))
+    ((_ (c e ...) clause ...) (if c (begin e ...) (my-cond clause ...)))))
+(my-cond (x 1 2) (else 3))
+(define-syntax flatten
+  (syntax-rules ()
+    ((_ (a ...) ...) '(a ... ...))))
+(flatten (1 2) () (3))
+(define-syntax tail
+  (syntax-rules ()
+    ((_ a ... b . rest) '(b rest))))
+(tail 1 2 3 . 4)
+(define-syntax vec
+  (syntax-rules ()
+    ((_ #(a ...)) (list a ...))))
+(vec #(1 2))
+(define-syntax my-list
+  (syntax-rules ::: ()
+    ((_ x :::) (list x ::: '...))))
+(my-list 1 2)
+(define-syntax escaped
+  (syntax-rules ()
+    ((_ x) '(x (... ...)))))
+(escaped 1)`, t)
+	checkExpansion(program, 1, "CallExp(LambdaExp(a b, AddExp(a, b)), 1, 2)", t)
+	checkExpansion(program, 3, "IfExp(x, BeginExp(1, 2), MacroUseExp((my-cond (else 3))))", t)
+	checkExpansion(program, 5, "QuoteExp((1 2 3))", t)
+	checkExpansion(program, 7, "QuoteExp((3 4))", t)
+	checkExpansion(program, 9, "CallExp(list, 1, 2)", t)
+	checkExpansion(program, 11, "CallExp(list, 1, 2, QuoteExp(...))", t)
+	checkExpansion(program, 13, "QuoteExp((1 ...))", t)
+	// the example from R7RS, where the inner macro's ellipsis comes from the
+	// outer macro's template
+	program = parseProgram(`(define-syntax be-like-begin
+  (syntax-rules ()
+    ((be-like-begin name)
+     (define-syntax name
+       (syntax-rules ()
+         ((name expr (... ...))
+          (begin expr (... ...))))))))
+(be-like-begin sequence)
+(sequence 1 2 3 4)`, t)
+	checkExpansion(program, 2, "BeginExp(1, 2, 3, 4)", t)
+}
+
+func TestMacroLiterals(t *testing.T) {
+	program := parseProgram(`(define-syntax arrow
+  (syntax-rules (=>)
+    ((_ a => b) (b a))
+    ((_ a b) (list a b))
+    ((_ a b c) (list a b c))))
+(arrow 1 => f)
+(arrow 1 2)
+(let ((=> 1)) (arrow 1 => 2))`, t)
+	checkExpansion(program, 1, "CallExp(f, 1)", t)
+	checkExpansion(program, 2, "CallExp(list, 1, 2)", t)
+	// a locally bound => isn't the literal any more
+	let := program.GetSubNodes()[3].(*LetExp)
+	if let.Body()[0].GetSubNodes()[0].DebugString() != "CallExp(list, 1, =>, 2)" {
+		t.Error("Incorrect expansion, got", let.Body()[0].GetSubNodes()[0].DebugString())
+	}
+}
+
+func TestLetSyntax(t *testing.T) {
+	program := parseProgram(`(let ((x 'outer))
+  (let-syntax ((m (syntax-rules () ((_) x))))
+    (let ((x 'inner)) (m))))
+(letrec-syntax ((my-and (syntax-rules ()
+                          ((_) #t)
+                          ((_ e) e)
+                          ((_ e1 e2 ...) (if e1 (my-and e2 ...) #f)))))
+  (my-and a b c))
+(define (f)
+  (define-syntax twice (syntax-rules () ((_ e) (begin e e))))
+  (twice (display 1)))`, t)
+	// the x the macro refers to is still the outer one, with the inner x renamed
+	expected := "LetExp((x QuoteExp(outer)), LetExp(, LetExp((x.1 QuoteExp(inner)), MacroUseExp((m)))))"
+	if program.GetSubNodes()[0].DebugString() != expected {
+		t.Error("Incorrect let-syntax, got", program.GetSubNodes()[0].DebugString())
+	}
+	use := program.GetSubNodes()[0].(*LetExp).Body()[0].(*LetExp).Body()[0].(*LetExp).Body()[0]
+	if use.GetSubNodes()[0].DebugString() != "x" {
+		t.Error("Incorrect expansion, got", use.GetSubNodes()[0].DebugString())
+	}
+	letrec := program.GetSubNodes()[1].(*LetExp)
+	if letrec.Body()[0].GetSubNodes()[0].DebugString() != "IfExp(a, MacroUseExp((my-and b c)), false)" {
+		t.Error("Incorrect expansion, got", letrec.Body()[0].GetSubNodes()[0].DebugString())
+	}
+	lambda := program.GetSubNodes()[2].GetSubNodes()[0]
+	if lambda.DebugString() != "LambdaExp(, DefineSyntaxExp(twice), MacroUseExp((twice (display 1))))" {
+		t.Error("Incorrect internal define-syntax, got", lambda.DebugString())
+	}
+}
+
+// macros can expand into definitions, even within bodies
+func TestMacroDefinitions(t *testing.T) {
+	program := parseProgram(`(define-syntax def
+  (syntax-rules ()
+    ((_ name value) (define name value))))
+(def x 1)
+(lambda () (def y 2) (def z y) z)`, t)
+	checkExpansion(program, 1, "DefExp(x, 1)", t)
+	lambda := program.GetSubNodes()[2]
+	if lambda.DebugString() != "LambdaExp(, MacroUseExp((def y 2)), MacroUseExp((def z y)), z)" {
+		t.Error("Incorrect body, got", lambda.DebugString())
+	}
+	if lambda.GetSubNodes()[1].GetSubNodes()[0].DebugString() != "DefExp(z, y)" {
+		t.Error("Incorrect expansion, got", lambda.GetSubNodes()[1].GetSubNodes()[0].DebugString())
+	}
+}
+
+func TestMacroErrors(t *testing.T) {
+	inputs := []string{
+		"(define-syntax m (syntax-rules () ((_ a) a))) (m)",
+		"(define-syntax m (syntax-rules () ((_ a) (a ...)))) (m 1)",
+		"(define-syntax m (syntax-rules () ((_ a ...) a))) (m 1)",
+		"(define-syntax m (syntax-rules () ((_) (m)))) (m)",
+		"(define-syntax m (lambda (x) x))",
+		"(define-syntax m (syntax-rules () (_ 1)))",
+		"(syntax-rules () ((_) 1))",
+		"(define-syntax m (syntax-rules () ((_) 1))) m",
+	}
+	for _, input := range inputs {
+		tokens, _ := LexExp(input)
+		if _, parseErrors := ParseTokens(tokens); len(parseErrors) != 1 {
+			t.Error("Expected an error parsing", input, "got", parseErrors)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	input := `(define-syntax my-or
+  (syntax-rules ()
+    ((_) #f)
+    ((_ e) e)
+    ((_ e r ...) (let ((t e)) (if t t (my-or r ...))))))
+(lambda (a b) (my-or a b))`
+	program := parseProgram(input, t)
+	original := program.DebugString()
+	node, err := ExpandOnce(program)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	expected := "LambdaExp(a b, LetExp((t.1 a), IfExp(t.1, t.1, MacroUseExp((my-or b)))))"
+	if node.GetSubNodes()[1].DebugString() != expected {
+		t.Error("Incorrect single expansion, got", node.GetSubNodes()[1].DebugString())
+	}
+	node, err = Expand(program)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	expected = "LambdaExp(a b, LetExp((t.1 a), IfExp(t.1, t.1, b)))"
+	if node.GetSubNodes()[1].DebugString() != expected {
+		t.Error("Incorrect full expansion, got", node.GetSubNodes()[1].DebugString())
+	}
+	// expanding gives a copy, leaving the macro uses in the original
+	if program.DebugString() != original {
+		t.Error("Expanding changed the original tree to", program.DebugString())
+	}
+	// a lone macro use gets replaced by its expansion
+	use := parseProgram(input, t).GetSubNodes()[1].GetSubNodes()[0]
+	node, err = Expand(use)
+	if err != nil {
+		t.Fatal("Unexpected error:", err)
+	}
+	if node.GetType() != LetNode {
+		t.Error("Expected a let, got", node.DebugString())
+	}
+	if _, err := Expand(NewMacroUseExp(NewSymbol("m"), nil)); err == nil {
+		t.Error("Expected an error expanding a use with no expansion")
+	}
+}
@@ -0,0 +1,411 @@
+package schego
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// objectKind is the type of value an object in the heap holds. Objects are how
+// the VM passes around values whose type isn't known until the program runs,
+// such as the elements of a list: on the stack, an object is just the 8-byte
+// address it lives at in the heap, with the VM keeping track of each object's
+// kind so that it can check what it's been given.
+type objectKind byte
+
+const (
+	boolObject objectKind = iota + 1
+	charObject
+	intObject
+	doubleObject
+	stringObject
+	symbolObject
+	emptyListObject
+	pairObject
+	vectorObject
+	// what expressions without a useful value give, such as a one-armed if
+	// whose test fails
+	unspecifiedObject
+	// a procedure, held as the address of its code, how many arguments it
+	// takes, and the objects it captured from where it was created
+	procedureObject
+	// a box holding another object, which is how closures share variables
+	// that can be assigned to
+	cellObject
+	// a record, held as the ID of its type followed by the object in each
+	// of its fields
+	recordObject
+	// what read gives once its input has run out
+	eofObject
+)
+
+// what each kind of object is called in error messages
+var objectKindNames = map[objectKind]string{boolObject: "a boolean", charObject: "a character",
+	intObject: "an integer", doubleObject: "a double", stringObject: "a string", symbolObject: "a symbol",
+	emptyListObject: "the empty list", pairObject: "a pair", vectorObject: "a vector",
+	unspecifiedObject: "an unspecified value", procedureObject: "a procedure", cellObject: "a cell",
+	recordObject: "a record", eofObject: "the end of file object"}
+
+// newObject allocates an object of the given kind in the heap, returning its address
+func (v *VMState) newObject(kind objectKind, payload []byte) uint64 {
+	// even objects with nothing in them need an address of their own
+	size := uint64(len(payload))
+	if size == 0 {
+		size = 1
+	}
+	address := v.Heap.Allocate(size)
+	v.Heap.Write(bytes.NewBuffer(payload), address)
+	v.objects[address] = kind
+	return address
+}
+
+// singleton gives the one object of a kind that only ever has one, such as the
+// empty list, allocating it the first time it's needed
+func (v *VMState) singleton(kind objectKind) uint64 {
+	if address, ok := v.singletons[kind]; ok {
+		return address
+	}
+	address := v.newObject(kind, nil)
+	v.singletons[kind] = address
+	return address
+}
+
+func (v *VMState) pushObject(address uint64) {
+	v.pushInt(int64(address))
+}
+
+func (v *VMState) popObject() uint64 {
+	return uint64(v.Stack.PopInt())
+}
+
+// describeObject names the kind of value at an address, for error messages
+func (v *VMState) describeObject(address uint64) string {
+	if kind, ok := v.objects[address]; ok {
+		if kind == recordObject {
+			return "a record of type " + v.recordTypes[int64(v.objectWord(address, 0))].name
+		}
+		return objectKindNames[kind]
+	}
+	return "something that isn't an object"
+}
+
+// expectObject checks the object at an address is of the given kind, stopping
+// the VM if it isn't
+func (v *VMState) expectObject(address uint64, kind objectKind) bool {
+	if v.objects[address] != kind {
+		v.fail("Expected " + objectKindNames[kind] + ", found " + v.describeObject(address))
+		return false
+	}
+	return true
+}
+
+// objectWord reads the 8-byte word at the given index into an object
+func (v *VMState) objectWord(address uint64, index uint64) uint64 {
+	var word uint64
+	binary.Read(v.Heap.Read(8, address+8*index), binary.LittleEndian, &word)
+	return word
+}
+
+// words encodes 8-byte words, the way objects hold numbers, lengths and
+// the addresses of other objects
+func words(values ...uint64) []byte {
+	buffer := new(bytes.Buffer)
+	binary.Write(buffer, binary.LittleEndian, values)
+	return buffer.Bytes()
+}
+
+// newStringObject allocates a string or symbol, which hold their length followed
+// by their UTF-8 encoding
+func (v *VMState) newStringObject(kind objectKind, str []byte) uint64 {
+	return v.newObject(kind, append(words(uint64(len(str))), str...))
+}
+
+// objectBytes reads the UTF-8 encoding of a string or symbol
+func (v *VMState) objectBytes(address uint64) []byte {
+	length := v.objectWord(address, 0)
+	return v.Heap.Read(length, address+8).Bytes()
+}
+
+// symbol gives the symbol with the given name. Symbols are interned, so two
+// symbols with the same name are always the same object.
+func (v *VMState) symbol(name string) uint64 {
+	if address, ok := v.symbols[name]; ok {
+		return address
+	}
+	address := v.newStringObject(symbolObject, []byte(name))
+	v.symbols[name] = address
+	return address
+}
+
+// recordField checks the object at an address is a record of the given type,
+// stopping the VM if it isn't, and gives the address of one of its fields
+func (v *VMState) recordField(address uint64, typeID int64, field uint64) (uint64, bool) {
+	recordType := v.recordTypes[typeID]
+	if v.objects[address] != recordObject || int64(v.objectWord(address, 0)) != typeID {
+		v.fail("Expected a record of type " + recordType.name + ", found " + v.describeObject(address))
+		return 0, false
+	}
+	if field >= recordType.fieldCount {
+		v.fail("No field " + strconv.FormatUint(field, 10) + " in records of type " + recordType.name)
+		return 0, false
+	}
+	return address + 8*(field+1), true
+}
+
+// readObject reads the next datum from the VM's input and gives it as an object,
+// or gives the end of file object once there's nothing left to read
+func (v *VMState) readObject() (uint64, bool) {
+	if v.Input == nil {
+		return v.singleton(eofObject), true
+	}
+	if v.reader == nil {
+		v.reader = NewDatumReader(NewLexer(v.Input))
+	}
+	datum, err := v.reader.Read()
+	if err == io.EOF {
+		return v.singleton(eofObject), true
+	}
+	if err != nil {
+		v.fail(err.Error())
+		return 0, false
+	}
+	return v.datumObject(datum)
+}
+
+// datumObject allocates the objects that make up a datum, the same ones quoting
+// it in a program would give
+func (v *VMState) datumObject(datum Datum) (uint64, bool) {
+	switch datum := datum.(type) {
+	case *BoolDatum:
+		return v.newObject(boolObject, pushBool(datum.Value)[1:]), true
+	case *CharDatum:
+		return v.newObject(charObject, words(uint64(datum.Value))), true
+	case *IntDatum:
+		return v.newObject(intObject, words(uint64(datum.Value))), true
+	case *FloatDatum:
+		return v.newObject(doubleObject, words(math.Float64bits(datum.Value))), true
+	case *StringDatum:
+		return v.newStringObject(stringObject, []byte(datum.Value)), true
+	case *Symbol:
+		return v.symbol(datum.Name), true
+	case *EmptyList:
+		return v.singleton(emptyListObject), true
+	case *Pair:
+		car, ok := v.datumObject(datum.Car)
+		if !ok {
+			return 0, false
+		}
+		cdr, ok := v.datumObject(datum.Cdr)
+		if !ok {
+			return 0, false
+		}
+		return v.cons(car, cdr), true
+	case *Vector:
+		elements := []uint64{uint64(len(datum.Elements))}
+		for _, element := range datum.Elements {
+			address, ok := v.datumObject(element)
+			if !ok {
+				return 0, false
+			}
+			elements = append(elements, address)
+		}
+		return v.newObject(vectorObject, words(elements...)), true
+	}
+	v.fail("Can't read " + datum.String() + " yet")
+	return 0, false
+}
+
+func (v *VMState) cons(car uint64, cdr uint64) uint64 {
+	return v.newObject(pairObject, words(car, cdr))
+}
+
+// box pops a value of the type the opcode is for, and pushes an object holding it
+func (v *VMState) box(opcode byte) {
+	switch opcode {
+	case opBoxb:
+		v.pushObject(v.newObject(boolObject, []byte{v.Stack.PopByte()}))
+	case opBoxc:
+		v.pushObject(v.newObject(charObject, words(uint64(v.Stack.PopChar()))))
+	case opBoxi:
+		v.pushObject(v.newObject(intObject, words(uint64(v.Stack.PopInt()))))
+	case opBoxd:
+		v.pushObject(v.newObject(doubleObject, words(math.Float64bits(v.Stack.PopDouble()))))
+	case opBoxs:
+		// strings pushed by pushs come with their null terminator, which
+		// string objects leave off
+		str := bytes.TrimRight(v.Stack.PopString(), "\x00")
+		v.pushObject(v.newStringObject(stringObject, str))
+	}
+}
+
+// unbox pops an object, which has to be of the type the opcode is for, and
+// pushes the value it holds
+func (v *VMState) unbox(opcode byte) {
+	address := v.popObject()
+	switch opcode {
+	case opUnboxb:
+		if v.expectObject(address, boolObject) {
+			v.Stack.PushByte(v.Heap.Read(1, address).Bytes()[0])
+		}
+	case opUnboxc:
+		if v.expectObject(address, charObject) {
+			v.Stack.PushChar(rune(v.objectWord(address, 0)))
+		}
+	case opUnboxi:
+		if v.expectObject(address, intObject) {
+			v.pushInt(int64(v.objectWord(address, 0)))
+		}
+	case opUnboxd:
+		if v.expectObject(address, doubleObject) {
+			v.pushDouble(math.Float64frombits(v.objectWord(address, 0)))
+		}
+	case opUnboxs:
+		if v.expectObject(address, stringObject) {
+			v.Stack.PushString(append(v.objectBytes(address), 0))
+		}
+	}
+}
+
+// truthy checks whether an object counts as true, which everything but #f does
+func (v *VMState) truthy(address uint64) bool {
+	return v.objects[address] != boolObject || v.Heap.Read(1, address).Bytes()[0] != 0
+}
+
+// eqv checks whether two objects are eqv?: the same object, or numbers,
+// characters or booleans holding the same value
+func (v *VMState) eqv(x uint64, y uint64) bool {
+	if x == y {
+		return true
+	}
+	kind := v.objects[x]
+	if kind != v.objects[y] {
+		return false
+	}
+	switch kind {
+	case boolObject:
+		return v.Heap.Read(1, x).Bytes()[0] == v.Heap.Read(1, y).Bytes()[0]
+	case charObject, intObject, doubleObject:
+		return v.objectWord(x, 0) == v.objectWord(y, 0)
+	}
+	return false
+}
+
+// number reads a number object, giving its value both as an integer, if it is
+// one, and as a double
+func (v *VMState) number(address uint64) (int64, float64, bool, bool) {
+	switch v.objects[address] {
+	case intObject:
+		num := int64(v.objectWord(address, 0))
+		return num, float64(num), true, true
+	case doubleObject:
+		return 0, math.Float64frombits(v.objectWord(address, 0)), false, true
+	}
+	v.fail("Expected a number, found " + v.describeObject(address))
+	return 0, 0, false, false
+}
+
+// arithmetic pops two number objects and pushes the result of the operation the
+// opcode is for. Integers give an integer, apart from when they're divided,
+// while anything involving a double gives a double.
+func (v *VMState) arithmetic(opcode byte) {
+	y, x := v.popObject(), v.popObject()
+	xInt, xDouble, xExact, ok := v.number(x)
+	if !ok {
+		return
+	}
+	yInt, yDouble, yExact, ok := v.number(y)
+	if !ok {
+		return
+	}
+	if xExact && yExact && opcode != opOdiv {
+		results := map[byte]int64{opOadd: xInt + yInt, opOsub: xInt - yInt, opOmul: xInt * yInt}
+		v.pushObject(v.newObject(intObject, words(uint64(results[opcode]))))
+		return
+	}
+	results := map[byte]float64{opOadd: xDouble + yDouble, opOsub: xDouble - yDouble,
+		opOmul: xDouble * yDouble, opOdiv: xDouble / yDouble}
+	v.pushObject(v.newObject(doubleObject, words(math.Float64bits(results[opcode]))))
+}
+
+// compareNumbers pops two number objects and pushes how they compare, the same
+// way cmpi and cmpd do
+func (v *VMState) compareNumbers() {
+	y, x := v.popObject(), v.popObject()
+	xInt, xDouble, xExact, ok := v.number(x)
+	if !ok {
+		return
+	}
+	yInt, yDouble, yExact, ok := v.number(y)
+	if !ok {
+		return
+	}
+	if xExact && yExact {
+		xDouble, yDouble = float64(xInt), float64(yInt)
+		if xInt == yInt {
+			v.Stack.PushByte(0)
+			return
+		}
+	}
+	if xDouble == yDouble {
+		v.Stack.PushByte(0)
+	} else if xDouble > yDouble {
+		v.Stack.PushByte(1)
+	} else {
+		v.Stack.PushByte(2)
+	}
+}
+
+// writeObject writes an object out the way display shows it
+func (v *VMState) writeObject(output *strings.Builder, address uint64) {
+	switch v.objects[address] {
+	case boolObject:
+		if v.truthy(address) {
+			output.WriteString("#t")
+		} else {
+			output.WriteString("#f")
+		}
+	case charObject:
+		output.WriteRune(rune(v.objectWord(address, 0)))
+	case intObject:
+		output.WriteString(strconv.FormatInt(int64(v.objectWord(address, 0)), 10))
+	case doubleObject:
+		output.WriteString(strconv.FormatFloat(math.Float64frombits(v.objectWord(address, 0)), 'f', -1, 64))
+	case stringObject, symbolObject:
+		output.Write(v.objectBytes(address))
+	case emptyListObject:
+		output.WriteString("()")
+	case pairObject:
+		output.WriteString("(")
+		for {
+			v.writeObject(output, v.objectWord(address, 0))
+			address = v.objectWord(address, 1)
+			if v.objects[address] != pairObject {
+				break
+			}
+			output.WriteString(" ")
+		}
+		if v.objects[address] != emptyListObject {
+			output.WriteString(" . ")
+			v.writeObject(output, address)
+		}
+		output.WriteString(")")
+	case vectorObject:
+		output.WriteString("#(")
+		for index := uint64(0); index < v.objectWord(address, 0); index++ {
+			if index > 0 {
+				output.WriteString(" ")
+			}
+			v.writeObject(output, v.objectWord(address, index+1))
+		}
+		output.WriteString(")")
+	case procedureObject:
+		output.WriteString("#<procedure>")
+	case recordObject:
+		output.WriteString("#<" + v.recordTypes[int64(v.objectWord(address, 0))].name + ">")
+	case eofObject:
+		output.WriteString("#<eof>")
+	}
+}
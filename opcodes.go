@@ -0,0 +1,316 @@
+package schego
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// the opcodes the VM implements, as documented in doc/bytecode.md
+const (
+	opPushb   byte = 0x01
+	opPushc   byte = 0x02
+	opPushi   byte = 0x03
+	opPushd   byte = 0x04
+	opPushs   byte = 0x05
+	opCons    byte = 0x06
+	opDup     byte = 0x07
+	opHstoreb byte = 0x08
+	opHstorec byte = 0x09
+	opHstorei byte = 0x0A
+	opHstored byte = 0x0B
+	opHstores byte = 0x0C
+	opHstorel byte = 0x0D
+	opLstoreb byte = 0x0E
+	opLstorec byte = 0x0F
+	opLstorei byte = 0x10
+	opLstored byte = 0x11
+	opLstores byte = 0x12
+	opLstorel byte = 0x13
+	opHloadb  byte = 0x14
+	opHloadc  byte = 0x15
+	opHloadi  byte = 0x16
+	opHloadd  byte = 0x17
+	opHloads  byte = 0x18
+	opHloadl  byte = 0x19
+	opLloadb  byte = 0x1A
+	opLloadc  byte = 0x1B
+	opLloadi  byte = 0x1C
+	opLloadd  byte = 0x1D
+	opLloads  byte = 0x1E
+	opLloadl  byte = 0x1F
+	opHnewb   byte = 0x20
+	opHnewc   byte = 0x21
+	opHnewi   byte = 0x22
+	opHnewd   byte = 0x23
+	opHnews   byte = 0x24
+	opHnewl   byte = 0x25
+	opLnewb   byte = 0x26
+	opLnewc   byte = 0x27
+	opLnewi   byte = 0x28
+	opLnewd   byte = 0x29
+	opLnews   byte = 0x2A
+	opLnewl   byte = 0x2B
+	opJmp     byte = 0x2C
+	opJne     byte = 0x2D
+	opJeq     byte = 0x2E
+	opJlt     byte = 0x2F
+	opJlte    byte = 0x30
+	opJgt     byte = 0x31
+	opJgte    byte = 0x32
+	opJal     byte = 0x33
+	opJr      byte = 0x34
+	opAddi    byte = 0x36
+	opAddd    byte = 0x37
+	opSubi    byte = 0x38
+	opSubd    byte = 0x39
+	opMuli    byte = 0x3A
+	opMuld    byte = 0x3B
+	opDivd    byte = 0x3E
+	opCmpi    byte = 0x40
+	opCmpd    byte = 0x41
+	opSyscall byte = 0x43
+	opHsmnem  byte = 0x44
+	opCmpl    byte = 0x46
+	opHcar    byte = 0x47
+	opHcdr    byte = 0x49
+	opHscar   byte = 0x4B
+	opHscdr   byte = 0x4D
+	opRdef    byte = 0x4F
+	opHnewr   byte = 0x50
+	opRget    byte = 0x52
+	opRset    byte = 0x53
+	opRtest   byte = 0x54
+	opItod    byte = 0x55
+	opBoxb    byte = 0x58
+	opBoxc    byte = 0x59
+	opBoxi    byte = 0x5A
+	opBoxd    byte = 0x5B
+	opBoxs    byte = 0x5C
+	opUnboxb  byte = 0x5D
+	opUnboxc  byte = 0x5E
+	opUnboxi  byte = 0x5F
+	opUnboxd  byte = 0x60
+	opUnboxs  byte = 0x61
+	opOnil    byte = 0x62
+	opOvoid   byte = 0x63
+	opOcons   byte = 0x64
+	opOcar    byte = 0x65
+	opOcdr    byte = 0x66
+	opOsym    byte = 0x67
+	opOvec    byte = 0x68
+	opOtest   byte = 0x69
+	opOtruth  byte = 0x6A
+	opOeqv    byte = 0x6B
+	opOadd    byte = 0x6C
+	opOsub    byte = 0x6D
+	opOmul    byte = 0x6E
+	opOdiv    byte = 0x6F
+	opOcmp    byte = 0x70
+	opDropb   byte = 0x71
+	opDropc   byte = 0x72
+	opDropi   byte = 0x73
+	opDropd   byte = 0x74
+	opDrops   byte = 0x75
+	opHnewp   byte = 0x76
+	opJalc    byte = 0x77
+	opCload   byte = 0x78
+	opOcell   byte = 0x79
+	opOget    byte = 0x7A
+	opOset    byte = 0x7B
+)
+
+// the syscalls the VM implements
+const (
+	syscallPrintBool   byte = 0x01
+	syscallPrintChar   byte = 0x02
+	syscallPrintInt    byte = 0x03
+	syscallPrintDouble byte = 0x04
+	syscallPrintString byte = 0x05
+	syscallExit        byte = 0x06
+	syscallPrintRecord byte = 0x07
+	syscallPrintObject byte = 0x08
+	syscallRead        byte = 0x09
+)
+
+// operandKind is the kind of operand an instruction takes, which decides both
+// how it's written in assembly and how it's encoded
+type operandKind int
+
+const (
+	// #t or #f, encoded as 1 byte
+	boolOperand operandKind = iota
+	// a quoted character such as 'a', encoded as 1 to 4 bytes of UTF-8
+	charOperand
+	// a 64-bit integer
+	intOperand
+	// a 64-bit double precision float
+	doubleOperand
+	// a quoted string such as "hi", encoded as UTF-8 with a null terminator
+	stringOperand
+	// a 2-byte heap mnemonic, either written as a number or named
+	mnemonicOperand
+	// a 4-byte reference to a local
+	localOperand
+	// a label, or a number of bytes, to jump by from the end of the instruction
+	jumpOperand
+	// the name or number of a syscall
+	syscallOperand
+	// a 1-byte object kind, written as a number
+	kindOperand
+)
+
+// the number of bytes each kind of operand takes up, other than characters
+// and strings, whose length varies
+var operandSizes = map[operandKind]int{boolOperand: 1, intOperand: 8, doubleOperand: 8, mnemonicOperand: 2,
+	localOperand: 4, jumpOperand: 8, syscallOperand: 1, kindOperand: 1}
+
+type instruction struct {
+	name     string
+	opcode   byte
+	operands []operandKind
+}
+
+// instructions lists every instruction the VM implements. Opcodes that
+// doc/bytecode.md reserves but the VM doesn't carry out yet are left out, so
+// nothing can emit them.
+var instructions = []instruction{
+	{"pushb", opPushb, []operandKind{boolOperand}},
+	{"pushc", opPushc, []operandKind{charOperand}},
+	{"pushi", opPushi, []operandKind{intOperand}},
+	{"pushd", opPushd, []operandKind{doubleOperand}},
+	{"pushs", opPushs, []operandKind{stringOperand}},
+	{"cons", opCons, nil},
+	{"dup", opDup, nil},
+	{"hstoreb", opHstoreb, []operandKind{mnemonicOperand}},
+	{"hstorec", opHstorec, []operandKind{mnemonicOperand}},
+	{"hstorei", opHstorei, []operandKind{mnemonicOperand}},
+	{"hstored", opHstored, []operandKind{mnemonicOperand}},
+	{"hstores", opHstores, []operandKind{mnemonicOperand}},
+	{"hstorel", opHstorel, []operandKind{mnemonicOperand}},
+	{"lstoreb", opLstoreb, []operandKind{localOperand}},
+	{"lstorec", opLstorec, []operandKind{localOperand}},
+	{"lstorei", opLstorei, []operandKind{localOperand}},
+	{"lstored", opLstored, []operandKind{localOperand}},
+	{"lstores", opLstores, []operandKind{localOperand}},
+	{"lstorel", opLstorel, []operandKind{localOperand}},
+	{"hloadb", opHloadb, []operandKind{mnemonicOperand}},
+	{"hloadc", opHloadc, []operandKind{mnemonicOperand}},
+	{"hloadi", opHloadi, []operandKind{mnemonicOperand}},
+	{"hloadd", opHloadd, []operandKind{mnemonicOperand}},
+	{"hloads", opHloads, []operandKind{mnemonicOperand}},
+	{"hloadl", opHloadl, []operandKind{mnemonicOperand}},
+	{"lloadb", opLloadb, []operandKind{localOperand}},
+	{"lloadc", opLloadc, []operandKind{localOperand}},
+	{"lloadi", opLloadi, []operandKind{localOperand}},
+	{"lloadd", opLloadd, []operandKind{localOperand}},
+	{"lloads", opLloads, []operandKind{localOperand}},
+	{"lloadl", opLloadl, []operandKind{localOperand}},
+	{"hnewb", opHnewb, []operandKind{mnemonicOperand}},
+	{"hnewc", opHnewc, []operandKind{mnemonicOperand}},
+	{"hnewi", opHnewi, []operandKind{mnemonicOperand}},
+	{"hnewd", opHnewd, []operandKind{mnemonicOperand}},
+	{"hnews", opHnews, []operandKind{mnemonicOperand}},
+	{"hnewl", opHnewl, []operandKind{mnemonicOperand}},
+	{"lnewb", opLnewb, []operandKind{localOperand}},
+	{"lnewc", opLnewc, []operandKind{localOperand}},
+	{"lnewi", opLnewi, []operandKind{localOperand}},
+	{"lnewd", opLnewd, []operandKind{localOperand}},
+	{"lnews", opLnews, []operandKind{localOperand}},
+	{"lnewl", opLnewl, []operandKind{localOperand}},
+	{"jmp", opJmp, []operandKind{jumpOperand}},
+	{"jne", opJne, []operandKind{jumpOperand}},
+	{"jeq", opJeq, []operandKind{jumpOperand}},
+	{"jlt", opJlt, []operandKind{jumpOperand}},
+	{"jlte", opJlte, []operandKind{jumpOperand}},
+	{"jgt", opJgt, []operandKind{jumpOperand}},
+	{"jgte", opJgte, []operandKind{jumpOperand}},
+	{"jal", opJal, []operandKind{jumpOperand}},
+	{"jr", opJr, nil},
+	{"addi", opAddi, nil},
+	{"addd", opAddd, nil},
+	{"subi", opSubi, nil},
+	{"subd", opSubd, nil},
+	{"muli", opMuli, nil},
+	{"muld", opMuld, nil},
+	{"divd", opDivd, nil},
+	{"cmpi", opCmpi, nil},
+	{"cmpd", opCmpd, nil},
+	{"syscall", opSyscall, []operandKind{syscallOperand}},
+	{"hsmnem", opHsmnem, []operandKind{mnemonicOperand, mnemonicOperand}},
+	{"cmpl", opCmpl, nil},
+	{"hcar", opHcar, nil},
+	{"hcdr", opHcdr, nil},
+	{"hscar", opHscar, nil},
+	{"hscdr", opHscdr, []operandKind{mnemonicOperand}},
+	{"rdef", opRdef, []operandKind{intOperand, intOperand}},
+	{"hnewr", opHnewr, []operandKind{intOperand}},
+	{"rget", opRget, []operandKind{intOperand, intOperand}},
+	{"rset", opRset, []operandKind{intOperand, intOperand}},
+	{"rtest", opRtest, []operandKind{intOperand}},
+	{"itod", opItod, nil},
+	{"boxb", opBoxb, nil},
+	{"boxc", opBoxc, nil},
+	{"boxi", opBoxi, nil},
+	{"boxd", opBoxd, nil},
+	{"boxs", opBoxs, nil},
+	{"unboxb", opUnboxb, nil},
+	{"unboxc", opUnboxc, nil},
+	{"unboxi", opUnboxi, nil},
+	{"unboxd", opUnboxd, nil},
+	{"unboxs", opUnboxs, nil},
+	{"onil", opOnil, nil},
+	{"ovoid", opOvoid, nil},
+	{"ocons", opOcons, nil},
+	{"ocar", opOcar, nil},
+	{"ocdr", opOcdr, nil},
+	{"osym", opOsym, nil},
+	{"ovec", opOvec, []operandKind{intOperand}},
+	{"otest", opOtest, []operandKind{kindOperand}},
+	{"otruth", opOtruth, nil},
+	{"oeqv", opOeqv, nil},
+	{"oadd", opOadd, nil},
+	{"osub", opOsub, nil},
+	{"omul", opOmul, nil},
+	{"odiv", opOdiv, nil},
+	{"ocmp", opOcmp, nil},
+	{"dropb", opDropb, nil},
+	{"dropc", opDropc, nil},
+	{"dropi", opDropi, nil},
+	{"dropd", opDropd, nil},
+	{"drops", opDrops, nil},
+	{"hnewp", opHnewp, []operandKind{intOperand, intOperand, jumpOperand}},
+	{"jalc", opJalc, []operandKind{intOperand}},
+	{"cload", opCload, []operandKind{localOperand}},
+	{"ocell", opOcell, nil},
+	{"oget", opOget, nil},
+	{"oset", opOset, nil},
+}
+
+// operandLengths gives how many bytes of operands follow each opcode, other than
+// pushc and pushs, whose operands vary in length
+var operandLengths = makeOperandLengths()
+
+func makeOperandLengths() map[byte]int {
+	lengths := make(map[byte]int)
+	for _, instruction := range instructions {
+		for _, kind := range instruction.operands {
+			lengths[instruction.opcode] += operandSizes[kind]
+		}
+	}
+	return lengths
+}
+
+// instructionLength gives the length of the instruction at the given position,
+// operands included
+func instructionLength(code []byte, position int) int {
+	switch opcode := code[position]; opcode {
+	case opPushc:
+		_, size := utf8.DecodeRune(code[position+1:])
+		return 1 + size
+	case opPushs:
+		// the string runs up to and including its null terminator
+		return 2 + bytes.IndexByte(code[position+1:], 0)
+	default:
+		return 1 + operandLengths[opcode]
+	}
+}
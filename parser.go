@@ -3,11 +3,12 @@ package schego
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
+	"io"
 	"math"
 	"strconv"
 	"strings"
+	"unicode"
 )
 
 type AstNodeType int
@@ -29,8 +30,42 @@ const (
 	IdentNode
 	IntNode
 	FloatNode
+	RationalNode
 	StringNode
 	BoolNode
+	CharNode
+	SymbolNode
+	ListNode
+	QuoteNode
+	QuasiquoteNode
+	UnquoteNode
+	UnquoteSplicingNode
+	VectorNode
+	BytevectorNode
+	CallNode
+	LetNode
+	LetStarNode
+	LetrecNode
+	LetrecStarNode
+	NamedLetNode
+	LetValuesNode
+	LetStarValuesNode
+	CondNode
+	CondClauseNode
+	CaseNode
+	CaseClauseNode
+	AndNode
+	OrNode
+	WhenNode
+	UnlessNode
+	BeginNode
+	DoNode
+	SetNode
+	DefineSyntaxNode
+	MacroUseNode
+	DefineRecordTypeNode
+	DefineLibraryNode
+	ImportNode
 )
 
 // base interface for functions needing to accept any kind of AST node
@@ -39,11 +74,14 @@ type AstNode interface {
 	AddSubNode(AstNode)
 	GetType() AstNodeType
 	DebugString() string
+	GetSpan() Span
+	SetSpan(Span)
 }
 
 // base struct that all AST node implementations build off of
 type SExp struct {
 	subNodes []AstNode
+	span     Span
 }
 
 func (s *SExp) GetSubNodes() []AstNode {
@@ -52,6 +90,17 @@ func (s *SExp) GetSubNodes() []AstNode {
 func (s *SExp) AddSubNode(node AstNode) {
 	s.subNodes = append(s.subNodes, node)
 }
+func (s *SExp) setSubNodes(nodes []AstNode) {
+	s.subNodes = nodes
+}
+
+// GetSpan returns the region of source text the node was parsed from
+func (s *SExp) GetSpan() Span {
+	return s.span
+}
+func (s *SExp) SetSpan(span Span) {
+	s.span = span
+}
 
 type Program struct {
 	SExp
@@ -67,160 +116,195 @@ func NewProgram(nodes ...AstNode) *Program {
 func (p Program) GetType() AstNodeType {
 	return ProgramNode
 }
+func (p Program) DebugString() string {
+	return "Program(" + bodyDebugString(p.subNodes) + ")"
+}
+
+// the fewest operands each arithmetic/comparison operator accepts
+var operatorArities = map[string]int{
+	"+": 0, "*": 0,
+	"-": 1, "/": 1,
+	"<": 2, "<=": 2, ">": 2, ">=": 2, "=": 2,
+}
+
+// operatorDebugString formats an arithmetic/comparison node and its operands
+func operatorDebugString(name string, operands []AstNode) string {
+	operandStrings := make([]string, 0)
+	for _, operand := range operands {
+		operandStrings = append(operandStrings, operand.DebugString())
+	}
+	return name + "(" + strings.Join(operandStrings, ", ") + ")"
+}
 
+// arithmetic and comparison nodes hold any number of operands, with the
+// arities R7RS gives them checked by the parser:
+// + and * take zero or more, where no operands means the identity (0 or 1)
+// - and / take one or more, where one operand means negation or reciprocal
+// comparisons take two or more, and hold if each adjacent pair compares true
 type AddExp struct {
 	SExp
 }
 
-func NewAddExp(lhs AstNode, rhs AstNode) *AddExp {
+func NewAddExp(operands ...AstNode) *AddExp {
 	node := new(AddExp)
-	node.AddSubNode(lhs)
-	node.AddSubNode(rhs)
+	for _, operand := range operands {
+		node.AddSubNode(operand)
+	}
 	return node
 }
 func (a AddExp) GetType() AstNodeType {
 	return AddNode
 }
 func (a AddExp) DebugString() string {
-	return "AddExp(" + a.subNodes[0].DebugString() + ", " + a.subNodes[1].DebugString() + ")"
+	return operatorDebugString("AddExp", a.subNodes)
 }
 
 type SubExp struct {
 	SExp
 }
 
-func NewSubExp(lhs AstNode, rhs AstNode) *SubExp {
+func NewSubExp(operands ...AstNode) *SubExp {
 	node := new(SubExp)
-	node.AddSubNode(lhs)
-	node.AddSubNode(rhs)
+	for _, operand := range operands {
+		node.AddSubNode(operand)
+	}
 	return node
 }
 func (s SubExp) GetType() AstNodeType {
 	return SubNode
 }
 func (s SubExp) DebugString() string {
-	return "SubExp(" + s.subNodes[0].DebugString() + ", " + s.subNodes[1].DebugString() + ")"
+	return operatorDebugString("SubExp", s.subNodes)
 }
 
 type MulExp struct {
 	SExp
 }
 
-func NewMulExp(lhs AstNode, rhs AstNode) *MulExp {
+func NewMulExp(operands ...AstNode) *MulExp {
 	node := new(MulExp)
-	node.AddSubNode(lhs)
-	node.AddSubNode(rhs)
+	for _, operand := range operands {
+		node.AddSubNode(operand)
+	}
 	return node
 }
 func (m MulExp) GetType() AstNodeType {
 	return MulNode
 }
 func (m MulExp) DebugString() string {
-	return "MulExp(" + m.subNodes[0].DebugString() + ", " + m.subNodes[1].DebugString() + ")"
+	return operatorDebugString("MulExp", m.subNodes)
 }
 
 type DivExp struct {
 	SExp
 }
 
-func NewDivExp(lhs AstNode, rhs AstNode) *DivExp {
+func NewDivExp(operands ...AstNode) *DivExp {
 	node := new(DivExp)
-	node.AddSubNode(lhs)
-	node.AddSubNode(rhs)
+	for _, operand := range operands {
+		node.AddSubNode(operand)
+	}
 	return node
 }
 func (d DivExp) GetType() AstNodeType {
 	return DivNode
 }
 func (d DivExp) DebugString() string {
-	return "DivExp(" + d.subNodes[0].DebugString() + ", " + d.subNodes[1].DebugString() + ")"
+	return operatorDebugString("DivExp", d.subNodes)
 }
 
 type LtExp struct {
 	SExp
 }
 
-func NewLtExp(lhs AstNode, rhs AstNode) *LtExp {
+func NewLtExp(operands ...AstNode) *LtExp {
 	node := new(LtExp)
-	node.AddSubNode(lhs)
-	node.AddSubNode(rhs)
+	for _, operand := range operands {
+		node.AddSubNode(operand)
+	}
 	return node
 }
 func (l LtExp) GetType() AstNodeType {
 	return LtNode
 }
 func (l LtExp) DebugString() string {
-	return "LtExp(" + l.subNodes[0].DebugString() + ", " + l.subNodes[1].DebugString() + ")"
+	return operatorDebugString("LtExp", l.subNodes)
 }
 
 type LteExp struct {
 	SExp
 }
 
-func NewLteExp(lhs AstNode, rhs AstNode) *LteExp {
+func NewLteExp(operands ...AstNode) *LteExp {
 	node := new(LteExp)
-	node.AddSubNode(lhs)
-	node.AddSubNode(rhs)
+	for _, operand := range operands {
+		node.AddSubNode(operand)
+	}
 	return node
 }
 func (l LteExp) GetType() AstNodeType {
 	return LteNode
 }
 func (l LteExp) DebugString() string {
-	return "LteExp(" + l.subNodes[0].DebugString() + ", " + l.subNodes[1].DebugString() + ")"
+	return operatorDebugString("LteExp", l.subNodes)
 }
 
 type GtExp struct {
 	SExp
 }
 
-func NewGtExp(lhs AstNode, rhs AstNode) *GtExp {
+func NewGtExp(operands ...AstNode) *GtExp {
 	node := new(GtExp)
-	node.AddSubNode(lhs)
-	node.AddSubNode(rhs)
+	for _, operand := range operands {
+		node.AddSubNode(operand)
+	}
 	return node
 }
 func (g GtExp) GetType() AstNodeType {
 	return GtNode
 }
 func (g GtExp) DebugString() string {
-	return "GtExp(" + g.subNodes[0].DebugString() + ", " + g.subNodes[1].DebugString() + ")"
+	return operatorDebugString("GtExp", g.subNodes)
 }
 
 type GteExp struct {
 	SExp
 }
 
-func NewGteExp(lhs AstNode, rhs AstNode) *GteExp {
+func NewGteExp(operands ...AstNode) *GteExp {
 	node := new(GteExp)
-	node.AddSubNode(lhs)
-	node.AddSubNode(rhs)
+	for _, operand := range operands {
+		node.AddSubNode(operand)
+	}
 	return node
 }
 func (g GteExp) GetType() AstNodeType {
-	return LteNode
+	return GteNode
 }
 func (g GteExp) DebugString() string {
-	return "GteExp(" + g.subNodes[0].DebugString() + ", " + g.subNodes[1].DebugString() + ")"
+	return operatorDebugString("GteExp", g.subNodes)
 }
 
 type EqExp struct {
 	SExp
 }
 
-func NewEqExp(lhs AstNode, rhs AstNode) *EqExp {
+func NewEqExp(operands ...AstNode) *EqExp {
 	node := new(EqExp)
-	node.AddSubNode(lhs)
-	node.AddSubNode(rhs)
+	for _, operand := range operands {
+		node.AddSubNode(operand)
+	}
 	return node
 }
 func (e EqExp) GetType() AstNodeType {
 	return EqNode
 }
 func (e EqExp) DebugString() string {
-	return "EqExp(" + e.subNodes[0].DebugString() + ", " + e.subNodes[1].DebugString() + ")"
+	return operatorDebugString("EqExp", e.subNodes)
 }
 
+// IfExp's sub-nodes are the condition followed by the consequent and, unless
+// the if is one-armed, the alternative. Both branches are in tail position.
 type IfExp struct {
 	SExp
 }
@@ -232,13 +316,342 @@ func NewIfExp(cond AstNode, onTrue AstNode, onFalse AstNode) *IfExp {
 	node.AddSubNode(onFalse)
 	return node
 }
+
+// NewOneArmedIfExp creates an if with no alternative, whose value is unspecified
+// when the condition is false
+func NewOneArmedIfExp(cond AstNode, onTrue AstNode) *IfExp {
+	node := new(IfExp)
+	node.AddSubNode(cond)
+	node.AddSubNode(onTrue)
+	return node
+}
 func (i IfExp) GetType() AstNodeType {
 	return IfNode
 }
 func (i IfExp) DebugString() string {
+	if len(i.subNodes) == 2 {
+		return "IfExp(" + i.subNodes[0].DebugString() + ", " + i.subNodes[1].DebugString() + ")"
+	}
 	return "IfExp(" + i.subNodes[0].DebugString() + ", " + i.subNodes[1].DebugString() + ", " + i.subNodes[2].DebugString() + ")"
 }
 
+// CondExp tries each of its CondClause sub-nodes in turn, evaluating the first
+// one whose test passes
+type CondExp struct {
+	SExp
+}
+
+func NewCondExp(clauses ...*CondClause) *CondExp {
+	node := new(CondExp)
+	for _, clause := range clauses {
+		node.AddSubNode(clause)
+	}
+	return node
+}
+func (c CondExp) GetType() AstNodeType {
+	return CondNode
+}
+func (c CondExp) DebugString() string {
+	return "CondExp(" + bodyDebugString(c.subNodes) + ")"
+}
+
+// CondClause is one clause of a cond. Its sub-nodes are the test followed by the
+// body, except for an else clause, which has no test. The last body expression
+// is in tail position, and a clause without a body yields the value of its test.
+// An arrow clause has a single body expression giving the procedure to call
+// with the test's value, with the call being in tail position.
+type CondClause struct {
+	SExp
+	Else  bool
+	Arrow bool
+}
+
+func NewCondClause(test AstNode, body ...AstNode) *CondClause {
+	node := new(CondClause)
+	node.AddSubNode(test)
+	for _, exp := range body {
+		node.AddSubNode(exp)
+	}
+	return node
+}
+
+// NewCondArrowClause creates a (test => receiver) clause
+func NewCondArrowClause(test AstNode, receiver AstNode) *CondClause {
+	node := NewCondClause(test, receiver)
+	node.Arrow = true
+	return node
+}
+
+// NewCondElseClause creates an else clause, which has to come last
+func NewCondElseClause(body ...AstNode) *CondClause {
+	node := new(CondClause)
+	node.Else = true
+	for _, exp := range body {
+		node.AddSubNode(exp)
+	}
+	return node
+}
+func (c CondClause) GetType() AstNodeType {
+	return CondClauseNode
+}
+func (c CondClause) DebugString() string {
+	switch {
+	case c.Else:
+		return "CondClause(else, " + bodyDebugString(c.subNodes) + ")"
+	case c.Arrow:
+		return "CondClause(" + c.subNodes[0].DebugString() + " => " + c.subNodes[1].DebugString() + ")"
+	}
+	return "CondClause(" + bodyDebugString(c.subNodes) + ")"
+}
+
+// CaseExp's sub-nodes are the key followed by CaseClauses; the first clause
+// with a datum matching the key (per eqv?) gets evaluated
+type CaseExp struct {
+	SExp
+}
+
+func NewCaseExp(key AstNode, clauses ...*CaseClause) *CaseExp {
+	node := new(CaseExp)
+	node.AddSubNode(key)
+	for _, clause := range clauses {
+		node.AddSubNode(clause)
+	}
+	return node
+}
+func (c CaseExp) GetType() AstNodeType {
+	return CaseNode
+}
+func (c CaseExp) DebugString() string {
+	return "CaseExp(" + bodyDebugString(c.subNodes) + ")"
+}
+
+// CaseClause is one clause of a case, with the data to match held as literal
+// nodes and the sub-nodes being the body. The last body expression is in tail
+// position. An arrow clause has a single body expression giving the procedure
+// to call with the key, with the call being in tail position.
+type CaseClause struct {
+	SExp
+	Data  []AstNode
+	Else  bool
+	Arrow bool
+}
+
+func NewCaseClause(data []AstNode, body ...AstNode) *CaseClause {
+	node := new(CaseClause)
+	node.Data = append([]AstNode(nil), data...)
+	for _, exp := range body {
+		node.AddSubNode(exp)
+	}
+	return node
+}
+
+// NewCaseArrowClause creates a ((data ...) => receiver) clause
+func NewCaseArrowClause(data []AstNode, receiver AstNode) *CaseClause {
+	node := NewCaseClause(data, receiver)
+	node.Arrow = true
+	return node
+}
+
+// NewCaseElseClause creates an else clause, which has to come last
+func NewCaseElseClause(body ...AstNode) *CaseClause {
+	node := NewCaseClause(nil, body...)
+	node.Else = true
+	return node
+}
+
+// NewCaseElseArrowClause creates an (else => receiver) clause
+func NewCaseElseArrowClause(receiver AstNode) *CaseClause {
+	node := NewCaseElseClause(receiver)
+	node.Arrow = true
+	return node
+}
+func (c CaseClause) GetType() AstNodeType {
+	return CaseClauseNode
+}
+func (c CaseClause) DebugString() string {
+	data := "else"
+	if !c.Else {
+		dataStrings := make([]string, 0)
+		for _, datum := range c.Data {
+			dataStrings = append(dataStrings, datum.DebugString())
+		}
+		data = "(" + strings.Join(dataStrings, " ") + ")"
+	}
+	if c.Arrow {
+		return "CaseClause(" + data + " => " + c.subNodes[0].DebugString() + ")"
+	}
+	return "CaseClause(" + data + ", " + bodyDebugString(c.subNodes) + ")"
+}
+
+// AndExp evaluates its sub-nodes left to right, stopping at the first false
+// one; the last is in tail position, and with none the value is #t
+type AndExp struct {
+	SExp
+}
+
+func NewAndExp(exps ...AstNode) *AndExp {
+	node := new(AndExp)
+	for _, exp := range exps {
+		node.AddSubNode(exp)
+	}
+	return node
+}
+func (a AndExp) GetType() AstNodeType {
+	return AndNode
+}
+func (a AndExp) DebugString() string {
+	return "AndExp(" + bodyDebugString(a.subNodes) + ")"
+}
+
+// OrExp evaluates its sub-nodes left to right, stopping at the first true one;
+// the last is in tail position, and with none the value is #f
+type OrExp struct {
+	SExp
+}
+
+func NewOrExp(exps ...AstNode) *OrExp {
+	node := new(OrExp)
+	for _, exp := range exps {
+		node.AddSubNode(exp)
+	}
+	return node
+}
+func (o OrExp) GetType() AstNodeType {
+	return OrNode
+}
+func (o OrExp) DebugString() string {
+	return "OrExp(" + bodyDebugString(o.subNodes) + ")"
+}
+
+// WhenExp's sub-nodes are the test followed by the body, which is evaluated
+// only if the test passes; the last body expression is in tail position
+type WhenExp struct {
+	SExp
+}
+
+func NewWhenExp(test AstNode, body ...AstNode) *WhenExp {
+	node := new(WhenExp)
+	node.AddSubNode(test)
+	for _, exp := range body {
+		node.AddSubNode(exp)
+	}
+	return node
+}
+func (w WhenExp) GetType() AstNodeType {
+	return WhenNode
+}
+func (w WhenExp) DebugString() string {
+	return "WhenExp(" + bodyDebugString(w.subNodes) + ")"
+}
+
+// UnlessExp's sub-nodes are the test followed by the body, which is evaluated
+// only if the test fails; the last body expression is in tail position
+type UnlessExp struct {
+	SExp
+}
+
+func NewUnlessExp(test AstNode, body ...AstNode) *UnlessExp {
+	node := new(UnlessExp)
+	node.AddSubNode(test)
+	for _, exp := range body {
+		node.AddSubNode(exp)
+	}
+	return node
+}
+func (u UnlessExp) GetType() AstNodeType {
+	return UnlessNode
+}
+func (u UnlessExp) DebugString() string {
+	return "UnlessExp(" + bodyDebugString(u.subNodes) + ")"
+}
+
+// BeginExp evaluates its sub-nodes in order, yielding the value of the last,
+// which is in tail position
+type BeginExp struct {
+	SExp
+}
+
+func NewBeginExp(exps ...AstNode) *BeginExp {
+	node := new(BeginExp)
+	for _, exp := range exps {
+		node.AddSubNode(exp)
+	}
+	return node
+}
+func (b BeginExp) GetType() AstNodeType {
+	return BeginNode
+}
+func (b BeginExp) DebugString() string {
+	return "BeginExp(" + bodyDebugString(b.subNodes) + ")"
+}
+
+// DoExp is a loop. Its variables are bound to their inits, then on each
+// iteration the test is evaluated; if it passes the result expressions are
+// evaluated and the last one's value returned (from tail position), otherwise
+// the commands run and the variables are rebound to their steps. A variable
+// without a step keeps its value, so its step is just a reference to itself.
+// The sub-nodes are the inits, the steps, the test, the results and the commands.
+type DoExp struct {
+	SExp
+	Names   []string
+	results int
+}
+
+func NewDoExp(names []string, inits []AstNode, steps []AstNode, test AstNode, results []AstNode, commands ...AstNode) *DoExp {
+	node := new(DoExp)
+	node.Names = append([]string(nil), names...)
+	node.results = len(results)
+	exps := append(append([]AstNode(nil), inits...), steps...)
+	exps = append(append(append(exps, test), results...), commands...)
+	for _, exp := range exps {
+		node.AddSubNode(exp)
+	}
+	return node
+}
+
+// Inits returns the expressions giving the initial value of each variable
+func (d DoExp) Inits() []AstNode {
+	return d.subNodes[:len(d.Names)]
+}
+
+// Steps returns the expressions giving each variable's value on the next iteration
+func (d DoExp) Steps() []AstNode {
+	return d.subNodes[len(d.Names) : 2*len(d.Names)]
+}
+
+// Test returns the expression deciding when the loop ends
+func (d DoExp) Test() AstNode {
+	return d.subNodes[2*len(d.Names)]
+}
+
+// Results returns the expressions evaluated once the loop ends
+func (d DoExp) Results() []AstNode {
+	return d.subNodes[2*len(d.Names)+1 : 2*len(d.Names)+1+d.results]
+}
+
+// Commands returns the expressions evaluated on each iteration
+func (d DoExp) Commands() []AstNode {
+	return d.subNodes[2*len(d.Names)+1+d.results:]
+}
+func (d DoExp) GetType() AstNodeType {
+	return DoNode
+}
+func (d DoExp) DebugString() string {
+	bindingStrings := make([]string, 0)
+	for index, name := range d.Names {
+		bindingStrings = append(bindingStrings, "("+name+" "+d.Inits()[index].DebugString()+" "+d.Steps()[index].DebugString()+")")
+	}
+	testStrings := []string{d.Test().DebugString()}
+	for _, result := range d.Results() {
+		testStrings = append(testStrings, result.DebugString())
+	}
+	debugString := "DoExp((" + strings.Join(bindingStrings, " ") + "), (" + strings.Join(testStrings, " ") + ")"
+	if len(d.Commands()) > 0 {
+		debugString += ", " + bodyDebugString(d.Commands())
+	}
+	return debugString + ")"
+}
+
 type DefExp struct {
 	SExp
 	Name string
@@ -257,316 +670,1921 @@ func (d DefExp) DebugString() string {
 	return "DefExp(" + d.Name + ", " + d.subNodes[0].DebugString() + ")"
 }
 
+// SetExp assigns a new value to an existing binding, which may be a global, a
+// local or a variable captured by a closure
+type SetExp struct {
+	SExp
+	Name string
+	// whether the name refers to a top-level binding rather than a local one
+	Global bool
+}
+
+func NewSetExp(name string, exp AstNode) *SetExp {
+	node := new(SetExp)
+	node.Name = name
+	node.AddSubNode(exp)
+	return node
+}
+func (s SetExp) GetType() AstNodeType {
+	return SetNode
+}
+func (s SetExp) DebugString() string {
+	return "SetExp(" + s.Name + ", " + s.subNodes[0].DebugString() + ")"
+}
+
+// LambdaExp is a procedure. Its sub-nodes make up the body, with any internal
+// definitions coming first and the value of the last expression being returned.
 type LambdaExp struct {
 	SExp
 	Args []string
+	// name bound to a list of any arguments beyond Args, or empty if there's none
+	Rest string
+}
+
+func NewLambdaExp(args []string, body ...AstNode) *LambdaExp {
+	return NewVariadicLambdaExp(args, "", body...)
 }
 
-func NewLambdaExp(args []string, exp AstNode) *LambdaExp {
+// NewVariadicLambdaExp creates a lambda taking a rest argument after the given
+// fixed arguments, such as (lambda (a b . rest) ...) or (lambda args ...)
+func NewVariadicLambdaExp(args []string, rest string, body ...AstNode) *LambdaExp {
 	node := new(LambdaExp)
 	// copy to avoid the fact that the slice refers to data that could and will
 	// get overwritten
 	node.Args = append([]string(nil), args...)
-	node.AddSubNode(exp)
+	node.Rest = rest
+	for _, exp := range body {
+		node.AddSubNode(exp)
+	}
 	return node
 }
 func (l LambdaExp) GetType() AstNodeType {
 	return LambdaNode
 }
 func (l LambdaExp) DebugString() string {
-	return "LambdaExp(" + strings.Trim(fmt.Sprintf("%v", l.Args), "[]") + ", " + l.subNodes[0].DebugString() + ")"
+	formals := strings.Trim(fmt.Sprintf("%v", l.Args), "[]")
+	if l.Rest != "" {
+		formals = strings.TrimLeft(formals+" . "+l.Rest, " ")
+	}
+	return "LambdaExp(" + formals + ", " + bodyDebugString(l.subNodes) + ")"
 }
 
-type IdentExp struct {
+// CallExp applies a procedure to arguments. The first sub-node is the expression
+// giving the procedure, with the arguments following it.
+type CallExp struct {
 	SExp
-	Name string
 }
 
-func NewIdentExp(name string) *IdentExp {
-	node := new(IdentExp)
-	node.Name = name
+func NewCallExp(operator AstNode, args ...AstNode) *CallExp {
+	node := new(CallExp)
+	node.AddSubNode(operator)
+	for _, arg := range args {
+		node.AddSubNode(arg)
+	}
 	return node
 }
-func (i IdentExp) GetType() AstNodeType {
-	return IdentNode
+func (c CallExp) GetType() AstNodeType {
+	return CallNode
 }
-func (i IdentExp) DebugString() string {
-	return i.Name
+func (c CallExp) DebugString() string {
+	subStrings := make([]string, 0)
+	for _, subNode := range c.subNodes {
+		subStrings = append(subStrings, subNode.DebugString())
+	}
+	return "CallExp(" + strings.Join(subStrings, ", ") + ")"
 }
 
-type IntLiteral struct {
+// Formals are the parameters of a procedure, or the names a let-values binding
+// receives its values into
+type Formals struct {
+	Args []string
+	// name bound to a list of any values beyond Args, or empty if there's none
+	Rest string
+}
+
+// String writes the formals out the way they appear in source
+func (f Formals) String() string {
+	if len(f.Args) == 0 && f.Rest != "" {
+		return f.Rest
+	}
+	written := "(" + strings.Join(f.Args, " ")
+	if f.Rest != "" {
+		written += " . " + f.Rest
+	}
+	return written + ")"
+}
+
+// bindingExp is what the let family shares: one name per binding, with the
+// sub-nodes being the init expressions, one per binding, followed by the body
+type bindingExp struct {
 	SExp
-	Value int64
+	Names []string
 }
 
-func NewIntLiteral(value int64) *IntLiteral {
-	node := new(IntLiteral)
-	node.Value = value
+func newBindingExp(names []string, inits []AstNode, body []AstNode) bindingExp {
+	node := bindingExp{Names: append([]string(nil), names...)}
+	for _, exp := range append(append([]AstNode(nil), inits...), body...) {
+		node.AddSubNode(exp)
+	}
 	return node
 }
-func (i IntLiteral) GetType() AstNodeType {
-	return IntNode
+
+// Inits returns the expressions giving the initial value of each binding
+func (b bindingExp) Inits() []AstNode {
+	return b.subNodes[:len(b.Names)]
 }
-func (i IntLiteral) DebugString() string {
-	return strconv.FormatInt(i.Value, 10)
+
+// Body returns the body expressions, internal definitions included
+func (b bindingExp) Body() []AstNode {
+	return b.subNodes[len(b.Names):]
 }
 
-type FloatLiteral struct {
-	SExp
-	Value float64
+// debugString formats the bindings and body, following on from the given prefix
+func (b bindingExp) debugString(prefix string) string {
+	bindingStrings := make([]string, 0)
+	for index, init := range b.Inits() {
+		bindingStrings = append(bindingStrings, "("+b.Names[index]+" "+init.DebugString()+")")
+	}
+	return prefix + strings.Join(bindingStrings, " ") + ", " + bodyDebugString(b.Body()) + ")"
 }
 
-func NewFloatLiteral(value float64) *FloatLiteral {
-	node := new(FloatLiteral)
-	node.Value = value
-	return node
+// bodyDebugString formats a sequence of body expressions
+func bodyDebugString(body []AstNode) string {
+	bodyStrings := make([]string, 0)
+	for _, exp := range body {
+		bodyStrings = append(bodyStrings, exp.DebugString())
+	}
+	return strings.Join(bodyStrings, ", ")
 }
-func (f FloatLiteral) GetType() AstNodeType {
-	return FloatNode
+
+// LetExp binds each name to the value of its init, with every init evaluated
+// in the enclosing scope
+type LetExp struct {
+	bindingExp
 }
-func (f FloatLiteral) DebugString() string {
-	return strconv.FormatFloat(f.Value, 'g', -1, 64)
+
+func NewLetExp(names []string, inits []AstNode, body ...AstNode) *LetExp {
+	return &LetExp{newBindingExp(names, inits, body)}
+}
+func (l LetExp) GetType() AstNodeType {
+	return LetNode
+}
+func (l LetExp) DebugString() string {
+	return l.debugString("LetExp(")
 }
 
-type StringLiteral struct {
-	SExp
-	Value string
+// LetStarExp binds names one after the other, so each init can see the
+// bindings before it
+type LetStarExp struct {
+	bindingExp
 }
 
-func NewStringLiteral(value string) *StringLiteral {
-	node := new(StringLiteral)
-	node.Value = value
-	return node
+func NewLetStarExp(names []string, inits []AstNode, body ...AstNode) *LetStarExp {
+	return &LetStarExp{newBindingExp(names, inits, body)}
 }
-func (s StringLiteral) GetType() AstNodeType {
-	return StringNode
+func (l LetStarExp) GetType() AstNodeType {
+	return LetStarNode
 }
-func (s StringLiteral) DebugString() string {
-	return "\"" + s.Value + "\""
+func (l LetStarExp) DebugString() string {
+	return l.debugString("LetStarExp(")
 }
 
-type BoolLiteral struct {
-	SExp
-	Value bool
+// LetrecExp binds every name before evaluating any init, so the inits can refer
+// to each other; typically they're mutually recursive lambdas
+type LetrecExp struct {
+	bindingExp
 }
 
-func NewBoolLiteral(value bool) *BoolLiteral {
-	node := new(BoolLiteral)
-	node.Value = value
-	return node
+func NewLetrecExp(names []string, inits []AstNode, body ...AstNode) *LetrecExp {
+	return &LetrecExp{newBindingExp(names, inits, body)}
 }
-func (b BoolLiteral) GetType() AstNodeType {
-	return BoolNode
+func (l LetrecExp) GetType() AstNodeType {
+	return LetrecNode
 }
-func (b BoolLiteral) DebugString() string {
-	return strconv.FormatBool(b.Value)
+func (l LetrecExp) DebugString() string {
+	return l.debugString("LetrecExp(")
 }
 
-// ParseTokens takes tokens and returns an AST (Abstract Syntax Tree) representation
-func ParseTokens(tokens []*Token) *Program {
-	program := NewProgram()
-	currentIndex := 0
-	for len(tokens)-1 >= currentIndex {
-		node, _ := parseExpression(tokens, &currentIndex)
-		program.AddSubNode(node)
-	}
-	return program
+// LetrecStarExp is a LetrecExp whose inits are evaluated and assigned left to right
+type LetrecStarExp struct {
+	bindingExp
+}
+
+func NewLetrecStarExp(names []string, inits []AstNode, body ...AstNode) *LetrecStarExp {
+	return &LetrecStarExp{newBindingExp(names, inits, body)}
+}
+func (l LetrecStarExp) GetType() AstNodeType {
+	return LetrecStarNode
+}
+func (l LetrecStarExp) DebugString() string {
+	return l.debugString("LetrecStarExp(")
+}
+
+// NamedLetExp is a let whose body is also bound to Name as a procedure taking
+// the bindings as arguments, which is how loops get written. The inits are
+// evaluated in the enclosing scope, where Name isn't visible.
+type NamedLetExp struct {
+	bindingExp
+	Name string
+}
+
+func NewNamedLetExp(name string, names []string, inits []AstNode, body ...AstNode) *NamedLetExp {
+	return &NamedLetExp{newBindingExp(names, inits, body), name}
+}
+func (n NamedLetExp) GetType() AstNodeType {
+	return NamedLetNode
+}
+func (n NamedLetExp) DebugString() string {
+	return n.debugString("NamedLetExp(" + n.Name + ", ")
+}
+
+// valuesBindingExp is what let-values and let*-values share: one set of formals
+// per binding, receiving the values its init returns
+type valuesBindingExp struct {
+	SExp
+	Formals []Formals
 }
 
-// accept checks to see if the current token matches a given token type, and advances if so
-func accept(tokens []*Token, expectedType TokenType, currentIndex *int) bool {
-	if tokens[*currentIndex].Type == expectedType {
-		*currentIndex++
-		return true
+func newValuesBindingExp(formals []Formals, inits []AstNode, body []AstNode) valuesBindingExp {
+	node := valuesBindingExp{Formals: append([]Formals(nil), formals...)}
+	for _, exp := range append(append([]AstNode(nil), inits...), body...) {
+		node.AddSubNode(exp)
 	}
-	return false
+	return node
+}
+
+// Inits returns the expressions giving the values of each binding
+func (v valuesBindingExp) Inits() []AstNode {
+	return v.subNodes[:len(v.Formals)]
 }
 
-// grabAccepted returns the token just before current, useful for grabbing the value of an accepted token
-func grabAccepted(tokens []*Token, currentIndex *int) *Token {
-	return tokens[*currentIndex-1]
+// Body returns the body expressions, internal definitions included
+func (v valuesBindingExp) Body() []AstNode {
+	return v.subNodes[len(v.Formals):]
 }
 
-// expect returns an error if the current token doesn't match the given type
-func expect(tokens []*Token, expectedType TokenType, currentIndex *int) error {
-	if len(tokens)-1 < *currentIndex {
-		return errors.New("Unexpected EOF")
-	} else if tokens[*currentIndex].Type != expectedType {
-		return errors.New("Unexpected token " + tokens[*currentIndex].Value.String())
+// debugString formats the bindings and body, following on from the given prefix
+func (v valuesBindingExp) debugString(prefix string) string {
+	bindingStrings := make([]string, 0)
+	for index, init := range v.Inits() {
+		bindingStrings = append(bindingStrings, "("+v.Formals[index].String()+" "+init.DebugString()+")")
 	}
-	return nil
+	return prefix + strings.Join(bindingStrings, " ") + ", " + bodyDebugString(v.Body()) + ")"
 }
 
-func parseExpression(tokens []*Token, currentIndex *int) (AstNode, error) {
+// LetValuesExp binds the values returned by each init, with every init
+// evaluated in the enclosing scope
+type LetValuesExp struct {
+	valuesBindingExp
+}
+
+func NewLetValuesExp(formals []Formals, inits []AstNode, body ...AstNode) *LetValuesExp {
+	return &LetValuesExp{newValuesBindingExp(formals, inits, body)}
+}
+func (l LetValuesExp) GetType() AstNodeType {
+	return LetValuesNode
+}
+func (l LetValuesExp) DebugString() string {
+	return l.debugString("LetValuesExp(")
+}
+
+// LetStarValuesExp binds values one binding after the other, so each init can
+// see the bindings before it
+type LetStarValuesExp struct {
+	valuesBindingExp
+}
+
+func NewLetStarValuesExp(formals []Formals, inits []AstNode, body ...AstNode) *LetStarValuesExp {
+	return &LetStarValuesExp{newValuesBindingExp(formals, inits, body)}
+}
+func (l LetStarValuesExp) GetType() AstNodeType {
+	return LetStarValuesNode
+}
+func (l LetStarValuesExp) DebugString() string {
+	return l.debugString("LetStarValuesExp(")
+}
+
+type IdentExp struct {
+	SExp
+	Name string
+	// whether the name refers to a top-level binding rather than a local one
+	Global bool
+}
+
+func NewIdentExp(name string) *IdentExp {
+	node := new(IdentExp)
+	node.Name = name
+	return node
+}
+func (i IdentExp) GetType() AstNodeType {
+	return IdentNode
+}
+func (i IdentExp) DebugString() string {
+	return i.Name
+}
+
+type IntLiteral struct {
+	SExp
+	Value int64
+}
+
+func NewIntLiteral(value int64) *IntLiteral {
+	node := new(IntLiteral)
+	node.Value = value
+	return node
+}
+func (i IntLiteral) GetType() AstNodeType {
+	return IntNode
+}
+func (i IntLiteral) DebugString() string {
+	return strconv.FormatInt(i.Value, 10)
+}
+
+type FloatLiteral struct {
+	SExp
+	Value float64
+}
+
+func NewFloatLiteral(value float64) *FloatLiteral {
+	node := new(FloatLiteral)
+	node.Value = value
+	return node
+}
+func (f FloatLiteral) GetType() AstNodeType {
+	return FloatNode
+}
+func (f FloatLiteral) DebugString() string {
+	return strconv.FormatFloat(f.Value, 'g', -1, 64)
+}
+
+type RationalLiteral struct {
+	SExp
+	Numerator   int64
+	Denominator int64
+}
+
+func NewRationalLiteral(numerator int64, denominator int64) *RationalLiteral {
+	node := new(RationalLiteral)
+	node.Numerator = numerator
+	node.Denominator = denominator
+	return node
+}
+func (r RationalLiteral) GetType() AstNodeType {
+	return RationalNode
+}
+func (r RationalLiteral) DebugString() string {
+	return strconv.FormatInt(r.Numerator, 10) + "/" + strconv.FormatInt(r.Denominator, 10)
+}
+
+type StringLiteral struct {
+	SExp
+	Value string
+}
+
+func NewStringLiteral(value string) *StringLiteral {
+	node := new(StringLiteral)
+	node.Value = value
+	return node
+}
+func (s StringLiteral) GetType() AstNodeType {
+	return StringNode
+}
+func (s StringLiteral) DebugString() string {
+	return "\"" + s.Value + "\""
+}
+
+type BoolLiteral struct {
+	SExp
+	Value bool
+}
+
+func NewBoolLiteral(value bool) *BoolLiteral {
+	node := new(BoolLiteral)
+	node.Value = value
+	return node
+}
+func (b BoolLiteral) GetType() AstNodeType {
+	return BoolNode
+}
+func (b BoolLiteral) DebugString() string {
+	return strconv.FormatBool(b.Value)
+}
+
+type CharLiteral struct {
+	SExp
+	Value rune
+}
+
+func NewCharLiteral(value rune) *CharLiteral {
+	node := new(CharLiteral)
+	node.Value = value
+	return node
+}
+func (c CharLiteral) GetType() AstNodeType {
+	return CharNode
+}
+func (c CharLiteral) DebugString() string {
+	// print named characters by name to keep the output readable
+	for name, char := range charNames {
+		if char == c.Value {
+			return "#\\" + name
+		}
+	}
+	if !unicode.IsPrint(c.Value) {
+		return "#\\x" + strconv.FormatInt(int64(c.Value), 16)
+	}
+	return "#\\" + string(c.Value)
+}
+
+type SymbolLiteral struct {
+	SExp
+	Name string
+}
+
+func NewSymbolLiteral(name string) *SymbolLiteral {
+	node := new(SymbolLiteral)
+	node.Name = name
+	return node
+}
+func (s SymbolLiteral) GetType() AstNodeType {
+	return SymbolNode
+}
+func (s SymbolLiteral) DebugString() string {
+	return s.Name
+}
+
+// ListLiteral is a list appearing within quoted data. Dotted lists keep
+// their tail as the last sub-node.
+type ListLiteral struct {
+	SExp
+	Dotted bool
+}
+
+func NewListLiteral(elements ...AstNode) *ListLiteral {
+	node := new(ListLiteral)
+	for _, element := range elements {
+		node.AddSubNode(element)
+	}
+	return node
+}
+
+// NewDottedListLiteral creates an improper list, such as (a b . c)
+func NewDottedListLiteral(tail AstNode, elements ...AstNode) *ListLiteral {
+	node := NewListLiteral(elements...)
+	node.AddSubNode(tail)
+	node.Dotted = true
+	return node
+}
+func (l ListLiteral) GetType() AstNodeType {
+	return ListNode
+}
+func (l ListLiteral) DebugString() string {
+	elements := make([]string, 0)
+	for index, element := range l.subNodes {
+		if l.Dotted && index == len(l.subNodes)-1 {
+			elements = append(elements, ".")
+		}
+		elements = append(elements, element.DebugString())
+	}
+	return "(" + strings.Join(elements, " ") + ")"
+}
+
+// VectorLiteral is a #(...) vector, whose elements are data rather than expressions
+type VectorLiteral struct {
+	SExp
+}
+
+func NewVectorLiteral(elements ...AstNode) *VectorLiteral {
+	node := new(VectorLiteral)
+	for _, element := range elements {
+		node.AddSubNode(element)
+	}
+	return node
+}
+func (v VectorLiteral) GetType() AstNodeType {
+	return VectorNode
+}
+func (v VectorLiteral) DebugString() string {
+	elements := make([]string, 0)
+	for _, element := range v.subNodes {
+		elements = append(elements, element.DebugString())
+	}
+	return "#(" + strings.Join(elements, " ") + ")"
+}
+
+type BytevectorLiteral struct {
+	SExp
+	Value []byte
+}
+
+func NewBytevectorLiteral(value []byte) *BytevectorLiteral {
+	node := new(BytevectorLiteral)
+	node.Value = append([]byte(nil), value...)
+	return node
+}
+func (b BytevectorLiteral) GetType() AstNodeType {
+	return BytevectorNode
+}
+func (b BytevectorLiteral) DebugString() string {
+	elements := make([]string, 0)
+	for _, element := range b.Value {
+		elements = append(elements, strconv.Itoa(int(element)))
+	}
+	return "#u8(" + strings.Join(elements, " ") + ")"
+}
+
+type QuoteExp struct {
+	SExp
+}
+
+func NewQuoteExp(datum AstNode) *QuoteExp {
+	node := new(QuoteExp)
+	node.AddSubNode(datum)
+	return node
+}
+func (q QuoteExp) GetType() AstNodeType {
+	return QuoteNode
+}
+func (q QuoteExp) DebugString() string {
+	return "QuoteExp(" + q.subNodes[0].DebugString() + ")"
+}
+
+// QuasiquoteExp holds a template which may contain unquoted expressions. Level is
+// the quasiquote nesting depth, where 1 is the outermost quasiquote; unquotes only
+// get evaluated when they're at level 1.
+type QuasiquoteExp struct {
+	SExp
+	Level int
+}
+
+func NewQuasiquoteExp(level int, template AstNode) *QuasiquoteExp {
+	node := new(QuasiquoteExp)
+	node.Level = level
+	node.AddSubNode(template)
+	return node
+}
+func (q QuasiquoteExp) GetType() AstNodeType {
+	return QuasiquoteNode
+}
+func (q QuasiquoteExp) DebugString() string {
+	return "QuasiquoteExp(" + q.subNodes[0].DebugString() + ")"
+}
+
+// UnquoteExp holds an expression to evaluate if Level is 1, or more of the
+// template if this is an unquote within a nested quasiquote
+type UnquoteExp struct {
+	SExp
+	Level int
+}
+
+func NewUnquoteExp(level int, exp AstNode) *UnquoteExp {
+	node := new(UnquoteExp)
+	node.Level = level
+	node.AddSubNode(exp)
+	return node
+}
+func (u UnquoteExp) GetType() AstNodeType {
+	return UnquoteNode
+}
+func (u UnquoteExp) DebugString() string {
+	return "UnquoteExp(" + u.subNodes[0].DebugString() + ")"
+}
+
+// UnquoteSplicingExp works like UnquoteExp, except that the resulting list gets
+// spliced into the enclosing list
+type UnquoteSplicingExp struct {
+	SExp
+	Level int
+}
+
+func NewUnquoteSplicingExp(level int, exp AstNode) *UnquoteSplicingExp {
+	node := new(UnquoteSplicingExp)
+	node.Level = level
+	node.AddSubNode(exp)
+	return node
+}
+func (u UnquoteSplicingExp) GetType() AstNodeType {
+	return UnquoteSplicingNode
+}
+func (u UnquoteSplicingExp) DebugString() string {
+	return "UnquoteSplicingExp(" + u.subNodes[0].DebugString() + ")"
+}
+
+// DefineSyntaxExp records a macro definition. The macro itself lives on in the
+// parser, which expands its uses into MacroUseExps.
+type DefineSyntaxExp struct {
+	SExp
+	Name string
+}
+
+func NewDefineSyntaxExp(name string) *DefineSyntaxExp {
+	node := new(DefineSyntaxExp)
+	node.Name = name
+	return node
+}
+func (d DefineSyntaxExp) GetType() AstNodeType {
+	return DefineSyntaxNode
+}
+func (d DefineSyntaxExp) DebugString() string {
+	return "DefineSyntaxExp(" + d.Name + ")"
+}
+
+// MacroUseExp is a use of a macro. Its single sub-node is what the use expanded
+// into, which can hold further macro uses of its own.
+type MacroUseExp struct {
+	SExp
+	// the form as written, macro keyword and all
+	Form Datum
+}
+
+func NewMacroUseExp(form Datum, expansion AstNode) *MacroUseExp {
+	node := new(MacroUseExp)
+	node.Form = form
+	node.AddSubNode(expansion)
+	return node
+}
+func (m MacroUseExp) GetType() AstNodeType {
+	return MacroUseNode
+}
+func (m MacroUseExp) DebugString() string {
+	return "MacroUseExp(" + m.Form.String() + ")"
+}
+
+// DefineLibraryExp is an R7RS library. Its sub-nodes are the library's imports
+// followed by its body, and the library's definitions get its name put in front,
+// so (define x 1) in (foo bar) becomes DefExp(foo/bar/x, 1).
+type DefineLibraryExp struct {
+	SExp
+	Name string
+	// the names the library exports its bindings under
+	Exports []string
+}
+
+func NewDefineLibraryExp(name string, exports []string, body ...AstNode) *DefineLibraryExp {
+	node := new(DefineLibraryExp)
+	node.Name = name
+	node.Exports = append([]string(nil), exports...)
+	for _, exp := range body {
+		node.AddSubNode(exp)
+	}
+	return node
+}
+func (d DefineLibraryExp) GetType() AstNodeType {
+	return DefineLibraryNode
+}
+func (d DefineLibraryExp) DebugString() string {
+	debugString := "DefineLibraryExp(" + d.Name + ", (" + strings.Join(d.Exports, " ") + ")"
+	if len(d.subNodes) > 0 {
+		debugString += ", " + bodyDebugString(d.subNodes)
+	}
+	return debugString + ")"
+}
+
+// ImportExp makes the bindings of libraries visible. Its sub-nodes are any
+// libraries loaded from the search path for the first time by the import.
+type ImportExp struct {
+	SExp
+	// the import sets as written, such as (only (foo bar) baz)
+	Sets []string
+}
+
+func NewImportExp(sets []string, libraries ...AstNode) *ImportExp {
+	node := new(ImportExp)
+	node.Sets = append([]string(nil), sets...)
+	for _, library := range libraries {
+		node.AddSubNode(library)
+	}
+	return node
+}
+func (i ImportExp) GetType() AstNodeType {
+	return ImportNode
+}
+func (i ImportExp) DebugString() string {
+	return "ImportExp(" + strings.Join(i.Sets, ", ") + ")"
+}
+
+// RecordField is one field of a record type, along with the procedures defined
+// to get at it. Modifier is empty for a field that can't be changed.
+type RecordField struct {
+	Name     string
+	Accessor string
+	Modifier string
+}
+
+// DefineRecordTypeExp defines a new record type, along with a constructor, a type
+// predicate and the accessors and modifiers for its fields. Records are a type of
+// their own at runtime rather than being built out of lists or vectors.
+type DefineRecordTypeExp struct {
+	SExp
+	Name        string
+	Constructor string
+	// the fields the constructor takes, in the order it takes them
+	ConstructorFields []string
+	Predicate         string
+	Fields            []RecordField
+}
+
+func NewDefineRecordTypeExp(name string, constructor string, constructorFields []string, predicate string, fields ...RecordField) *DefineRecordTypeExp {
+	node := new(DefineRecordTypeExp)
+	node.Name = name
+	node.Constructor = constructor
+	node.ConstructorFields = append([]string(nil), constructorFields...)
+	node.Predicate = predicate
+	node.Fields = append([]RecordField(nil), fields...)
+	return node
+}
+func (d DefineRecordTypeExp) GetType() AstNodeType {
+	return DefineRecordTypeNode
+}
+func (d DefineRecordTypeExp) DebugString() string {
+	constructor := strings.Join(append([]string{d.Constructor}, d.ConstructorFields...), " ")
+	debugStrings := []string{d.Name, "(" + constructor + ")", d.Predicate}
+	for _, field := range d.Fields {
+		fieldString := field.Name + " " + field.Accessor
+		if field.Modifier != "" {
+			fieldString += " " + field.Modifier
+		}
+		debugStrings = append(debugStrings, "("+fieldString+")")
+	}
+	return "DefineRecordTypeExp(" + strings.Join(debugStrings, ", ") + ")"
+}
+
+// ParseError describes a form that could not be read or parsed.
+type ParseError struct {
+	Span Span
+	// what the parser was looking for, and what it found instead
+	Expected string
+	Found    string
+	// the library or included file the error is in, or empty if it's in the
+	// source text being parsed
+	File string
+}
+
+func (e ParseError) Error() string {
+	location := e.Span.Start.String()
+	if e.File != "" {
+		location = e.File + ":" + location
+	}
+	if e.Expected == "" {
+		return "Unexpected " + e.Found + " at " + location
+	}
+	return "Expected " + e.Expected + ", found " + e.Found + " at " + location
+}
+
+// ParseTokens takes tokens and returns an AST (Abstract Syntax Tree) representation.
+// The tokens are read into generic data first, which then gets parsed into AST nodes,
+// with macro uses being expanded along the way.
+// A form that fails to read or parse is reported and skipped, with parsing picking
+// back up at the next top-level form so every problem gets reported in one go.
+// Libraries and included files are looked for in the current directory.
+func ParseTokens(tokens []*Token) (*Program, []ParseError) {
+	return ParseTokensWithPath(tokens, []string{"."})
+}
+
+// ParseTokensWithPath is like ParseTokens, but looks for imported libraries and
+// included files in the given directories, in order.
+func ParseTokensWithPath(tokens []*Token, searchPath []string) (*Program, []ParseError) {
+	program := NewProgram()
+	parseErrors := make([]ParseError, 0)
+	reader := NewDatumReaderTokens(tokens)
+	// macros defined by one form are available to the forms after it
+	env := newGlobalEnv()
+	env.state.searchPath = searchPath
+	for {
+		datum, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			parseErrors = append(parseErrors, toParseError(err))
+			continue
+		}
+		node, err := parseExpression(datum, env)
+		if err != nil {
+			parseErrors = append(parseErrors, toParseError(err))
+			continue
+		}
+		program.AddSubNode(node)
+	}
+	for _, err := range env.checkAssignments() {
+		parseErrors = append(parseErrors, toParseError(err))
+	}
+	if len(tokens) > 0 {
+		program.SetSpan(Span{tokens[0].Span.Start, tokens[len(tokens)-1].Span.End})
+	}
+	return program, parseErrors
+}
+
+// toParseError passes ParseErrors through, wrapping anything else
+func toParseError(err error) ParseError {
+	if parseErr, ok := err.(ParseError); ok {
+		return parseErr
+	}
+	return ParseError{Found: err.Error()}
+}
+
+// ParseDatum parses a single datum as an expression, returning its AST representation.
+// Errors are returned as ParseErrors.
+func ParseDatum(datum Datum) (AstNode, error) {
+	return parseExpression(datum, newGlobalEnv())
+}
+
+// syntaxError builds a ParseError pointing at the datum found instead of what was expected
+func syntaxError(expected string, found Datum) error {
+	return ParseError{Span: found.GetSpan(), Expected: expected, Found: found.String()}
+}
+
+// parseExpression parses a single expression, recording the span of source text it covers
+func parseExpression(datum Datum, env *syntaxEnv) (AstNode, error) {
+	node, err := parseNode(datum, env)
+	if err != nil {
+		return nil, err
+	}
+	node.SetSpan(datum.GetSpan())
+	return node, nil
+}
+
+// parseLiteral turns a self-evaluating datum into a literal node
+func parseLiteral(datum Datum) (AstNode, bool) {
+	switch literal := datum.(type) {
+	case *IntDatum:
+		return NewIntLiteral(literal.Value), true
+	case *FloatDatum:
+		return NewFloatLiteral(literal.Value), true
+	case *RationalDatum:
+		return NewRationalLiteral(literal.Numerator, literal.Denominator), true
+	case *StringDatum:
+		return NewStringLiteral(literal.Value), true
+	case *BoolDatum:
+		return NewBoolLiteral(literal.Value), true
+	case *CharDatum:
+		return NewCharLiteral(literal.Value), true
+	case *Bytevector:
+		return NewBytevectorLiteral(literal.Value), true
+	}
+	return nil, false
+}
+
+func parseNode(datum Datum, env *syntaxEnv) (AstNode, error) {
 	// try literals/idents first
-	if accept(tokens, TokenIntLiteral, currentIndex) {
-		literal := grabAccepted(tokens, currentIndex)
-		return NewIntLiteral(bufferToInt(literal.Value)), nil
-	} else if accept(tokens, TokenFloatLiteral, currentIndex) {
-		literal := grabAccepted(tokens, currentIndex)
-		return NewFloatLiteral(bufferToFloat(literal.Value)), nil
-	} else if accept(tokens, TokenStringLiteral, currentIndex) {
-		literal := grabAccepted(tokens, currentIndex)
-		return NewStringLiteral(literal.Value.String()), nil
-	} else if accept(tokens, TokenBoolLiteral, currentIndex) {
-		literal := grabAccepted(tokens, currentIndex)
-		return NewBoolLiteral(literal.Value.Bytes()[0] == 1), nil
-	} else if accept(tokens, TokenIdent, currentIndex) {
-		identToken := grabAccepted(tokens, currentIndex)
-		return NewIdentExp(identToken.Value.String()), nil
-	}
-	// not a literal, attempt to parse an expression
-	lparenError := expect(tokens, TokenLParen, currentIndex)
-	if lparenError != nil {
-		return nil, lparenError
-	}
-	// jump past the lparen
-	*currentIndex++
-	if accept(tokens, TokenOp, currentIndex) {
-		// grab the operator token so we can find out which one it is
-		opToken := grabAccepted(tokens, currentIndex)
-		// parse the left-hand and right hand sides recursively
-		// this also takes care of handling nested expressions
-		lhs, lhsError := parseExpression(tokens, currentIndex)
-		if lhsError != nil {
-			return nil, lhsError
-		}
-		rhs, rhsError := parseExpression(tokens, currentIndex)
-		if rhsError != nil {
-			return nil, rhsError
-		}
-
-		// what sort of operator node do we want to build?
-		var expNode AstNode
-		switch opToken.Value.String() {
-		case "+":
-			expNode = NewAddExp(lhs, rhs)
-		case "-":
-			expNode = NewSubExp(lhs, rhs)
-		case "*":
-			expNode = NewMulExp(lhs, rhs)
-		case "/":
-			expNode = NewDivExp(lhs, rhs)
-		case "<":
-			expNode = NewLtExp(lhs, rhs)
-		case "<=":
-			expNode = NewLteExp(lhs, rhs)
-		case ">":
-			expNode = NewGtExp(lhs, rhs)
-		case ">=":
-			expNode = NewGteExp(lhs, rhs)
-		case "=":
-			expNode = NewEqExp(lhs, rhs)
-		}
-
-		// make sure the expression has a closing rparen
-		expError := closeExp(tokens, currentIndex)
-		if expError != nil {
-			return nil, expError
-		}
-		return expNode, nil
-	}
-	if accept(tokens, TokenIdent, currentIndex) {
-		identToken := grabAccepted(tokens, currentIndex)
-		switch identToken.Value.String() {
-		case "if":
-			// TODO: error-handling here (and throughout the parser!)
-			cond, _ := parseExpression(tokens, currentIndex)
-			ifTrue, _ := parseExpression(tokens, currentIndex)
-			ifFalse, _ := parseExpression(tokens, currentIndex)
-			ifNode := NewIfExp(cond, ifTrue, ifFalse)
-			expError := closeExp(tokens, currentIndex)
-			if expError != nil {
-				return nil, expError
+	if literal, ok := parseLiteral(datum); ok {
+		return literal, nil
+	}
+	switch exp := datum.(type) {
+	case *Symbol, *Alias:
+		variable, ok := env.lookup(exp).(*variableBinding)
+		if !ok {
+			// keywords can't be used as variables
+			return nil, syntaxError("expression", exp)
+		}
+		return newReference(variable), nil
+	case *Vector:
+		// vectors are self-evaluating, so their elements are plain data
+		return parseQuoted(exp, 0, env)
+	case *Pair:
+		return parseCombination(exp, env)
+	}
+	return nil, syntaxError("expression", datum)
+}
+
+// newReference creates a node referring to the given variable
+func newReference(variable *variableBinding) *IdentExp {
+	node := NewIdentExp(variable.Name)
+	node.Global = variable.Global
+	return node
+}
+
+// parseCombination parses a parenthesized expression
+func parseCombination(exp *Pair, env *syntaxEnv) (AstNode, error) {
+	// macro uses don't have to be proper lists, so they get checked for first
+	if isIdentifier(exp.Car) {
+		if _, ok := env.lookup(exp.Car).(*macro); ok {
+			return parseMacroUse(exp, env)
+		}
+	}
+	elements, tail := listElements(exp)
+	if _, ok := tail.(*EmptyList); !ok {
+		return nil, syntaxError("proper list", exp)
+	}
+	if !isIdentifier(elements[0]) {
+		// only a procedure can be applied, which no literal is
+		if _, isPair := elements[0].(*Pair); !isPair {
+			return nil, syntaxError("procedure", elements[0])
+		}
+		return parseCall(elements, env)
+	}
+	operands := elements[1:]
+	switch binding := env.lookup(elements[0]).(type) {
+	case *specialForm:
+		return parseSpecialForm(exp, binding.Keyword, operands, env)
+	case *variableBinding:
+		// the arithmetic and comparison operators get nodes of their own,
+		// unless they've been shadowed by local variables
+		if _, ok := operatorArities[binding.Name]; ok && binding.Global {
+			return parseOperator(exp, binding.Name, operands, env)
+		}
+	}
+	// anything else is a procedure call
+	return parseCall(elements, env)
+}
+
+// parseOperator parses an arithmetic or comparison operator's operands
+func parseOperator(exp Datum, operator string, operands []Datum, env *syntaxEnv) (AstNode, error) {
+	if minOperands := operatorArities[operator]; len(operands) < minOperands {
+		return nil, syntaxError(fmt.Sprintf("at least %d operand(s) for %s", minOperands, operator), exp)
+	}
+	// parse the operands recursively
+	// this also takes care of handling nested expressions
+	subExps, err := parseExpressions(operands, env)
+	if err != nil {
+		return nil, err
+	}
+	// what sort of operator node do we want to build?
+	switch operator {
+	case "+":
+		return NewAddExp(subExps...), nil
+	case "-":
+		return NewSubExp(subExps...), nil
+	case "*":
+		return NewMulExp(subExps...), nil
+	case "/":
+		return NewDivExp(subExps...), nil
+	case "<":
+		return NewLtExp(subExps...), nil
+	case "<=":
+		return NewLteExp(subExps...), nil
+	case ">":
+		return NewGtExp(subExps...), nil
+	case ">=":
+		return NewGteExp(subExps...), nil
+	default:
+		return NewEqExp(subExps...), nil
+	}
+}
+
+// parseMacroUse expands a macro use and parses what it expands into
+func parseMacroUse(exp *Pair, env *syntaxEnv) (AstNode, error) {
+	if env.state.expansionDepth == maxExpansionDepth {
+		return nil, syntaxError("macro expansion to finish", exp)
+	}
+	expanded, uses, err := expandHead(exp, env)
+	if err != nil {
+		return nil, err
+	}
+	env.state.expansionDepth++
+	defer func() { env.state.expansionDepth-- }()
+	node, err := parseExpression(expanded, env)
+	if err != nil {
+		return nil, err
+	}
+	return wrapMacroUses(node, uses), nil
+}
+
+// parseSpecialForm parses one of the forms built into the parser
+func parseSpecialForm(exp *Pair, keyword string, operands []Datum, env *syntaxEnv) (AstNode, error) {
+	switch keyword {
+	case "if":
+		if len(operands) != 2 && len(operands) != 3 {
+			return nil, syntaxError("2 or 3 operands for if", exp)
+		}
+		subExps, err := parseExpressions(operands, env)
+		if err != nil {
+			return nil, err
+		}
+		if len(subExps) == 2 {
+			return NewOneArmedIfExp(subExps[0], subExps[1]), nil
+		}
+		return NewIfExp(subExps[0], subExps[1], subExps[2]), nil
+	case "cond":
+		return parseCond(exp, operands, env)
+	case "case":
+		return parseCase(exp, operands, env)
+	case "and", "or":
+		subExps, err := parseExpressions(operands, env)
+		if err != nil {
+			return nil, err
+		}
+		if keyword == "and" {
+			return NewAndExp(subExps...), nil
+		}
+		return NewOrExp(subExps...), nil
+	case "when", "unless":
+		if len(operands) < 2 {
+			return nil, syntaxError("test and body for "+keyword, exp)
+		}
+		subExps, err := parseExpressions(operands, env)
+		if err != nil {
+			return nil, err
+		}
+		if keyword == "when" {
+			return NewWhenExp(subExps[0], subExps[1:]...), nil
+		}
+		return NewUnlessExp(subExps[0], subExps[1:]...), nil
+	case "begin":
+		if len(operands) == 0 {
+			return nil, syntaxError("at least 1 operand for begin", exp)
+		}
+		subExps, err := parseExpressions(operands, env)
+		if err != nil {
+			return nil, err
+		}
+		return NewBeginExp(subExps...), nil
+	case "do":
+		return parseDo(exp, operands, env)
+	case "define":
+		if len(operands) < 2 {
+			return nil, syntaxError("at least 2 operands for define", exp)
+		}
+		// are we attempting to define a function?
+		if signature, ok := operands[0].(*Pair); ok {
+			if !isIdentifier(signature.Car) {
+				return nil, syntaxError("function name", signature.Car)
+			}
+			// the name is bound first so the function can call itself
+			variable := env.defineVariable(signature.Car)
+			lambdaNode, err := parseLambda(exp, signature.Cdr, operands[1:], env)
+			if err != nil {
+				return nil, err
+			}
+			// the shorthand lambda shares its span with the enclosing define
+			lambdaNode.SetSpan(exp.GetSpan())
+			return NewDefExp(variable.Name, lambdaNode), nil
+		}
+		// defining something besides a function
+		if len(operands) != 2 {
+			return nil, syntaxError("2 operands for define", exp)
+		}
+		if !isIdentifier(operands[0]) {
+			return nil, syntaxError("name", operands[0])
+		}
+		variable := env.defineVariable(operands[0])
+		// this handles longhand lambda definitions too
+		newExp, err := parseExpression(operands[1], env)
+		if err != nil {
+			return nil, err
+		}
+		return NewDefExp(variable.Name, newExp), nil
+	case "set!":
+		if len(operands) != 2 {
+			return nil, syntaxError("2 operands for set!", exp)
+		}
+		if !isIdentifier(operands[0]) {
+			return nil, syntaxError("name", operands[0])
+		}
+		variable, ok := env.lookup(operands[0]).(*variableBinding)
+		if !ok {
+			return nil, syntaxError("variable", operands[0])
+		}
+		if variable.Global && !variable.defined {
+			// the global could still be defined further on
+			global := env.global()
+			global.assignments = append(global.assignments, assignment{variable, operands[0]})
+		}
+		newExp, err := parseExpression(operands[1], env)
+		if err != nil {
+			return nil, err
+		}
+		node := NewSetExp(variable.Name, newExp)
+		node.Global = variable.Global
+		return node, nil
+	case "lambda":
+		if len(operands) < 2 {
+			return nil, syntaxError("at least 2 operands for lambda", exp)
+		}
+		return parseLambda(exp, operands[0], operands[1:], env)
+	case "let":
+		// a name straight after let makes it a named let
+		if len(operands) > 0 && isIdentifier(operands[0]) {
+			return parseNamedLet(exp, operands[0], operands[1:], env)
+		}
+		return parseLet(exp, keyword, operands, env)
+	case "let*", "letrec", "letrec*":
+		return parseLet(exp, keyword, operands, env)
+	case "let-values", "let*-values":
+		return parseLetValues(exp, keyword, operands, env)
+	case "quote":
+		if len(operands) != 1 {
+			return nil, syntaxError("1 operand for quote", exp)
+		}
+		datum, err := parseQuoted(operands[0], 0, env)
+		if err != nil {
+			return nil, err
+		}
+		return NewQuoteExp(datum), nil
+	case "quasiquote":
+		if len(operands) != 1 {
+			return nil, syntaxError("1 operand for quasiquote", exp)
+		}
+		template, err := parseQuoted(operands[0], 1, env)
+		if err != nil {
+			return nil, err
+		}
+		return NewQuasiquoteExp(1, template), nil
+	case "unquote", "unquote-splicing":
+		return nil, syntaxError("enclosing quasiquote", exp)
+	case "define-record-type":
+		return parseDefineRecordType(exp, operands, env)
+	case "define-library":
+		if env.parent != nil {
+			return nil, syntaxError("define-library at top level", exp)
+		}
+		dir := ""
+		if lib := env.library; lib != nil {
+			dir = lib.dir
+		}
+		return parseDefineLibrary(exp, operands, dir, env.state)
+	case "import":
+		return parseImport(exp, operands, env)
+	case "include":
+		return parseInclude(exp, operands, env)
+	case "cond-expand":
+		return parseCondExpand(exp, operands, env)
+	case "define-syntax":
+		if len(operands) != 2 {
+			return nil, syntaxError("2 operands for define-syntax", exp)
+		}
+		if !isIdentifier(operands[0]) {
+			return nil, syntaxError("name", operands[0])
+		}
+		transformer, err := parseSyntaxRules(identifierName(operands[0]), operands[1], env)
+		if err != nil {
+			return nil, err
+		}
+		env.bindings[identifierKey(operands[0])] = transformer
+		return NewDefineSyntaxExp(identifierName(operands[0])), nil
+	case "let-syntax", "letrec-syntax":
+		return parseLetSyntax(exp, keyword, operands, env)
+	}
+	// that leaves syntax-rules, which only makes sense within define-syntax
+	return nil, syntaxError("enclosing define-syntax", exp)
+}
+
+// parseCall parses a procedure call, with the procedure as the first element
+func parseCall(elements []Datum, env *syntaxEnv) (AstNode, error) {
+	subExps, err := parseExpressions(elements, env)
+	if err != nil {
+		return nil, err
+	}
+	return NewCallExp(subExps[0], subExps[1:]...), nil
+}
+
+// parseExpressions parses each of the given data as an expression
+func parseExpressions(data []Datum, env *syntaxEnv) ([]AstNode, error) {
+	nodes := make([]AstNode, 0)
+	for _, datum := range data {
+		node, err := parseExpression(datum, env)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// parseQuoted turns quoted data into literal nodes, recording the span of source
+// text it covers. level is the quasiquote nesting depth, with 0 meaning plain
+// quoted data, where unquotes are just more data.
+func parseQuoted(datum Datum, level int, env *syntaxEnv) (AstNode, error) {
+	node, err := parseQuotedNode(datum, level, env)
+	if err != nil {
+		return nil, err
+	}
+	node.SetSpan(datum.GetSpan())
+	return node, nil
+}
+
+// quotedForm checks whether the datum is a two-element list such as (unquote x),
+// returning the keyword and operand if so
+func quotedForm(datum Datum) (string, Datum, bool) {
+	pair, ok := datum.(*Pair)
+	if !ok || !isIdentifier(pair.Car) {
+		return "", nil, false
+	}
+	elements, tail := listElements(pair)
+	if _, ok := tail.(*EmptyList); !ok || len(elements) != 2 {
+		return "", nil, false
+	}
+	switch keyword := identifierName(pair.Car); keyword {
+	case "quasiquote", "unquote", "unquote-splicing":
+		return keyword, elements[1], true
+	}
+	return "", nil, false
+}
+
+func parseQuotedNode(datum Datum, level int, env *syntaxEnv) (AstNode, error) {
+	if literal, ok := parseLiteral(datum); ok {
+		return literal, nil
+	}
+	switch quoted := datum.(type) {
+	case *Symbol, *Alias:
+		// quoting an identifier a macro introduced gives the plain symbol
+		return NewSymbolLiteral(identifierName(quoted)), nil
+	case *EmptyList:
+		return NewListLiteral(), nil
+	case *Vector:
+		vector := NewVectorLiteral()
+		for _, element := range quoted.Elements {
+			node, err := parseQuoted(element, level, env)
+			if err != nil {
+				return nil, err
+			}
+			vector.AddSubNode(node)
+		}
+		return vector, nil
+	}
+	// within a quasiquote, the special forms need handling
+	if keyword, operand, ok := quotedForm(datum); ok && level > 0 {
+		return parseQuotedForm(keyword, operand, level, env)
+	}
+	list := NewListLiteral()
+	var current Datum = datum
+	for {
+		pair, ok := current.(*Pair)
+		if !ok {
+			break
+		}
+		// (a . ,b) reads as (a unquote b), but still means an unquoted tail
+		if _, _, ok := quotedForm(pair); ok && level > 0 && len(list.subNodes) > 0 {
+			break
+		}
+		element, err := parseQuoted(pair.Car, level, env)
+		if err != nil {
+			return nil, err
+		}
+		list.AddSubNode(element)
+		current = pair.Cdr
+	}
+	if _, ok := current.(*EmptyList); !ok {
+		tail, err := parseQuoted(current, level, env)
+		if err != nil {
+			return nil, err
+		}
+		list.AddSubNode(tail)
+		list.Dotted = true
+	}
+	return list, nil
+}
+
+// parseQuotedForm parses the operand of a quasiquote, unquote or unquote-splicing
+// found within a quasiquote template at the given level
+func parseQuotedForm(keyword string, operand Datum, level int, env *syntaxEnv) (AstNode, error) {
+	switch {
+	case keyword == "quasiquote":
+		template, err := parseQuoted(operand, level+1, env)
+		if err != nil {
+			return nil, err
+		}
+		return NewQuasiquoteExp(level+1, template), nil
+	case level == 1:
+		// unquoted expressions finally get evaluated
+		exp, err := parseExpression(operand, env)
+		if err != nil {
+			return nil, err
+		}
+		if keyword == "unquote" {
+			return NewUnquoteExp(level, exp), nil
+		}
+		return NewUnquoteSplicingExp(level, exp), nil
+	}
+	template, err := parseQuoted(operand, level-1, env)
+	if err != nil {
+		return nil, err
+	}
+	if keyword == "unquote" {
+		return NewUnquoteExp(level, template), nil
+	}
+	return NewUnquoteSplicingExp(level, template), nil
+}
+
+// parseLambda parses the formals and body of a lambda or shorthand define
+func parseLambda(exp Datum, formals Datum, body []Datum, env *syntaxEnv) (*LambdaExp, error) {
+	args, rest, err := parseFormals(formals)
+	if err != nil {
+		return nil, err
+	}
+	lambdaEnv := env.extend()
+	bound := bindFormals(lambdaEnv, args, rest)
+	bodyExps, err := parseBody(exp, body, lambdaEnv)
+	if err != nil {
+		return nil, err
+	}
+	return NewVariadicLambdaExp(bound.Args, bound.Rest, bodyExps...), nil
+}
+
+// parseFormals parses the formals of a function/lambda: a list of argument names,
+// which can be dotted to take a rest argument, or a lone name taking every argument.
+// The rest argument is nil if there's none.
+func parseFormals(formals Datum) ([]Datum, Datum, error) {
+	funcArgs := make([]Datum, 0)
+	seen := make(map[interface{}]bool)
+	// checkArg checks the argument is a name that hasn't been used yet
+	checkArg := func(arg Datum) error {
+		if !isIdentifier(arg) {
+			return syntaxError("argument name", arg)
+		}
+		if seen[identifierKey(arg)] {
+			return syntaxError("distinct argument names", arg)
+		}
+		seen[identifierKey(arg)] = true
+		return nil
+	}
+	args, tail := listElements(formals)
+	for _, arg := range args {
+		if err := checkArg(arg); err != nil {
+			return nil, nil, err
+		}
+		funcArgs = append(funcArgs, arg)
+	}
+	if _, ok := tail.(*EmptyList); ok {
+		return funcArgs, nil, nil
+	}
+	if err := checkArg(tail); err != nil {
+		return nil, nil, err
+	}
+	return funcArgs, tail, nil
+}
+
+// bindFormals binds the arguments parsed by parseFormals as variables
+func bindFormals(env *syntaxEnv, args []Datum, rest Datum) Formals {
+	bound := Formals{Args: make([]string, 0)}
+	for _, arg := range args {
+		bound.Args = append(bound.Args, env.bindVariable(arg).Name)
+	}
+	if rest != nil {
+		bound.Rest = env.bindVariable(rest).Name
+	}
+	return bound
+}
+
+// formKeyword returns the keyword of the special form the datum is, if it's one
+func formKeyword(datum Datum, env *syntaxEnv) string {
+	pair, ok := datum.(*Pair)
+	if !ok || !isIdentifier(pair.Car) {
+		return ""
+	}
+	if form, ok := env.lookup(pair.Car).(*specialForm); ok {
+		return form.Keyword
+	}
+	return ""
+}
+
+// parseBody parses a body, such as a lambda's: any internal definitions, followed
+// by at least one expression
+func parseBody(exp Datum, body []Datum, env *syntaxEnv) ([]AstNode, error) {
+	nodes, expressions, err := parseDefinitions(body, env.extend(), true)
+	if err != nil {
+		return nil, err
+	}
+	if expressions == 0 {
+		return nil, syntaxError("expression in body", exp)
+	}
+	return nodes, nil
+}
+
+// parseDefinitions parses a sequence of forms that can include definitions,
+// returning the nodes and how many of them are expressions. Macro uses get
+// expanded up front to tell which forms are definitions, and the names they
+// define get bound before anything is parsed, since they're in scope throughout.
+// Within bodies, definitions have to come before any expressions.
+func parseDefinitions(body []Datum, env *syntaxEnv, definitionsFirst bool) ([]AstNode, int, error) {
+	forms := make([]Datum, len(body))
+	uses := make([][]Datum, len(body))
+	nodes := make([]AstNode, len(body))
+	expressions := 0
+	for index, datum := range body {
+		expanded, formUses, err := expandHead(datum, env)
+		if err != nil {
+			return nil, 0, err
+		}
+		forms[index], uses[index] = expanded, formUses
+		keyword := formKeyword(expanded, env)
+		definition := keyword == "define" || keyword == "define-syntax" || keyword == "define-record-type"
+		if definition && definitionsFirst && expressions > 0 {
+			return nil, 0, syntaxError("definitions before expressions", datum)
+		}
+		switch keyword {
+		case "define-syntax", "define-record-type":
+			// macros get defined straight away, since they can change how the
+			// forms after them expand. Record types have no expressions to
+			// parse, so they may as well bind their procedures now too.
+			node, err := parseExpression(expanded, env)
+			if err != nil {
+				return nil, 0, err
 			}
-			return ifNode, nil
+			nodes[index] = node
 		case "define":
-			// are we attempting to define a function?
-			if accept(tokens, TokenLParen, currentIndex) {
-				nameError := expect(tokens, TokenIdent, currentIndex)
-				if nameError != nil {
-					return nil, nameError
-				}
-				accept(tokens, TokenIdent, currentIndex)
-				funcName := grabAccepted(tokens, currentIndex).Value.String()
-				funcArgs, _ := parseArgs(tokens, currentIndex)
-				lambdaExp, _ := parseExpression(tokens, currentIndex)
-				expError := closeExp(tokens, currentIndex)
-				if expError != nil {
-					return nil, expError
-				}
-				lambdaNode := NewLambdaExp(funcArgs, lambdaExp)
-				defNode := NewDefExp(funcName, lambdaNode)
-				return defNode, nil
-			} else {
-				// defining something besides a function
-				nameError := expect(tokens, TokenIdent, currentIndex)
-				if nameError != nil {
-					return nil, nameError
+			// leave malformed definitions for the parser to report
+			operands, _ := listElements(expanded.(*Pair).Cdr)
+			if len(operands) == 0 {
+				continue
+			}
+			name := operands[0]
+			if signature, ok := name.(*Pair); ok {
+				name = signature.Car
+			}
+			if isIdentifier(name) {
+				env.defineVariable(name)
+			}
+		default:
+			expressions++
+		}
+	}
+	for index, form := range forms {
+		if nodes[index] == nil {
+			node, err := parseExpression(form, env)
+			if err != nil {
+				return nil, 0, err
+			}
+			nodes[index] = node
+		}
+		nodes[index] = wrapMacroUses(nodes[index], uses[index])
+	}
+	return nodes, expressions, nil
+}
+
+// parseBindings checks a list of (name init) bindings, returning the names and
+// inits. The names have to be distinct unless they get bound one after the other,
+// as with let*.
+func parseBindings(bindings Datum, distinct bool) ([]Datum, []Datum, error) {
+	elements, err := properList(bindings, "list of bindings")
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make([]Datum, 0)
+	inits := make([]Datum, 0)
+	seen := make(map[interface{}]bool)
+	for _, binding := range elements {
+		parts, tail := listElements(binding)
+		if _, ok := tail.(*EmptyList); !ok || len(parts) != 2 {
+			return nil, nil, syntaxError("(name init) binding", binding)
+		}
+		if !isIdentifier(parts[0]) {
+			return nil, nil, syntaxError("name", parts[0])
+		}
+		if distinct && seen[identifierKey(parts[0])] {
+			return nil, nil, syntaxError("distinct names", parts[0])
+		}
+		seen[identifierKey(parts[0])] = true
+		names = append(names, parts[0])
+		inits = append(inits, parts[1])
+	}
+	return names, inits, nil
+}
+
+// parseLet parses let, let*, letrec and letrec*
+func parseLet(exp Datum, keyword string, operands []Datum, env *syntaxEnv) (AstNode, error) {
+	if len(operands) < 2 {
+		return nil, syntaxError("at least 2 operands for "+keyword, exp)
+	}
+	names, initData, err := parseBindings(operands[0], keyword != "let*")
+	if err != nil {
+		return nil, err
+	}
+	boundNames := make([]string, 0)
+	inits := make([]AstNode, 0)
+	bodyEnv := env.extend()
+	switch keyword {
+	case "let":
+		// the inits can't see any of the bindings
+		inits, err = parseExpressions(initData, env)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			boundNames = append(boundNames, bodyEnv.bindVariable(name).Name)
+		}
+	case "let*":
+		// each init can see the bindings before it
+		bodyEnv = env
+		for index, name := range names {
+			init, err := parseExpression(initData[index], bodyEnv)
+			if err != nil {
+				return nil, err
+			}
+			inits = append(inits, init)
+			bodyEnv = bodyEnv.extend()
+			boundNames = append(boundNames, bodyEnv.bindVariable(name).Name)
+		}
+	default:
+		// every init can see every binding
+		for _, name := range names {
+			boundNames = append(boundNames, bodyEnv.bindVariable(name).Name)
+		}
+		inits, err = parseExpressions(initData, bodyEnv)
+		if err != nil {
+			return nil, err
+		}
+	}
+	body, err := parseBody(exp, operands[1:], bodyEnv)
+	if err != nil {
+		return nil, err
+	}
+	switch keyword {
+	case "let":
+		return NewLetExp(boundNames, inits, body...), nil
+	case "let*":
+		return NewLetStarExp(boundNames, inits, body...), nil
+	case "letrec":
+		return NewLetrecExp(boundNames, inits, body...), nil
+	default:
+		return NewLetrecStarExp(boundNames, inits, body...), nil
+	}
+}
+
+// parseNamedLet parses a named let, with the operands following the name
+func parseNamedLet(exp Datum, name Datum, operands []Datum, env *syntaxEnv) (AstNode, error) {
+	if len(operands) < 2 {
+		return nil, syntaxError("bindings and body for named let", exp)
+	}
+	names, initData, err := parseBindings(operands[0], true)
+	if err != nil {
+		return nil, err
+	}
+	inits, err := parseExpressions(initData, env)
+	if err != nil {
+		return nil, err
+	}
+	// the body sees the loop's name, with the bindings shadowing it
+	loopEnv := env.extend()
+	loopName := loopEnv.bindVariable(name).Name
+	bodyEnv := loopEnv.extend()
+	boundNames := make([]string, 0)
+	for _, name := range names {
+		boundNames = append(boundNames, bodyEnv.bindVariable(name).Name)
+	}
+	body, err := parseBody(exp, operands[1:], bodyEnv)
+	if err != nil {
+		return nil, err
+	}
+	return NewNamedLetExp(loopName, boundNames, inits, body...), nil
+}
+
+// parseLetValues parses let-values and let*-values, whose bindings each take
+// formals rather than a single name
+func parseLetValues(exp Datum, keyword string, operands []Datum, env *syntaxEnv) (AstNode, error) {
+	if len(operands) < 2 {
+		return nil, syntaxError("at least 2 operands for "+keyword, exp)
+	}
+	elements, err := properList(operands[0], "list of bindings")
+	if err != nil {
+		return nil, err
+	}
+	formals := make([]Formals, 0)
+	inits := make([]AstNode, 0)
+	seen := make(map[interface{}]bool)
+	// let-values evaluates every init before binding anything, while
+	// let*-values binds each set of formals before the next init
+	initEnv := env
+	bodyEnv := env.extend()
+	for _, binding := range elements {
+		parts, tail := listElements(binding)
+		if _, ok := tail.(*EmptyList); !ok || len(parts) != 2 {
+			return nil, syntaxError("(formals init) binding", binding)
+		}
+		args, rest, err := parseFormals(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		// every name bound by let-values has to be distinct, not just those
+		// within one set of formals
+		if keyword == "let-values" {
+			for _, name := range append(args, rest) {
+				if name == nil {
+					continue
 				}
-				accept(tokens, TokenIdent, currentIndex)
-				name := grabAccepted(tokens, currentIndex)
-				// this handles longhand lambda definitions too
-				newExp, _ := parseExpression(tokens, currentIndex)
-				expError := closeExp(tokens, currentIndex)
-				if expError != nil {
-					return nil, expError
+				if seen[identifierKey(name)] {
+					return nil, syntaxError("distinct names", parts[0])
 				}
-				defNode := NewDefExp(name.Value.String(), newExp)
-				return defNode, nil
-			}
-		case "lambda":
-			lparenError := expect(tokens, TokenLParen, currentIndex)
-			if lparenError != nil {
-				return nil, lparenError
+				seen[identifierKey(name)] = true
 			}
-			*currentIndex++
-			lambdaArgs, _ := parseArgs(tokens, currentIndex)
-			lambdaExp, _ := parseExpression(tokens, currentIndex)
-			expError := closeExp(tokens, currentIndex)
-			if expError != nil {
-				return nil, expError
+		}
+		init, err := parseExpression(parts[1], initEnv)
+		if err != nil {
+			return nil, err
+		}
+		if keyword == "let*-values" {
+			bodyEnv = initEnv.extend()
+			initEnv = bodyEnv
+		}
+		formals = append(formals, bindFormals(bodyEnv, args, rest))
+		inits = append(inits, init)
+	}
+	body, err := parseBody(exp, operands[1:], bodyEnv)
+	if err != nil {
+		return nil, err
+	}
+	if keyword == "let-values" {
+		return NewLetValuesExp(formals, inits, body...), nil
+	}
+	return NewLetStarValuesExp(formals, inits, body...), nil
+}
+
+// parseDefineRecordType parses
+// (define-record-type name (constructor field ...) predicate (field accessor [modifier]) ...)
+// binding the record type's name and each of its procedures
+func parseDefineRecordType(exp Datum, operands []Datum, env *syntaxEnv) (AstNode, error) {
+	if len(operands) < 3 {
+		return nil, syntaxError("name, constructor and predicate for define-record-type", exp)
+	}
+	if !isIdentifier(operands[0]) {
+		return nil, syntaxError("record type name", operands[0])
+	}
+	constructor, err := properList(operands[1], "(constructor field ...)")
+	if err != nil {
+		return nil, err
+	}
+	if len(constructor) == 0 || !isIdentifier(constructor[0]) {
+		return nil, syntaxError("(constructor field ...)", operands[1])
+	}
+	if !isIdentifier(operands[2]) {
+		return nil, syntaxError("predicate name", operands[2])
+	}
+	// field names aren't bound to anything, so they're compared as written
+	specs := make([][]Datum, 0)
+	fieldNames := make(map[string]bool)
+	for _, spec := range operands[3:] {
+		parts, tail := listElements(spec)
+		if _, ok := tail.(*EmptyList); !ok || len(parts) < 2 || len(parts) > 3 {
+			return nil, syntaxError("(field accessor [modifier])", spec)
+		}
+		for _, part := range parts {
+			if !isIdentifier(part) {
+				return nil, syntaxError("name", part)
 			}
-			lambdaNode := NewLambdaExp(lambdaArgs, lambdaExp)
-			return lambdaNode, nil
 		}
+		if fieldNames[identifierName(parts[0])] {
+			return nil, syntaxError("distinct field names", parts[0])
+		}
+		fieldNames[identifierName(parts[0])] = true
+		specs = append(specs, parts)
+	}
+	constructorFields := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, field := range constructor[1:] {
+		if !isIdentifier(field) {
+			return nil, syntaxError("field name", field)
+		}
+		name := identifierName(field)
+		if !fieldNames[name] || seen[name] {
+			return nil, syntaxError("distinct field of "+identifierName(operands[0]), field)
+		}
+		seen[name] = true
+		constructorFields = append(constructorFields, name)
 	}
-	// no matches?
-	return nil, errors.New("Unexpected token")
+	// everything checks out, so bind the names, taking on any renaming
+	fields := make([]RecordField, 0)
+	for _, parts := range specs {
+		field := RecordField{Name: identifierName(parts[0]), Accessor: env.defineVariable(parts[1]).Name}
+		if len(parts) == 3 {
+			field.Modifier = env.defineVariable(parts[2]).Name
+		}
+		fields = append(fields, field)
+	}
+	name := env.defineVariable(operands[0]).Name
+	constructorName := env.defineVariable(constructor[0]).Name
+	predicate := env.defineVariable(operands[2]).Name
+	return NewDefineRecordTypeExp(name, constructorName, constructorFields, predicate, fields...), nil
 }
 
-// convenience function to ensure an expression is properly closed
-func closeExp(tokens []*Token, currentIndex *int) error {
-	rparenError := expect(tokens, TokenRParen, currentIndex)
-	if rparenError != nil {
-		return rparenError
+// parseLetSyntax parses let-syntax and letrec-syntax, whose macros are only
+// visible within the body. For letrec-syntax, they can use each other too.
+func parseLetSyntax(exp Datum, keyword string, operands []Datum, env *syntaxEnv) (AstNode, error) {
+	if len(operands) < 2 {
+		return nil, syntaxError("at least 2 operands for "+keyword, exp)
+	}
+	names, specs, err := parseBindings(operands[0], true)
+	if err != nil {
+		return nil, err
+	}
+	bodyEnv := env.extend()
+	macroEnv := env
+	if keyword == "letrec-syntax" {
+		macroEnv = bodyEnv
 	}
-	*currentIndex += 1
-	return nil
+	for index, name := range names {
+		transformer, err := parseSyntaxRules(identifierName(name), specs[index], macroEnv)
+		if err != nil {
+			return nil, err
+		}
+		bodyEnv.bindings[identifierKey(name)] = transformer
+	}
+	body, err := parseBody(exp, operands[1:], bodyEnv)
+	if err != nil {
+		return nil, err
+	}
+	// the body is then just like a let's with no bindings
+	return NewLetExp(nil, nil, body...), nil
 }
 
-// convenience function to parse the argument list for a function/lambda
-func parseArgs(tokens []*Token, currentIndex *int) ([]string, error) {
-	funcArgs := make([]string, 0)
-	for {
-		if accept(tokens, TokenIdent, currentIndex) {
-			arg := grabAccepted(tokens, currentIndex).Value.String()
-			funcArgs = append(funcArgs, arg)
+// isKeyword checks whether the datum is the given identifier, such as else or =>
+func isKeyword(datum Datum, keyword string) bool {
+	return isIdentifier(datum) && identifierName(datum) == keyword
+}
+
+// properList returns the elements of a list, failing if it isn't a proper one
+func properList(datum Datum, expected string) ([]Datum, error) {
+	elements, tail := listElements(datum)
+	if _, ok := tail.(*EmptyList); !ok {
+		return nil, syntaxError(expected, datum)
+	}
+	return elements, nil
+}
+
+// parseCond parses the clauses of a cond
+func parseCond(exp Datum, operands []Datum, env *syntaxEnv) (AstNode, error) {
+	if len(operands) == 0 {
+		return nil, syntaxError("at least 1 clause for cond", exp)
+	}
+	node := NewCondExp()
+	for index, clause := range operands {
+		parts, err := properList(clause, "cond clause")
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == 0 {
+			return nil, syntaxError("cond clause", clause)
+		}
+		var clauseNode *CondClause
+		switch {
+		case isKeyword(parts[0], "else"):
+			if index != len(operands)-1 {
+				return nil, syntaxError("else clause last", clause)
+			}
+			if len(parts) == 1 {
+				return nil, syntaxError("body for else clause", clause)
+			}
+			body, err := parseExpressions(parts[1:], env)
+			if err != nil {
+				return nil, err
+			}
+			clauseNode = NewCondElseClause(body...)
+		case len(parts) > 1 && isKeyword(parts[1], "=>"):
+			if len(parts) != 3 {
+				return nil, syntaxError("1 receiver after =>", clause)
+			}
+			subExps, err := parseExpressions([]Datum{parts[0], parts[2]}, env)
+			if err != nil {
+				return nil, err
+			}
+			clauseNode = NewCondArrowClause(subExps[0], subExps[1])
+		default:
+			subExps, err := parseExpressions(parts, env)
+			if err != nil {
+				return nil, err
+			}
+			clauseNode = NewCondClause(subExps[0], subExps[1:]...)
+		}
+		clauseNode.SetSpan(clause.GetSpan())
+		node.AddSubNode(clauseNode)
+	}
+	return node, nil
+}
+
+// parseCase parses the key and clauses of a case
+func parseCase(exp Datum, operands []Datum, env *syntaxEnv) (AstNode, error) {
+	if len(operands) < 2 {
+		return nil, syntaxError("key and at least 1 clause for case", exp)
+	}
+	key, err := parseExpression(operands[0], env)
+	if err != nil {
+		return nil, err
+	}
+	node := NewCaseExp(key)
+	clauses := operands[1:]
+	for index, clause := range clauses {
+		parts, err := properList(clause, "case clause")
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) < 2 {
+			return nil, syntaxError("case clause", clause)
+		}
+		isElse := isKeyword(parts[0], "else")
+		if isElse && index != len(clauses)-1 {
+			return nil, syntaxError("else clause last", clause)
+		}
+		var data []AstNode
+		if !isElse {
+			dataList, err := properList(parts[0], "list of data")
+			if err != nil {
+				return nil, err
+			}
+			for _, datum := range dataList {
+				literal, err := parseQuoted(datum, 0, env)
+				if err != nil {
+					return nil, err
+				}
+				data = append(data, literal)
+			}
+		}
+		var clauseNode *CaseClause
+		if isKeyword(parts[1], "=>") {
+			if len(parts) != 3 {
+				return nil, syntaxError("1 receiver after =>", clause)
+			}
+			receiver, err := parseExpression(parts[2], env)
+			if err != nil {
+				return nil, err
+			}
+			if isElse {
+				clauseNode = NewCaseElseArrowClause(receiver)
+			} else {
+				clauseNode = NewCaseArrowClause(data, receiver)
+			}
 		} else {
-			expError := closeExp(tokens, currentIndex)
-			if expError != nil {
-				return nil, expError
+			body, err := parseExpressions(parts[1:], env)
+			if err != nil {
+				return nil, err
 			}
-			break
+			if isElse {
+				clauseNode = NewCaseElseClause(body...)
+			} else {
+				clauseNode = NewCaseClause(data, body...)
+			}
+		}
+		clauseNode.SetSpan(clause.GetSpan())
+		node.AddSubNode(clauseNode)
+	}
+	return node, nil
+}
+
+// parseDo parses a do loop
+func parseDo(exp Datum, operands []Datum, env *syntaxEnv) (AstNode, error) {
+	if len(operands) < 2 {
+		return nil, syntaxError("variables and test clause for do", exp)
+	}
+	specs, err := properList(operands[0], "list of variables")
+	if err != nil {
+		return nil, err
+	}
+	names := make([]Datum, 0)
+	inits := make([]AstNode, 0)
+	stepData := make([]Datum, 0)
+	seen := make(map[interface{}]bool)
+	for _, spec := range specs {
+		parts, err := properList(spec, "(variable init step) spec")
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) != 2 && len(parts) != 3 {
+			return nil, syntaxError("(variable init step) spec", spec)
+		}
+		if !isIdentifier(parts[0]) {
+			return nil, syntaxError("name", parts[0])
+		}
+		if seen[identifierKey(parts[0])] {
+			return nil, syntaxError("distinct names", parts[0])
+		}
+		seen[identifierKey(parts[0])] = true
+		// the inits are evaluated outside the loop
+		init, err := parseExpression(parts[1], env)
+		if err != nil {
+			return nil, err
 		}
+		// without a step, the variable keeps its value
+		step := parts[0]
+		if len(parts) == 3 {
+			step = parts[2]
+		}
+		names = append(names, parts[0])
+		inits = append(inits, init)
+		stepData = append(stepData, step)
+	}
+	loopEnv := env.extend()
+	boundNames := make([]string, 0)
+	for _, name := range names {
+		boundNames = append(boundNames, loopEnv.bindVariable(name).Name)
+	}
+	steps, err := parseExpressions(stepData, loopEnv)
+	if err != nil {
+		return nil, err
+	}
+	testClause, err := properList(operands[1], "test clause")
+	if err != nil {
+		return nil, err
 	}
-	return funcArgs, nil
+	if len(testClause) == 0 {
+		return nil, syntaxError("test clause", operands[1])
+	}
+	testExps, err := parseExpressions(testClause, loopEnv)
+	if err != nil {
+		return nil, err
+	}
+	commands, err := parseExpressions(operands[2:], loopEnv)
+	if err != nil {
+		return nil, err
+	}
+	return NewDoExp(boundNames, inits, steps, testExps[0], testExps[1:], commands...), nil
 }
 
 func bufferToInt(buffer bytes.Buffer) int64 {
 	num, _ := binary.Varint(buffer.Bytes())
 	return num
 }
+func bufferToRational(buffer bytes.Buffer) (int64, int64) {
+	numerator, numLength := binary.Varint(buffer.Bytes())
+	denominator, _ := binary.Varint(buffer.Bytes()[numLength:])
+	return numerator, denominator
+}
 func bufferToFloat(buffer bytes.Buffer) float64 {
 	bits := binary.LittleEndian.Uint64(buffer.Bytes())
 	return math.Float64frombits(bits)
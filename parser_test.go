@@ -1,6 +1,7 @@
 package schego
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -16,102 +17,576 @@ func checkProgram(program *Program, expectedProgram *Program, t *testing.T) {
 }
 
 func TestParseSingleExp(t *testing.T) {
-	tokens := LexExp("(+ 5 3)")
-	program := ParseTokens(tokens)
+	tokens, _ := LexExp("(+ 5 3)")
+	program, _ := ParseTokens(tokens)
 	expectedProgram := NewProgram(NewAddExp(NewIntLiteral(5), NewIntLiteral(3)))
 	checkProgram(program, expectedProgram, t)
 }
 
 func TestNestedExp(t *testing.T) {
-	tokens := LexExp("(* (- 8 (+ 5 6)) 52)")
-	program := ParseTokens(tokens)
+	tokens, _ := LexExp("(* (- 8 (+ 5 6)) 52)")
+	program, _ := ParseTokens(tokens)
 	expectedProgram := NewProgram(NewMulExp(NewSubExp(NewIntLiteral(8), NewAddExp(NewIntLiteral(5), NewIntLiteral(6))), NewIntLiteral(52)))
 	checkProgram(program, expectedProgram, t)
 }
 
 func TestMultipleExp(t *testing.T) {
-	tokens := LexExp("(+ 3 4)\n(+ 5 6)")
-	program := ParseTokens(tokens)
+	tokens, _ := LexExp("(+ 3 4)\n(+ 5 6)")
+	program, _ := ParseTokens(tokens)
 	expectedProgram := NewProgram(NewAddExp(NewIntLiteral(3), NewIntLiteral(4)), NewAddExp(NewIntLiteral(5), NewIntLiteral(6)))
 	checkProgram(program, expectedProgram, t)
 }
 
 func TestParseFloatExp(t *testing.T) {
-	tokens := LexExp("(/ 2.718 3.145)")
-	program := ParseTokens(tokens)
+	tokens, _ := LexExp("(/ 2.718 3.145)")
+	program, _ := ParseTokens(tokens)
 	expectedProgram := NewProgram(NewDivExp(NewFloatLiteral(2.718), NewFloatLiteral(3.145)))
 	checkProgram(program, expectedProgram, t)
 }
 
 func TestParseLtCmpExp(t *testing.T) {
-	tokens := LexExp("(<= (< 7 1) 10)")
-	program := ParseTokens(tokens)
+	tokens, _ := LexExp("(<= (< 7 1) 10)")
+	program, _ := ParseTokens(tokens)
 	expectedProgram := NewProgram(NewLteExp(NewLtExp(NewIntLiteral(7), NewIntLiteral(1)), NewIntLiteral(10)))
 	checkProgram(program, expectedProgram, t)
 }
 
 func TestParseGtCmpExp(t *testing.T) {
-	tokens := LexExp("(>= (> 6 2) 9)")
-	program := ParseTokens(tokens)
+	tokens, _ := LexExp("(>= (> 6 2) 9)")
+	program, _ := ParseTokens(tokens)
 	expectedProgram := NewProgram(NewGteExp(NewGtExp(NewIntLiteral(6), NewIntLiteral(2)), NewIntLiteral(9)))
 	checkProgram(program, expectedProgram, t)
 }
 
 func TestEqExp(t *testing.T) {
-	tokens := LexExp("(= (< 3 3) (>= 1 9))")
-	program := ParseTokens(tokens)
+	tokens, _ := LexExp("(= (< 3 3) (>= 1 9))")
+	program, _ := ParseTokens(tokens)
 	expectedProgram := NewProgram(NewEqExp(NewLtExp(NewIntLiteral(3), NewIntLiteral(3)), NewGteExp(NewIntLiteral(1), NewIntLiteral(9))))
 	checkProgram(program, expectedProgram, t)
 }
 
 func TestStringLiteralExp(t *testing.T) {
-	tokens := LexExp("(+ \"la li \" \"lu le lo\")")
-	program := ParseTokens(tokens)
+	tokens, _ := LexExp("(+ \"la li \" \"lu le lo\")")
+	program, _ := ParseTokens(tokens)
 	expectedProgram := NewProgram(NewAddExp(NewStringLiteral("la li "), NewStringLiteral("lu le lo")))
 	checkProgram(program, expectedProgram, t)
 }
 
 func TestBoolLiteralExp(t *testing.T) {
-	tokens := LexExp("(= #t #f)")
-	program := ParseTokens(tokens)
+	tokens, _ := LexExp("(= #t #f)")
+	program, _ := ParseTokens(tokens)
 	expectedProgram := NewProgram(NewEqExp(NewBoolLiteral(true), NewBoolLiteral(false)))
 	checkProgram(program, expectedProgram, t)
 }
 
 func TestIfExp(t *testing.T) {
-	tokens := LexExp("(if (> 6 5) \"true\" \"false\")")
-	program := ParseTokens(tokens)
+	tokens, _ := LexExp("(if (> 6 5) \"true\" \"false\")")
+	program, _ := ParseTokens(tokens)
 	expectedProgram := NewProgram(NewIfExp(NewGtExp(NewIntLiteral(6), NewIntLiteral(5)), NewStringLiteral("true"), NewStringLiteral("false")))
 	checkProgram(program, expectedProgram, t)
 }
 
 func TestDefineExp(t *testing.T) {
-	tokens := LexExp("(define x 5)")
-	program := ParseTokens(tokens)
+	tokens, _ := LexExp("(define x 5)")
+	program, _ := ParseTokens(tokens)
 	expectedProgram := NewProgram(NewDefExp("x", NewIntLiteral(5)))
 	checkProgram(program, expectedProgram, t)
 }
 
 func TestLambdaExp(t *testing.T) {
-	tokens := LexExp("(lambda (x y) (= x y))")
-	program := ParseTokens(tokens)
+	tokens, _ := LexExp("(lambda (x y) (= x y))")
+	program, _ := ParseTokens(tokens)
 	expectedProgram := NewProgram(NewLambdaExp([]string{"x", "y"}, NewEqExp(NewIdentExp("x"), NewIdentExp("y"))))
 	checkProgram(program, expectedProgram, t)
 }
 
 func TestDefLambdaExp(t *testing.T) {
-	tokens := LexExp("(define (square x) (* x x))")
-	program := ParseTokens(tokens)
+	tokens, _ := LexExp("(define (square x) (* x x))")
+	program, _ := ParseTokens(tokens)
 	expectedProgram := NewProgram(NewDefExp("square", NewLambdaExp([]string{"x"}, NewMulExp(NewIdentExp("x"), NewIdentExp("x")))))
 	checkProgram(program, expectedProgram, t)
 }
 
 func TestDefLambdaLonghandExp(t *testing.T) {
-	shorthandTokens := LexExp("(define (mul x y) (* x y))")
-	shorthandProgram := ParseTokens(shorthandTokens)
-	longhandTokens := LexExp("(define mul (lambda (x y) (* x y)))")
-	longhandProgram := ParseTokens(longhandTokens)
+	shorthandTokens, _ := LexExp("(define (mul x y) (* x y))")
+	shorthandProgram, _ := ParseTokens(shorthandTokens)
+	longhandTokens, _ := LexExp("(define mul (lambda (x y) (* x y)))")
+	longhandProgram, _ := ParseTokens(longhandTokens)
 	expectedProgram := NewProgram(NewDefExp("mul", NewLambdaExp([]string{"x", "y"}, NewMulExp(NewIdentExp("x"), NewIdentExp("y")))))
 	checkProgram(shorthandProgram, expectedProgram, t)
 	checkProgram(longhandProgram, expectedProgram, t)
 }
+
+func TestNodeSpans(t *testing.T) {
+	tokens, _ := LexExp("(define x\n  (+ 1 2))")
+	program, _ := ParseTokens(tokens)
+	defNode := program.GetSubNodes()[0]
+	if defNode.GetSpan() != (Span{Position{1, 1, 0}, Position{2, 11, 20}}) {
+		t.Error("Incorrect define span, got", defNode.GetSpan())
+	}
+	addNode := defNode.GetSubNodes()[0]
+	if addNode.GetSpan() != (Span{Position{2, 3, 12}, Position{2, 10, 19}}) {
+		t.Error("Incorrect addition span, got", addNode.GetSpan())
+	}
+	rhsNode := addNode.GetSubNodes()[1]
+	if rhsNode.GetSpan() != (Span{Position{2, 8, 17}, Position{2, 9, 18}}) {
+		t.Error("Incorrect literal span, got", rhsNode.GetSpan())
+	}
+}
+
+func TestNumberLiteralExp(t *testing.T) {
+	tokens, _ := LexExp("(- -5 (* #x10 (+ 1/3 1e2)))")
+	program, _ := ParseTokens(tokens)
+	expectedProgram := NewProgram(NewSubExp(NewIntLiteral(-5), NewMulExp(NewIntLiteral(16), NewAddExp(NewRationalLiteral(1, 3), NewFloatLiteral(100)))))
+	checkProgram(program, expectedProgram, t)
+}
+
+func TestCharLiteralExp(t *testing.T) {
+	tokens, _ := LexExp("(= #\\a #\\space)")
+	program, _ := ParseTokens(tokens)
+	expectedProgram := NewProgram(NewEqExp(NewCharLiteral('a'), NewCharLiteral(' ')))
+	checkProgram(program, expectedProgram, t)
+	if program.GetSubNodes()[0].DebugString() != "EqExp(#\\a, #\\space)" {
+		t.Error("Incorrect debug string, got", program.GetSubNodes()[0].DebugString())
+	}
+}
+
+func TestStringEscapeExp(t *testing.T) {
+	tokens, _ := LexExp(`(+ "tab\tbed" "\x3bb;")`)
+	program, _ := ParseTokens(tokens)
+	expectedProgram := NewProgram(NewAddExp(NewStringLiteral("tab\tbed"), NewStringLiteral("λ")))
+	checkProgram(program, expectedProgram, t)
+}
+
+func TestDatumComment(t *testing.T) {
+	tokens, _ := LexExp("#;(define x 1) (+ #;(* 2 3) 4 #; #; 7 8 5 #;9) ; trailing\n#;(a (b)) #;'(c)")
+	program, _ := ParseTokens(tokens)
+	expectedProgram := NewProgram(NewAddExp(NewIntLiteral(4), NewIntLiteral(5)))
+	if len(program.GetSubNodes()) != 1 {
+		t.Fatal("Expected a single expression, got", len(program.GetSubNodes()))
+	}
+	checkProgram(program, expectedProgram, t)
+}
+
+func TestQuoteExp(t *testing.T) {
+	shorthandTokens, _ := LexExp("'(a (1 \"b\") . #t)")
+	shorthandProgram, _ := ParseTokens(shorthandTokens)
+	longhandTokens, _ := LexExp("(quote (a (1 \"b\") . #t))")
+	longhandProgram, _ := ParseTokens(longhandTokens)
+	expectedProgram := NewProgram(NewQuoteExp(NewDottedListLiteral(NewBoolLiteral(true),
+		NewSymbolLiteral("a"), NewListLiteral(NewIntLiteral(1), NewStringLiteral("b")))))
+	checkProgram(shorthandProgram, expectedProgram, t)
+	checkProgram(longhandProgram, expectedProgram, t)
+	// quotes and unquotes within quoted data are just more data
+	tokens, _ := LexExp("'(+ 'x ,y)")
+	program, _ := ParseTokens(tokens)
+	expectedProgram = NewProgram(NewQuoteExp(NewListLiteral(NewSymbolLiteral("+"),
+		NewListLiteral(NewSymbolLiteral("quote"), NewSymbolLiteral("x")),
+		NewListLiteral(NewSymbolLiteral("unquote"), NewSymbolLiteral("y")))))
+	checkProgram(program, expectedProgram, t)
+}
+
+func TestQuasiquoteExp(t *testing.T) {
+	shorthandTokens, _ := LexExp("`(1 ,(+ 2 3) ,@xs)")
+	shorthandProgram, _ := ParseTokens(shorthandTokens)
+	longhandTokens, _ := LexExp("(quasiquote (1 (unquote (+ 2 3)) (unquote-splicing xs)))")
+	longhandProgram, _ := ParseTokens(longhandTokens)
+	expectedProgram := NewProgram(NewQuasiquoteExp(1, NewListLiteral(NewIntLiteral(1),
+		NewUnquoteExp(1, NewAddExp(NewIntLiteral(2), NewIntLiteral(3))),
+		NewUnquoteSplicingExp(1, NewIdentExp("xs")))))
+	checkProgram(shorthandProgram, expectedProgram, t)
+	checkProgram(longhandProgram, expectedProgram, t)
+}
+
+func TestNestedQuasiquoteExp(t *testing.T) {
+	tokens, _ := LexExp("`(a `(b ,(c ,x)))")
+	program, _ := ParseTokens(tokens)
+	template := program.GetSubNodes()[0].GetSubNodes()[0]
+	inner, ok := template.GetSubNodes()[1].(*QuasiquoteExp)
+	if !ok || inner.Level != 2 {
+		t.Fatal("Expected a level 2 quasiquote, got", template.GetSubNodes()[1].DebugString())
+	}
+	unquote := inner.GetSubNodes()[0].GetSubNodes()[1].(*UnquoteExp)
+	if unquote.Level != 2 || unquote.GetSubNodes()[0].GetType() != ListNode {
+		t.Error("Expected the level 2 unquote to hold a template, got", unquote.DebugString())
+	}
+	innermost := unquote.GetSubNodes()[0].GetSubNodes()[1].(*UnquoteExp)
+	if innermost.Level != 1 || innermost.GetSubNodes()[0].GetType() != IdentNode {
+		t.Error("Expected the level 1 unquote to hold an expression, got", innermost.DebugString())
+	}
+}
+
+func TestVectorLiteralExp(t *testing.T) {
+	tokens, _ := LexExp("(define v #(1 (+ 2 3) #(\"a\"))) (define bv #u8(0 16 255)) `#(1 ,x)")
+	program, _ := ParseTokens(tokens)
+	expectedProgram := NewProgram(
+		NewDefExp("v", NewVectorLiteral(NewIntLiteral(1),
+			NewListLiteral(NewSymbolLiteral("+"), NewIntLiteral(2), NewIntLiteral(3)),
+			NewVectorLiteral(NewStringLiteral("a")))),
+		NewDefExp("bv", NewBytevectorLiteral([]byte{0, 16, 255})),
+		NewQuasiquoteExp(1, NewVectorLiteral(NewIntLiteral(1), NewUnquoteExp(1, NewIdentExp("x")))))
+	checkProgram(program, expectedProgram, t)
+	if program.GetSubNodes()[1].DebugString() != "DefExp(bv, #u8(0 16 255))" {
+		t.Error("Incorrect debug string, got", program.GetSubNodes()[1].DebugString())
+	}
+}
+
+func TestCallExp(t *testing.T) {
+	tokens, _ := LexExp("(define (square x) (* x x)) (square (f)) ((lambda (x) x) 1)")
+	program, _ := ParseTokens(tokens)
+	expectedProgram := NewProgram(
+		NewDefExp("square", NewLambdaExp([]string{"x"}, NewMulExp(NewIdentExp("x"), NewIdentExp("x")))),
+		NewCallExp(NewIdentExp("square"), NewCallExp(NewIdentExp("f"))),
+		NewCallExp(NewLambdaExp([]string{"x"}, NewIdentExp("x")), NewIntLiteral(1)))
+	if len(program.GetSubNodes()) != 3 {
+		t.Fatal("Expected 3 expressions, got", len(program.GetSubNodes()))
+	}
+	checkProgram(program, expectedProgram, t)
+	// literals can't be applied
+	tokens, _ = LexExp("(1 2)")
+	if _, parseErrors := ParseTokens(tokens); len(parseErrors) != 1 {
+		t.Error("Expected applying a literal to be rejected")
+	}
+}
+
+func TestVariadicArithmeticExp(t *testing.T) {
+	tokens, _ := LexExp("(+ 1 2 3) (*) (+) (- x) (/ 2) (- 10 1 2) (< a b c) (= 1 1 1 1)")
+	program, _ := ParseTokens(tokens)
+	expectedProgram := NewProgram(
+		NewAddExp(NewIntLiteral(1), NewIntLiteral(2), NewIntLiteral(3)),
+		NewMulExp(),
+		NewAddExp(),
+		NewSubExp(NewIdentExp("x")),
+		NewDivExp(NewIntLiteral(2)),
+		NewSubExp(NewIntLiteral(10), NewIntLiteral(1), NewIntLiteral(2)),
+		NewLtExp(NewIdentExp("a"), NewIdentExp("b"), NewIdentExp("c")),
+		NewEqExp(NewIntLiteral(1), NewIntLiteral(1), NewIntLiteral(1), NewIntLiteral(1)))
+	if len(program.GetSubNodes()) != 8 {
+		t.Fatal("Expected 8 expressions, got", len(program.GetSubNodes()))
+	}
+	checkProgram(program, expectedProgram, t)
+	// too few operands
+	tokens, _ = LexExp("(-) (/) (< 1) (=)")
+	if _, parseErrors := ParseTokens(tokens); len(parseErrors) != 4 {
+		t.Error("Expected forms with too few operands to be rejected")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tokens, _ := LexExp("(if 1) (+ 1 (define)) ) (lambda (x 5) x) (+ 1 2) (f (g 1 . 2) 3) (1 2) (+ 3 4")
+	program, parseErrors := ParseTokens(tokens)
+	// only the good forms make it into the program
+	expectedProgram := NewProgram(NewAddExp(NewIntLiteral(1), NewIntLiteral(2)))
+	if len(program.GetSubNodes()) != 1 {
+		t.Fatal("Expected 1 expression, got", len(program.GetSubNodes()))
+	}
+	checkProgram(program, expectedProgram, t)
+	expectedErrors := []ParseError{
+		{Span{Position{1, 1, 0}, Position{1, 7, 6}}, "2 or 3 operands for if", "(if 1)", ""},
+		{Span{Position{1, 13, 12}, Position{1, 21, 20}}, "at least 2 operands for define", "(define)", ""},
+		{Span{Position{1, 23, 22}, Position{1, 24, 23}}, "datum", ")", ""},
+		{Span{Position{1, 36, 35}, Position{1, 37, 36}}, "argument name", "5", ""},
+		{Span{Position{1, 53, 52}, Position{1, 62, 61}}, "proper list", "(g 1 . 2)", ""},
+		{Span{Position{1, 67, 66}, Position{1, 68, 67}}, "procedure", "1", ""},
+		{Span{Position{1, 78, 77}, Position{1, 78, 77}}, ")", "EOF", ""},
+	}
+	if len(parseErrors) != len(expectedErrors) {
+		t.Fatal("Expected", len(expectedErrors), "errors, got", parseErrors)
+	}
+	for index, parseError := range parseErrors {
+		if parseError != expectedErrors[index] {
+			t.Error("Incorrect error, got", parseError, "expected", expectedErrors[index])
+		}
+	}
+	if parseErrors[0].Error() != "Expected 2 or 3 operands for if, found (if 1) at 1:1" {
+		t.Error("Incorrect error message, got", parseErrors[0].Error())
+	}
+}
+
+func TestLambdaFormals(t *testing.T) {
+	tokens, _ := LexExp(`(lambda (a b . rest) rest) (lambda args args) (define (f . xs) xs)
+(define (g x) (define y 1) (define (h) y) (display x) (+ x (h)))`)
+	program, parseErrors := ParseTokens(tokens)
+	if len(parseErrors) != 0 {
+		t.Fatal("Unexpected errors:", parseErrors)
+	}
+	expectedProgram := NewProgram(
+		NewVariadicLambdaExp([]string{"a", "b"}, "rest", NewIdentExp("rest")),
+		NewVariadicLambdaExp(nil, "args", NewIdentExp("args")),
+		NewDefExp("f", NewVariadicLambdaExp(nil, "xs", NewIdentExp("xs"))),
+		NewDefExp("g", NewLambdaExp([]string{"x"},
+			NewDefExp("y", NewIntLiteral(1)),
+			NewDefExp("h", NewLambdaExp(nil, NewIdentExp("y"))),
+			NewCallExp(NewIdentExp("display"), NewIdentExp("x")),
+			NewAddExp(NewIdentExp("x"), NewCallExp(NewIdentExp("h"))))))
+	checkProgram(program, expectedProgram, t)
+	if program.GetSubNodes()[0].DebugString() != "LambdaExp(a b . rest, rest)" {
+		t.Error("Incorrect debug string, got", program.GetSubNodes()[0].DebugString())
+	}
+	if program.GetSubNodes()[1].DebugString() != "LambdaExp(. args, args)" {
+		t.Error("Incorrect debug string, got", program.GetSubNodes()[1].DebugString())
+	}
+	// bad formals, empty bodies and definitions after expressions
+	tokens, _ = LexExp("(lambda (a a) a) (lambda (a . 1) a) (lambda (x)) (lambda () (define x 1)) (lambda () 1 (define x 1) x)")
+	if _, parseErrors := ParseTokens(tokens); len(parseErrors) != 5 {
+		t.Error("Expected 5 errors, got", parseErrors)
+	}
+}
+
+func TestLetExp(t *testing.T) {
+	tokens, _ := LexExp(`(let ((x 1) (y 2)) (+ x y)) (let* ((x 1) (x (+ x 1))) x) (let () 1)
+(letrec ((even? (lambda (n) (if (= n 0) #t (odd? (- n 1))))) (odd? (lambda (n) (if (= n 0) #f (even? (- n 1)))))) (even? 10))
+(letrec* ((a 1) (b (+ a 1))) (define c b) c)`)
+	program, parseErrors := ParseTokens(tokens)
+	if len(parseErrors) != 0 {
+		t.Fatal("Unexpected errors:", parseErrors)
+	}
+	evenLambda := NewLambdaExp([]string{"n"}, NewIfExp(NewEqExp(NewIdentExp("n"), NewIntLiteral(0)), NewBoolLiteral(true),
+		NewCallExp(NewIdentExp("odd?"), NewSubExp(NewIdentExp("n"), NewIntLiteral(1)))))
+	oddLambda := NewLambdaExp([]string{"n"}, NewIfExp(NewEqExp(NewIdentExp("n"), NewIntLiteral(0)), NewBoolLiteral(false),
+		NewCallExp(NewIdentExp("even?"), NewSubExp(NewIdentExp("n"), NewIntLiteral(1)))))
+	expectedProgram := NewProgram(
+		NewLetExp([]string{"x", "y"}, []AstNode{NewIntLiteral(1), NewIntLiteral(2)}, NewAddExp(NewIdentExp("x"), NewIdentExp("y"))),
+		// a shadowing variable gets a unique name
+		NewLetStarExp([]string{"x", "x.1"}, []AstNode{NewIntLiteral(1), NewAddExp(NewIdentExp("x"), NewIntLiteral(1))}, NewIdentExp("x.1")),
+		NewLetExp(nil, nil, NewIntLiteral(1)),
+		NewLetrecExp([]string{"even?", "odd?"}, []AstNode{evenLambda, oddLambda}, NewCallExp(NewIdentExp("even?"), NewIntLiteral(10))),
+		NewLetrecStarExp([]string{"a", "b"}, []AstNode{NewIntLiteral(1), NewAddExp(NewIdentExp("a"), NewIntLiteral(1))},
+			NewDefExp("c", NewIdentExp("b")), NewIdentExp("c")))
+	checkProgram(program, expectedProgram, t)
+	if program.GetSubNodes()[0].DebugString() != "LetExp((x 1) (y 2), AddExp(x, y))" {
+		t.Error("Incorrect debug string, got", program.GetSubNodes()[0].DebugString())
+	}
+	letExp := program.GetSubNodes()[0].(*LetExp)
+	if len(letExp.Inits()) != 2 || len(letExp.Body()) != 1 {
+		t.Error("Incorrect inits/body split, got", len(letExp.Inits()), len(letExp.Body()))
+	}
+}
+
+func TestNamedLetExp(t *testing.T) {
+	tokens, _ := LexExp("(let loop ((i 0) (acc '())) (if (< i 3) (loop (+ i 1) (cons i acc)) acc))")
+	program, parseErrors := ParseTokens(tokens)
+	if len(parseErrors) != 0 {
+		t.Fatal("Unexpected errors:", parseErrors)
+	}
+	expectedProgram := NewProgram(NewNamedLetExp("loop", []string{"i", "acc"}, []AstNode{NewIntLiteral(0), NewQuoteExp(NewListLiteral())},
+		NewIfExp(NewLtExp(NewIdentExp("i"), NewIntLiteral(3)),
+			NewCallExp(NewIdentExp("loop"), NewAddExp(NewIdentExp("i"), NewIntLiteral(1)), NewCallExp(NewIdentExp("cons"), NewIdentExp("i"), NewIdentExp("acc"))),
+			NewIdentExp("acc"))))
+	checkProgram(program, expectedProgram, t)
+	if !strings.HasPrefix(program.GetSubNodes()[0].DebugString(), "NamedLetExp(loop, (i 0) (acc ") {
+		t.Error("Incorrect debug string, got", program.GetSubNodes()[0].DebugString())
+	}
+}
+
+func TestLetValuesExp(t *testing.T) {
+	tokens, _ := LexExp("(let-values (((a b) (values 1 2)) ((c . d) (values 3 4 5)) (all (values))) (list a b c d all)) (let*-values (((x) (values 1)) ((x) (values x))) x)")
+	program, parseErrors := ParseTokens(tokens)
+	if len(parseErrors) != 0 {
+		t.Fatal("Unexpected errors:", parseErrors)
+	}
+	values := func(args ...AstNode) AstNode {
+		return NewCallExp(NewIdentExp("values"), args...)
+	}
+	expectedProgram := NewProgram(
+		NewLetValuesExp([]Formals{{[]string{"a", "b"}, ""}, {[]string{"c"}, "d"}, {nil, "all"}},
+			[]AstNode{values(NewIntLiteral(1), NewIntLiteral(2)), values(NewIntLiteral(3), NewIntLiteral(4), NewIntLiteral(5)), values()},
+			NewCallExp(NewIdentExp("list"), NewIdentExp("a"), NewIdentExp("b"), NewIdentExp("c"), NewIdentExp("d"), NewIdentExp("all"))),
+		NewLetStarValuesExp([]Formals{{[]string{"x"}, ""}, {[]string{"x.1"}, ""}},
+			[]AstNode{values(NewIntLiteral(1)), values(NewIdentExp("x"))}, NewIdentExp("x.1")))
+	checkProgram(program, expectedProgram, t)
+	expectedString := "LetValuesExp(((a b) CallExp(values, 1, 2)) ((c . d) CallExp(values, 3, 4, 5)) (all CallExp(values)), CallExp(list, a, b, c, d, all))"
+	if program.GetSubNodes()[0].DebugString() != expectedString {
+		t.Error("Incorrect debug string, got", program.GetSubNodes()[0].DebugString())
+	}
+}
+
+func TestLetErrors(t *testing.T) {
+	inputs := []string{"(let ((x 1)))", "(let ((x 1) (x 2)) x)", "(let (x) x)", "(let ((1 2)) 1)", "(letrec ((x)) x)",
+		"(let loop ())", "(let-values (((a b) (f)) ((a) (g))) a)", "(let-values ((a)) a)", "(let x 1)"}
+	for _, input := range inputs {
+		tokens, _ := LexExp(input)
+		if _, parseErrors := ParseTokens(tokens); len(parseErrors) != 1 {
+			t.Error("Expected an error parsing", input, "got", parseErrors)
+		}
+	}
+}
+
+func TestOneArmedIfExp(t *testing.T) {
+	tokens, _ := LexExp("(if (> x 0) (display x))")
+	program, _ := ParseTokens(tokens)
+	expectedProgram := NewProgram(NewOneArmedIfExp(NewGtExp(NewIdentExp("x"), NewIntLiteral(0)), NewCallExp(NewIdentExp("display"), NewIdentExp("x"))))
+	checkProgram(program, expectedProgram, t)
+	if program.GetSubNodes()[0].DebugString() != "IfExp(GtExp(x, 0), CallExp(display, x))" {
+		t.Error("Incorrect debug string, got", program.GetSubNodes()[0].DebugString())
+	}
+}
+
+func TestCondExp(t *testing.T) {
+	tokens, _ := LexExp("(cond ((> x 0) 'pos) ((assv x table) => cdr) ((f x)) (else (display x) 'neg))")
+	program, parseErrors := ParseTokens(tokens)
+	if len(parseErrors) != 0 {
+		t.Fatal("Unexpected errors:", parseErrors)
+	}
+	expectedProgram := NewProgram(NewCondExp(
+		NewCondClause(NewGtExp(NewIdentExp("x"), NewIntLiteral(0)), NewQuoteExp(NewSymbolLiteral("pos"))),
+		NewCondArrowClause(NewCallExp(NewIdentExp("assv"), NewIdentExp("x"), NewIdentExp("table")), NewIdentExp("cdr")),
+		NewCondClause(NewCallExp(NewIdentExp("f"), NewIdentExp("x"))),
+		NewCondElseClause(NewCallExp(NewIdentExp("display"), NewIdentExp("x")), NewQuoteExp(NewSymbolLiteral("neg")))))
+	checkProgram(program, expectedProgram, t)
+	clauses := program.GetSubNodes()[0].GetSubNodes()
+	if clauses[1].DebugString() != "CondClause(CallExp(assv, x, table) => cdr)" {
+		t.Error("Incorrect debug string, got", clauses[1].DebugString())
+	}
+	if clauses[3].DebugString() != "CondClause(else, CallExp(display, x), QuoteExp(neg))" {
+		t.Error("Incorrect debug string, got", clauses[3].DebugString())
+	}
+}
+
+func TestCaseExp(t *testing.T) {
+	tokens, _ := LexExp("(case (* 2 3) ((2 3 5 7) 'prime) ((1 4 6 8 9) => f) (else 'other))")
+	program, parseErrors := ParseTokens(tokens)
+	if len(parseErrors) != 0 {
+		t.Fatal("Unexpected errors:", parseErrors)
+	}
+	ints := func(values ...int64) []AstNode {
+		nodes := make([]AstNode, 0)
+		for _, value := range values {
+			nodes = append(nodes, NewIntLiteral(value))
+		}
+		return nodes
+	}
+	expectedProgram := NewProgram(NewCaseExp(NewMulExp(NewIntLiteral(2), NewIntLiteral(3)),
+		NewCaseClause(ints(2, 3, 5, 7), NewQuoteExp(NewSymbolLiteral("prime"))),
+		NewCaseArrowClause(ints(1, 4, 6, 8, 9), NewIdentExp("f")),
+		NewCaseElseClause(NewQuoteExp(NewSymbolLiteral("other")))))
+	checkProgram(program, expectedProgram, t)
+	clauses := program.GetSubNodes()[0].GetSubNodes()
+	if clauses[1].DebugString() != "CaseClause((2 3 5 7), QuoteExp(prime))" {
+		t.Error("Incorrect debug string, got", clauses[1].DebugString())
+	}
+	if clauses[2].DebugString() != "CaseClause((1 4 6 8 9) => f)" {
+		t.Error("Incorrect debug string, got", clauses[2].DebugString())
+	}
+}
+
+func TestSequencingExp(t *testing.T) {
+	tokens, _ := LexExp("(and) (and a b) (or a (f b)) (when (f) 1 2) (unless x y) (begin (display 1) 2)")
+	program, parseErrors := ParseTokens(tokens)
+	if len(parseErrors) != 0 {
+		t.Fatal("Unexpected errors:", parseErrors)
+	}
+	expectedProgram := NewProgram(
+		NewAndExp(),
+		NewAndExp(NewIdentExp("a"), NewIdentExp("b")),
+		NewOrExp(NewIdentExp("a"), NewCallExp(NewIdentExp("f"), NewIdentExp("b"))),
+		NewWhenExp(NewCallExp(NewIdentExp("f")), NewIntLiteral(1), NewIntLiteral(2)),
+		NewUnlessExp(NewIdentExp("x"), NewIdentExp("y")),
+		NewBeginExp(NewCallExp(NewIdentExp("display"), NewIntLiteral(1)), NewIntLiteral(2)))
+	checkProgram(program, expectedProgram, t)
+}
+
+func TestDoExp(t *testing.T) {
+	tokens, _ := LexExp("(do ((vec (make-vector 5)) (i 0 (+ i 1))) ((= i 5) vec) (vector-set! vec i i))")
+	program, parseErrors := ParseTokens(tokens)
+	if len(parseErrors) != 0 {
+		t.Fatal("Unexpected errors:", parseErrors)
+	}
+	expectedProgram := NewProgram(NewDoExp([]string{"vec", "i"},
+		[]AstNode{NewCallExp(NewIdentExp("make-vector"), NewIntLiteral(5)), NewIntLiteral(0)},
+		[]AstNode{NewIdentExp("vec"), NewAddExp(NewIdentExp("i"), NewIntLiteral(1))},
+		NewEqExp(NewIdentExp("i"), NewIntLiteral(5)), []AstNode{NewIdentExp("vec")},
+		NewCallExp(NewIdentExp("vector-set!"), NewIdentExp("vec"), NewIdentExp("i"), NewIdentExp("i"))))
+	checkProgram(program, expectedProgram, t)
+	expectedString := "DoExp(((vec CallExp(make-vector, 5) vec) (i 0 AddExp(i, 1))), (EqExp(i, 5) vec), CallExp(vector-set!, vec, i, i))"
+	if program.GetSubNodes()[0].DebugString() != expectedString {
+		t.Error("Incorrect debug string, got", program.GetSubNodes()[0].DebugString())
+	}
+	doExp := program.GetSubNodes()[0].(*DoExp)
+	if len(doExp.Results()) != 1 || len(doExp.Commands()) != 1 {
+		t.Error("Incorrect results/commands split, got", len(doExp.Results()), len(doExp.Commands()))
+	}
+}
+
+func TestControlErrors(t *testing.T) {
+	inputs := []string{"(cond)", "(cond (else 1) (x 2))", "(cond (x =>))", "(cond ())", "(case x)", "(case x (1 2))",
+		"(case x (else 1) ((1) 2))", "(when x)", "(begin)", "(do ((i 0 1 2)) (#t))", "(do ((i 0)) ())", "(do ((i 0) (i 1)) (#t))"}
+	for _, input := range inputs {
+		tokens, _ := LexExp(input)
+		if _, parseErrors := ParseTokens(tokens); len(parseErrors) != 1 {
+			t.Error("Expected an error parsing", input, "got", parseErrors)
+		}
+	}
+}
+
+func TestSetExp(t *testing.T) {
+	tokens, _ := LexExp("(define x 1) (set! x (+ x 1)) (lambda (n) (set! n 0) n)")
+	program, parseErrors := ParseTokens(tokens)
+	if len(parseErrors) != 0 {
+		t.Fatal("Unexpected errors:", parseErrors)
+	}
+	expectedProgram := NewProgram(
+		NewDefExp("x", NewIntLiteral(1)),
+		NewSetExp("x", NewAddExp(NewIdentExp("x"), NewIntLiteral(1))),
+		NewLambdaExp([]string{"n"}, NewSetExp("n", NewIntLiteral(0)), NewIdentExp("n")))
+	checkProgram(program, expectedProgram, t)
+	if program.GetSubNodes()[1].DebugString() != "SetExp(x, AddExp(x, 1))" {
+		t.Error("Incorrect debug string, got", program.GetSubNodes()[1].DebugString())
+	}
+	tokens, _ = LexExp("(set! x) (set! 1 2) (set! x 1 2)")
+	if _, parseErrors := ParseTokens(tokens); len(parseErrors) != 3 {
+		t.Error("Expected 3 errors, got", parseErrors)
+	}
+	// a global can be assigned before it's defined, but it has to be defined somewhere
+	tokens, _ = LexExp("(define (f) (set! later 1)) (define later 0)")
+	if _, parseErrors := ParseTokens(tokens); len(parseErrors) != 0 {
+		t.Error("Unexpected errors:", parseErrors)
+	}
+	tokens, _ = LexExp("(define x 1)\n(set! y x)")
+	_, parseErrors = ParseTokens(tokens)
+	if len(parseErrors) != 1 || parseErrors[0].Error() != "Expected defined variable, found y at 2:7" {
+		t.Error("Expected an error assigning to an unbound variable, got", parseErrors)
+	}
+}
+
+func TestDefineRecordTypeExp(t *testing.T) {
+	tokens, _ := LexExp(`(define-record-type point (make-point x y) point?
+  (x point-x set-point-x!)
+  (y point-y))
+(point-x (make-point 1 2))
+(lambda () (define-record-type box (box v) box? (v unbox)) (box? (box 1)))`)
+	program, parseErrors := ParseTokens(tokens)
+	if len(parseErrors) != 0 {
+		t.Fatal("Unexpected errors:", parseErrors)
+	}
+	expectedProgram := NewProgram(
+		NewDefineRecordTypeExp("point", "make-point", []string{"x", "y"}, "point?",
+			RecordField{"x", "point-x", "set-point-x!"}, RecordField{"y", "point-y", ""}),
+		NewCallExp(NewIdentExp("point-x"), NewCallExp(NewIdentExp("make-point"), NewIntLiteral(1), NewIntLiteral(2))),
+		NewLambdaExp(nil,
+			NewDefineRecordTypeExp("box", "box", []string{"v"}, "box?", RecordField{"v", "unbox", ""}),
+			NewCallExp(NewIdentExp("box?"), NewCallExp(NewIdentExp("box"), NewIntLiteral(1)))))
+	checkProgram(program, expectedProgram, t)
+	expected := "DefineRecordTypeExp(point, (make-point x y), point?, (x point-x set-point-x!), (y point-y))"
+	if program.GetSubNodes()[0].DebugString() != expected {
+		t.Error("Incorrect debug string, got", program.GetSubNodes()[0].DebugString())
+	}
+	// the procedures are top-level bindings like any other definition
+	if !program.GetSubNodes()[1].GetSubNodes()[0].(*IdentExp).Global {
+		t.Error("Expected point-x to be global")
+	}
+	tokens, _ = LexExp("(define-record-type empty (make-empty) empty?)")
+	if _, parseErrors := ParseTokens(tokens); len(parseErrors) != 0 {
+		t.Error("Unexpected errors for a record type without fields:", parseErrors)
+	}
+	inputs := []string{"(define-record-type point make-point point?)", "(define-record-type point (make-point z) point? (x point-x))",
+		"(define-record-type point (make-point x x) point? (x point-x))", "(define-record-type point (make-point) point? (x point-x) (x point-x2))",
+		"(define-record-type point (make-point) point? (x))", "(define-record-type point (make-point) point? (x 1))",
+		"(lambda () 1 (define-record-type point (make-point) point?))"}
+	for _, input := range inputs {
+		tokens, _ := LexExp(input)
+		if _, parseErrors := ParseTokens(tokens); len(parseErrors) != 1 {
+			t.Error("Expected an error parsing", input, "got", parseErrors)
+		}
+	}
+}
@@ -0,0 +1,576 @@
+package schego
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Datum is a piece of generic Scheme data, as produced by the reader. Source code
+// gets read as data before it's parsed into an AST, and the read procedure hands
+// the very same data back at runtime.
+type Datum interface {
+	// String returns the written representation of the datum
+	String() string
+	GetSpan() Span
+	SetSpan(Span)
+}
+
+// base struct that all Datum implementations build off of
+type datumBase struct {
+	span Span
+}
+
+// GetSpan returns the region of source text the datum was read from
+func (d *datumBase) GetSpan() Span {
+	return d.span
+}
+func (d *datumBase) SetSpan(span Span) {
+	d.span = span
+}
+
+type Pair struct {
+	datumBase
+	Car Datum
+	Cdr Datum
+}
+
+func NewPair(car Datum, cdr Datum) *Pair {
+	pair := new(Pair)
+	pair.Car = car
+	pair.Cdr = cdr
+	return pair
+}
+func (p *Pair) String() string {
+	elements, tail := listElements(p)
+	written := make([]string, 0)
+	for _, element := range elements {
+		written = append(written, element.String())
+	}
+	if _, ok := tail.(*EmptyList); !ok {
+		written = append(written, ".", tail.String())
+	}
+	return "(" + strings.Join(written, " ") + ")"
+}
+
+type EmptyList struct {
+	datumBase
+}
+
+func NewEmptyList() *EmptyList {
+	return new(EmptyList)
+}
+func (e *EmptyList) String() string {
+	return "()"
+}
+
+type Symbol struct {
+	datumBase
+	Name string
+}
+
+func NewSymbol(name string) *Symbol {
+	symbol := new(Symbol)
+	symbol.Name = name
+	return symbol
+}
+func (s *Symbol) String() string {
+	return s.Name
+}
+
+type IntDatum struct {
+	datumBase
+	Value int64
+}
+
+func NewIntDatum(value int64) *IntDatum {
+	datum := new(IntDatum)
+	datum.Value = value
+	return datum
+}
+func (i *IntDatum) String() string {
+	return strconv.FormatInt(i.Value, 10)
+}
+
+type FloatDatum struct {
+	datumBase
+	Value float64
+}
+
+func NewFloatDatum(value float64) *FloatDatum {
+	datum := new(FloatDatum)
+	datum.Value = value
+	return datum
+}
+func (f *FloatDatum) String() string {
+	return strconv.FormatFloat(f.Value, 'g', -1, 64)
+}
+
+type RationalDatum struct {
+	datumBase
+	Numerator   int64
+	Denominator int64
+}
+
+func NewRationalDatum(numerator int64, denominator int64) *RationalDatum {
+	datum := new(RationalDatum)
+	datum.Numerator = numerator
+	datum.Denominator = denominator
+	return datum
+}
+func (r *RationalDatum) String() string {
+	return strconv.FormatInt(r.Numerator, 10) + "/" + strconv.FormatInt(r.Denominator, 10)
+}
+
+type StringDatum struct {
+	datumBase
+	Value string
+}
+
+func NewStringDatum(value string) *StringDatum {
+	datum := new(StringDatum)
+	datum.Value = value
+	return datum
+}
+func (s *StringDatum) String() string {
+	var written strings.Builder
+	written.WriteRune('"')
+	for _, char := range s.Value {
+		switch char {
+		case '"', '\\':
+			written.WriteRune('\\')
+			written.WriteRune(char)
+		case '\n':
+			written.WriteString("\\n")
+		case '\t':
+			written.WriteString("\\t")
+		case '\r':
+			written.WriteString("\\r")
+		default:
+			if unicode.IsPrint(char) {
+				written.WriteRune(char)
+			} else {
+				written.WriteString("\\x" + strconv.FormatInt(int64(char), 16) + ";")
+			}
+		}
+	}
+	written.WriteRune('"')
+	return written.String()
+}
+
+type BoolDatum struct {
+	datumBase
+	Value bool
+}
+
+func NewBoolDatum(value bool) *BoolDatum {
+	datum := new(BoolDatum)
+	datum.Value = value
+	return datum
+}
+func (b *BoolDatum) String() string {
+	if b.Value {
+		return "#t"
+	}
+	return "#f"
+}
+
+type CharDatum struct {
+	datumBase
+	Value rune
+}
+
+func NewCharDatum(value rune) *CharDatum {
+	datum := new(CharDatum)
+	datum.Value = value
+	return datum
+}
+func (c *CharDatum) String() string {
+	return NewCharLiteral(c.Value).DebugString()
+}
+
+type Vector struct {
+	datumBase
+	Elements []Datum
+}
+
+func NewVector(elements ...Datum) *Vector {
+	vector := new(Vector)
+	vector.Elements = append([]Datum(nil), elements...)
+	return vector
+}
+func (v *Vector) String() string {
+	written := make([]string, 0)
+	for _, element := range v.Elements {
+		written = append(written, element.String())
+	}
+	return "#(" + strings.Join(written, " ") + ")"
+}
+
+type Bytevector struct {
+	datumBase
+	Value []byte
+}
+
+func NewBytevector(value []byte) *Bytevector {
+	bytevector := new(Bytevector)
+	bytevector.Value = append([]byte(nil), value...)
+	return bytevector
+}
+func (b *Bytevector) String() string {
+	return NewBytevectorLiteral(b.Value).DebugString()
+}
+
+// NewList builds a proper list out of the given elements
+func NewList(elements ...Datum) Datum {
+	return NewDottedList(NewEmptyList(), elements...)
+}
+
+// NewDottedList builds a list out of the given elements that ends in tail rather
+// than the empty list
+func NewDottedList(tail Datum, elements ...Datum) Datum {
+	list := tail
+	for index := len(elements) - 1; index >= 0; index-- {
+		list = NewPair(elements[index], list)
+	}
+	return list
+}
+
+// listElements walks the pairs of a list, returning its elements along with
+// whatever terminates it, which is the empty list for proper lists
+func listElements(datum Datum) ([]Datum, Datum) {
+	elements := make([]Datum, 0)
+	for {
+		pair, ok := datum.(*Pair)
+		if !ok {
+			return elements, datum
+		}
+		elements = append(elements, pair.Car)
+		datum = pair.Cdr
+	}
+}
+
+// TokenSource is anything that hands out tokens one at a time, returning io.EOF
+// once it runs out. Lexer is the obvious example.
+type TokenSource interface {
+	Next() (*Token, error)
+}
+
+// tokenSlice is a TokenSource over tokens that have already been lexed
+type tokenSlice struct {
+	tokens []*Token
+	index  int
+}
+
+func (t *tokenSlice) Next() (*Token, error) {
+	if t.index >= len(t.tokens) {
+		return nil, io.EOF
+	}
+	token := t.tokens[t.index]
+	t.index++
+	return token, nil
+}
+
+// DatumReader turns tokens into generic Scheme data, one datum at a time. It backs
+// both the parser and the read procedure.
+type DatumReader struct {
+	source TokenSource
+	// one token of lookahead, which is all the datum syntax needs
+	peeked *Token
+	// where the last token read ended, for pointing at an unexpected EOF
+	lastEnd Position
+	// how many lists/vectors are open, so a bad form can be skipped past
+	depth int
+}
+
+// NewDatumReader creates a DatumReader that pulls tokens from the given source.
+func NewDatumReader(source TokenSource) *DatumReader {
+	reader := new(DatumReader)
+	reader.source = source
+	reader.lastEnd = Position{Line: 1, Column: 1}
+	return reader
+}
+
+// NewDatumReaderTokens creates a DatumReader over already-lexed tokens.
+func NewDatumReaderTokens(tokens []*Token) *DatumReader {
+	return NewDatumReader(&tokenSlice{tokens: tokens})
+}
+
+func (r *DatumReader) next() (*Token, error) {
+	token := r.peeked
+	r.peeked = nil
+	if token == nil {
+		var err error
+		token, err = r.source.Next()
+		if err != nil {
+			return nil, err
+		}
+	}
+	r.lastEnd = token.Span.End
+	switch token.Type {
+	case TokenLParen, TokenVectorStart, TokenBytevectorStart:
+		r.depth++
+	case TokenRParen:
+		if r.depth > 0 {
+			r.depth--
+		}
+	}
+	return token, nil
+}
+
+func (r *DatumReader) peek() (*Token, error) {
+	if r.peeked == nil {
+		token, err := r.source.Next()
+		if err != nil {
+			return nil, err
+		}
+		r.peeked = token
+	}
+	return r.peeked, nil
+}
+
+// readError builds a ParseError pointing at the token found instead of what was
+// expected, showing it as it was written if it came from source text
+func readError(expected string, token *Token) error {
+	found := token.Text
+	if found == "" {
+		found = token.Value.String()
+	}
+	return ParseError{Span: token.Span, Expected: expected, Found: found}
+}
+
+// eofError builds a ParseError for input that ran out while more was expected
+func (r *DatumReader) eofError(expected string) error {
+	return ParseError{Span: Span{r.lastEnd, r.lastEnd}, Expected: expected, Found: "EOF"}
+}
+
+// Read reads the next datum, returning io.EOF once the tokens run out. After an
+// error, the rest of the bad datum is skipped so the next Read starts afresh at
+// the following top-level datum.
+func (r *DatumReader) Read() (Datum, error) {
+	r.depth = 0
+	datum, err := r.read()
+	if err != nil && err != io.EOF {
+		r.recover()
+	}
+	return datum, err
+}
+
+func (r *DatumReader) read() (Datum, error) {
+	if err := r.skipDatumComments(); err != nil {
+		return nil, err
+	}
+	token, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+	return r.readFrom(token)
+}
+
+// recover skips tokens until every list the bad datum opened has been closed
+func (r *DatumReader) recover() {
+	for r.depth > 0 {
+		if _, err := r.next(); err != nil {
+			// lexical errors within the bad datum have nothing more to add
+			if _, ok := err.(LexError); !ok {
+				return
+			}
+		}
+	}
+}
+
+// readInner reads a datum that has to be there, such as the one following a quote
+func (r *DatumReader) readInner() (Datum, error) {
+	datum, err := r.read()
+	if err == io.EOF {
+		return nil, r.eofError("datum")
+	}
+	return datum, err
+}
+
+// skipDatumComments skips over any #; datum comments coming up, along with the
+// datum each one comments out
+func (r *DatumReader) skipDatumComments() error {
+	for {
+		token, err := r.peek()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if token.Type != TokenDatumComment {
+			return nil
+		}
+		r.next()
+		// readInner takes care of datum comments nested in front of the datum
+		if _, err := r.readInner(); err != nil {
+			return err
+		}
+	}
+}
+
+// the long forms of ' ` , and ,@
+var quoteAbbreviations = map[TokenType]string{
+	TokenQuote:           "quote",
+	TokenQuasiquote:      "quasiquote",
+	TokenUnquote:         "unquote",
+	TokenUnquoteSplicing: "unquote-splicing",
+}
+
+// readFrom reads the datum starting with the given (already consumed) token.
+func (r *DatumReader) readFrom(token *Token) (Datum, error) {
+	var datum Datum
+	switch token.Type {
+	case TokenIntLiteral:
+		datum = NewIntDatum(bufferToInt(token.Value))
+	case TokenFloatLiteral:
+		datum = NewFloatDatum(bufferToFloat(token.Value))
+	case TokenRationalLiteral:
+		datum = NewRationalDatum(bufferToRational(token.Value))
+	case TokenStringLiteral:
+		datum = NewStringDatum(token.Value.String())
+	case TokenBoolLiteral:
+		datum = NewBoolDatum(token.Value.Bytes()[0] == 1)
+	case TokenCharLiteral:
+		char, _ := utf8.DecodeRune(token.Value.Bytes())
+		datum = NewCharDatum(char)
+	case TokenIdent, TokenOp:
+		name := token.Value.String()
+		// |foo bar| is the symbol "foo bar"
+		if len(name) >= 2 && strings.HasPrefix(name, "|") && strings.HasSuffix(name, "|") {
+			name = name[1 : len(name)-1]
+		}
+		datum = NewSymbol(name)
+	case TokenQuote, TokenQuasiquote, TokenUnquote, TokenUnquoteSplicing:
+		quoted, err := r.readInner()
+		if err != nil {
+			return nil, err
+		}
+		keyword := NewSymbol(quoteAbbreviations[token.Type])
+		keyword.SetSpan(token.Span)
+		datum = NewList(keyword, quoted)
+		setListSpans(datum, Span{token.Span.Start, quoted.GetSpan().End})
+		return datum, nil
+	case TokenLParen:
+		return r.readList(token)
+	case TokenVectorStart:
+		elements, closeToken, err := r.readSequence()
+		if err != nil {
+			return nil, err
+		}
+		datum = NewVector(elements...)
+		datum.SetSpan(Span{token.Span.Start, closeToken.Span.End})
+		return datum, nil
+	case TokenBytevectorStart:
+		elements, closeToken, err := r.readSequence()
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, 0)
+		for _, element := range elements {
+			num, ok := element.(*IntDatum)
+			if !ok || num.Value < 0 || num.Value > 255 {
+				return nil, ParseError{Span: element.GetSpan(), Expected: "byte", Found: element.String()}
+			}
+			value = append(value, byte(num.Value))
+		}
+		datum = NewBytevector(value)
+		datum.SetSpan(Span{token.Span.Start, closeToken.Span.End})
+		return datum, nil
+	default:
+		return nil, readError("datum", token)
+	}
+	datum.SetSpan(token.Span)
+	return datum, nil
+}
+
+// readSequence reads data up until the closing rparen, returning the data and the rparen
+func (r *DatumReader) readSequence() ([]Datum, *Token, error) {
+	elements := make([]Datum, 0)
+	for {
+		if err := r.skipDatumComments(); err != nil {
+			return nil, nil, err
+		}
+		token, err := r.next()
+		if err == io.EOF {
+			return nil, nil, r.eofError(")")
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if token.Type == TokenRParen {
+			return elements, token, nil
+		}
+		element, err := r.readFrom(token)
+		if err != nil {
+			return nil, nil, err
+		}
+		elements = append(elements, element)
+	}
+}
+
+// readList reads a list, dotted or otherwise, whose lparen has already been consumed
+func (r *DatumReader) readList(lparen *Token) (Datum, error) {
+	elements := make([]Datum, 0)
+	var tail Datum = NewEmptyList()
+	var closeToken *Token
+	for closeToken == nil {
+		if err := r.skipDatumComments(); err != nil {
+			return nil, err
+		}
+		token, err := r.next()
+		if err == io.EOF {
+			return nil, r.eofError(")")
+		} else if err != nil {
+			return nil, err
+		}
+		switch {
+		case token.Type == TokenRParen:
+			closeToken = token
+		case token.Type == TokenDot && len(elements) > 0:
+			// the datum after the dot ends the list
+			tail, err = r.readInner()
+			if err != nil {
+				return nil, err
+			}
+			if err := r.skipDatumComments(); err != nil {
+				return nil, err
+			}
+			closeToken, err = r.next()
+			if err == io.EOF {
+				return nil, r.eofError(")")
+			} else if err != nil {
+				return nil, err
+			} else if closeToken.Type != TokenRParen {
+				return nil, readError(")", closeToken)
+			}
+		default:
+			element, err := r.readFrom(token)
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, element)
+		}
+	}
+	list := NewDottedList(tail, elements...)
+	if len(elements) == 0 {
+		list.SetSpan(Span{lparen.Span.Start, closeToken.Span.End})
+	} else {
+		setListSpans(list, Span{lparen.Span.Start, closeToken.Span.End})
+	}
+	return list, nil
+}
+
+// setListSpans gives the pairs of a list their spans; the first pair covers the
+// whole list, with each pair after it starting at its own element
+func setListSpans(list Datum, span Span) {
+	list.SetSpan(span)
+	pair, ok := list.(*Pair)
+	for ok {
+		if next, isPair := pair.Cdr.(*Pair); isPair {
+			next.SetSpan(Span{next.Car.GetSpan().Start, span.End})
+		}
+		pair, ok = pair.Cdr.(*Pair)
+	}
+}
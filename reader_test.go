@@ -0,0 +1,132 @@
+package schego
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// readAll reads every datum out of the given source text
+func readAll(input string, t *testing.T) []Datum {
+	tokens, _ := LexExp(input)
+	reader := NewDatumReaderTokens(tokens)
+	data := make([]Datum, 0)
+	for {
+		datum, err := reader.Read()
+		if err == io.EOF {
+			return data
+		} else if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		data = append(data, datum)
+	}
+}
+
+func checkData(data []Datum, expected []string, t *testing.T) {
+	if len(data) != len(expected) {
+		t.Fatal("Incorrect datum count, got", len(data))
+	}
+	for index, datum := range data {
+		if datum.String() != expected[index] {
+			t.Error("Incorrect datum, got", datum.String(), "expected", expected[index])
+		}
+	}
+}
+
+func TestReadAtoms(t *testing.T) {
+	data := readAll("42 -1.5 1/3 \"hi\\n\" #t #\\a abc + |two words|", t)
+	checkData(data, []string{"42", "-1.5", "1/3", "\"hi\\n\"", "#t", "#\\a", "abc", "+", "two words"}, t)
+	if _, ok := data[6].(*Symbol); !ok {
+		t.Error("Expected a symbol, got", data[6].String())
+	}
+}
+
+func TestReadLists(t *testing.T) {
+	data := readAll("(a (b c) ()) (1 2 . 3) (a . (b . (c . ()))) #(1 (2)) #u8(1 2)", t)
+	checkData(data, []string{"(a (b c) ())", "(1 2 . 3)", "(a b c)", "#(1 (2))", "#u8(1 2)"}, t)
+	pair := data[1].(*Pair)
+	if pair.Car.(*IntDatum).Value != 1 {
+		t.Error("Incorrect car, got", pair.Car.String())
+	}
+	tail := pair.Cdr.(*Pair).Cdr
+	if tail.(*IntDatum).Value != 3 {
+		t.Error("Incorrect dotted tail, got", tail.String())
+	}
+}
+
+func TestReadQuotes(t *testing.T) {
+	data := readAll("'a `(b ,c ,@d) #;(skipped) '#;x y", t)
+	checkData(data, []string{"(quote a)", "(quasiquote (b (unquote c) (unquote-splicing d)))", "(quote y)"}, t)
+}
+
+func TestReadSpans(t *testing.T) {
+	data := readAll("(a\n (b c))", t)
+	list := data[0].(*Pair)
+	if list.GetSpan() != (Span{Position{1, 1, 0}, Position{2, 8, 10}}) {
+		t.Error("Incorrect list span, got", list.GetSpan())
+	}
+	inner := list.Cdr.(*Pair).Car
+	if inner.GetSpan() != (Span{Position{2, 2, 4}, Position{2, 7, 9}}) {
+		t.Error("Incorrect inner list span, got", inner.GetSpan())
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	inputs := []string{")", "(a b", "(. a)", "(a . b c)", "#u8(256)", "'"}
+	for _, input := range inputs {
+		tokens, _ := LexExp(input)
+		reader := NewDatumReaderTokens(tokens)
+		if _, err := reader.Read(); err == nil || err == io.EOF {
+			t.Error("Expected an error reading", input, "got", err)
+		}
+	}
+	// numbers and booleans are shown as they were written
+	tokens, _ := LexExp("(a . 1 #true)")
+	_, err := NewDatumReaderTokens(tokens).Read()
+	if err == nil || err.Error() != "Expected ), found #true at 1:8" {
+		t.Error("Incorrect error, got", err)
+	}
+}
+
+// a bad datum shouldn't stop the data after it from being read
+func TestReadRecovery(t *testing.T) {
+	tokens, _ := LexExp("(a (b . c d) e) ) (f #u8(300) g) h")
+	reader := NewDatumReaderTokens(tokens)
+	data := make([]Datum, 0)
+	errorCount := 0
+	for {
+		datum, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if _, ok := err.(ParseError); !ok {
+				t.Error("Expected a ParseError, got", err)
+			}
+			errorCount++
+			continue
+		}
+		data = append(data, datum)
+	}
+	if errorCount != 3 {
+		t.Error("Expected 3 errors, got", errorCount)
+	}
+	checkData(data, []string{"h"}, t)
+}
+
+// test reading straight from a lexer, the way the read procedure does
+func TestReadStream(t *testing.T) {
+	reader := NewDatumReader(NewLexer(strings.NewReader("(define (f x) x)\n(f 1)")))
+	expected := []string{"(define (f x) x)", "(f 1)"}
+	for _, written := range expected {
+		datum, err := reader.Read()
+		if err != nil {
+			t.Fatal("Unexpected error:", err)
+		}
+		if datum.String() != written {
+			t.Error("Incorrect datum, got", datum.String(), "expected", written)
+		}
+	}
+	if _, err := reader.Read(); err != io.EOF {
+		t.Error("Expected io.EOF, got", err)
+	}
+}
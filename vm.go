@@ -3,9 +3,12 @@ package schego
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"math"
 	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 // interface to write a null-terminated string to stdout
@@ -94,6 +97,28 @@ func (s *VMStack) PopString() []byte {
 	return utfBytes
 }
 
+// characters are pushed as their 4-byte code point, rather than however many
+// bytes they take up in UTF-8
+func (s *VMStack) PushChar(char rune) {
+	charBuffer := new(bytes.Buffer)
+	codepoint := int32(char)
+	binary.Write(charBuffer, binary.LittleEndian, &codepoint)
+	for _, charByte := range charBuffer.Bytes() {
+		s.PushByte(charByte)
+	}
+	s.lenLastPushed = 4
+}
+
+func (s *VMStack) PopChar() rune {
+	charBuffer := make([]byte, 0)
+	for i := 0; i < 4; i++ {
+		charBuffer = append([]byte{s.PopByte()}, charBuffer...)
+	}
+	var codepoint int32
+	binary.Read(bytes.NewBuffer(charBuffer), binary.LittleEndian, &codepoint)
+	return rune(codepoint)
+}
+
 func (s *VMStack) PushEmptyCell() {
 	// push the equivalent of an empty list cell onto the stack
 	zeroBuf := make([]byte, 8)
@@ -212,10 +237,10 @@ func (h *VMHeap) OrderFor(requestedBytes uint64) uint8 {
 	if(requestedBytes <= blockSize) {
 		return 0
 	}
-	// TODO: handle requests past maxOrder gracefully
 	// this is ugly, but kinda fast, and less stupid than the old solution
+	// round up, so requests between two block sizes get the bigger one
 	var order uint8
-	order = uint8(math.Log2(float64(requestedBytes)) - math.Log2(float64(blockSize)))
+	order = uint8(math.Ceil(math.Log2(float64(requestedBytes)) - math.Log2(float64(blockSize))))
 	return order
 }
 
@@ -227,7 +252,12 @@ func (h *VMHeap) CreateBlock(order uint8) {
 	// find smallest order that we can pull from
 	freeOrder := order + 1
 	for {
-		if h.NoFreeBlocksFor(freeOrder) {
+		if freeOrder > maxOrder {
+			// every block is in use, or the request is bigger than any block,
+			// so grow the heap and split up the new space
+			freeOrder = h.Grow(order)
+			break
+		} else if h.NoFreeBlocksFor(freeOrder) {
 			freeOrder += 1
 		} else {
 			break
@@ -241,6 +271,38 @@ func (h *VMHeap) CreateBlock(order uint8) {
 	}
 }
 
+// Grow adds a block to the end of the heap that's at least the given order, and
+// never smaller than the initial heap, returning the order of the new block.
+// Buddies are found by address, so a block has to start at a multiple of its
+// size; any space skipped to get there is added as smaller unused blocks.
+func (h *VMHeap) Grow(order uint8) uint8 {
+	if initialOrder := h.OrderFor(initialHeapSize); order < initialOrder {
+		order = initialOrder
+	}
+	size := blockBytes(order)
+	address := uint64(len(h.heapSpace))
+	aligned := (address + size - 1) / size * size
+	h.heapSpace = append(h.heapSpace, make([]byte, aligned+size-address)...)
+	for address < aligned {
+		// the biggest block that can start here without running into the new one
+		gapOrder := uint8(0)
+		for address%blockBytes(gapOrder+1) == 0 && address+blockBytes(gapOrder+1) <= aligned {
+			gapOrder++
+		}
+		h.unusedBlocks[gapOrder] = append(h.unusedBlocks[gapOrder], address)
+		h.blockMap[address] = gapOrder
+		address += blockBytes(gapOrder)
+	}
+	h.unusedBlocks[order] = append(h.unusedBlocks[order], aligned)
+	h.blockMap[aligned] = order
+	return order
+}
+
+// blockBytes gives the size of a block of the given order
+func blockBytes(order uint8) uint64 {
+	return blockSize << order
+}
+
 func (h *VMHeap) GetFreeBlock(order uint8) uint64 {
 	// return the address of the first free block of the given order
 	return h.unusedBlocks[order][0]
@@ -328,6 +390,41 @@ func (h *VMHeap) MergeWithBuddy(address uint64, order uint8) {
 	}
 }
 
+// name and size of a record type defined with rdef
+type recordType struct {
+	name       string
+	fieldCount uint64
+}
+
+// a call frame, pushed by jal or jalc and popped by jr, holding the address to
+// return to and the local variables of the procedure being run, along with the
+// procedure object it was called through, if it was, for cload to read from
+type callFrame struct {
+	returnAddress int64
+	locals        map[uint32][]byte
+	closure       uint64
+}
+
+func newCallFrame(returnAddress int64) *callFrame {
+	return &callFrame{returnAddress, make(map[uint32][]byte), 0}
+}
+
+// how many bytes each type of local takes up when newly created; strings start
+// out empty and grow as they're stored
+var localSizes = map[byte]int{0x26: 1, 0x27: 4, 0x28: 8, 0x29: 8, 0x2A: 0, 0x2B: 24}
+
+// VMError describes an instruction the VM couldn't carry out, such as an opcode
+// it doesn't implement
+type VMError struct {
+	// where the instruction starts in the bytecode
+	Offset  int64
+	Message string
+}
+
+func (e VMError) Error() string {
+	return fmt.Sprintf("%s at offset %d", e.Message, e.Offset)
+}
+
 type VMState struct {
 	Stack        VMStack
 	Heap         VMHeap
@@ -337,6 +434,23 @@ type VMState struct {
 	opcodeBuffer bytes.Reader
 	finished     bool
 	exitCode     int64
+	// record types defined with rdef
+	recordTypes map[int64]recordType
+	// the kind of every object allocated, the objects there's only ever one of,
+	// and every symbol by name so that each name gives the same symbol
+	objects    map[uint64]objectKind
+	singletons map[objectKind]uint64
+	symbols    map[string]uint64
+	// the call stack, with the frame for code outside any procedure at the bottom
+	frames []*callFrame
+	// where the instruction being run starts, and what stopped the VM if it
+	// couldn't carry on
+	instructionStart int64
+	err              error
+	// where read gets its data from, and the reader reading it; with no input,
+	// read only ever gives the end of file object
+	Input  io.Reader
+	reader *DatumReader
 }
 
 func (v *VMState) CanStep() bool {
@@ -363,6 +477,42 @@ func (v *VMState) ReadBytes(length int) []byte {
 	return byteBuffer
 }
 
+func (v *VMState) readInt() int64 {
+	var num int64
+	binary.Read(bytes.NewBuffer(v.ReadBytes(8)), binary.LittleEndian, &num)
+	return num
+}
+
+func (v *VMState) pushInt(num int64) {
+	intBuffer := bytes.NewBuffer(make([]byte, 0))
+	binary.Write(intBuffer, binary.LittleEndian, &num)
+	v.Stack.PushInt(intBuffer.Bytes())
+}
+
+func (v *VMState) pushDouble(num float64) {
+	doubleBuffer := bytes.NewBuffer(make([]byte, 0))
+	binary.Write(doubleBuffer, binary.LittleEndian, &num)
+	v.Stack.PushDouble(doubleBuffer.Bytes())
+}
+
+// readChar reads a UTF-8 encoded character
+func (v *VMState) readChar() rune {
+	firstByte := v.ReadBytes(1)[0]
+	// same as with pushs, the upper bits of the first byte say how long
+	// the character is
+	codepointLength := 1
+	if firstByte>>5 == 0x6 {
+		codepointLength = 2
+	} else if firstByte>>4 == 0xE {
+		codepointLength = 3
+	} else if firstByte>>3 == 0x1E {
+		codepointLength = 4
+	}
+	utfRune := append([]byte{firstByte}, v.ReadBytes(codepointLength-1)...)
+	char, _ := utf8.DecodeRune(utfRune)
+	return char
+}
+
 func (v *VMState) jump() {
 	addressBytes := v.ReadBytes(8)
 	var address int64
@@ -370,13 +520,70 @@ func (v *VMState) jump() {
 	v.opcodeBuffer.Seek(address, io.SeekCurrent)
 }
 
+// currentFrame returns the frame of the procedure being run
+func (v *VMState) currentFrame() *callFrame {
+	return v.frames[len(v.frames)-1]
+}
+
+// readLocal reads the 4-byte reference to a local in the current frame
+func (v *VMState) readLocal() uint32 {
+	var local uint32
+	binary.Read(bytes.NewBuffer(v.ReadBytes(4)), binary.LittleEndian, &local)
+	return local
+}
+
+// loadLocal reads the reference to a local and gives what it holds, stopping the
+// VM if the current frame has no such local, or if it's too small to hold a value
+// of the given size
+func (v *VMState) loadLocal(size int) ([]byte, bool) {
+	index := v.readLocal()
+	local, ok := v.currentFrame().locals[index]
+	if !ok {
+		v.fail(fmt.Sprintf("No local %d", index))
+		return nil, false
+	}
+	if len(local) < size {
+		v.fail(fmt.Sprintf("Local %d holds %d bytes, not %d", index, len(local), size))
+		return nil, false
+	}
+	return local, true
+}
+
+func (v *VMState) jumpIf(condition bool) {
+	if condition {
+		v.jump()
+	} else {
+		// skip the jump address
+		v.opcodeBuffer.Seek(8, io.SeekCurrent)
+	}
+}
+
+// fail stops the VM with an error about the instruction being run
+func (v *VMState) fail(message string) {
+	v.err = VMError{v.instructionStart, message}
+	v.exitCode = 1
+	v.finished = true
+}
+
+// Err returns the error that stopped the VM, or nil if it ran without one.
+func (v *VMState) Err() error {
+	return v.err
+}
+
 func (v *VMState) Step() {
 	if v.CanStep() == false {
 		// TODO: properly handle finished VM
 		return
 	}
+	v.instructionStart, _ = v.opcodeBuffer.Seek(0, io.SeekCurrent)
 	currentOpcode := v.NextOpcode()
 	switch currentOpcode {
+	case 0x01:
+		// pushb
+		v.Stack.PushByte(v.ReadBytes(1)[0])
+	case 0x02:
+		// pushc
+		v.Stack.PushChar(v.readChar())
 	case 0x03:
 		// pushi
 		// simply grab the next 8 bytes and push them
@@ -434,6 +641,19 @@ func (v *VMState) Step() {
 	case 0x07:
 		// dup
 		v.Stack.Dup()
+	case 0x08:
+		// hstoreb
+		mnemonic := string(v.ReadBytes(2))
+		address := v.mnemonicMap[mnemonic]
+		v.Heap.Write(bytes.NewBuffer([]byte{v.Stack.PopByte()}), address)
+	case 0x09:
+		// hstorec
+		mnemonic := string(v.ReadBytes(2))
+		address := v.mnemonicMap[mnemonic]
+		codepoint := int32(v.Stack.PopChar())
+		charBuffer := bytes.NewBuffer(make([]byte, 0))
+		binary.Write(charBuffer, binary.LittleEndian, &codepoint)
+		v.Heap.Write(charBuffer, address)
 	case 0x0A:
 		// hstorei
 		mnemonic := string(v.ReadBytes(2))
@@ -442,6 +662,14 @@ func (v *VMState) Step() {
 		intBuffer := bytes.NewBuffer(make([]byte, 0))
 		binary.Write(intBuffer, binary.LittleEndian, &num)
 		v.Heap.Write(intBuffer, address)
+	case 0x0B:
+		// hstored
+		mnemonic := string(v.ReadBytes(2))
+		address := v.mnemonicMap[mnemonic]
+		num := v.Stack.PopDouble()
+		doubleBuffer := bytes.NewBuffer(make([]byte, 0))
+		binary.Write(doubleBuffer, binary.LittleEndian, &num)
+		v.Heap.Write(doubleBuffer, address)
 	case 0x0C:
 		// hstores
 		mnemonic := string(v.ReadBytes(2))
@@ -474,12 +702,67 @@ func (v *VMState) Step() {
 			binary.Write(buffer, binary.LittleEndian, &cell[i])
 			v.Heap.Write(buffer, address+8*i)
 		}
+	case 0x0E:
+		// lstoreb
+		local := v.readLocal()
+		v.currentFrame().locals[local] = []byte{v.Stack.PopByte()}
+	case 0x0F:
+		// lstorec
+		local := v.readLocal()
+		codepoint := int32(v.Stack.PopChar())
+		charBuffer := bytes.NewBuffer(make([]byte, 0))
+		binary.Write(charBuffer, binary.LittleEndian, &codepoint)
+		v.currentFrame().locals[local] = charBuffer.Bytes()
+	case 0x10:
+		// lstorei
+		local := v.readLocal()
+		num := v.Stack.PopInt()
+		intBuffer := bytes.NewBuffer(make([]byte, 0))
+		binary.Write(intBuffer, binary.LittleEndian, &num)
+		v.currentFrame().locals[local] = intBuffer.Bytes()
+	case 0x11:
+		// lstored
+		local := v.readLocal()
+		num := v.Stack.PopDouble()
+		doubleBuffer := bytes.NewBuffer(make([]byte, 0))
+		binary.Write(doubleBuffer, binary.LittleEndian, &num)
+		v.currentFrame().locals[local] = doubleBuffer.Bytes()
+	case 0x12:
+		// lstores
+		local := v.readLocal()
+		// unlike in the heap, locals don't need room set aside ahead of time
+		v.currentFrame().locals[local] = v.Stack.PopString()
+	case 0x13:
+		// lstorel
+		local := v.readLocal()
+		cell := v.Stack.PopCell()
+		cellBuffer := bytes.NewBuffer(make([]byte, 0))
+		binary.Write(cellBuffer, binary.LittleEndian, cell)
+		v.currentFrame().locals[local] = cellBuffer.Bytes()
+	case 0x14:
+		// hloadb
+		mnemonic := string(v.ReadBytes(2))
+		address := v.mnemonicMap[mnemonic]
+		v.Stack.PushByte(v.Heap.Read(1, address).Bytes()[0])
+	case 0x15:
+		// hloadc
+		mnemonic := string(v.ReadBytes(2))
+		address := v.mnemonicMap[mnemonic]
+		var codepoint int32
+		binary.Read(v.Heap.Read(4, address), binary.LittleEndian, &codepoint)
+		v.Stack.PushChar(rune(codepoint))
 	case 0x16:
 		// hloadi
 		mnemonic := string(v.ReadBytes(2))
 		address := v.mnemonicMap[mnemonic]
 		buffer := v.Heap.Read(8, address)
 		v.Stack.PushInt(buffer.Bytes())
+	case 0x17:
+		// hloadd
+		mnemonic := string(v.ReadBytes(2))
+		address := v.mnemonicMap[mnemonic]
+		buffer := v.Heap.Read(8, address)
+		v.Stack.PushDouble(buffer.Bytes())
 	case 0x18:
 		// hloads
 		mnemonic := string(v.ReadBytes(2))
@@ -493,11 +776,55 @@ func (v *VMState) Step() {
 		address := v.mnemonicMap[mnemonic]
 		buffer := v.Heap.Read(24, address)
 		v.Stack.PushCell(buffer.Bytes())
+	case 0x1A:
+		// lloadb
+		if local, ok := v.loadLocal(1); ok {
+			v.Stack.PushByte(local[0])
+		}
+	case 0x1B:
+		// lloadc
+		if local, ok := v.loadLocal(4); ok {
+			var codepoint int32
+			binary.Read(bytes.NewBuffer(local), binary.LittleEndian, &codepoint)
+			v.Stack.PushChar(rune(codepoint))
+		}
+	case 0x1C:
+		// lloadi
+		if local, ok := v.loadLocal(8); ok {
+			v.Stack.PushInt(local[:8])
+		}
+	case 0x1D:
+		// lloadd
+		if local, ok := v.loadLocal(8); ok {
+			v.Stack.PushDouble(local[:8])
+		}
+	case 0x1E:
+		// lloads
+		if local, ok := v.loadLocal(0); ok {
+			v.Stack.PushString(local)
+		}
+	case 0x1F:
+		// lloadl
+		if local, ok := v.loadLocal(24); ok {
+			v.Stack.PushCell(local[:24])
+		}
+	case 0x20:
+		// hnewb
+		mnemonic := string(v.ReadBytes(2))
+		v.mnemonicMap[mnemonic] = v.Heap.Allocate(1)
+	case 0x21:
+		// hnewc
+		mnemonic := string(v.ReadBytes(2))
+		v.mnemonicMap[mnemonic] = v.Heap.Allocate(4)
 	case 0x22:
 		// hnewi
 		mnemonic := string(v.ReadBytes(2))
 		address := v.Heap.Allocate(8)
 		v.mnemonicMap[mnemonic] = address
+	case 0x23:
+		// hnewd
+		mnemonic := string(v.ReadBytes(2))
+		v.mnemonicMap[mnemonic] = v.Heap.Allocate(8)
 	case 0x24:
 		// hnews
 		mnemonic := string(v.ReadBytes(2))
@@ -516,18 +843,54 @@ func (v *VMState) Step() {
 		mnemonic := string(v.ReadBytes(2))
 		address := v.Heap.Allocate(24)
 		v.mnemonicMap[mnemonic] = address
+	case 0x26, 0x27, 0x28, 0x29, 0x2A, 0x2B:
+		// lnewb, lnewc, lnewi, lnewd, lnews and lnewl
+		local := v.readLocal()
+		v.currentFrame().locals[local] = make([]byte, localSizes[currentOpcode])
 	case 0x2C:
 		// jmp
 		v.jump()
 	case 0x2D:
 		// jne
 		cmpResult := v.Stack.PopByte()
-		if cmpResult != 0 {
-			v.jump()
-		} else {
-			// skip the jump address
-			v.opcodeBuffer.Seek(8, io.SeekCurrent)
+		v.jumpIf(cmpResult != 0)
+	case 0x2E:
+		// jeq
+		cmpResult := v.Stack.PopByte()
+		v.jumpIf(cmpResult == 0)
+	case 0x2F:
+		// jlt
+		cmpResult := v.Stack.PopByte()
+		v.jumpIf(cmpResult == 2)
+	case 0x30:
+		// jlte
+		cmpResult := v.Stack.PopByte()
+		v.jumpIf(cmpResult == 0 || cmpResult == 2)
+	case 0x31:
+		// jgt
+		cmpResult := v.Stack.PopByte()
+		v.jumpIf(cmpResult == 1)
+	case 0x32:
+		// jgte
+		cmpResult := v.Stack.PopByte()
+		v.jumpIf(cmpResult == 0 || cmpResult == 1)
+	case 0x33:
+		// jal
+		offset := v.readInt()
+		// return to just past the jump address
+		returnAddress, _ := v.opcodeBuffer.Seek(0, io.SeekCurrent)
+		v.frames = append(v.frames, newCallFrame(returnAddress))
+		v.opcodeBuffer.Seek(offset, io.SeekCurrent)
+	case 0x34:
+		// jr
+		if len(v.frames) == 1 {
+			// returning from outside any procedure ends the program
+			v.finished = true
+			return
 		}
+		frame := v.currentFrame()
+		v.frames = v.frames[:len(v.frames)-1]
+		v.opcodeBuffer.Seek(frame.returnAddress, io.SeekStart)
 	case 0x36:
 		// addi
 		y := v.Stack.PopInt()
@@ -536,6 +899,36 @@ func (v *VMState) Step() {
 		intBuffer := bytes.NewBuffer(make([]byte, 0))
 		binary.Write(intBuffer, binary.LittleEndian, &newInt)
 		v.Stack.PushInt(intBuffer.Bytes())
+	case 0x37:
+		// addd
+		y := v.Stack.PopDouble()
+		x := v.Stack.PopDouble()
+		v.pushDouble(x + y)
+	case 0x38:
+		// subi
+		y := v.Stack.PopInt()
+		x := v.Stack.PopInt()
+		v.pushInt(x - y)
+	case 0x39:
+		// subd
+		y := v.Stack.PopDouble()
+		x := v.Stack.PopDouble()
+		v.pushDouble(x - y)
+	case 0x3A:
+		// muli
+		y := v.Stack.PopInt()
+		x := v.Stack.PopInt()
+		v.pushInt(x * y)
+	case 0x3B:
+		// muld
+		y := v.Stack.PopDouble()
+		x := v.Stack.PopDouble()
+		v.pushDouble(x * y)
+	case 0x3E:
+		// divd
+		y := v.Stack.PopDouble()
+		x := v.Stack.PopDouble()
+		v.pushDouble(x / y)
 	case 0x40:
 		// cmpi
 		y := v.Stack.PopInt()
@@ -562,6 +955,16 @@ func (v *VMState) Step() {
 		// syscall
 		syscall := v.ReadBytes(1)[0]
 		switch syscall {
+		case 0x01:
+			// print boolean
+			if v.Stack.PopByte() != 0 {
+				v.Console.Write("#t")
+			} else {
+				v.Console.Write("#f")
+			}
+		case 0x02:
+			// print character
+			v.Console.Write(string(v.Stack.PopChar()))
 		case 0x03:
 			// print integer
 			intNum := v.Stack.PopInt()
@@ -582,6 +985,26 @@ func (v *VMState) Step() {
 			exitCode := v.Stack.PopInt()
 			v.exitCode = exitCode
 			v.finished = true
+		case 0x07:
+			// print record
+			address := v.popObject()
+			if v.expectObject(address, recordObject) {
+				output := new(strings.Builder)
+				v.writeObject(output, address)
+				v.Console.Write(output.String())
+			}
+		case 0x08:
+			// print object, all in one go so that a list is written out whole
+			output := new(strings.Builder)
+			v.writeObject(output, v.popObject())
+			v.Console.Write(output.String())
+		case 0x09:
+			// read a datum from the input
+			if address, ok := v.readObject(); ok {
+				v.pushObject(address)
+			}
+		default:
+			v.fail(fmt.Sprintf("Unknown syscall 0x%02X", syscall))
 		}
 	case 0x44:
 		// hsmem
@@ -646,6 +1069,204 @@ func (v *VMState) Step() {
 		cellBuffer := bytes.NewBuffer(make([]byte, 0))
 		binary.Write(cellBuffer, binary.LittleEndian, cell)
 		v.Stack.PushCell(cellBuffer.Bytes())
+	case 0x4F:
+		// rdef
+		typeID := v.readInt()
+		fieldCount := uint64(v.readInt())
+		// drop the null terminator pushs leaves on the end
+		name := string(bytes.TrimRight(v.Stack.PopString(), "\x00"))
+		v.recordTypes[typeID] = recordType{name, fieldCount}
+	case 0x50:
+		// hnewr
+		typeID := v.readInt()
+		recordType, ok := v.recordTypes[typeID]
+		if !ok {
+			v.fail(fmt.Sprintf("Unknown record type %d", typeID))
+			return
+		}
+		fields := make([]uint64, recordType.fieldCount)
+		for i := recordType.fieldCount; i > 0; i-- {
+			fields[i-1] = v.popObject()
+		}
+		v.pushObject(v.newObject(recordObject, words(append([]uint64{uint64(typeID)}, fields...)...)))
+	case 0x52:
+		// rget
+		typeID := v.readInt()
+		field := uint64(v.readInt())
+		if address, ok := v.recordField(v.popObject(), typeID, field); ok {
+			v.pushObject(v.objectWord(address, 0))
+		}
+	case 0x53:
+		// rset
+		typeID := v.readInt()
+		field := uint64(v.readInt())
+		value := v.popObject()
+		if address, ok := v.recordField(v.popObject(), typeID, field); ok {
+			v.Heap.Write(bytes.NewBuffer(words(value)), address)
+		}
+	case 0x54:
+		// rtest
+		typeID := v.readInt()
+		address := v.popObject()
+		// like the comparison opcodes, 0 means a match
+		if v.objects[address] == recordObject && int64(v.objectWord(address, 0)) == typeID {
+			v.Stack.PushByte(0)
+		} else {
+			v.Stack.PushByte(1)
+		}
+	case 0x55:
+		// itod
+		v.pushDouble(float64(v.Stack.PopInt()))
+	case 0x58, 0x59, 0x5A, 0x5B, 0x5C:
+		// boxb, boxc, boxi, boxd and boxs
+		v.box(currentOpcode)
+	case 0x5D, 0x5E, 0x5F, 0x60, 0x61:
+		// unboxb, unboxc, unboxi, unboxd and unboxs
+		v.unbox(currentOpcode)
+	case 0x62:
+		// onil
+		v.pushObject(v.singleton(emptyListObject))
+	case 0x63:
+		// ovoid
+		v.pushObject(v.singleton(unspecifiedObject))
+	case 0x64:
+		// ocons
+		cdr := v.popObject()
+		car := v.popObject()
+		v.pushObject(v.cons(car, cdr))
+	case 0x65, 0x66:
+		// ocar and ocdr
+		address := v.popObject()
+		if v.expectObject(address, pairObject) {
+			v.pushObject(v.objectWord(address, uint64(currentOpcode-0x65)))
+		}
+	case 0x67:
+		// osym
+		name := string(bytes.TrimRight(v.Stack.PopString(), "\x00"))
+		v.pushObject(v.symbol(name))
+	case 0x68:
+		// ovec
+		count := uint64(v.readInt())
+		elements := make([]uint64, count)
+		for i := count; i > 0; i-- {
+			elements[i-1] = v.popObject()
+		}
+		v.pushObject(v.newObject(vectorObject, words(append([]uint64{count}, elements...)...)))
+	case 0x69:
+		// otest
+		kind := objectKind(v.ReadBytes(1)[0])
+		// like the comparison opcodes, 0 means a match
+		if v.objects[v.popObject()] == kind {
+			v.Stack.PushByte(0)
+		} else {
+			v.Stack.PushByte(1)
+		}
+	case 0x6A:
+		// otruth
+		if v.truthy(v.popObject()) {
+			v.Stack.PushByte(1)
+		} else {
+			v.Stack.PushByte(0)
+		}
+	case 0x6B:
+		// oeqv
+		y := v.popObject()
+		x := v.popObject()
+		if v.eqv(x, y) {
+			v.Stack.PushByte(0)
+		} else {
+			v.Stack.PushByte(1)
+		}
+	case 0x6C, 0x6D, 0x6E, 0x6F:
+		// oadd, osub, omul and odiv
+		v.arithmetic(currentOpcode)
+	case 0x70:
+		// ocmp
+		v.compareNumbers()
+	case 0x71:
+		// dropb
+		v.Stack.PopByte()
+	case 0x72:
+		// dropc
+		v.Stack.PopChar()
+	case 0x73:
+		// dropi
+		v.Stack.PopInt()
+	case 0x74:
+		// dropd
+		v.Stack.PopDouble()
+	case 0x75:
+		// drops
+		v.Stack.PopString()
+	case 0x76:
+		// hnewp
+		arity := uint64(v.readInt())
+		count := uint64(v.readInt())
+		offset := v.readInt()
+		// like jal, the code is found by jumping from the end of the instruction
+		here, _ := v.opcodeBuffer.Seek(0, io.SeekCurrent)
+		captures := make([]uint64, count)
+		for i := count; i > 0; i-- {
+			captures[i-1] = v.popObject()
+		}
+		payload := words(append([]uint64{uint64(here + offset), arity, count}, captures...)...)
+		v.pushObject(v.newObject(procedureObject, payload))
+	case 0x77:
+		// jalc
+		argCount := uint64(v.readInt())
+		address := v.popObject()
+		if !v.expectObject(address, procedureObject) {
+			return
+		}
+		if arity := int64(v.objectWord(address, 1)); arity < 0 {
+			// a procedure taking any number of arguments after the ones it
+			// needs gets the rest of them as a list
+			required := uint64(-arity - 1)
+			if argCount < required {
+				v.fail(fmt.Sprintf("Expected at least %d arguments for the procedure, found %d", required, argCount))
+				return
+			}
+			rest := v.singleton(emptyListObject)
+			for i := required; i < argCount; i++ {
+				rest = v.cons(v.popObject(), rest)
+			}
+			v.pushObject(rest)
+		} else if uint64(arity) != argCount {
+			v.fail(fmt.Sprintf("Expected %d arguments for the procedure, found %d", arity, argCount))
+			return
+		}
+		returnAddress, _ := v.opcodeBuffer.Seek(0, io.SeekCurrent)
+		frame := newCallFrame(returnAddress)
+		frame.closure = address
+		v.frames = append(v.frames, frame)
+		v.opcodeBuffer.Seek(int64(v.objectWord(address, 0)), io.SeekStart)
+	case 0x78:
+		// cload
+		index := uint64(v.readLocal())
+		closure := v.currentFrame().closure
+		if v.objects[closure] != procedureObject || index >= v.objectWord(closure, 2) {
+			v.fail(fmt.Sprintf("No captured object %d", index))
+			return
+		}
+		v.pushObject(v.objectWord(closure, 3+index))
+	case 0x79:
+		// ocell
+		v.pushObject(v.newObject(cellObject, words(v.popObject())))
+	case 0x7A:
+		// oget
+		cell := v.popObject()
+		if v.expectObject(cell, cellObject) {
+			v.pushObject(v.objectWord(cell, 0))
+		}
+	case 0x7B:
+		// oset
+		cell := v.popObject()
+		value := v.popObject()
+		if v.expectObject(cell, cellObject) {
+			v.Heap.Write(bytes.NewBuffer(words(value)), cell)
+		}
+	default:
+		v.fail(fmt.Sprintf("Unknown opcode 0x%02X", currentOpcode))
 	}
 }
 
@@ -660,6 +1281,11 @@ func NewVM(opcodes []byte, console VMConsole) *VMState {
 	vm.Console = console
 	vm.Heap = *NewVMHeap()
 	vm.mnemonicMap = make(map[string]uint64)
+	vm.recordTypes = make(map[int64]recordType)
+	vm.objects = make(map[uint64]objectKind)
+	vm.singletons = make(map[objectKind]uint64)
+	vm.symbols = make(map[string]uint64)
+	vm.frames = []*callFrame{newCallFrame(0)}
 	return vm
 }
 
@@ -11,7 +11,7 @@ type DummyConsole struct {
 
 func (d *DummyConsole) Write(line string) {
 	// trim null
-	d.consoleOutput = strings.TrimRight(line, "\x00")
+	d.consoleOutput += strings.TrimRight(line, "\x00")
 }
 
 func StepVM(vm *VMState, count int) {
@@ -670,3 +670,645 @@ func TestListSum(t *testing.T) {
 		t.Error("Incorrect output, got: ", console.consoleOutput)
 	}
 }
+
+func TestRecordFields(t *testing.T) {
+	// create a record with 3 fields, which takes up more than the smallest
+	// heap block, and make sure allocating something else afterwards
+	// doesn't clobber the last field
+	// mnemonics:
+	// 0xDEAD - an integer allocated after the record
+	// locals:
+	// 0 - the record
+	opcodes := []byte{
+		0x05, // pushs
+		0x70, // p
+		0x6F, // o
+		0x69, // i
+		0x6E, // n
+		0x74, // t
+		0x00, // null
+		0x4F, // rdef
+		0x01,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // type ID 1
+		0x03,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 3 fields
+		0x03, // pushi
+		0x03,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 3
+		0x5A, // boxi
+		0x63, // ovoid
+		0x03, // pushi
+		0x04,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 4
+		0x5A, // boxi
+		0x50, // hnewr
+		0x01,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // type ID 1
+		0x28, // lnewi
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x10, // lstorei
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x22, // hnewi
+		0xDE,
+		0xAD, // reference mnemonic - 0xDEAD
+		0x03, // pushi
+		0x63,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 99
+		0x0A, // hstorei
+		0xDE,
+		0xAD, // reference mnemonic - 0xDEAD
+		0x1C, // lloadi
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x03, // pushi
+		0x05,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 5
+		0x5A, // boxi
+		0x53, // rset
+		0x01,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // type ID 1
+		0x01,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // field 1
+		0x1C, // lloadi
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x52, // rget
+		0x01,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // type ID 1
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // field 0
+		0x5F, // unboxi
+		0x1C, // lloadi
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x52, // rget
+		0x01,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // type ID 1
+		0x01,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // field 1
+		0x5F, // unboxi
+		0x1C, // lloadi
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x52, // rget
+		0x01,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // type ID 1
+		0x02,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // field 2
+		0x5F, // unboxi
+		0x36, // addi
+		0x36, // addi
+		0x43, // syscall
+		0x03, // print integer
+	}
+	console := DummyConsole{}
+	RunVM(opcodes, &console)
+	if console.consoleOutput != "12" {
+		t.Error("Incorrect output, got: ", console.consoleOutput)
+	}
+}
+
+func TestRecordPredicate(t *testing.T) {
+	// locals:
+	// 0 - a point record
+	opcodes := []byte{
+		0x05, // pushs
+		0x70, // p
+		0x6F, // o
+		0x69, // i
+		0x6E, // n
+		0x74, // t
+		0x00, // null
+		0x4F, // rdef
+		0x01,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // type ID 1
+		0x02,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 2 fields
+		0x05, // pushs
+		0x62, // b
+		0x6F, // o
+		0x78, // x
+		0x00, // null
+		0x4F, // rdef
+		0x02,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // type ID 2
+		0x01,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 1 field
+		0x63, // ovoid
+		0x63, // ovoid
+		0x50, // hnewr
+		0x01,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // type ID 1
+		0x28, // lnewi
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x10, // lstorei
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x1C, // lloadi
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x54, // rtest
+		0x01,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // type ID 1
+		0x1C, // lloadi
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x54, // rtest
+		0x02,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // type ID 2
+		0x03, // pushi
+		0x01,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 1
+		0x5A, // boxi
+		0x54, // rtest
+		0x01,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // type ID 1
+		0x1C, // lloadi
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x43, // syscall
+		0x07, // print record
+	}
+	console := DummyConsole{}
+	vm := NewVM(opcodes, &console)
+	StepVM(vm, 16)
+	if vm.Stack.PopByte() != 1 {
+		t.Error("Expected an integer not to be a point")
+	}
+	if vm.Stack.PopByte() != 1 {
+		t.Error("Expected a point not to be a box")
+	}
+	if vm.Stack.PopByte() != 0 {
+		t.Error("Expected a point to be a point")
+	}
+	StepVM(vm, 2)
+	if console.consoleOutput != "#<point>" {
+		t.Error("Incorrect output, got: ", console.consoleOutput)
+	}
+}
+
+func TestCallFrame(t *testing.T) {
+	// call a procedure that doubles its argument, which it takes off the
+	// stack into a local
+	opcodes := []byte{
+		0x2C, // jmp
+		0x16,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 22 - skip over the procedure
+		0x28, // lnewi
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x10, // lstorei
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x1C, // lloadi
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x1C, // lloadi
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x36, // addi
+		0x34, // jr
+		0x03, // pushi
+		0x15,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 21
+		0x33, // jal
+		0xD8,
+		0xFF,
+		0xFF,
+		0xFF,
+		0xFF,
+		0xFF,
+		0xFF,
+		0xFF, // -40 - back to the procedure
+		0x43, // syscall
+		0x03, // print integer
+	}
+	console := DummyConsole{}
+	RunVM(opcodes, &console)
+	if console.consoleOutput != "42" {
+		t.Error("Incorrect output, got: ", console.consoleOutput)
+	}
+}
+
+func TestLocalFrames(t *testing.T) {
+	// locals belong to the frame they're created in, so a procedure using
+	// the same reference doesn't touch the caller's local
+	opcodes := []byte{
+		0x28, // lnewi
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x03, // pushi
+		0x05,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 5
+		0x10, // lstorei
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x2C, // jmp
+		0x14,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 20 - skip over the procedure
+		0x28, // lnewi
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x03, // pushi
+		0x07,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 7
+		0x10, // lstorei
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x34, // jr
+		0x33, // jal
+		0xE3,
+		0xFF,
+		0xFF,
+		0xFF,
+		0xFF,
+		0xFF,
+		0xFF,
+		0xFF, // -29 - back to the procedure
+		0x1C, // lloadi
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x43, // syscall
+		0x03, // print integer
+	}
+	console := DummyConsole{}
+	RunVM(opcodes, &console)
+	if console.consoleOutput != "5" {
+		t.Error("Incorrect output, got: ", console.consoleOutput)
+	}
+}
+
+func TestUnknownOpcode(t *testing.T) {
+	opcodes := []byte{
+		0x03, // pushi
+		0x02,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 2
+		0x03, // pushi
+		0x03,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 3
+		0x35, // addc, which is reserved but not implemented
+		0x43, // syscall
+		0x06, // exit
+	}
+	vm := NewVM(opcodes, &DummyConsole{})
+	for vm.CanStep() {
+		vm.Step()
+	}
+	if vm.Err() == nil || vm.Err().Error() != "Unknown opcode 0x35 at offset 18" {
+		t.Error("Expected an unknown opcode error, got: ", vm.Err())
+	}
+	if vm.ExitCode() != 1 {
+		t.Error("Expected exit code 1, got: ", vm.ExitCode())
+	}
+}
+
+func TestMissingLocal(t *testing.T) {
+	opcodes := []byte{
+		0x26, // lnewb
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0
+		0x1C, // lloadi
+		0x00,
+		0x00,
+		0x00,
+		0x00, // local 0, which only holds a byte
+		0x1A, // lloadb
+		0x01,
+		0x00,
+		0x00,
+		0x00, // local 1, which was never created
+	}
+	vm := NewVM(opcodes, &DummyConsole{})
+	for vm.CanStep() {
+		vm.Step()
+	}
+	if vm.Err() == nil || vm.Err().Error() != "Local 0 holds 1 bytes, not 8 at offset 5" {
+		t.Error("Expected a local size error, got: ", vm.Err())
+	}
+	vm = NewVM(append([]byte{0x26, 0x00, 0x00, 0x00, 0x00}, opcodes[10:]...), &DummyConsole{})
+	for vm.CanStep() {
+		vm.Step()
+	}
+	if vm.Err() == nil || vm.Err().Error() != "No local 1 at offset 5" {
+		t.Error("Expected a missing local error, got: ", vm.Err())
+	}
+}
+
+func TestObjects(t *testing.T) {
+	opcodes := []byte{
+		0x03, // pushi
+		0x01,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 1
+		0x5A, // boxi
+		0x05, // pushs
+		0x61, // a
+		0x00, // null terminator
+		0x67, // osym
+		0x62, // onil
+		0x64, // ocons
+		0x64, // ocons
+		0x43, // syscall
+		0x08, // print object
+	}
+	console := DummyConsole{}
+	RunVM(opcodes, &console)
+	if console.consoleOutput != "(1 a)" {
+		t.Error("Expected (1 a) to be printed, got: ", console.consoleOutput)
+	}
+}
+
+func TestLargeObjects(t *testing.T) {
+	// allocate strings bigger than the whole of the initial heap, which has to
+	// grow to fit them, then something small to make sure it still fits in
+	// around them
+	large := strings.Repeat("a", 20000)
+	larger := strings.Repeat("b", 70000)
+	opcodes := []byte{0x05} // pushs
+	opcodes = append(append(opcodes, large...), 0x00)
+	opcodes = append(opcodes, 0x5C, 0x05) // boxs, pushs
+	opcodes = append(append(opcodes, larger...), 0x00)
+	opcodes = append(opcodes,
+		0x5C, // boxs
+		0x05, // pushs
+		0x63, // c
+		0x00, // null terminator
+		0x5C, // boxs
+		0x62, // onil
+		0x64, // ocons
+		0x64, // ocons
+		0x64, // ocons
+		0x43, // syscall
+		0x08, // print object
+	)
+	console := DummyConsole{}
+	vm := NewVM(opcodes, &console)
+	for vm.CanStep() {
+		vm.Step()
+	}
+	if vm.Err() != nil {
+		t.Fatal("Unexpected error: ", vm.Err())
+	}
+	if console.consoleOutput != "("+large+" "+larger+" c)" {
+		t.Error("Incorrect output, got ", len(console.consoleOutput), " bytes")
+	}
+}
+
+func TestObjectTypeError(t *testing.T) {
+	opcodes := []byte{
+		0x03, // pushi
+		0x01,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00,
+		0x00, // 1
+		0x5A, // boxi
+		0x65, // ocar
+	}
+	vm := NewVM(opcodes, &DummyConsole{})
+	for vm.CanStep() {
+		vm.Step()
+	}
+	if vm.Err() == nil || vm.Err().Error() != "Expected a pair, found an integer at offset 10" {
+		t.Error("Expected a type error, got: ", vm.Err())
+	}
+}